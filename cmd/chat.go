@@ -0,0 +1,42 @@
+package main
+
+import (
+	"os/signal"
+
+	"github.com/meschbach/marvin/internal/query"
+	"github.com/spf13/cobra"
+	"golang.org/x/sys/unix"
+)
+
+func chatCommand(global *globalOptions) *cobra.Command {
+	chatOpts := &query.ChatOptions{}
+
+	cmd := &cobra.Command{
+		Use:   "chat",
+		Short: "Interactive multi-turn chat keeping tools running between turns",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, done := signal.NotifyContext(cmd.Context(), unix.SIGINT, unix.SIGTERM)
+			defer done()
+
+			config, err := global.config.Load()
+			if err != nil {
+				return err
+			}
+			return query.ChatWithConfig(ctx, config, cmd.InOrStdin(), chatOpts)
+		},
+	}
+	pflags := cmd.PersistentFlags()
+	pflags.BoolVarP(&chatOpts.ShowThinking, "show-thinking", "t", false, "Show the models thinking")
+	pflags.BoolVarP(&chatOpts.ShowTools, "show-tools", "s", false, "Show tools available and usage")
+	pflags.BoolVarP(&chatOpts.DumpTooling, "dump-tools", "d", false, "Dumps the available tools to the LLM")
+	pflags.BoolVarP(&chatOpts.ShowDone, "show-done", "e", false, "Show the Done command issued by the LLM")
+	pflags.StringVarP(&chatOpts.Output, "output", "o", query.OutputText, "output format: text or jsonl")
+	pflags.StringVar(&chatOpts.Session, "session", "", "Resume and record the conversation under the named session")
+	pflags.StringVar(&chatOpts.Agent, "agent", "", "use the named agent profile of the configuration")
+	pflags.IntVar(&chatOpts.ParallelToolCalls, "parallel-tools", 0, "run up to this many tool calls from a single turn concurrently")
+	chatOpts.Limits.PersistentFlags(cmd)
+	chatOpts.Ollama.PersistentFlags(cmd)
+	chatOpts.Traffic.PersistentFlags(cmd)
+	return cmd
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/meschbach/marvin/internal/query"
+	"github.com/spf13/cobra"
+)
+
+func compareCommand(global *globalOptions) *cobra.Command {
+	compareOpts := &query.CompareOptions{}
+	cmd := &cobra.Command{
+		Use:   "compare --models <a,b,...> <query...>",
+		Short: "Runs a query against several models and compares the results side by side",
+		Long: "Runs the query against each model with the same configuration and a fresh set of tools, then shows the " +
+			"answers, tool calls, latencies and token counts of each.  The comparison is saved as a Markdown report, or " +
+			"JSON when the report path ends with .json.",
+		Args: cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			config, err := global.config.Load()
+			if err != nil {
+				return err
+			}
+			return query.PerformCompare(cmd.Context(), config, strings.Join(args, " "), cmd.OutOrStdout(), compareOpts)
+		},
+	}
+	pflags := cmd.PersistentFlags()
+	pflags.StringSliceVar(&compareOpts.Models, "models", nil, "comma separated models to run the query against")
+	pflags.StringVar(&compareOpts.Report, "report", "", "save the comparison to the file instead of marvin-compare-<time>.md")
+	compareOpts.Limits.PersistentFlags(cmd)
+	compareOpts.Ollama.PersistentFlags(cmd)
+	compareOpts.ResponseFormat.PersistentFlags(cmd)
+	_ = cmd.MarkPersistentFlagRequired("models")
+	return cmd
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"github.com/meschbach/marvin/internal/config"
+	"github.com/meschbach/marvin/internal/query"
+	"github.com/spf13/cobra"
+)
+
+func evalCommand(global *globalOptions) *cobra.Command {
+	evalOpts := &query.EvalOptions{}
+	cmd := &cobra.Command{
+		Use:   "eval <suite.hcl...>",
+		Short: "Runs the eval cases of the suites and reports their pass rates",
+		Long: "Runs the prompt of each eval block through the query pipeline, checking the tools called, the answer, and the " +
+			"turns and tokens used.  Exits with a failure when any case does not reach its pass rate.",
+		Args: cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			var suites []*config.EvalFile
+			for _, path := range args {
+				suite, err := config.LoadEvalFile(path)
+				if err != nil {
+					return err
+				}
+				suites = append(suites, suite)
+			}
+			return query.PerformEval(cmd.Context(), suites, global.config.Load, cmd.OutOrStdout(), evalOpts)
+		},
+	}
+	pflags := cmd.PersistentFlags()
+	pflags.IntVar(&evalOpts.Runs, "runs", 0, "run every case this many times instead of the number given by the suite")
+	pflags.StringVar(&evalOpts.JUnit, "junit", "", "write a JUnit XML report to the file")
+	return cmd
+}
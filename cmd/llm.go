@@ -1,9 +1,10 @@
 package main
 
 import (
+	"errors"
 	"fmt"
-	"os"
 	"strings"
+	"time"
 
 	"github.com/meschbach/marvin/internal/query"
 	"github.com/spf13/cobra"
@@ -15,21 +16,18 @@ func queryCommand(global *globalOptions) *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "query <query...>",
 		Short: "Send a free-form query to Ollama and print the response",
-		Args:  cobra.MinimumNArgs(1),
-		Run: func(cmd *cobra.Command, args []string) {
+		RunE: func(cmd *cobra.Command, args []string) error {
 			actualQuery := strings.Join(args, " ")
-			if actualQuery == "" {
-				fmt.Fprintln(os.Stderr, "No query provided")
+			if actualQuery == "" && queryOpts.Prompt == "" {
 				_ = cmd.Help()
-				return
+				return errors.New("no query provided")
 			}
 
 			config, err := global.config.Load()
 			if err != nil {
-				fmt.Fprintf(os.Stderr, "Error loading config: %v\n", err)
-				return
+				return err
 			}
-			query.PerformWithConfig(config, actualQuery, queryOpts)
+			return query.PerformWithConfig(config, actualQuery, queryOpts)
 		},
 	}
 	pflags := cmd.PersistentFlags()
@@ -37,26 +35,99 @@ func queryCommand(global *globalOptions) *cobra.Command {
 	pflags.BoolVarP(&queryOpts.ShowTools, "show-tools", "s", false, "Show tools available and usage")
 	pflags.BoolVarP(&queryOpts.DumpTooling, "dump-tools", "d", false, "Dumps the available tools to the LLM")
 	pflags.BoolVarP(&queryOpts.ShowDone, "show-done", "e", false, "Show the Done command issued by the LLM")
+	pflags.StringVar(&queryOpts.Session, "session", "", "Resume and record the conversation under the named session")
+	pflags.StringVar(&queryOpts.Agent, "agent", "", "use the named agent profile of the configuration")
+	pflags.StringVar(&queryOpts.Prompt, "prompt", "", "start the conversation with the MCP prompt named <server>.<prompt>")
+	pflags.StringArrayVar(&queryOpts.PromptArguments, "arg", nil, "fill in an argument of the prompt as name=value; may be repeated")
+	pflags.IntVar(&queryOpts.ParallelToolCalls, "parallel-tools", 0, "run up to this many tool calls from a single turn concurrently")
+	queryOpts.Limits.PersistentFlags(cmd)
+	queryOpts.Ollama.PersistentFlags(cmd)
+	queryOpts.Traffic.PersistentFlags(cmd)
+	queryOpts.ResponseFormat.PersistentFlags(cmd)
+	pflags.StringVarP(&queryOpts.Output, "output", "o", query.OutputText, "output format: text or jsonl")
 	return cmd
 }
 
 func goalCommand(global *globalOptions) *cobra.Command {
+	goalOpts := &query.GoalOptions{}
 	cmd := &cobra.Command{
 		Use:   "goal <goal...>",
-		Short: "Declare a high-level goal for the current session",
-		Long:  "Declare a high-level goal for the current session. This command currently echoes the goal text.",
-		Args:  cobra.MinimumNArgs(1),
-		Run: func(cmd *cobra.Command, args []string) {
+		Short: "Plan the steps toward a goal then carry them out",
+		Long: "Asks the model to plan the steps toward the goal and, once the plan is approved, carries out each step in " +
+			"a conversation of its own with the configured tools.  The goal is re-planned when a step fails, finishing " +
+			"with a summary of each step.  Persisted goals are listed, shown and resumed with the list, show and resume " +
+			"subcommands; quote a goal starting with one of those words.",
+		Args: cobra.MinimumNArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
 			goal := strings.Join(args, " ")
-			fmt.Println(goal)
 			config, err := global.config.Load()
 			if err != nil {
-				fmt.Fprintf(os.Stderr, "Error loading config: %v\n", err)
-				return
+				return err
 			}
 
-			query.PerformGoalWithConfig(config, goal)
+			return query.PerformGoalWithConfig(config, goal, goalOpts)
 		},
 	}
+	cmd.Flags().StringVar(&goalOpts.Session, "session", "", "Resume and record the planning conversation under the named session")
+	goalFlags(cmd, goalOpts)
+
+	store := query.NewGoalStore(query.DefaultGoalDirectory)
+	cmd.AddCommand(&cobra.Command{
+		Use:   "resume <id>",
+		Short: "Continues a persisted goal from where it stopped",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			config, err := global.config.Load()
+			if err != nil {
+				return err
+			}
+			return query.ResumeGoalWithConfig(config, args[0], goalOpts)
+		},
+	})
+	cmd.AddCommand(&cobra.Command{
+		Use:   "show <id>",
+		Short: "Shows the steps of a persisted goal with their tool calls, outputs and timestamps",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			details, err := store.Details(args[0])
+			if err != nil {
+				return err
+			}
+			fmt.Fprint(cmd.OutOrStdout(), details)
+			return nil
+		},
+	})
+	cmd.AddCommand(&cobra.Command{
+		Use:   "list",
+		Short: "Lists the persisted goals",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			goals, err := store.List()
+			if err != nil {
+				return err
+			}
+			if len(goals) == 0 {
+				fmt.Fprintln(cmd.OutOrStdout(), "No goals found")
+			}
+			for _, g := range goals {
+				fmt.Fprintf(cmd.OutOrStdout(), "%s\t%s\t%d/%d steps done\t%s\t%s\n", g.ID, g.Status, g.Done, g.Steps, g.UpdatedAt.Format(time.RFC3339), g.Goal)
+			}
+			return nil
+		},
+	})
 	return cmd
 }
+
+// goalFlags registers the flags controlling how a goal is pursued, shared with resume
+func goalFlags(cmd *cobra.Command, goalOpts *query.GoalOptions) {
+	pflags := cmd.PersistentFlags()
+	pflags.BoolVarP(&goalOpts.AutoApprove, "yes", "y", false, "carry out plans without asking for approval")
+	pflags.IntVar(&goalOpts.MaxReplans, "max-replans", 2, "times the goal may be re-planned after a step fails")
+	pflags.StringVar(&goalOpts.Clarify, "clarify", query.ClarifyAuto, "answer clarifying questions: auto (tty when interactive, otherwise fail), tty, assume or fail")
+	pflags.StringVar(&goalOpts.Answers, "answers", "", "answers file matching clarifying questions by pattern, consulted before --clarify")
+	pflags.IntVar(&goalOpts.ParallelToolCalls, "parallel-tools", 0, "run up to this many tool calls from a single turn of a step concurrently")
+	goalOpts.Limits.PersistentFlags(cmd)
+	goalOpts.Ollama.PersistentFlags(cmd)
+	goalOpts.Traffic.PersistentFlags(cmd)
+	pflags.StringVarP(&goalOpts.Output, "output", "o", query.OutputText, "output format: text or jsonl")
+}
@@ -5,16 +5,20 @@ import (
 	"os"
 
 	"github.com/meschbach/marvin/internal/config"
+	"github.com/meschbach/marvin/internal/logging"
+	"github.com/meschbach/marvin/internal/query"
 	"github.com/spf13/cobra"
 )
 
 type globalOptions struct {
-	config *config.CommandLineOptions
+	config  *config.CommandLineOptions
+	logging *logging.Options
 }
 
 func main() {
 	globalOpts := &globalOptions{
-		config: config.NewCommandLineOptions(),
+		config:  config.NewCommandLineOptions(),
+		logging: &logging.Options{},
 	}
 
 	mcpList := mcpListCommand(globalOpts)
@@ -23,6 +27,7 @@ func main() {
 		Use: "mcp",
 	}
 	mcp.AddCommand(mcpList)
+	mcp.AddCommand(mcpServeCommand(globalOpts))
 
 	queryCmd := queryCommand(globalOpts)
 	goalCmd := goalCommand(globalOpts)
@@ -30,18 +35,31 @@ func main() {
 	root := &cobra.Command{
 		Use:   "marvin",
 		Short: "An AI workbench experiment backed by ollama",
+		PersistentPreRun: func(cmd *cobra.Command, args []string) {
+			globalOpts.logging.Install(cmd.ErrOrStderr())
+			// arguments have been accepted; failures from here on are not usage problems
+			cmd.SilenceUsage = true
+		},
+		SilenceErrors: true,
 	}
 	globalOpts.config.PersistentFlags(root)
+	globalOpts.logging.PersistentFlags(root)
 
 	root.AddCommand(mcp)
 	root.AddCommand(queryCmd)
+	root.AddCommand(chatCommand(globalOpts))
 	root.AddCommand(goalCmd)
 	root.AddCommand(ragCommand(globalOpts))
+	root.AddCommand(sessionCommand())
+	root.AddCommand(evalCommand(globalOpts))
+	root.AddCommand(compareCommand(globalOpts))
 
 	if err := root.Execute(); err != nil {
-		if _, err := fmt.Fprintf(os.Stderr, "%s\n", err); err != nil {
-			panic(err)
+		if !query.Reported(err) {
+			if _, err := fmt.Fprintf(os.Stderr, "Error: %s\n", err); err != nil {
+				panic(err)
+			}
 		}
-		os.Exit(-1)
+		os.Exit(query.ExitCode(err))
 	}
 }
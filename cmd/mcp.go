@@ -1,8 +1,6 @@
 package main
 
 import (
-	"fmt"
-	"os"
 	"os/signal"
 
 	"github.com/meschbach/marvin/internal/query"
@@ -13,24 +11,48 @@ import (
 func mcpListCommand(global *globalOptions) *cobra.Command {
 	type options struct {
 		detailed bool
+		output   string
 	}
 	opts := &options{}
 
 	cmd := &cobra.Command{
 		Use: "list",
-		Run: func(cmd *cobra.Command, args []string) {
+		RunE: func(cmd *cobra.Command, args []string) error {
 			ctx, done := signal.NotifyContext(cmd.Context(), unix.SIGSTOP, unix.SIGINT, unix.SIGTERM)
 			defer done()
 
 			cfg, err := global.config.Load()
 			if err != nil {
-				fmt.Fprintf(os.Stderr, "Error loading config: %v\n", err)
-				return
+				return err
 			}
-			query.ListMCPTools(ctx, cfg, opts.detailed)
+			return query.ListMCPTools(ctx, cfg, opts.detailed, opts.output)
 		},
 	}
 	pflags := cmd.PersistentFlags()
 	pflags.BoolVarP(&opts.detailed, "detailed", "d", false, "Provides detailed output for the tool")
+	pflags.StringVarP(&opts.output, "output", "o", query.OutputText, "output format: text or jsonl")
+	return cmd
+}
+
+func mcpServeCommand(global *globalOptions) *cobra.Command {
+	opts := &query.ServeOptions{}
+	cmd := &cobra.Command{
+		Use:   "serve",
+		Short: "Publishes the configured documents, and optionally the configured MCP servers, as an MCP server",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			ctx, done := signal.NotifyContext(cmd.Context(), unix.SIGINT, unix.SIGTERM)
+			defer done()
+
+			cfg, err := global.config.Load()
+			if err != nil {
+				return err
+			}
+			return query.ServeMCP(ctx, cfg, opts)
+		},
+	}
+	pflags := cmd.PersistentFlags()
+	pflags.StringVarP(&opts.Transport, "transport", "t", query.ServeStdio, "transport to serve over: stdio or http")
+	pflags.StringVar(&opts.Address, "address", "localhost:8080", "address to listen on when serving over http")
+	pflags.BoolVar(&opts.Proxy, "proxy", false, "also publish the tools of every configured MCP server")
 	return cmd
 }
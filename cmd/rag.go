@@ -1,65 +1,69 @@
 package main
 
 import (
+	"errors"
 	"fmt"
-	"os"
+	"log/slog"
 	"os/signal"
 
+	"github.com/meschbach/marvin/internal/config"
+	"github.com/meschbach/marvin/internal/logging"
+	"github.com/meschbach/marvin/internal/query"
 	"github.com/spf13/cobra"
 	"golang.org/x/sys/unix"
 )
 
 func ragCommand(global *globalOptions) *cobra.Command {
+	var ollama config.OllamaOptionsBlock
 	index := &cobra.Command{
 		Use:   "index",
 		Short: "Indexes all documents from the configuration file",
-		Run: func(cmd *cobra.Command, args []string) {
+		RunE: func(cmd *cobra.Command, args []string) error {
 			procContext, done := signal.NotifyContext(cmd.Context(), unix.SIGSTOP)
 			defer done()
 
 			file, problem := global.config.Load()
 			if problem != nil {
-				fmt.Fprintf(os.Stderr, "%s\n", problem.Error())
-				return
+				return problem
 			}
+			file = file.WithOllamaOverrides(ollama)
 
-			fmt.Printf("Indexing %d repositories\n", len(file.Documents))
+			slog.Info(fmt.Sprintf("indexing %d repositories", len(file.Documents)), logging.Component, "rag")
 			for _, group := range file.Documents {
 				if err := group.Index(procContext); err != nil {
-					fmt.Fprintf(os.Stderr, "%s\n", err.Error())
+					problem = errors.Join(problem, fmt.Errorf("indexing %q: %w", group.Name, err))
 				}
 			}
+			return problem
 		},
 	}
 
-	query := &cobra.Command{
+	var output string
+	queryCmd := &cobra.Command{
 		Use:   "query <store> <query>",
 		Short: "Queries the RAG store",
 		Args:  cobra.ExactArgs(2),
-		Run: func(cmd *cobra.Command, args []string) {
+		RunE: func(cmd *cobra.Command, args []string) error {
 			procContext, done := signal.NotifyContext(cmd.Context(), unix.SIGSTOP)
 			defer done()
 
 			file, problem := global.config.Load()
 			if problem != nil {
-				fmt.Fprintf(os.Stderr, "%s\n", problem.Error())
-				return
+				return problem
 			}
+			file = file.WithOllamaOverrides(ollama)
 
-			result, err := file.QueryRAGDocuments(procContext, args[0], args[1])
-			if err != nil {
-				fmt.Fprintf(os.Stderr, "%s\n", err.Error())
-				return
-			}
-			fmt.Println(result)
+			return query.QueryRAG(procContext, file, args[0], args[1], output)
 		},
 	}
+	queryCmd.Flags().StringVarP(&output, "output", "o", query.OutputText, "output format: text or jsonl")
 
 	rag := &cobra.Command{
 		Use:   "rag",
 		Short: "Operations against the RAG store",
 	}
+	ollama.EmbeddingFlags(rag)
 	rag.AddCommand(index)
-	rag.AddCommand(query)
+	rag.AddCommand(queryCmd)
 	return rag
 }
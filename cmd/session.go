@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/meschbach/marvin/internal/query"
+	"github.com/spf13/cobra"
+)
+
+func sessionCommand() *cobra.Command {
+	store := query.NewSessionStore(query.DefaultSessionDirectory)
+
+	list := &cobra.Command{
+		Use:   "list",
+		Short: "Lists the persisted sessions",
+		Args:  cobra.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			sessions, err := store.List()
+			if err != nil {
+				return err
+			}
+			if len(sessions) == 0 {
+				fmt.Fprintln(cmd.OutOrStdout(), "No sessions found")
+			}
+			for _, s := range sessions {
+				forked := ""
+				if s.ForkedFrom != "" {
+					forked = fmt.Sprintf(" (forked from %s)", s.ForkedFrom)
+				}
+				fmt.Fprintf(cmd.OutOrStdout(), "%s\t%d messages\t%s\t%s%s\n", s.Name, s.Messages, s.Model, s.UpdatedAt.Format(time.RFC3339), forked)
+			}
+			return nil
+		},
+	}
+
+	show := &cobra.Command{
+		Use:   "show <session>",
+		Short: "Shows the messages of a session with their index for forking",
+		Args:  cobra.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			messages, err := store.Messages(args[0])
+			if err != nil {
+				return err
+			}
+			for i, m := range messages {
+				content := m.Content
+				for _, call := range m.ToolCalls {
+					content += fmt.Sprintf(" [tool call %s %s]", call.Function.Name, call.Function.Arguments.String())
+				}
+				fmt.Fprintf(cmd.OutOrStdout(), "%d\t%s\t%s\n", i, m.Role, strings.ReplaceAll(content, "\n", " "))
+			}
+			return nil
+		},
+	}
+
+	var forkAt int
+	fork := &cobra.Command{
+		Use:   "fork <source> <target>",
+		Short: "Branches a new session from the history of an existing session",
+		Args:  cobra.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := store.Fork(args[0], args[1], forkAt); err != nil {
+				return err
+			}
+			fmt.Fprintf(cmd.OutOrStdout(), "Forked %s into %s\n", args[0], args[1])
+			return nil
+		},
+	}
+	fork.Flags().IntVar(&forkAt, "at", -1, "index of the last message to keep, as shown by `session show`; defaults to the entire history")
+
+	session := &cobra.Command{
+		Use:   "session",
+		Short: "Operations on persisted conversations",
+	}
+	session.AddCommand(list)
+	session.AddCommand(show)
+	session.AddCommand(fork)
+	return session
+}
@@ -7,5 +7,4 @@ EOS
 }
 
 docker_mcp "thinking" "mcp/sequentialthinking" {
-  verbose = false
 }
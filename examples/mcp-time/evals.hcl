@@ -0,0 +1,31 @@
+eval "utc-time" {
+  config    = "marvin.hcl"
+  prompt    = "What time is it in UTC right now?"
+  runs      = 5
+  pass_rate = 0.8
+
+  tool "time.get_current_time" {
+    arguments = {
+      timezone = "UTC"
+    }
+  }
+
+  answer {
+    matches = "\\d{1,2}:\\d{2}"
+  }
+
+  max_turns = 4
+}
+
+eval "no-tool-for-arithmetic" {
+  config = "marvin.hcl"
+  prompt = "What is 12 plus 30?"
+
+  tool "time.get_current_time" {
+    called = false
+  }
+
+  answer {
+    matches = "42"
+  }
+}
@@ -8,7 +8,6 @@ EOS
 }
 
 docker_mcp "time" "mcp/time" {
-  verbose = false
   args {
     strings = ["--local-timezone", "America/Los_Angeles"]
   }
@@ -13,7 +13,6 @@ EOS
 }
 
 docker_mcp "email" "ghcr.io/ai-zerolab/mcp-email-server:latest" {
-  verbose = true
   mount "/root/.config/zerolib/mcp_email_server/config.toml" "config/config.toml" {
   }
   env "MCP_EMAIL_SERVER_LOG_LEVEL" {
@@ -25,5 +24,4 @@ docker_mcp "email" "ghcr.io/ai-zerolab/mcp-email-server:latest" {
 }
 
 docker_mcp "working_list" "mcp/sequentialthinking" {
-  verbose = true
 }
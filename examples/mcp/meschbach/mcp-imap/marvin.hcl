@@ -10,7 +10,6 @@ EOS
 }
 
 docker_mcp "meschbach" "ghcr.io/meschbach/mcp-imap:v0.1.1" {
-  verbose = false
   env "MCP_MAILBOX" {
     pass_through = true
   }
@@ -23,5 +22,4 @@ docker_mcp "meschbach" "ghcr.io/meschbach/mcp-imap:v0.1.1" {
 }
 
 docker_mcp "working_list" "mcp/sequentialthinking" {
-  verbose = false
 }
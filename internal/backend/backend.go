@@ -0,0 +1,20 @@
+// Package backend abstracts the servers hosting language models.  The Ollama API types are used as the common
+// vocabulary for requests and responses regardless of the provider.
+package backend
+
+import (
+	"context"
+
+	"github.com/ollama/ollama/api"
+)
+
+// Backend streams chats, embeds text and describes the models of a provider
+type Backend interface {
+	// Chat sends the request and invokes fn with each part of the response as it is streamed.  Tool calls and usage
+	// are delivered no later than the final part, which has Done set.
+	Chat(ctx context.Context, req *api.ChatRequest, fn api.ChatResponseFunc) error
+	// Embed returns the embedding vector of the prompt
+	Embed(ctx context.Context, req *api.EmbeddingRequest) (*api.EmbeddingResponse, error)
+	// ContextWindow is the number of tokens the model attends to, or 0 when the provider can not tell
+	ContextWindow(ctx context.Context, model string) (int, error)
+}
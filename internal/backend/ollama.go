@@ -0,0 +1,86 @@
+package backend
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/ollama/ollama/api"
+	"github.com/ollama/ollama/envconfig"
+)
+
+// Ollama is a backend served by Ollama
+type Ollama struct {
+	client *api.Client
+}
+
+// NewOllama connects to the Ollama server at baseURL, or the server named by the environment when baseURL is empty.
+// Requests are made through client, or http.DefaultClient when nil.
+func NewOllama(baseURL string, client *http.Client) (*Ollama, error) {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	if baseURL == "" {
+		return &Ollama{client: api.NewClient(envconfig.Host(), client)}, nil
+	}
+	base, err := url.Parse(baseURL)
+	if err != nil {
+		return nil, err
+	}
+	return &Ollama{client: api.NewClient(base, client)}, nil
+}
+
+func (o *Ollama) Chat(ctx context.Context, req *api.ChatRequest, fn api.ChatResponseFunc) error {
+	return o.client.Chat(ctx, req, fn)
+}
+
+func (o *Ollama) Embed(ctx context.Context, req *api.EmbeddingRequest) (*api.EmbeddingResponse, error) {
+	return o.client.Embeddings(ctx, req)
+}
+
+// defaultOllamaContextWindow is the num_ctx Ollama uses when the model does not declare one
+const defaultOllamaContextWindow = 4096
+
+// ContextWindow is the num_ctx parameter of the model, bounded by the context length the model was trained with
+func (o *Ollama) ContextWindow(ctx context.Context, model string) (int, error) {
+	details, err := o.client.Show(ctx, &api.ShowRequest{Model: model})
+	if err != nil {
+		return 0, err
+	}
+	window := defaultOllamaContextWindow
+	if configured := parameterNumCtx(details.Parameters); configured > 0 {
+		window = configured
+	}
+	if trained := modelContextLength(details.ModelInfo); trained > 0 && trained < window {
+		window = trained
+	}
+	return window, nil
+}
+
+// parameterNumCtx extracts num_ctx from the parameter listing of a model, which has a `name value` pair on each line
+func parameterNumCtx(parameters string) int {
+	for _, line := range strings.Split(parameters, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "num_ctx" {
+			if value, err := strconv.Atoi(fields[1]); err == nil {
+				return value
+			}
+		}
+	}
+	return 0
+}
+
+// modelContextLength finds the `<architecture>.context_length` entry of the model information
+func modelContextLength(info map[string]any) int {
+	for key, value := range info {
+		if !strings.HasSuffix(key, ".context_length") {
+			continue
+		}
+		if length, ok := value.(float64); ok {
+			return int(length)
+		}
+	}
+	return 0
+}
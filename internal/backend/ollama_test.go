@@ -0,0 +1,13 @@
+package backend
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParameterNumCtx(t *testing.T) {
+	assert.Equal(t, 8192, parameterNumCtx("stop                           \"<|im_end|>\"\nnum_ctx                        8192\n"))
+	assert.Equal(t, 0, parameterNumCtx("temperature 0.1"))
+	assert.Equal(t, 131072, modelContextLength(map[string]any{"general.architecture": "llama", "llama.context_length": float64(131072)}))
+}
@@ -0,0 +1,279 @@
+package backend
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/ollama/ollama/api"
+)
+
+// OpenAI is a backend served through the OpenAI compatible `/v1/chat/completions` and `/v1/embeddings` endpoints, as
+// offered by llama.cpp server, vLLM and LM Studio amongst others.
+type OpenAI struct {
+	// baseURL is the prefix of the endpoints, such as http://localhost:8080/v1
+	baseURL string
+	apiKey  string
+	http    *http.Client
+}
+
+// NewOpenAI creates a backend for the server at baseURL.  apiKey is sent as a bearer token when not empty.
+func NewOpenAI(baseURL, apiKey string, client *http.Client) *OpenAI {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &OpenAI{baseURL: strings.TrimSuffix(baseURL, "/"), apiKey: apiKey, http: client}
+}
+
+type openAIToolCall struct {
+	Index    int    `json:"index"`
+	ID       string `json:"id,omitempty"`
+	Type     string `json:"type,omitempty"`
+	Function struct {
+		Name      string `json:"name,omitempty"`
+		Arguments string `json:"arguments,omitempty"`
+	} `json:"function"`
+}
+
+type openAIMessage struct {
+	Role       string           `json:"role"`
+	Content    string           `json:"content"`
+	ToolCalls  []openAIToolCall `json:"tool_calls,omitempty"`
+	ToolCallID string           `json:"tool_call_id,omitempty"`
+	Name       string           `json:"name,omitempty"`
+}
+
+type openAIJSONSchema struct {
+	Name   string          `json:"name"`
+	Strict bool            `json:"strict"`
+	Schema json.RawMessage `json:"schema"`
+}
+
+type openAIResponseFormat struct {
+	Type       string            `json:"type"`
+	JSONSchema *openAIJSONSchema `json:"json_schema,omitempty"`
+}
+
+type openAIChatRequest struct {
+	Model          string                `json:"model"`
+	Messages       []openAIMessage       `json:"messages"`
+	Tools          api.Tools             `json:"tools,omitempty"`
+	Stream         bool                  `json:"stream"`
+	StreamOptions  map[string]bool       `json:"stream_options,omitempty"`
+	ResponseFormat *openAIResponseFormat `json:"response_format,omitempty"`
+	Temperature    any                   `json:"temperature,omitempty"`
+	TopP           any                   `json:"top_p,omitempty"`
+	Seed           any                   `json:"seed,omitempty"`
+	MaxTokens      any                   `json:"max_tokens,omitempty"`
+	Stop           any                   `json:"stop,omitempty"`
+}
+
+type openAIChunk struct {
+	Choices []struct {
+		Delta struct {
+			Content          string           `json:"content"`
+			ReasoningContent string           `json:"reasoning_content"`
+			ToolCalls        []openAIToolCall `json:"tool_calls"`
+		} `json:"delta"`
+		FinishReason *string `json:"finish_reason"`
+	} `json:"choices"`
+	Usage *struct {
+		PromptTokens     int `json:"prompt_tokens"`
+		CompletionTokens int `json:"completion_tokens"`
+	} `json:"usage"`
+}
+
+func (o *OpenAI) Chat(ctx context.Context, req *api.ChatRequest, fn api.ChatResponseFunc) error {
+	body := openAIChatRequest{
+		Model:         req.Model,
+		Tools:         req.Tools,
+		Stream:        true,
+		StreamOptions: map[string]bool{"include_usage": true},
+		Temperature:   req.Options["temperature"],
+		TopP:          req.Options["top_p"],
+		Seed:          req.Options["seed"],
+		MaxTokens:     req.Options["num_predict"],
+		Stop:          req.Options["stop"],
+	}
+	for _, m := range req.Messages {
+		body.Messages = append(body.Messages, toOpenAIMessage(m))
+	}
+	body.ResponseFormat = toOpenAIResponseFormat(req.Format)
+
+	response, err := o.post(ctx, "/chat/completions", body)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	var calls []openAIToolCall
+	final := api.ChatResponse{Model: req.Model, Message: api.Message{Role: "assistant"}, Done: true}
+	scanner := bufio.NewScanner(response.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data:")
+		if !ok {
+			continue
+		}
+		data = strings.TrimSpace(data)
+		if data == "[DONE]" {
+			break
+		}
+		var chunk openAIChunk
+		if err := json.Unmarshal([]byte(data), &chunk); err != nil {
+			return fmt.Errorf("decoding stream: %w", err)
+		}
+		if chunk.Usage != nil {
+			final.PromptEvalCount = chunk.Usage.PromptTokens
+			final.EvalCount = chunk.Usage.CompletionTokens
+		}
+		for _, choice := range chunk.Choices {
+			for _, call := range choice.Delta.ToolCalls {
+				calls = mergeToolCall(calls, call)
+			}
+			if choice.FinishReason != nil {
+				final.DoneReason = *choice.FinishReason
+			}
+			if choice.Delta.Content == "" && choice.Delta.ReasoningContent == "" {
+				continue
+			}
+			part := api.ChatResponse{Model: req.Model, Message: api.Message{
+				Role:     "assistant",
+				Content:  choice.Delta.Content,
+				Thinking: choice.Delta.ReasoningContent,
+			}}
+			if err := fn(part); err != nil {
+				return err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("reading stream: %w", err)
+	}
+
+	for _, call := range calls {
+		arguments := api.ToolCallFunctionArguments{}
+		if call.Function.Arguments != "" {
+			if err := json.Unmarshal([]byte(call.Function.Arguments), &arguments); err != nil {
+				return fmt.Errorf("decoding arguments of tool call %q: %w", call.Function.Name, err)
+			}
+		}
+		final.Message.ToolCalls = append(final.Message.ToolCalls, api.ToolCall{
+			ID:       call.ID,
+			Function: api.ToolCallFunction{Index: call.Index, Name: call.Function.Name, Arguments: arguments},
+		})
+	}
+	return fn(final)
+}
+
+// mergeToolCall accumulates a streamed fragment of a tool call.  Fragments of the same call share an index.
+func mergeToolCall(calls []openAIToolCall, fragment openAIToolCall) []openAIToolCall {
+	for i := range calls {
+		if calls[i].Index == fragment.Index {
+			if fragment.ID != "" {
+				calls[i].ID = fragment.ID
+			}
+			calls[i].Function.Name += fragment.Function.Name
+			calls[i].Function.Arguments += fragment.Function.Arguments
+			return calls
+		}
+	}
+	return append(calls, fragment)
+}
+
+func toOpenAIMessage(m api.Message) openAIMessage {
+	out := openAIMessage{Role: m.Role, Content: m.Content}
+	switch m.Role {
+	case "tool", "tool_result":
+		out.Role = "tool"
+		out.ToolCallID = m.ToolCallID
+		out.Name = m.ToolName
+	}
+	for i, call := range m.ToolCalls {
+		arguments, _ := json.Marshal(call.Function.Arguments)
+		converted := openAIToolCall{Index: i, ID: call.ID, Type: "function"}
+		converted.Function.Name = call.Function.Name
+		converted.Function.Arguments = string(arguments)
+		out.ToolCalls = append(out.ToolCalls, converted)
+	}
+	return out
+}
+
+// toOpenAIResponseFormat translates the Ollama format, either "json" or a JSON schema
+func toOpenAIResponseFormat(format json.RawMessage) *openAIResponseFormat {
+	trimmed := bytes.TrimSpace(format)
+	if len(trimmed) == 0 {
+		return nil
+	}
+	if string(trimmed) == `"json"` {
+		return &openAIResponseFormat{Type: "json_object"}
+	}
+	return &openAIResponseFormat{
+		Type:       "json_schema",
+		JSONSchema: &openAIJSONSchema{Name: "response", Strict: true, Schema: trimmed},
+	}
+}
+
+func (o *OpenAI) Embed(ctx context.Context, req *api.EmbeddingRequest) (*api.EmbeddingResponse, error) {
+	response, err := o.post(ctx, "/embeddings", map[string]any{"model": req.Model, "input": req.Prompt})
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+	var decoded struct {
+		Data []struct {
+			Embedding []float64 `json:"embedding"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(response.Body).Decode(&decoded); err != nil {
+		return nil, fmt.Errorf("decoding embeddings: %w", err)
+	}
+	if len(decoded.Data) == 0 {
+		return &api.EmbeddingResponse{}, nil
+	}
+	return &api.EmbeddingResponse{Embedding: decoded.Data[0].Embedding}, nil
+}
+
+// ContextWindow is not described by the OpenAI API
+func (o *OpenAI) ContextWindow(ctx context.Context, model string) (int, error) {
+	return 0, nil
+}
+
+// post sends the body as JSON, returning an api.StatusError when the server rejects the request
+func (o *OpenAI) post(ctx context.Context, path string, body any) (*http.Response, error) {
+	encoded, err := json.Marshal(body)
+	if err != nil {
+		return nil, err
+	}
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, o.baseURL+path, bytes.NewReader(encoded))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	if o.apiKey != "" {
+		request.Header.Set("Authorization", "Bearer "+o.apiKey)
+	}
+	response, err := o.http.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode >= http.StatusBadRequest {
+		defer response.Body.Close()
+		message, _ := io.ReadAll(io.LimitReader(response.Body, 4096))
+		var decoded struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if json.Unmarshal(message, &decoded) == nil && decoded.Error.Message != "" {
+			message = []byte(decoded.Error.Message)
+		}
+		return nil, api.StatusError{StatusCode: response.StatusCode, Status: response.Status, ErrorMessage: strings.TrimSpace(string(message))}
+	}
+	return response, nil
+}
@@ -0,0 +1,114 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ollama/ollama/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOpenAI_ChatStreamsContentAndToolCalls(t *testing.T) {
+	var received map[string]any
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/chat/completions", r.URL.Path)
+		assert.Equal(t, "Bearer secret", r.Header.Get("Authorization"))
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&received))
+		w.Header().Set("Content-Type", "text/event-stream")
+		for _, chunk := range []string{
+			`{"choices":[{"delta":{"role":"assistant","reasoning_content":"hmm"}}]}`,
+			`{"choices":[{"delta":{"content":"Checking "}}]}`,
+			`{"choices":[{"delta":{"content":"the time"}}]}`,
+			`{"choices":[{"delta":{"tool_calls":[{"index":0,"id":"call_1","type":"function","function":{"name":"time.now","arguments":"{\"zone\":"}}]}}]}`,
+			`{"choices":[{"delta":{"tool_calls":[{"index":0,"function":{"arguments":"\"UTC\"}"}}]},"finish_reason":"tool_calls"}]}`,
+			`{"choices":[],"usage":{"prompt_tokens":12,"completion_tokens":5}}`,
+			`[DONE]`,
+		} {
+			fmt.Fprintf(w, "data: %s\n\n", chunk)
+		}
+	}))
+	defer server.Close()
+
+	temperature := 0.2
+	openAI := NewOpenAI(server.URL+"/v1/", "secret", nil)
+	var parts []api.ChatResponse
+	err := openAI.Chat(context.Background(), &api.ChatRequest{
+		Model: "qwen",
+		Messages: []api.Message{
+			{Role: "user", Content: "What time is it?"},
+			{Role: "assistant", ToolCalls: []api.ToolCall{{ID: "call_0", Function: api.ToolCallFunction{Name: "time.now", Arguments: api.ToolCallFunctionArguments{"zone": "PST"}}}}},
+			{Role: "tool", ToolCallID: "call_0", ToolName: "time.now", Content: "noon"},
+		},
+		Tools:   api.Tools{{Type: "function", Function: api.ToolFunction{Name: "time.now", Description: "current time"}}},
+		Format:  json.RawMessage(`{"type":"object"}`),
+		Options: map[string]any{"temperature": temperature, "num_predict": 64},
+	}, func(resp api.ChatResponse) error {
+		parts = append(parts, resp)
+		return nil
+	})
+	require.NoError(t, err)
+
+	require.Len(t, parts, 4)
+	assert.Equal(t, "hmm", parts[0].Message.Thinking)
+	assert.Equal(t, "Checking ", parts[1].Message.Content)
+	assert.Equal(t, "the time", parts[2].Message.Content)
+	final := parts[3]
+	assert.True(t, final.Done)
+	assert.Equal(t, "tool_calls", final.DoneReason)
+	assert.Equal(t, 12, final.PromptEvalCount)
+	assert.Equal(t, 5, final.EvalCount)
+	require.Len(t, final.Message.ToolCalls, 1)
+	assert.Equal(t, "call_1", final.Message.ToolCalls[0].ID)
+	assert.Equal(t, "time.now", final.Message.ToolCalls[0].Function.Name)
+	assert.Equal(t, api.ToolCallFunctionArguments{"zone": "UTC"}, final.Message.ToolCalls[0].Function.Arguments)
+
+	assert.Equal(t, "qwen", received["model"])
+	assert.Equal(t, true, received["stream"])
+	assert.Equal(t, temperature, received["temperature"])
+	assert.Equal(t, float64(64), received["max_tokens"])
+	assert.Equal(t, "json_schema", received["response_format"].(map[string]any)["type"])
+	messages := received["messages"].([]any)
+	require.Len(t, messages, 3)
+	call := messages[1].(map[string]any)["tool_calls"].([]any)[0].(map[string]any)
+	assert.Equal(t, `{"zone":"PST"}`, call["function"].(map[string]any)["arguments"])
+	assert.Equal(t, "call_0", messages[2].(map[string]any)["tool_call_id"])
+	tool := received["tools"].([]any)[0].(map[string]any)
+	assert.Equal(t, "time.now", tool["function"].(map[string]any)["name"])
+}
+
+func TestOpenAI_Embed(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/v1/embeddings", r.URL.Path)
+		var body map[string]any
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		assert.Equal(t, "hello", body["input"])
+		fmt.Fprint(w, `{"data":[{"embedding":[0.5,0.25]}]}`)
+	}))
+	defer server.Close()
+
+	resp, err := NewOpenAI(server.URL+"/v1", "", nil).Embed(context.Background(), &api.EmbeddingRequest{Model: "nomic", Prompt: "hello"})
+	require.NoError(t, err)
+	assert.Equal(t, []float64{0.5, 0.25}, resp.Embedding)
+}
+
+func TestOpenAI_ErrorsAreStatusErrors(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		fmt.Fprint(w, `{"error":{"message":"model 'missing' not found"}}`)
+	}))
+	defer server.Close()
+
+	err := NewOpenAI(server.URL, "", nil).Chat(context.Background(), &api.ChatRequest{Model: "missing"}, func(api.ChatResponse) error {
+		return nil
+	})
+	var status api.StatusError
+	require.ErrorAs(t, err, &status)
+	assert.Equal(t, http.StatusNotFound, status.StatusCode)
+	assert.True(t, strings.Contains(status.ErrorMessage, "not found"))
+}
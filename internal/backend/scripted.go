@@ -0,0 +1,128 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sync"
+
+	"github.com/ollama/ollama/api"
+)
+
+// Scripted plays back a fixed sequence of replies in place of a model, recording each request it receives.  It allows
+// conversations to be exercised deterministically without a server.
+type Scripted struct {
+	lock     sync.Mutex
+	replies  []ScriptedReply
+	requests []api.ChatRequest
+	// Window is reported as the context window of every model
+	Window int
+	// Embeddings maps each prompt to its vector.  Embedding an unknown prompt is an error.
+	Embeddings map[string][]float64
+}
+
+// ScriptedReply is the response to a single chat request
+type ScriptedReply struct {
+	// Thinking is streamed before the content
+	Thinking string
+	// Parts are streamed in order as the content of the reply
+	Parts []string
+	// ToolCalls are delivered with the final part
+	ToolCalls []api.ToolCall
+	// PromptTokens and ResponseTokens are reported as the usage of the reply
+	PromptTokens   int
+	ResponseTokens int
+	// Err fails the request after streaming any Thinking and Parts, instead of completing the reply
+	Err error
+}
+
+// Reply answers with content
+func Reply(content string) ScriptedReply {
+	return ScriptedReply{Parts: []string{content}}
+}
+
+// CallTools answers by requesting the tools be called
+func CallTools(calls ...api.ToolCall) ScriptedReply {
+	return ScriptedReply{ToolCalls: calls}
+}
+
+// ToolCall builds a call to the named tool
+func ToolCall(id, name string, arguments map[string]any) api.ToolCall {
+	return api.ToolCall{ID: id, Function: api.ToolCallFunction{Name: name, Arguments: arguments}}
+}
+
+// NewScripted creates a backend answering each chat request with the next of the replies
+func NewScripted(replies ...ScriptedReply) *Scripted {
+	return &Scripted{replies: replies}
+}
+
+// Requests are the chat requests received so far, in order
+func (s *Scripted) Requests() []api.ChatRequest {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return slices.Clone(s.requests)
+}
+
+// Remaining is the number of replies yet to be played
+func (s *Scripted) Remaining() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return len(s.replies)
+}
+
+func (s *Scripted) Chat(ctx context.Context, req *api.ChatRequest, fn api.ChatResponseFunc) error {
+	s.lock.Lock()
+	recorded := *req
+	// The caller continues to append to its history; the recorded request must not observe those changes.
+	recorded.Messages = slices.Clone(req.Messages)
+	s.requests = append(s.requests, recorded)
+	if len(s.replies) == 0 {
+		s.lock.Unlock()
+		return fmt.Errorf("script exhausted after %d replies", len(s.requests)-1)
+	}
+	reply := s.replies[0]
+	s.replies = s.replies[1:]
+	s.lock.Unlock()
+
+	if reply.Thinking != "" {
+		if err := fn(api.ChatResponse{Model: req.Model, Message: api.Message{Role: "assistant", Thinking: reply.Thinking}}); err != nil {
+			return err
+		}
+	}
+	for _, part := range reply.Parts {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(api.ChatResponse{Model: req.Model, Message: api.Message{Role: "assistant", Content: part}}); err != nil {
+			return err
+		}
+	}
+	if reply.Err != nil {
+		return reply.Err
+	}
+	doneReason := "stop"
+	if len(reply.ToolCalls) > 0 {
+		doneReason = "tool_calls"
+	}
+	final := api.ChatResponse{
+		Model:      req.Model,
+		Message:    api.Message{Role: "assistant", ToolCalls: reply.ToolCalls},
+		Done:       true,
+		DoneReason: doneReason,
+	}
+	final.PromptEvalCount = reply.PromptTokens
+	final.EvalCount = reply.ResponseTokens
+	return fn(final)
+}
+
+func (s *Scripted) Embed(ctx context.Context, req *api.EmbeddingRequest) (*api.EmbeddingResponse, error) {
+	vector, ok := s.Embeddings[req.Prompt]
+	if !ok {
+		return nil, fmt.Errorf("no embedding scripted for %q", req.Prompt)
+	}
+	return &api.EmbeddingResponse{Embedding: vector}, nil
+}
+
+func (s *Scripted) ContextWindow(ctx context.Context, model string) (int, error) {
+	return s.Window, nil
+}
@@ -0,0 +1,59 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/ollama/ollama/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScripted_PlaysRepliesInOrder(t *testing.T) {
+	script := NewScripted(
+		ScriptedReply{Thinking: "hmm", Parts: []string{"Checking ", "the time"}, ToolCalls: []api.ToolCall{ToolCall("1", "time.now", nil)}, PromptTokens: 7, ResponseTokens: 3},
+		Reply("noon"),
+	)
+	var parts []api.ChatResponse
+	collect := func(resp api.ChatResponse) error {
+		parts = append(parts, resp)
+		return nil
+	}
+
+	history := []api.Message{{Role: "user", Content: "What time is it?"}}
+	require.NoError(t, script.Chat(context.Background(), &api.ChatRequest{Model: "m", Messages: history}, collect))
+	require.Len(t, parts, 4)
+	assert.Equal(t, "hmm", parts[0].Message.Thinking)
+	assert.Equal(t, "Checking ", parts[1].Message.Content)
+	final := parts[3]
+	assert.True(t, final.Done)
+	assert.Equal(t, "tool_calls", final.DoneReason)
+	assert.Equal(t, 7, final.PromptEvalCount)
+	assert.Equal(t, 3, final.EvalCount)
+	assert.Equal(t, "time.now", final.Message.ToolCalls[0].Function.Name)
+
+	history[0].Content = "changed"
+	parts = nil
+	require.NoError(t, script.Chat(context.Background(), &api.ChatRequest{Model: "m", Messages: history}, collect))
+	assert.Equal(t, "noon", parts[0].Message.Content)
+	assert.Equal(t, 0, script.Remaining())
+
+	requests := script.Requests()
+	require.Len(t, requests, 2)
+	assert.Equal(t, "What time is it?", requests[0].Messages[0].Content, "recorded requests are isolated from the caller")
+	assert.Equal(t, "changed", requests[1].Messages[0].Content)
+}
+
+func TestScripted_FailsWhenExhaustedOrScripted(t *testing.T) {
+	cause := errors.New("unreachable")
+	script := NewScripted(ScriptedReply{Err: cause})
+	ignore := func(api.ChatResponse) error { return nil }
+
+	assert.ErrorIs(t, script.Chat(context.Background(), &api.ChatRequest{}, ignore), cause)
+	assert.ErrorContains(t, script.Chat(context.Background(), &api.ChatRequest{}, ignore), "script exhausted after 1 replies")
+	assert.Len(t, script.Requests(), 2)
+
+	_, err := script.Embed(context.Background(), &api.EmbeddingRequest{Prompt: "unknown"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,122 @@
+package cassette
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	"github.com/meschbach/marvin/internal/backend"
+	"github.com/ollama/ollama/api"
+)
+
+// backendCassette is the name of the cassette holding the traffic of the language model backend
+const backendCassette = "backend"
+
+const (
+	kindChat          = "chat"
+	kindEmbed         = "embed"
+	kindContextWindow = "context_window"
+)
+
+// Backend records the traffic of next, or replaces next with the recording when replaying
+func (d *Deck) Backend(next backend.Backend) backend.Backend {
+	if d == nil {
+		return next
+	}
+	if d.replay {
+		return &replayingBackend{d.tape(backendCassette)}
+	}
+	return &recordingBackend{next: next, tape: d.tape(backendCassette)}
+}
+
+type contextWindowRequest struct {
+	Model string `json:"model"`
+}
+
+type recordingBackend struct {
+	next backend.Backend
+	tape *tape
+}
+
+func (r *recordingBackend) Chat(ctx context.Context, req *api.ChatRequest, fn api.ChatResponseFunc) error {
+	var parts []api.ChatResponse
+	err := r.next.Chat(ctx, req, func(resp api.ChatResponse) error {
+		parts = append(parts, resp)
+		return fn(resp)
+	})
+	r.tape.record(kindChat, req, parts, err)
+	return err
+}
+
+func (r *recordingBackend) Embed(ctx context.Context, req *api.EmbeddingRequest) (*api.EmbeddingResponse, error) {
+	resp, err := r.next.Embed(ctx, req)
+	r.tape.record(kindEmbed, req, resp, err)
+	return resp, err
+}
+
+func (r *recordingBackend) ContextWindow(ctx context.Context, model string) (int, error) {
+	window, err := r.next.ContextWindow(ctx, model)
+	r.tape.record(kindContextWindow, contextWindowRequest{model}, window, err)
+	return window, err
+}
+
+type replayingBackend struct {
+	tape *tape
+}
+
+func (r *replayingBackend) Chat(ctx context.Context, req *api.ChatRequest, fn api.ChatResponseFunc) error {
+	recorded, err := r.tape.play(kindChat, req)
+	if err != nil {
+		return err
+	}
+	var parts []api.ChatResponse
+	if err := decodeResponse(recorded, &parts); err != nil {
+		return err
+	}
+	for _, part := range parts {
+		if err := fn(part); err != nil {
+			return err
+		}
+	}
+	return recorded.failure()
+}
+
+func (r *replayingBackend) Embed(ctx context.Context, req *api.EmbeddingRequest) (*api.EmbeddingResponse, error) {
+	recorded, err := r.tape.play(kindEmbed, req)
+	if err != nil {
+		return nil, err
+	}
+	if recorded.Error != nil {
+		return nil, recorded.failure()
+	}
+	var resp api.EmbeddingResponse
+	if err := decodeResponse(recorded, &resp); err != nil {
+		return nil, err
+	}
+	return &resp, nil
+}
+
+func (r *replayingBackend) ContextWindow(ctx context.Context, model string) (int, error) {
+	recorded, err := r.tape.play(kindContextWindow, contextWindowRequest{model})
+	if err != nil {
+		return 0, err
+	}
+	if recorded.Error != nil {
+		return 0, recorded.failure()
+	}
+	var window int
+	if err := decodeResponse(recorded, &window); err != nil {
+		return 0, err
+	}
+	return window, nil
+}
+
+func decodeResponse(recorded *Interaction, out any) error {
+	if len(recorded.Response) == 0 {
+		return nil
+	}
+	if err := json.Unmarshal(recorded.Response, out); err != nil {
+		return fmt.Errorf("decoding recorded %s response: %w", recorded.Kind, err)
+	}
+	return nil
+}
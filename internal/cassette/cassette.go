@@ -0,0 +1,373 @@
+// Package cassette records the traffic between marvin and the services it depends on, language model backends and MCP
+// servers, so it may be replayed later in place of those services.  Each service is recorded to its own cassette, a
+// JSON file within a directory.
+package cassette
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/meschbach/marvin/internal/logging"
+	"github.com/ollama/ollama/api"
+	"github.com/spf13/cobra"
+)
+
+// Options selects recording or replaying of traffic from the command line
+type Options struct {
+	// Record is the directory cassettes are written to
+	Record string
+	// Replay is the directory of cassettes standing in for the live services
+	Replay string
+}
+
+// PersistentFlags registers --record and --replay on the command
+func (o *Options) PersistentFlags(forCommand *cobra.Command) {
+	flags := forCommand.PersistentFlags()
+	flags.StringVar(&o.Record, "record", "", "record model and MCP traffic as cassettes in the directory")
+	flags.StringVar(&o.Replay, "replay", "", "replay model and MCP traffic from the cassettes in the directory instead of contacting the services")
+	forCommand.MarkFlagsMutuallyExclusive("record", "replay")
+}
+
+// Open the deck selected by the options.  Without either option the deck is nil, which passes traffic through.
+func (o *Options) Open() (*Deck, error) {
+	switch {
+	case o == nil:
+		return nil, nil
+	case o.Record != "" && o.Replay != "":
+		return nil, errors.New("only one of record or replay may be set")
+	case o.Record != "":
+		return Record(o.Record)
+	case o.Replay != "":
+		return Replay(o.Replay)
+	default:
+		return nil, nil
+	}
+}
+
+// Deck holds the cassettes of a directory, either recording to them or replaying them.  A nil deck passes traffic
+// through untouched.
+type Deck struct {
+	dir    string
+	replay bool
+	lock   sync.Mutex
+	tapes  map[string]*tape
+}
+
+// Record creates a deck writing cassettes to dir when closed, replacing any existing recordings
+func Record(dir string) (*Deck, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	return &Deck{dir: dir, tapes: map[string]*tape{}}, nil
+}
+
+// Replay creates a deck serving the cassettes previously recorded to dir
+func Replay(dir string) (*Deck, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%q is not a directory", dir)
+	}
+	return &Deck{dir: dir, replay: true, tapes: map[string]*tape{}}, nil
+}
+
+// Replaying is true when recordings stand in for the live services
+func (d *Deck) Replaying() bool {
+	return d != nil && d.replay
+}
+
+// tape returns the cassette of the named service, loading the recording when replaying
+func (d *Deck) tape(name string) *tape {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if t, ok := d.tapes[name]; ok {
+		return t
+	}
+	t := &tape{name: name, path: filepath.Join(d.dir, name+".json"), sequence: map[string]int{}}
+	if d.replay {
+		t.load()
+	}
+	d.tapes[name] = t
+	return t
+}
+
+// Close writes the recorded cassettes.  When replaying, recorded interactions which were never requested are logged as
+// they indicate the run diverged from the recording.
+func (d *Deck) Close() (problem error) {
+	if d == nil {
+		return nil
+	}
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	for _, t := range d.tapes {
+		if d.replay {
+			if unplayed := t.unplayed(); unplayed > 0 {
+				slog.Warn(fmt.Sprintf("%d recorded interactions were not replayed", unplayed), logging.Component, "cassette", "cassette", t.path)
+			}
+			continue
+		}
+		if err := t.save(); err != nil {
+			problem = errors.Join(problem, fmt.Errorf("writing cassette %q: %w", t.path, err))
+		}
+	}
+	return problem
+}
+
+// Interaction is a single exchange with a service
+type Interaction struct {
+	// Kind distinguishes the operations of a service, such as chat or embed
+	Kind     string          `json:"kind"`
+	Request  json.RawMessage `json:"request"`
+	Response json.RawMessage `json:"response,omitempty"`
+	Error    *RecordedError  `json:"error,omitempty"`
+}
+
+// RecordedError is the failure a service responded with
+type RecordedError struct {
+	Message string `json:"message"`
+	// StatusCode is set when the backend rejected the request with an HTTP status
+	StatusCode int `json:"status_code,omitempty"`
+}
+
+func recordError(err error) *RecordedError {
+	if err == nil {
+		return nil
+	}
+	recorded := &RecordedError{Message: err.Error()}
+	var status api.StatusError
+	if errors.As(err, &status) {
+		recorded.StatusCode = status.StatusCode
+		recorded.Message = status.ErrorMessage
+	}
+	return recorded
+}
+
+// failure recreates the recorded error, if any
+func (i *Interaction) failure() error {
+	if i.Error == nil {
+		return nil
+	}
+	if i.Error.StatusCode != 0 {
+		return api.StatusError{StatusCode: i.Error.StatusCode, ErrorMessage: i.Error.Message}
+	}
+	return errors.New(i.Error.Message)
+}
+
+type cassetteFile struct {
+	Interactions []Interaction `json:"interactions"`
+}
+
+// tape is the cassette of a single service
+type tape struct {
+	name         string
+	path         string
+	lock         sync.Mutex
+	interactions []Interaction
+	played       []bool
+	// sequence counts the requests of each kind made to the tape
+	sequence map[string]int
+	// problem is the failure to load the recording
+	problem error
+}
+
+func (t *tape) load() {
+	contents, err := os.ReadFile(t.path)
+	if err != nil {
+		t.problem = err
+		return
+	}
+	var file cassetteFile
+	if err := json.Unmarshal(contents, &file); err != nil {
+		t.problem = fmt.Errorf("decoding: %w", err)
+		return
+	}
+	t.interactions = file.Interactions
+	t.played = make([]bool, len(file.Interactions))
+}
+
+func (t *tape) save() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	contents, err := json.MarshalIndent(cassetteFile{Interactions: t.interactions}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(t.path, contents, 0o644)
+}
+
+// record appends the exchange to the tape
+func (t *tape) record(kind string, request, response any, failure error) {
+	interaction := Interaction{Kind: kind, Error: recordError(failure)}
+	var err error
+	if interaction.Request, err = json.Marshal(request); err != nil {
+		slog.Warn("unable to record request", logging.Component, "cassette", "cassette", t.path, "kind", kind, "err", err)
+		return
+	}
+	if response != nil {
+		if interaction.Response, err = json.Marshal(response); err != nil {
+			slog.Warn("unable to record response", logging.Component, "cassette", "cassette", t.path, "kind", kind, "err", err)
+			return
+		}
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.interactions = append(t.interactions, interaction)
+}
+
+// play finds the first recording of the kind not yet played which matches the request.  Requests are compared as
+// JSON so the order of object keys does not matter.
+func (t *tape) play(kind string, request any) (*Interaction, error) {
+	sent, err := normalize(request)
+	if err != nil {
+		return nil, err
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.sequence[kind]++
+	if t.problem != nil {
+		return nil, fmt.Errorf("replaying cassette %q: %w", t.path, t.problem)
+	}
+	var candidate any
+	candidates := 0
+	for i := range t.interactions {
+		if t.played[i] || t.interactions[i].Kind != kind {
+			continue
+		}
+		var recorded any
+		if err := json.Unmarshal(t.interactions[i].Request, &recorded); err != nil {
+			return nil, fmt.Errorf("cassette %q interaction %d: %w", t.path, i, err)
+		}
+		if reflect.DeepEqual(recorded, sent) {
+			t.played[i] = true
+			return &t.interactions[i], nil
+		}
+		if candidates == 0 {
+			candidate = recorded
+		}
+		candidates++
+	}
+	mismatch := &MismatchError{Cassette: t.path, Kind: kind, Sequence: t.sequence[kind]}
+	if candidates == 0 {
+		mismatch.Difference = fmt.Sprintf("the recording has no further %s requests", kind)
+	} else {
+		mismatch.Difference = difference("", candidate, sent)
+	}
+	return nil, mismatch
+}
+
+func (t *tape) unplayed() (count int) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	for _, played := range t.played {
+		if !played {
+			count++
+		}
+	}
+	return count
+}
+
+// normalize round trips the value through JSON producing maps, slices and primitives which may be compared
+func normalize(value any) (any, error) {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+	var out any
+	err = json.Unmarshal(encoded, &out)
+	return out, err
+}
+
+// MismatchError reports a request which does not match any remaining recording of a cassette
+type MismatchError struct {
+	Cassette string
+	Kind     string
+	// Sequence counts the requests of the kind sent to the cassette, starting at 1
+	Sequence int
+	// Difference describes how the request differs from the next recording of the same kind
+	Difference string
+}
+
+func (m *MismatchError) Error() string {
+	return fmt.Sprintf("replaying cassette %q: %s request %d does not match the recording: %s", m.Cassette, m.Kind, m.Sequence, m.Difference)
+}
+
+// difference describes the first point at which the sent value departs from the recorded value
+func difference(path string, recorded, sent any) string {
+	switch r := recorded.(type) {
+	case map[string]any:
+		s, ok := sent.(map[string]any)
+		if !ok {
+			break
+		}
+		keys := map[string]bool{}
+		for key := range r {
+			keys[key] = true
+		}
+		for key := range s {
+			keys[key] = true
+		}
+		ordered := make([]string, 0, len(keys))
+		for key := range keys {
+			ordered = append(ordered, key)
+		}
+		sort.Strings(ordered)
+		for _, key := range ordered {
+			if d := difference(path+"."+key, r[key], s[key]); d != "" {
+				return d
+			}
+		}
+		return ""
+	case []any:
+		s, ok := sent.([]any)
+		if !ok {
+			break
+		}
+		for i := 0; i < len(r) && i < len(s); i++ {
+			if d := difference(fmt.Sprintf("%s[%d]", path, i), r[i], s[i]); d != "" {
+				return d
+			}
+		}
+		if len(r) != len(s) {
+			return fmt.Sprintf("%s: recorded %d entries, sent %d", location(path), len(r), len(s))
+		}
+		return ""
+	}
+	if reflect.DeepEqual(recorded, sent) {
+		return ""
+	}
+	return fmt.Sprintf("%s: recorded %s, sent %s", location(path), brief(recorded), brief(sent))
+}
+
+func location(path string) string {
+	if path == "" {
+		return "request"
+	}
+	return strings.TrimPrefix(path, ".")
+}
+
+// brief renders a value as JSON, truncated to keep the message readable
+func brief(value any) string {
+	if value == nil {
+		return "nothing"
+	}
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprintf("%v", value)
+	}
+	const limit = 80
+	if len(encoded) > limit {
+		return string(encoded[:limit]) + "…"
+	}
+	return string(encoded)
+}
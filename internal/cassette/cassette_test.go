@@ -0,0 +1,134 @@
+package cassette
+
+import (
+	"context"
+	"io/fs"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/meschbach/marvin/internal/backend"
+	"github.com/ollama/ollama/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func chatRequest(content string) *api.ChatRequest {
+	return &api.ChatRequest{Model: "m", Messages: []api.Message{{Role: "user", Content: content}}}
+}
+
+func collect(parts *[]api.ChatResponse) api.ChatResponseFunc {
+	return func(resp api.ChatResponse) error {
+		*parts = append(*parts, resp)
+		return nil
+	}
+}
+
+// recordBackend records the script answering each of the requests to a new cassette directory
+func recordBackend(t *testing.T, script *backend.Scripted, requests ...*api.ChatRequest) string {
+	t.Helper()
+	dir := t.TempDir()
+	deck, err := Record(dir)
+	require.NoError(t, err)
+	recording := deck.Backend(script)
+	for _, req := range requests {
+		_ = recording.Chat(context.Background(), req, func(api.ChatResponse) error { return nil })
+	}
+	require.NoError(t, deck.Close())
+	return dir
+}
+
+func TestDeck_ReplaysBackend(t *testing.T) {
+	script := backend.NewScripted(backend.ScriptedReply{Parts: []string{"Hello ", "there"}, PromptTokens: 3, ResponseTokens: 2})
+	script.Window = 8192
+	script.Embeddings = map[string][]float64{"hello": {0.5, 0.25}}
+
+	dir := t.TempDir()
+	deck, err := Record(dir)
+	require.NoError(t, err)
+	recording := deck.Backend(script)
+	var recorded []api.ChatResponse
+	require.NoError(t, recording.Chat(context.Background(), chatRequest("hi"), collect(&recorded)))
+	_, err = recording.Embed(context.Background(), &api.EmbeddingRequest{Model: "e", Prompt: "hello"})
+	require.NoError(t, err)
+	_, err = recording.ContextWindow(context.Background(), "m")
+	require.NoError(t, err)
+	require.NoError(t, deck.Close())
+	assert.FileExists(t, filepath.Join(dir, "backend.json"))
+
+	deck, err = Replay(dir)
+	require.NoError(t, err)
+	replaying := deck.Backend(nil)
+	window, err := replaying.ContextWindow(context.Background(), "m")
+	require.NoError(t, err)
+	assert.Equal(t, 8192, window)
+	embedding, err := replaying.Embed(context.Background(), &api.EmbeddingRequest{Model: "e", Prompt: "hello"})
+	require.NoError(t, err)
+	assert.Equal(t, []float64{0.5, 0.25}, embedding.Embedding)
+	var replayed []api.ChatResponse
+	require.NoError(t, replaying.Chat(context.Background(), chatRequest("hi"), collect(&replayed)))
+	assert.Equal(t, recorded, replayed)
+	require.NoError(t, deck.Close())
+}
+
+func TestDeck_ReportsMismatches(t *testing.T) {
+	dir := recordBackend(t, backend.NewScripted(backend.Reply("one")), chatRequest("hi"))
+	deck, err := Replay(dir)
+	require.NoError(t, err)
+	replaying := deck.Backend(nil)
+	ignore := func(api.ChatResponse) error { return nil }
+
+	err = replaying.Chat(context.Background(), chatRequest("bye"), ignore)
+	var mismatch *MismatchError
+	require.ErrorAs(t, err, &mismatch)
+	assert.Equal(t, "chat", mismatch.Kind)
+	assert.Equal(t, 1, mismatch.Sequence)
+	assert.Equal(t, `messages[0].content: recorded "hi", sent "bye"`, mismatch.Difference)
+	assert.Contains(t, err.Error(), filepath.Join(dir, "backend.json"))
+
+	require.NoError(t, replaying.Chat(context.Background(), chatRequest("hi"), ignore))
+	err = replaying.Chat(context.Background(), chatRequest("hi"), ignore)
+	require.ErrorAs(t, err, &mismatch)
+	assert.Equal(t, 3, mismatch.Sequence)
+	assert.Equal(t, "the recording has no further chat requests", mismatch.Difference)
+}
+
+func TestDeck_ReplaysFailures(t *testing.T) {
+	missing := api.StatusError{StatusCode: http.StatusNotFound, ErrorMessage: "model not found"}
+	dir := recordBackend(t, backend.NewScripted(backend.ScriptedReply{Err: missing}), chatRequest("hi"))
+	deck, err := Replay(dir)
+	require.NoError(t, err)
+
+	err = deck.Backend(nil).Chat(context.Background(), chatRequest("hi"), func(api.ChatResponse) error { return nil })
+	var status api.StatusError
+	require.ErrorAs(t, err, &status)
+	assert.Equal(t, http.StatusNotFound, status.StatusCode)
+	assert.Equal(t, "model not found", status.ErrorMessage)
+}
+
+func TestDeck_MissingCassette(t *testing.T) {
+	deck, err := Replay(t.TempDir())
+	require.NoError(t, err)
+	err = deck.Backend(nil).Chat(context.Background(), chatRequest("hi"), func(api.ChatResponse) error { return nil })
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	_, err = Replay(filepath.Join(t.TempDir(), "absent"))
+	assert.Error(t, err)
+}
+
+func TestDifference(t *testing.T) {
+	for name, example := range map[string]struct {
+		recorded, sent any
+		expected       string
+	}{
+		"equal":         {map[string]any{"a": 1.0}, map[string]any{"a": 1.0}, ""},
+		"nested":        {map[string]any{"a": []any{"x", "y"}}, map[string]any{"a": []any{"x", "z"}}, `a[1]: recorded "y", sent "z"`},
+		"added key":     {map[string]any{}, map[string]any{"b": true}, "b: recorded nothing, sent true"},
+		"longer":        {[]any{1.0}, []any{1.0, 2.0}, "request: recorded 1 entries, sent 2"},
+		"changed shape": {map[string]any{"a": "x"}, map[string]any{"a": []any{"x"}}, `a: recorded "x", sent ["x"]`},
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, example.expected, difference("", example.recorded, example.sent))
+		})
+	}
+}
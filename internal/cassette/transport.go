@@ -0,0 +1,134 @@
+package cassette
+
+import (
+	"context"
+	"strings"
+
+	"github.com/mark3labs/mcp-go/client/transport"
+	"github.com/mark3labs/mcp-go/mcp"
+)
+
+const (
+	kindRequest      = "request"
+	kindNotification = "notification"
+)
+
+// rpcCall is the recorded form of a JSON-RPC request.  The ID is omitted as it depends on the order of concurrent
+// requests rather than their content.
+type rpcCall struct {
+	Method string `json:"method"`
+	Params any    `json:"params,omitempty"`
+}
+
+// Transport records the JSON-RPC traffic with the named MCP server over next.  When replaying next is not used and may
+// be nil.  Requests and notifications sent by the server are passed through when recording but are not recorded.
+func (d *Deck) Transport(server string, next transport.Interface) transport.Interface {
+	if d == nil {
+		return next
+	}
+	name := "mcp-" + strings.Map(func(r rune) rune {
+		if r == '/' || r == '\\' || r == ':' {
+			return '_'
+		}
+		return r
+	}, server)
+	if d.replay {
+		return &replayingTransport{tape: d.tape(name)}
+	}
+	return &recordingTransport{next: next, tape: d.tape(name)}
+}
+
+type recordingTransport struct {
+	next transport.Interface
+	tape *tape
+}
+
+func (r *recordingTransport) Start(ctx context.Context) error {
+	return r.next.Start(ctx)
+}
+
+func (r *recordingTransport) SendRequest(ctx context.Context, request transport.JSONRPCRequest) (*transport.JSONRPCResponse, error) {
+	resp, err := r.next.SendRequest(ctx, request)
+	var response any
+	if resp != nil {
+		response = resp
+	}
+	r.tape.record(kindRequest, rpcCall{request.Method, request.Params}, response, err)
+	return resp, err
+}
+
+func (r *recordingTransport) SendNotification(ctx context.Context, notification mcp.JSONRPCNotification) error {
+	err := r.next.SendNotification(ctx, notification)
+	r.tape.record(kindNotification, rpcCall{notification.Method, notification.Params}, nil, err)
+	return err
+}
+
+func (r *recordingTransport) SetNotificationHandler(handler func(notification mcp.JSONRPCNotification)) {
+	r.next.SetNotificationHandler(handler)
+}
+
+// SetRequestHandler passes requests initiated by the server through to the client
+func (r *recordingTransport) SetRequestHandler(handler transport.RequestHandler) {
+	if bidirectional, ok := r.next.(transport.BidirectionalInterface); ok {
+		bidirectional.SetRequestHandler(handler)
+	}
+}
+
+// SetProtocolVersion passes the negotiated version through to HTTP transports
+func (r *recordingTransport) SetProtocolVersion(version string) {
+	if connection, ok := r.next.(transport.HTTPConnection); ok {
+		connection.SetProtocolVersion(version)
+	}
+}
+
+func (r *recordingTransport) Close() error {
+	return r.next.Close()
+}
+
+func (r *recordingTransport) GetSessionId() string {
+	return r.next.GetSessionId()
+}
+
+type replayingTransport struct {
+	tape *tape
+}
+
+func (r *replayingTransport) Start(ctx context.Context) error {
+	return nil
+}
+
+func (r *replayingTransport) SendRequest(ctx context.Context, request transport.JSONRPCRequest) (*transport.JSONRPCResponse, error) {
+	recorded, err := r.tape.play(kindRequest, rpcCall{request.Method, request.Params})
+	if err != nil {
+		return nil, err
+	}
+	if recorded.Error != nil {
+		return nil, recorded.failure()
+	}
+	var resp transport.JSONRPCResponse
+	if err := decodeResponse(recorded, &resp); err != nil {
+		return nil, err
+	}
+	resp.ID = request.ID
+	return &resp, nil
+}
+
+func (r *replayingTransport) SendNotification(ctx context.Context, notification mcp.JSONRPCNotification) error {
+	recorded, err := r.tape.play(kindNotification, rpcCall{notification.Method, notification.Params})
+	if err != nil {
+		return err
+	}
+	return recorded.failure()
+}
+
+// SetNotificationHandler is ignored as notifications from the server are not recorded
+func (r *replayingTransport) SetNotificationHandler(handler func(notification mcp.JSONRPCNotification)) {
+}
+
+func (r *replayingTransport) Close() error {
+	return nil
+}
+
+func (r *replayingTransport) GetSessionId() string {
+	return ""
+}
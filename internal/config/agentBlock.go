@@ -0,0 +1,176 @@
+package config
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// AgentBlock is a named profile selecting a model, system prompt, tools and documents from the definitions shared by
+// the file
+type AgentBlock struct {
+	Name string `hcl:"name,label"`
+	// Model overrides the model of the file
+	Model string `hcl:"model,optional"`
+	// SystemPrompt overrides the system prompt of the file
+	SystemPrompt *SystemPromptBlock `hcl:"system_prompt,block"`
+	// Tools names the docker_mcp, http_mcp and local_program blocks available to the agent.  All of them are when unset.
+	Tools []string `hcl:"tools,optional"`
+	// Documents names the documents blocks available to the agent.  All of them are when unset.
+	Documents []string `hcl:"documents,optional"`
+	// Description tells a coordinating model what the agent is for when it is offered as a tool
+	Description string `hcl:"description,optional"`
+	// Delegates names the other agents this agent may hand tasks to.  None are unless named.
+	Delegates []string `hcl:"delegates,optional"`
+	// Limits replaces the limits of the file while running as the agent
+	Limits *LimitsBlock `hcl:"limits,block"`
+}
+
+// ForAgent is the configuration as seen by the named agent: its model and system prompt replace those of the file and
+// only the tools and documents it names remain.  Agents are always selected from the file as parsed.  An empty name is
+// the file itself.
+func (f *File) ForAgent(name string) (*File, error) {
+	if name == "" {
+		return f, nil
+	}
+	f = f.definitions()
+	agent := f.agent(name)
+	if agent == nil {
+		return nil, fmt.Errorf("no agent %q, expected one of: %s", name, strings.Join(f.agentNames(), ", "))
+	}
+	selected := *f
+	selected.shared = f
+	selected.selected = agent
+	if agent.Model != "" {
+		selected.Model = agent.Model
+	}
+	if agent.SystemPrompt != nil {
+		selected.SystemPrompt = agent.SystemPrompt
+	}
+	if agent.Limits != nil {
+		selected.Limits = agent.Limits
+	}
+	if agent.Tools != nil {
+		selected.LocalPrograms = nil
+		for _, program := range f.LocalPrograms {
+			if slices.Contains(agent.Tools, program.Name) {
+				selected.LocalPrograms = append(selected.LocalPrograms, program)
+			}
+		}
+		selected.DockerMCPBlock = nil
+		for _, docker := range f.DockerMCPBlock {
+			if slices.Contains(agent.Tools, docker.Name) {
+				selected.DockerMCPBlock = append(selected.DockerMCPBlock, docker)
+			}
+		}
+		selected.HTTPMCP = nil
+		for _, server := range f.HTTPMCP {
+			if slices.Contains(agent.Tools, server.Name) {
+				selected.HTTPMCP = append(selected.HTTPMCP, server)
+			}
+		}
+	}
+	if agent.Documents != nil {
+		selected.Documents = nil
+		for _, documents := range f.Documents {
+			if slices.Contains(agent.Documents, documents.Name) {
+				selected.Documents = append(selected.Documents, documents)
+			}
+		}
+	}
+	return &selected, nil
+}
+
+// Delegates are the agents a conversation using this configuration may hand tasks to: those named by the delegates of
+// the selected agent.  Without a selected agent there are none, so delegation is only offered when asked for.
+func (f *File) Delegates() []*AgentBlock {
+	if f == nil || f.selected == nil {
+		return nil
+	}
+	var out []*AgentBlock
+	for _, agent := range f.definitions().Agents {
+		if slices.Contains(f.selected.Delegates, agent.Name) {
+			out = append(out, agent)
+		}
+	}
+	return out
+}
+
+// definitions is the file as parsed, before any agent was selected
+func (f *File) definitions() *File {
+	if f != nil && f.shared != nil {
+		return f.shared
+	}
+	return f
+}
+
+func (f *File) agent(name string) *AgentBlock {
+	if f == nil {
+		return nil
+	}
+	for _, agent := range f.Agents {
+		if agent.Name == name {
+			return agent
+		}
+	}
+	return nil
+}
+
+func (f *File) agentNames() []string {
+	if f == nil {
+		return nil
+	}
+	names := make([]string, 0, len(f.Agents))
+	for _, agent := range f.Agents {
+		names = append(names, agent.Name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// validateAgents ensures agent names are unique and each agent only names tools and documents defined by the file
+func (f *File) validateAgents() error {
+	tools := map[string]bool{}
+	for _, program := range f.LocalPrograms {
+		tools[program.Name] = true
+	}
+	for _, docker := range f.DockerMCPBlock {
+		tools[docker.Name] = true
+	}
+	for _, server := range f.HTTPMCP {
+		tools[server.Name] = true
+	}
+	documents := map[string]bool{}
+	for _, block := range f.Documents {
+		documents[block.Name] = true
+	}
+	seen := map[string]bool{}
+	for _, agent := range f.Agents {
+		if seen[agent.Name] {
+			return fmt.Errorf("agent %q is declared more than once", agent.Name)
+		}
+		seen[agent.Name] = true
+		for _, tool := range agent.Tools {
+			if !tools[tool] {
+				return fmt.Errorf("agent %q: no docker_mcp, http_mcp or local_program named %q", agent.Name, tool)
+			}
+		}
+		for _, name := range agent.Documents {
+			if !documents[name] {
+				return fmt.Errorf("agent %q: no documents named %q", agent.Name, name)
+			}
+		}
+	}
+	for _, agent := range f.Agents {
+		for _, name := range agent.Delegates {
+			if name == agent.Name {
+				return fmt.Errorf("agent %q may not delegate to itself", agent.Name)
+			}
+			if !seen[name] {
+				return fmt.Errorf("agent %q: no agent named %q", agent.Name, name)
+			}
+		}
+	}
+	return nil
+}
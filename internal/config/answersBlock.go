@@ -0,0 +1,48 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"regexp"
+
+	"github.com/hashicorp/hcl/v2/gohcl"
+	"github.com/hashicorp/hcl/v2/hclparse"
+	"github.com/meschbach/marvin/internal/logging"
+)
+
+// AnswersFile supplies answers to the clarifying questions of a model ahead of time, for goals run without a person
+// at the terminal
+type AnswersFile struct {
+	Answers []*AnswerBlock `hcl:"answer,block"`
+}
+
+// AnswerBlock answers any question matching the pattern
+type AnswerBlock struct {
+	// Pattern is a regular expression matched against the question
+	Pattern string `hcl:"pattern"`
+	// Answer is the reply given to a matching question
+	Answer string `hcl:"answer"`
+}
+
+// LoadAnswersFile parses and validates the answers at path
+func LoadAnswersFile(path string) (*AnswersFile, error) {
+	slog.Debug("loading answers", logging.Component, "config", "path", path)
+	parsed, diags := hclparse.NewParser().ParseHCLFile(path)
+	if diags.HasErrors() {
+		return nil, &LoadError{Path: path, Underlying: diags}
+	}
+	answers := &AnswersFile{}
+	if diags := gohcl.DecodeBody(parsed.Body, nil, answers); diags.HasErrors() {
+		return nil, &LoadError{Path: path, Underlying: fmt.Errorf("decode HCL: %w", diags)}
+	}
+	if len(answers.Answers) == 0 {
+		return nil, &LoadError{Path: path, Underlying: errors.New("no answer blocks")}
+	}
+	for i, answer := range answers.Answers {
+		if _, err := regexp.Compile(answer.Pattern); err != nil {
+			return nil, &LoadError{Path: path, Underlying: fmt.Errorf("answer %d pattern: %w", i+1, err)}
+		}
+	}
+	return answers, nil
+}
@@ -0,0 +1,89 @@
+package config
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/meschbach/marvin/internal/backend"
+)
+
+// Backend providers which may be selected by a backend block
+const (
+	BackendOllama = "ollama"
+	BackendOpenAI = "openai"
+)
+
+// BackendBlock selects the server hosting the models.  Without a block Ollama is used as configured by the environment.
+type BackendBlock struct {
+	// Provider is ollama or openai, the latter for servers offering the OpenAI compatible API
+	Provider string `hcl:"provider,label"`
+	// URL of the server.  For openai this is the prefix of the endpoints, such as http://localhost:8080/v1
+	URL string `hcl:"url,optional"`
+	// APIKey is sent as a bearer token to openai servers
+	APIKey string `hcl:"api_key,optional"`
+	// APIKeyEnv names an environment variable holding the API key
+	APIKeyEnv string `hcl:"api_key_env,optional"`
+	// Timeout bounds each request, such as "5m"
+	Timeout string `hcl:"timeout,optional"`
+}
+
+// Validate reports unknown providers and settings the provider does not support
+func (b *BackendBlock) Validate() error {
+	if b == nil {
+		return nil
+	}
+	if _, err := b.timeout(); err != nil {
+		return err
+	}
+	switch b.Provider {
+	case BackendOllama:
+		if b.APIKey != "" || b.APIKeyEnv != "" {
+			return fmt.Errorf("api_key is not supported by the %s provider", BackendOllama)
+		}
+		return nil
+	case BackendOpenAI:
+		if b.URL == "" {
+			return fmt.Errorf("url is required by the %s provider", BackendOpenAI)
+		}
+		if b.APIKey != "" && b.APIKeyEnv != "" {
+			return fmt.Errorf("only api_key or api_key_env can be set, not both")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown provider %q, expected %s or %s", b.Provider, BackendOllama, BackendOpenAI)
+	}
+}
+
+// Open connects to the configured backend
+func (b *BackendBlock) Open() (backend.Backend, error) {
+	if b == nil {
+		return backend.NewOllama("", nil)
+	}
+	if err := b.Validate(); err != nil {
+		return nil, err
+	}
+	timeout, _ := b.timeout()
+	switch b.Provider {
+	case BackendOpenAI:
+		apiKey := b.APIKey
+		if b.APIKeyEnv != "" {
+			apiKey = os.Getenv(b.APIKeyEnv)
+		}
+		return backend.NewOpenAI(b.URL, apiKey, &http.Client{Timeout: timeout}), nil
+	default:
+		return backend.NewOllama(b.URL, &http.Client{Timeout: timeout})
+	}
+}
+
+func (b *BackendBlock) timeout() (time.Duration, error) {
+	if b.Timeout == "" {
+		return 0, nil
+	}
+	timeout, err := time.ParseDuration(b.Timeout)
+	if err != nil {
+		return 0, fmt.Errorf("timeout %q: %w", b.Timeout, err)
+	}
+	return timeout, nil
+}
@@ -3,10 +3,12 @@ package config
 import (
 	"errors"
 	"fmt"
+	"log/slog"
 
 	"github.com/hashicorp/hcl/v2"
 	"github.com/hashicorp/hcl/v2/gohcl"
 	"github.com/hashicorp/hcl/v2/hclparse"
+	"github.com/meschbach/marvin/internal/logging"
 	"github.com/spf13/cobra"
 )
 
@@ -28,13 +30,25 @@ func (c *CommandLineOptions) PersistentFlags(forCommand *cobra.Command) {
 func (c *CommandLineOptions) Load() (*File, error) {
 	file, err := loadConfig(c.ConfigFile)
 	if err != nil {
-		return nil, err
+		return nil, &LoadError{Path: c.ConfigFile, Underlying: err}
 	}
 	return file, nil
 }
 
+// LoadError reports a configuration file which could not be read or is invalid
+type LoadError struct {
+	Path       string
+	Underlying error
+}
+
+func (l *LoadError) Error() string {
+	return fmt.Sprintf("loading config %q: %s", l.Path, l.Underlying.Error())
+}
+
+func (l *LoadError) Unwrap() error { return l.Underlying }
+
 func loadConfig(filePath string) (*File, error) {
-	fmt.Printf("Loading config from %s\n", filePath)
+	slog.Debug("loading config", logging.Component, "config", "path", filePath)
 	p := hclparse.NewParser()
 	parsedContent, diags := p.ParseHCLFile(filePath)
 	if diags != nil {
@@ -52,6 +66,45 @@ func interpretConfigFile(parsedContent *hcl.File, workingPath string) (*File, er
 	if diags.HasErrors() {
 		return nil, fmt.Errorf("decode HCL: %w", diags)
 	}
+	if cfg.OllamaOptions != nil {
+		if err := cfg.OllamaOptions.Validate(); err != nil {
+			return nil, fmt.Errorf("ollama_options: %w", err)
+		}
+	}
+	if err := cfg.Backend.Validate(); err != nil {
+		return nil, fmt.Errorf("backend: %w", err)
+	}
+	if cfg.Context != nil {
+		if _, err := cfg.Context.ResolveStrategy(); err != nil {
+			return nil, err
+		}
+	}
+	for _, program := range cfg.LocalPrograms {
+		if err := program.Sampling.Validate(); err != nil {
+			return nil, fmt.Errorf("local_program %q sampling: %w", program.Name, err)
+		}
+	}
+	for _, docker := range cfg.DockerMCPBlock {
+		if err := docker.Sampling.Validate(); err != nil {
+			return nil, fmt.Errorf("docker_mcp %q sampling: %w", docker.Name, err)
+		}
+	}
+	for _, server := range cfg.HTTPMCP {
+		if err := server.Validate(); err != nil {
+			return nil, fmt.Errorf("http_mcp %q: %w", server.Name, err)
+		}
+	}
+	if err := cfg.Elicitation.Validate(); err != nil {
+		return nil, fmt.Errorf("elicitation: %w", err)
+	}
+	if err := cfg.validateAgents(); err != nil {
+		return nil, err
+	}
+	for _, docker := range cfg.DockerMCPBlock {
+		if docker.Verbose != nil {
+			slog.Warn("verbose is deprecated and ignored; pass --verbose instead", logging.Component, "config", "docker_mcp", docker.Name)
+		}
+	}
 	_, err := cfg.resolveWorkingDirectory(workingPath)
 	return cfg, err
 }
@@ -0,0 +1,55 @@
+package config
+
+import "fmt"
+
+const (
+	// CompactionDropToolResults replaces the content of older tool results with a placeholder
+	CompactionDropToolResults = "drop_tool_results"
+	// CompactionSummarize asks the model to summarize the older turns of the conversation
+	CompactionSummarize = "summarize"
+	// CompactionSlidingWindow forgets the oldest turns of the conversation
+	CompactionSlidingWindow = "sliding_window"
+)
+
+const defaultCompactionThreshold = 0.8
+const defaultKeepRecent = 6
+
+// ContextBlock configures how the conversation history is kept within the context window of the model
+type ContextBlock struct {
+	// Strategy is one of drop_tool_results, summarize or sliding_window
+	Strategy string `hcl:"strategy,optional"`
+	// Threshold is the fraction of the context window which triggers compaction
+	Threshold float64 `hcl:"threshold,optional"`
+	// KeepRecent is the number of most recent messages never compacted
+	KeepRecent int `hcl:"keep_recent,optional"`
+	// NumCtx overrides the context window size detected for the model
+	NumCtx int `hcl:"num_ctx,optional"`
+}
+
+// ResolveStrategy returns the configured strategy, defaulting to dropping tool results
+func (c *ContextBlock) ResolveStrategy() (string, error) {
+	switch c.Strategy {
+	case "":
+		return CompactionDropToolResults, nil
+	case CompactionDropToolResults, CompactionSummarize, CompactionSlidingWindow:
+		return c.Strategy, nil
+	default:
+		return "", fmt.Errorf("unknown context strategy %q, expected one of %s, %s or %s", c.Strategy, CompactionDropToolResults, CompactionSummarize, CompactionSlidingWindow)
+	}
+}
+
+// ResolveThreshold returns the configured threshold or the default when unset or out of range
+func (c *ContextBlock) ResolveThreshold() float64 {
+	if c.Threshold <= 0 || c.Threshold > 1 {
+		return defaultCompactionThreshold
+	}
+	return c.Threshold
+}
+
+// ResolveKeepRecent returns the number of recent messages to protect from compaction
+func (c *ContextBlock) ResolveKeepRecent() int {
+	if c.KeepRecent <= 0 {
+		return defaultKeepRecent
+	}
+	return c.KeepRecent
+}
@@ -2,28 +2,28 @@ package config
 
 import (
 	"errors"
-	"fmt"
+	"log/slog"
 	"os"
 	"path/filepath"
+
+	"github.com/meschbach/marvin/internal/logging"
 )
 
 type DockerMCPBlock struct {
-	Name    string              `hcl:"name,label"`
-	Image   string              `hcl:"image,label"`
-	Args    []DockerMCPBlockArg `hcl:"args,block"`
-	Mount   []DockerMCPMount    `hcl:"mount,block"`
-	Env     []DockerMCPBlockEnv `hcl:"env,block"`
-	Verbose *bool               `hcl:"verbose,optional"`
+	Name  string              `hcl:"name,label"`
+	Image string              `hcl:"image,label"`
+	Args  []DockerMCPBlockArg `hcl:"args,block"`
+	Mount []DockerMCPMount    `hcl:"mount,block"`
+	Env   []DockerMCPBlockEnv `hcl:"env,block"`
+	// Verbose is deprecated and ignored in favor of the --verbose flag
+	Verbose *bool `hcl:"verbose,optional"`
 	//WorkingDirectory is an optionally overridable path.  By default, the working directory is the directory containing
 	//the enclosing configuration.
 	WorkingDirectory string `hcl:"working_directory,optional"`
-}
-
-func (d *DockerMCPBlock) ResolveVerbose() bool {
-	if d.Verbose == nil {
-		return false
-	}
-	return *d.Verbose
+	// Serial declares the server can not service concurrent tool calls
+	Serial bool `hcl:"serial,optional"`
+	// Sampling lets the server request completions from the model
+	Sampling *SamplingBlock `hcl:"sampling,block"`
 }
 
 func (d *DockerMCPBlock) EnsureWorkingDirectory(marvinWorkingDirectory string) string {
@@ -31,9 +31,7 @@ func (d *DockerMCPBlock) EnsureWorkingDirectory(marvinWorkingDirectory string) s
 		return d.WorkingDirectory
 	}
 	d.WorkingDirectory = filepath.Join(marvinWorkingDirectory, d.WorkingDirectory)
-	if d.ResolveVerbose() {
-		fmt.Printf("docker-%s >{cfg} Using working directory: %s\n", d.Name, d.WorkingDirectory)
-	}
+	slog.Debug("using working directory", logging.Component, "docker-"+d.Name, "path", d.WorkingDirectory)
 	return d.WorkingDirectory
 }
 
@@ -4,10 +4,12 @@ import (
 	"context"
 	"fmt"
 	"io/fs"
+	"log/slog"
 	"os"
 	"path/filepath"
 
-	"github.com/ollama/ollama/api"
+	"github.com/meschbach/marvin/internal/backend"
+	"github.com/meschbach/marvin/internal/logging"
 	"github.com/philippgille/chromem-go"
 )
 
@@ -19,6 +21,10 @@ type DocumentsBlock struct {
 	Description  string `hcl:"description,optional"`
 	//Model is the embedding model to use
 	Model string `hcl:"model,optional"`
+	// options are the generation options of the enclosing configuration
+	options *OllamaOptionsBlock
+	// backend is the backend block of the enclosing configuration
+	backend *BackendBlock
 }
 
 type QueryResult struct {
@@ -27,11 +33,16 @@ type QueryResult struct {
 }
 
 func (d *DocumentsBlock) Query(ctx context.Context, query string) ([]QueryResult, error) {
-	client, err := api.ClientFromEnvironment()
+	client, err := d.backend.Open()
 	if err != nil {
-		return nil, fmt.Errorf("creating Ollama client for embeddings: %w", err)
+		return nil, fmt.Errorf("opening backend for embeddings: %w", err)
 	}
-	embedder := &ollamaEncoder{client, d.EmbeddingModel()}
+	return d.QueryWith(ctx, client, query)
+}
+
+// QueryWith searches the indexed documents, embedding the query with client
+func (d *DocumentsBlock) QueryWith(ctx context.Context, client backend.Backend, query string) ([]QueryResult, error) {
+	embedder := &backendEncoder{client, d.EmbeddingModel(), d.options}
 
 	db, err := chromem.NewPersistentDB(d.StoragePath, false)
 	if err != nil {
@@ -85,15 +96,15 @@ func (d *DocumentsBlock) Index(ctx context.Context) error {
 	}
 
 	// Create a client once and capture in the closure
-	client, err := api.ClientFromEnvironment()
+	client, err := d.backend.Open()
 	if err != nil {
-		return fmt.Errorf("creating Ollama client for embeddings: %w", err)
+		return fmt.Errorf("opening backend for embeddings: %w", err)
 	}
 
 	// Determine an embedding model from env or use a sensible default known to work with Ollama
 	embeddingModel := d.EmbeddingModel()
-	embedder := &ollamaEncoder{client, embeddingModel}
-	fmt.Printf("Using embedding model %q\n", embeddingModel)
+	embedder := &backendEncoder{client, embeddingModel, d.options}
+	slog.Debug("using embedding model", logging.Component, "rag-"+d.Name, "model", embeddingModel)
 
 	col, err := db.GetOrCreateCollection(d.Name, meta, embedder.Encode)
 	if err != nil {
@@ -154,6 +165,6 @@ func (d *DocumentsBlock) Index(ctx context.Context) error {
 	if err := col.AddDocuments(ctx, docs, concurrency); err != nil {
 		return fmt.Errorf("adding documents: %w", err)
 	}
-	fmt.Printf("Added %d documents\n", len(docs))
+	slog.Info(fmt.Sprintf("added %d documents", len(docs)), logging.Component, "rag-"+d.Name)
 	return nil
 }
@@ -0,0 +1,35 @@
+package config
+
+import "fmt"
+
+// Replies to the elicitation requests of MCP servers when no one is at the terminal
+const (
+	ElicitationDecline  = "decline"
+	ElicitationCancel   = "cancel"
+	ElicitationDefaults = "defaults"
+)
+
+// ElicitationBlock controls how MCP servers asking for input during a tool call are answered
+type ElicitationBlock struct {
+	// NonInteractive is the reply when no one is at the terminal: decline, the default, cancel or defaults, accepting
+	// the defaults of the requested fields and declining when a required field has none
+	NonInteractive string `hcl:"non_interactive,optional"`
+}
+
+// Validate reports unknown non-interactive replies
+func (e *ElicitationBlock) Validate() error {
+	switch e.ResolveNonInteractive() {
+	case ElicitationDecline, ElicitationCancel, ElicitationDefaults:
+		return nil
+	default:
+		return fmt.Errorf("unknown non_interactive reply %q, expected %s, %s or %s", e.NonInteractive, ElicitationDecline, ElicitationCancel, ElicitationDefaults)
+	}
+}
+
+// ResolveNonInteractive returns the configured non-interactive reply or decline when unset
+func (e *ElicitationBlock) ResolveNonInteractive() string {
+	if e == nil || e.NonInteractive == "" {
+		return ElicitationDecline
+	}
+	return e.NonInteractive
+}
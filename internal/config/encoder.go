@@ -5,25 +5,32 @@ import (
 	"fmt"
 	"math"
 
+	"github.com/meschbach/marvin/internal/backend"
 	"github.com/ollama/ollama/api"
 )
 
-type ollamaEncoder struct {
-	client    *api.Client
+// backendEncoder embeds documents through the configured backend
+type backendEncoder struct {
+	client    backend.Backend
 	modelName string
+	options   *OllamaOptionsBlock
 }
 
-func (o *ollamaEncoder) Encode(ctx context.Context, text string) ([]float32, error) {
-	// Call Ollama embeddings endpoint
-	resp, err := o.client.Embeddings(ctx, &api.EmbeddingRequest{
+func (o *backendEncoder) Encode(ctx context.Context, text string) ([]float32, error) {
+	// Call the embeddings endpoint
+	req := &api.EmbeddingRequest{
 		Model:  o.modelName,
 		Prompt: text,
-	})
+	}
+	if err := o.options.ApplyToEmbedding(req); err != nil {
+		return nil, err
+	}
+	resp, err := o.client.Embed(ctx, req)
 	if err != nil {
-		return nil, fmt.Errorf("ollama embeddings: %w", err)
+		return nil, fmt.Errorf("embeddings: %w", err)
 	}
 	if len(resp.Embedding) == 0 {
-		return nil, fmt.Errorf("ollama embeddings: empty vector")
+		return nil, fmt.Errorf("embeddings: empty vector")
 	}
 
 	// Convert to []float32 and normalize to unit length as required by chromem-go
@@ -0,0 +1,204 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"path/filepath"
+	"regexp"
+
+	"github.com/hashicorp/hcl/v2/gohcl"
+	"github.com/hashicorp/hcl/v2/hclparse"
+	"github.com/meschbach/marvin/internal/logging"
+)
+
+// EvalFile is a suite of evaluation cases run by `marvin eval`
+type EvalFile struct {
+	// Path the suite was loaded from
+	Path  string
+	Evals []*EvalBlock `hcl:"eval,block"`
+}
+
+// EvalBlock is a prompt to run through the query pipeline along with the assertions each run must satisfy
+type EvalBlock struct {
+	Name   string `hcl:"name,label"`
+	Prompt string `hcl:"prompt"`
+	// Config is the configuration to run the prompt with, relative to the eval file.  The configuration given on the
+	// command line is used when empty.
+	Config string `hcl:"config,optional"`
+	// Runs is the number of times the prompt is run, defaulting to once
+	Runs int `hcl:"runs,optional"`
+	// PassRate is the fraction of runs which must pass for the case to pass, defaulting to all of them
+	PassRate *float64 `hcl:"pass_rate,optional"`
+	// Tools are assertions on the tools called
+	Tools []*EvalToolBlock `hcl:"tool,block"`
+	// Answer holds assertions on the final answer
+	Answer *EvalAnswerBlock `hcl:"answer,block"`
+	// MaxTurns is the most requests a run may make to the model
+	MaxTurns int `hcl:"max_turns,optional"`
+	// MaxTokens is the most prompt and response tokens a run may consume
+	MaxTokens int `hcl:"max_tokens,optional"`
+}
+
+// EvalToolBlock asserts the named tool was, or was not, called with matching arguments
+type EvalToolBlock struct {
+	Name string `hcl:"name,label"`
+	// Called requires a matching call when true, the default, and forbids one when false
+	Called *bool `hcl:"called,optional"`
+	// Arguments must equal the arguments of the call.  Arguments which are not strings are compared as JSON.
+	Arguments map[string]string `hcl:"arguments,optional"`
+	// ArgumentPatterns are regular expressions the arguments of the call must match
+	ArgumentPatterns map[string]string `hcl:"argument_patterns,optional"`
+
+	// patterns are the compiled ArgumentPatterns
+	patterns map[string]*regexp.Regexp
+}
+
+// EvalAnswerBlock asserts the final answer matches a pattern or JSON schema
+type EvalAnswerBlock struct {
+	// Matches is a regular expression the answer must match
+	Matches string `hcl:"matches,optional"`
+	// NotMatches is a regular expression the answer must not match
+	NotMatches string `hcl:"not_matches,optional"`
+	// Schema is an inline JSON schema the answer must satisfy
+	Schema string `hcl:"schema,optional"`
+	// SchemaFile is the path of a JSON schema the answer must satisfy, relative to the eval file
+	SchemaFile string `hcl:"schema_file,optional"`
+
+	// matches and notMatches are the compiled Matches and NotMatches, nil when unset
+	matches    *regexp.Regexp
+	notMatches *regexp.Regexp
+}
+
+// ResolveRuns is the number of times to run the case, preferring override when set
+func (e *EvalBlock) ResolveRuns(override int) int {
+	if override > 0 {
+		return override
+	}
+	if e.Runs > 0 {
+		return e.Runs
+	}
+	return 1
+}
+
+// ResolvePassRate is the fraction of runs which must pass
+func (e *EvalBlock) ResolvePassRate() float64 {
+	if e.PassRate == nil {
+		return 1
+	}
+	return *e.PassRate
+}
+
+// ExpectCalled is true when the tool must be called and false when it must not be
+func (t *EvalToolBlock) ExpectCalled() bool {
+	return t.Called == nil || *t.Called
+}
+
+// CompiledArgumentPatterns are the regular expressions of ArgumentPatterns, compiled once the case is validated
+func (t *EvalToolBlock) CompiledArgumentPatterns() map[string]*regexp.Regexp {
+	return t.patterns
+}
+
+// MatchesPattern is the compiled Matches, nil when unset or before the case is validated
+func (a *EvalAnswerBlock) MatchesPattern() *regexp.Regexp {
+	if a == nil {
+		return nil
+	}
+	return a.matches
+}
+
+// NotMatchesPattern is the compiled NotMatches, nil when unset or before the case is validated
+func (a *EvalAnswerBlock) NotMatchesPattern() *regexp.Regexp {
+	if a == nil {
+		return nil
+	}
+	return a.notMatches
+}
+
+// ResponseFormat describes the schema of the answer, if any
+func (a *EvalAnswerBlock) ResponseFormat() ResponseFormatBlock {
+	if a == nil {
+		return ResponseFormatBlock{}
+	}
+	return ResponseFormatBlock{Schema: a.Schema, SchemaFile: a.SchemaFile}
+}
+
+// LoadEvalFile parses and validates the suite at path.  Paths within the suite are resolved relative to it.
+func LoadEvalFile(path string) (*EvalFile, error) {
+	slog.Debug("loading eval suite", logging.Component, "config", "path", path)
+	parsed, diags := hclparse.NewParser().ParseHCLFile(path)
+	if diags.HasErrors() {
+		return nil, &LoadError{Path: path, Underlying: diags}
+	}
+	suite := &EvalFile{Path: path}
+	if diags := gohcl.DecodeBody(parsed.Body, nil, suite); diags.HasErrors() {
+		return nil, &LoadError{Path: path, Underlying: fmt.Errorf("decode HCL: %w", diags)}
+	}
+	if err := suite.validate(filepath.Dir(path)); err != nil {
+		return nil, &LoadError{Path: path, Underlying: err}
+	}
+	return suite, nil
+}
+
+func (e *EvalFile) validate(base string) error {
+	if len(e.Evals) == 0 {
+		return errors.New("no eval blocks")
+	}
+	names := map[string]bool{}
+	for _, c := range e.Evals {
+		if names[c.Name] {
+			return fmt.Errorf("eval %q is declared more than once", c.Name)
+		}
+		names[c.Name] = true
+		if err := c.Validate(base); err != nil {
+			return fmt.Errorf("eval %q: %w", c.Name, err)
+		}
+	}
+	return nil
+}
+
+// Validate reports invalid settings and compiles the patterns of the case.  Paths are resolved relative to base.
+func (e *EvalBlock) Validate(base string) error {
+	if e.Prompt == "" {
+		return errors.New("prompt is empty")
+	}
+	if e.Runs < 0 {
+		return fmt.Errorf("runs must not be negative, got %d", e.Runs)
+	}
+	if rate := e.ResolvePassRate(); rate <= 0 || rate > 1 {
+		return fmt.Errorf("pass_rate must be greater than 0 and at most 1, got %g", rate)
+	}
+	if e.Config != "" && !filepath.IsAbs(e.Config) {
+		e.Config = filepath.Join(base, e.Config)
+	}
+	for _, tool := range e.Tools {
+		tool.patterns = map[string]*regexp.Regexp{}
+		for argument, pattern := range tool.ArgumentPatterns {
+			compiled, err := regexp.Compile(pattern)
+			if err != nil {
+				return fmt.Errorf("tool %q argument %q: %w", tool.Name, argument, err)
+			}
+			tool.patterns[argument] = compiled
+		}
+	}
+	if answer := e.Answer; answer != nil {
+		var err error
+		if answer.Matches != "" {
+			if answer.matches, err = regexp.Compile(answer.Matches); err != nil {
+				return fmt.Errorf("answer: %w", err)
+			}
+		}
+		if answer.NotMatches != "" {
+			if answer.notMatches, err = regexp.Compile(answer.NotMatches); err != nil {
+				return fmt.Errorf("answer: %w", err)
+			}
+		}
+		if answer.Schema != "" && answer.SchemaFile != "" {
+			return errors.New("answer: only one of schema or schema_file can be set")
+		}
+		if answer.SchemaFile != "" && !filepath.IsAbs(answer.SchemaFile) {
+			answer.SchemaFile = filepath.Join(base, answer.SchemaFile)
+		}
+	}
+	return nil
+}
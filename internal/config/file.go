@@ -4,6 +4,8 @@ import (
 	"context"
 	"fmt"
 	"path/filepath"
+
+	"github.com/meschbach/marvin/internal/backend"
 )
 
 const DefaultLanguageModel = "ministral-3:3b"
@@ -18,6 +20,29 @@ type File struct {
 	// Documents represents blocks fo contextual documents to manage
 	Documents      []*DocumentsBlock `hcl:"documents,block"`
 	DockerMCPBlock []*DockerMCPBlock `hcl:"docker_mcp,block"`
+	// HTTPMCP are MCP servers reached over HTTP
+	HTTPMCP []*HTTPMCPBlock `hcl:"http_mcp,block"`
+	// Limits bounds tool usage of a conversation
+	Limits *LimitsBlock `hcl:"limits,block"`
+	// OllamaOptions are the generation options passed with each request to Ollama
+	OllamaOptions *OllamaOptionsBlock `hcl:"ollama_options,block"`
+	// ResponseFormat constrains the final answer to JSON matching a schema
+	ResponseFormat *ResponseFormatBlock `hcl:"response_format,block"`
+	// Context enables compaction of the conversation history as it approaches the context window of the model
+	Context *ContextBlock `hcl:"context,block"`
+	// ParallelToolCalls opts into running up to this many tool calls from a single model turn concurrently
+	ParallelToolCalls int `hcl:"parallel_tool_calls,optional"`
+	// Backend selects the server hosting the models, defaulting to Ollama
+	Backend *BackendBlock `hcl:"backend,block"`
+	// Agents are named profiles drawing on the tools and documents defined above
+	Agents []*AgentBlock `hcl:"agent,block"`
+	// Elicitation controls how MCP servers asking for input during a tool call are answered
+	Elicitation *ElicitationBlock `hcl:"elicitation,block"`
+
+	// shared is the file as parsed when an agent has been selected from it
+	shared *File
+	// selected is the agent this configuration was narrowed to, if any
+	selected *AgentBlock
 }
 
 func (f *File) resolveWorkingDirectory(marvinFilePath string) (string, error) {
@@ -29,25 +54,92 @@ func (f *File) resolveWorkingDirectory(marvinFilePath string) (string, error) {
 	for _, block := range f.DockerMCPBlock {
 		block.EnsureWorkingDirectory(workingDirectory)
 	}
+	for _, block := range f.Documents {
+		block.options = f.OllamaOptions
+		block.backend = f.Backend
+	}
 	return workingDirectory, nil
 }
 
 // LanguageModel returns the language model to use for this configuration or the default if one is not set
 func (f *File) LanguageModel() string {
-	model := f.Model
-	if model != "" {
-		return model
+	if f == nil || f.Model == "" {
+		return DefaultLanguageModel
 	}
-	return DefaultLanguageModel
+	return f.Model
 }
 
-func (f *File) QueryRAGDocuments(ctx context.Context, storeName, query string) ([]QueryResult, error) {
+// OpenBackend connects to the configured backend, or Ollama as configured by the environment
+func (f *File) OpenBackend() (backend.Backend, error) {
+	if f == nil {
+		return backend.NewOllama("", nil)
+	}
+	return f.Backend.Open()
+}
+
+// ResolveLimits returns the configured conversation limits with any limits set in overrides taking precedence
+func (f *File) ResolveLimits(overrides LimitsBlock) LimitsBlock {
+	if f == nil {
+		return overrides
+	}
+	return f.Limits.Override(overrides)
+}
+
+// ResolveOllamaOptions returns the configured generation options with any options set in overrides taking precedence
+func (f *File) ResolveOllamaOptions(overrides OllamaOptionsBlock) OllamaOptionsBlock {
+	if f == nil {
+		return overrides
+	}
+	return f.OllamaOptions.Override(overrides)
+}
+
+// WithOllamaOverrides returns a copy of the configuration where each option set in overrides takes precedence, including
+// when embedding documents
+func (f *File) WithOllamaOverrides(overrides OllamaOptionsBlock) *File {
+	if f == nil {
+		return nil
+	}
+	options := f.OllamaOptions.Override(overrides)
+	out := *f
+	out.OllamaOptions = &options
+	out.Documents = make([]*DocumentsBlock, len(f.Documents))
+	for i, documents := range f.Documents {
+		overridden := *documents
+		overridden.options = &options
+		out.Documents[i] = &overridden
+	}
+	return &out
+}
+
+// ResolveResponseFormat returns the configured response format with any values set in overrides taking precedence
+func (f *File) ResolveResponseFormat(overrides ResponseFormatBlock) ResponseFormatBlock {
+	if f == nil {
+		return overrides
+	}
+	return f.ResponseFormat.Override(overrides)
+}
+
+// ResolveParallelToolCalls returns the number of concurrent tool calls, preferring override when set
+func (f *File) ResolveParallelToolCalls(override int) int {
+	if override > 0 || f == nil {
+		return override
+	}
+	return f.ParallelToolCalls
+}
+
+// DocumentsNamed is the documents block with the name, or nil when there is none
+func (f *File) DocumentsNamed(storeName string) *DocumentsBlock {
 	var documentBlock *DocumentsBlock
 	for _, doc := range f.Documents {
 		if doc.Name == storeName {
 			documentBlock = doc
 		}
 	}
+	return documentBlock
+}
+
+func (f *File) QueryRAGDocuments(ctx context.Context, storeName, query string) ([]QueryResult, error) {
+	documentBlock := f.DocumentsNamed(storeName)
 	if documentBlock == nil {
 		return nil, fmt.Errorf("no documents block with name %q", storeName)
 	}
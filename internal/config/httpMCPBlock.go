@@ -0,0 +1,76 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"time"
+)
+
+// Transports an http_mcp server may be reached over
+const (
+	HTTPTransportStreamable = "streamable_http"
+	HTTPTransportSSE        = "sse"
+)
+
+// HTTPMCPBlock is an MCP server running as a long-lived HTTP service
+type HTTPMCPBlock struct {
+	Name string `hcl:"name,label"`
+	// URL is the endpoint of the server, such as http://localhost:8080/mcp
+	URL string `hcl:"url"`
+	// Transport is streamable_http, the default, or sse for servers offering the legacy HTTP with SSE transport
+	Transport string `hcl:"transport,optional"`
+	// Headers are sent with every request, such as an Authorization header
+	Headers map[string]string `hcl:"headers,optional"`
+	// Timeout bounds discovering the tools of the server and each tool call, such as "30s"
+	Timeout string `hcl:"timeout,optional"`
+	// Serial declares the server can not service concurrent tool calls
+	Serial bool `hcl:"serial,optional"`
+	// Sampling lets the server request completions from the model
+	Sampling *SamplingBlock `hcl:"sampling,block"`
+}
+
+// Validate reports malformed URLs, unknown transports and malformed timeouts
+func (h *HTTPMCPBlock) Validate() error {
+	endpoint, err := url.Parse(h.URL)
+	if err != nil {
+		return fmt.Errorf("url: %w", err)
+	}
+	if endpoint.Scheme != "http" && endpoint.Scheme != "https" {
+		return fmt.Errorf("url %q must be http or https", h.URL)
+	}
+	switch h.ResolveTransport() {
+	case HTTPTransportStreamable, HTTPTransportSSE:
+	default:
+		return fmt.Errorf("unknown transport %q, expected %s or %s", h.Transport, HTTPTransportStreamable, HTTPTransportSSE)
+	}
+	if _, err := h.ResolveTimeout(); err != nil {
+		return err
+	}
+	if err := h.Sampling.Validate(); err != nil {
+		return fmt.Errorf("sampling: %w", err)
+	}
+	return nil
+}
+
+// ResolveTransport returns the configured transport or streamable HTTP when unset
+func (h *HTTPMCPBlock) ResolveTransport() string {
+	if h.Transport == "" {
+		return HTTPTransportStreamable
+	}
+	return h.Transport
+}
+
+// ResolveTimeout parses the timeout, zero when unset
+func (h *HTTPMCPBlock) ResolveTimeout() (time.Duration, error) {
+	if h.Timeout == "" {
+		return 0, nil
+	}
+	timeout, err := time.ParseDuration(h.Timeout)
+	if err != nil {
+		return 0, fmt.Errorf("timeout: %w", err)
+	}
+	if timeout <= 0 {
+		return 0, fmt.Errorf("timeout %q must be positive", h.Timeout)
+	}
+	return timeout, nil
+}
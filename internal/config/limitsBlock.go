@@ -0,0 +1,93 @@
+package config
+
+import "github.com/spf13/cobra"
+
+// Limits applied when none are configured, so a model stuck calling tools is stopped
+const (
+	// DefaultMaxAgentDepth is how deeply agents may delegate to one another
+	DefaultMaxAgentDepth = 2
+	// DefaultMaxTurns is the number of requests made to the model while it is still calling tools
+	DefaultMaxTurns = 20
+	// DefaultMaxIdenticalCalls is the number of times a tool may be invoked with exactly the same arguments
+	DefaultMaxIdenticalCalls = 3
+)
+
+// LimitsBlock bounds how long a conversation may keep calling tools before it is asked for a final answer.  A limit of
+// zero is unlimited.
+type LimitsBlock struct {
+	// MaxTurns is the number of requests made to the model while it is still calling tools, DefaultMaxTurns when unset
+	MaxTurns *int `hcl:"max_turns,optional"`
+	// MaxToolCalls is the total number of tool invocations
+	MaxToolCalls int `hcl:"max_tool_calls,optional"`
+	// MaxCallsPerTool is the number of invocations of any single tool
+	MaxCallsPerTool int `hcl:"max_calls_per_tool,optional"`
+	// MaxTokens is the total prompt and response tokens consumed
+	MaxTokens int `hcl:"max_tokens,optional"`
+	// MaxIdenticalCalls is the number of times a tool may be invoked with exactly the same arguments,
+	// DefaultMaxIdenticalCalls when unset
+	MaxIdenticalCalls *int `hcl:"max_identical_calls,optional"`
+	// MaxAgentDepth is how many agents deep a delegated task may be handed on, DefaultMaxAgentDepth when unset
+	MaxAgentDepth int `hcl:"max_agent_depth,optional"`
+}
+
+// Override returns a copy of the limits with each limit set within overrides replacing the configured value.
+func (l *LimitsBlock) Override(overrides LimitsBlock) LimitsBlock {
+	out := LimitsBlock{}
+	if l != nil {
+		out = *l
+	}
+	if overrides.MaxTurns != nil {
+		out.MaxTurns = overrides.MaxTurns
+	}
+	if overrides.MaxToolCalls > 0 {
+		out.MaxToolCalls = overrides.MaxToolCalls
+	}
+	if overrides.MaxCallsPerTool > 0 {
+		out.MaxCallsPerTool = overrides.MaxCallsPerTool
+	}
+	if overrides.MaxTokens > 0 {
+		out.MaxTokens = overrides.MaxTokens
+	}
+	if overrides.MaxIdenticalCalls != nil {
+		out.MaxIdenticalCalls = overrides.MaxIdenticalCalls
+	}
+	if overrides.MaxAgentDepth > 0 {
+		out.MaxAgentDepth = overrides.MaxAgentDepth
+	}
+	return out
+}
+
+// ResolveMaxTurns is the configured number of turns, zero when unlimited, or the default when unset
+func (l LimitsBlock) ResolveMaxTurns() int {
+	if l.MaxTurns != nil {
+		return *l.MaxTurns
+	}
+	return DefaultMaxTurns
+}
+
+// ResolveMaxIdenticalCalls is the configured number of identical calls, zero when unlimited, or the default when unset
+func (l LimitsBlock) ResolveMaxIdenticalCalls() int {
+	if l.MaxIdenticalCalls != nil {
+		return *l.MaxIdenticalCalls
+	}
+	return DefaultMaxIdenticalCalls
+}
+
+// ResolveMaxAgentDepth is the configured depth of delegation between agents or the default when unset
+func (l LimitsBlock) ResolveMaxAgentDepth() int {
+	if l.MaxAgentDepth > 0 {
+		return l.MaxAgentDepth
+	}
+	return DefaultMaxAgentDepth
+}
+
+// PersistentFlags registers command line overrides for each limit
+func (l *LimitsBlock) PersistentFlags(forCommand *cobra.Command) {
+	pflags := forCommand.PersistentFlags()
+	pflags.Var(optionalInt{&l.MaxTurns}, "max-turns", "maximum requests to the model while it is calling tools, 0 for unlimited (default 20)")
+	pflags.IntVar(&l.MaxToolCalls, "max-tool-calls", 0, "maximum total tool invocations")
+	pflags.IntVar(&l.MaxCallsPerTool, "max-calls-per-tool", 0, "maximum invocations of any single tool")
+	pflags.IntVar(&l.MaxTokens, "max-tokens", 0, "maximum prompt and response tokens consumed")
+	pflags.Var(optionalInt{&l.MaxIdenticalCalls}, "max-identical-calls", "maximum invocations of a tool with the same arguments, 0 for unlimited (default 3)")
+	pflags.IntVar(&l.MaxAgentDepth, "max-agent-depth", 0, "maximum depth of agents delegating tasks to other agents")
+}
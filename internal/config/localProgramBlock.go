@@ -4,4 +4,8 @@ type LocalProgramBlock struct {
 	Name    string   `hcl:"name,label"`
 	Program string   `hcl:"program"`
 	Args    []string `hcl:"args,optional"`
+	// Serial declares the program can not service concurrent tool calls
+	Serial bool `hcl:"serial,optional"`
+	// Sampling lets the program request completions from the model
+	Sampling *SamplingBlock `hcl:"sampling,block"`
 }
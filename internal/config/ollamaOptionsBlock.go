@@ -0,0 +1,221 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/ollama/ollama/api"
+	"github.com/spf13/cobra"
+)
+
+// OllamaOptionsBlock configures generation options passed on each chat and embedding request.  Unset options fall
+// back to the defaults of the model.
+type OllamaOptionsBlock struct {
+	Temperature *float64 `hcl:"temperature,optional"`
+	TopP        *float64 `hcl:"top_p,optional"`
+	Seed        *int     `hcl:"seed,optional"`
+	// NumCtx is the size of the context window
+	NumCtx *int `hcl:"num_ctx,optional"`
+	// NumPredict is the maximum number of tokens to generate
+	NumPredict *int     `hcl:"num_predict,optional"`
+	Stop       []string `hcl:"stop,optional"`
+	// KeepAlive is how long the model stays loaded after a request, such as "10m"
+	KeepAlive string `hcl:"keep_alive,optional"`
+	// Think is true, false, or one of the levels high, medium, or low for models supporting them
+	Think string `hcl:"think,optional"`
+}
+
+// Validate ensures the textual options may be interpreted
+func (o *OllamaOptionsBlock) Validate() error {
+	if _, err := o.keepAlive(); err != nil {
+		return err
+	}
+	_, err := o.think()
+	return err
+}
+
+// Override returns a copy of the options with each option set within overrides replacing the configured value.
+func (o *OllamaOptionsBlock) Override(overrides OllamaOptionsBlock) OllamaOptionsBlock {
+	out := OllamaOptionsBlock{}
+	if o != nil {
+		out = *o
+	}
+	if overrides.Temperature != nil {
+		out.Temperature = overrides.Temperature
+	}
+	if overrides.TopP != nil {
+		out.TopP = overrides.TopP
+	}
+	if overrides.Seed != nil {
+		out.Seed = overrides.Seed
+	}
+	if overrides.NumCtx != nil {
+		out.NumCtx = overrides.NumCtx
+	}
+	if overrides.NumPredict != nil {
+		out.NumPredict = overrides.NumPredict
+	}
+	if len(overrides.Stop) > 0 {
+		out.Stop = overrides.Stop
+	}
+	if overrides.KeepAlive != "" {
+		out.KeepAlive = overrides.KeepAlive
+	}
+	if overrides.Think != "" {
+		out.Think = overrides.Think
+	}
+	return out
+}
+
+// Options builds the model options map understood by Ollama
+func (o *OllamaOptionsBlock) Options() map[string]any {
+	if o == nil {
+		return nil
+	}
+	options := map[string]any{}
+	if o.Temperature != nil {
+		options["temperature"] = *o.Temperature
+	}
+	if o.TopP != nil {
+		options["top_p"] = *o.TopP
+	}
+	if o.Seed != nil {
+		options["seed"] = *o.Seed
+	}
+	if o.NumCtx != nil {
+		options["num_ctx"] = *o.NumCtx
+	}
+	if o.NumPredict != nil {
+		options["num_predict"] = *o.NumPredict
+	}
+	if len(o.Stop) > 0 {
+		options["stop"] = o.Stop
+	}
+	if len(options) == 0 {
+		return nil
+	}
+	return options
+}
+
+// ApplyToChat sets the options on the chat request
+func (o *OllamaOptionsBlock) ApplyToChat(req *api.ChatRequest) error {
+	if o == nil {
+		return nil
+	}
+	keepAlive, err := o.keepAlive()
+	if err != nil {
+		return err
+	}
+	think, err := o.think()
+	if err != nil {
+		return err
+	}
+	req.Options = o.Options()
+	req.KeepAlive = keepAlive
+	req.Think = think
+	return nil
+}
+
+// ApplyToEmbedding sets the options relevant to embedding on the request.  Only keep_alive applies; the generation
+// options and num_ctx describe the chat model rather than the embedding model.
+func (o *OllamaOptionsBlock) ApplyToEmbedding(req *api.EmbeddingRequest) error {
+	if o == nil {
+		return nil
+	}
+	keepAlive, err := o.keepAlive()
+	if err != nil {
+		return err
+	}
+	req.KeepAlive = keepAlive
+	return nil
+}
+
+func (o *OllamaOptionsBlock) keepAlive() (*api.Duration, error) {
+	if o.KeepAlive == "" {
+		return nil, nil
+	}
+	duration, err := time.ParseDuration(o.KeepAlive)
+	if err != nil {
+		return nil, fmt.Errorf("keep_alive %q: %w", o.KeepAlive, err)
+	}
+	return &api.Duration{Duration: duration}, nil
+}
+
+func (o *OllamaOptionsBlock) think() (*api.ThinkValue, error) {
+	switch o.Think {
+	case "":
+		return nil, nil
+	case "true", "false":
+		return &api.ThinkValue{Value: o.Think == "true"}, nil
+	case "high", "medium", "low":
+		return &api.ThinkValue{Value: o.Think}, nil
+	default:
+		return nil, fmt.Errorf("think %q must be true, false, high, medium, or low", o.Think)
+	}
+}
+
+// PersistentFlags registers command line overrides for each option
+func (o *OllamaOptionsBlock) PersistentFlags(forCommand *cobra.Command) {
+	pflags := forCommand.PersistentFlags()
+	pflags.Var(optionalFloat{&o.Temperature}, "temperature", "sampling temperature of the model")
+	pflags.Var(optionalFloat{&o.TopP}, "top-p", "nucleus sampling probability mass")
+	pflags.Var(optionalInt{&o.Seed}, "seed", "random seed for reproducible generation")
+	pflags.Var(optionalInt{&o.NumCtx}, "num-ctx", "size of the context window")
+	pflags.Var(optionalInt{&o.NumPredict}, "num-predict", "maximum number of tokens to generate")
+	pflags.StringSliceVar(&o.Stop, "stop", nil, "stop sequences ending generation")
+	pflags.StringVar(&o.KeepAlive, "keep-alive", "", "duration the model stays loaded after a request")
+	pflags.StringVar(&o.Think, "think", "", "thinking: true, false, high, medium, or low")
+}
+
+// EmbeddingFlags registers command line overrides for the options relevant to embedding
+func (o *OllamaOptionsBlock) EmbeddingFlags(forCommand *cobra.Command) {
+	pflags := forCommand.PersistentFlags()
+	pflags.StringVar(&o.KeepAlive, "keep-alive", "", "duration the embedding model stays loaded after a request")
+}
+
+// optionalFloat is a flag value only set when given on the command line
+type optionalFloat struct {
+	target **float64
+}
+
+func (o optionalFloat) String() string {
+	if *o.target == nil {
+		return ""
+	}
+	return strconv.FormatFloat(**o.target, 'g', -1, 64)
+}
+
+func (o optionalFloat) Set(value string) error {
+	parsed, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return err
+	}
+	*o.target = &parsed
+	return nil
+}
+
+func (o optionalFloat) Type() string { return "float" }
+
+// optionalInt is a flag value only set when given on the command line
+type optionalInt struct {
+	target **int
+}
+
+func (o optionalInt) String() string {
+	if *o.target == nil {
+		return ""
+	}
+	return strconv.Itoa(**o.target)
+}
+
+func (o optionalInt) Set(value string) error {
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		return err
+	}
+	*o.target = &parsed
+	return nil
+}
+
+func (o optionalInt) Type() string { return "int" }
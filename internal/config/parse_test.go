@@ -1,10 +1,19 @@
 package config
 
 import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/hashicorp/hcl/v2"
 	"github.com/hashicorp/hcl/v2/hclparse"
+	"github.com/meschbach/marvin/internal/backend"
+	"github.com/ollama/ollama/api"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -90,3 +99,450 @@ local_program "three" {
 		}
 	}
 }
+
+func TestLoadConfig_LimitsWithOverrides(t *testing.T) {
+	hcl := `
+limits {
+  max_turns = 4
+  max_identical_calls = 2
+}
+`
+	cfg, err := interpretConfigFile(parseHCLString(t, hcl, t.Name()+".hcl"), "/test/"+t.Name())
+	require.NoError(t, err)
+	require.NotNil(t, cfg.Limits)
+
+	unlimited := 0
+	limits := cfg.ResolveLimits(LimitsBlock{MaxTurns: &unlimited, MaxToolCalls: 3})
+	assert.Equal(t, 0, limits.ResolveMaxTurns(), "zero on the command line lifts the configured limit")
+	assert.Equal(t, 3, limits.MaxToolCalls)
+	assert.Equal(t, 2, limits.ResolveMaxIdenticalCalls())
+	assert.Equal(t, 0, limits.MaxTokens)
+}
+
+func TestLimitsBlock_DefaultsStopRunawayConversations(t *testing.T) {
+	var cfg *File
+	limits := cfg.ResolveLimits(LimitsBlock{})
+	assert.Equal(t, DefaultMaxTurns, limits.ResolveMaxTurns())
+	assert.Equal(t, DefaultMaxIdenticalCalls, limits.ResolveMaxIdenticalCalls())
+
+	cfg, err := interpretConfigFile(parseHCLString(t, "limits {\n  max_turns = 0\n}\n", t.Name()+".hcl"), "/test/"+t.Name())
+	require.NoError(t, err)
+	limits = cfg.ResolveLimits(LimitsBlock{})
+	assert.Equal(t, 0, limits.ResolveMaxTurns(), "configured as unlimited")
+	assert.Equal(t, DefaultMaxIdenticalCalls, limits.ResolveMaxIdenticalCalls())
+}
+
+func TestLoadConfig_OllamaOptions(t *testing.T) {
+	hcl := `
+ollama_options {
+  temperature = 0
+  seed        = 42
+  stop        = ["</answer>"]
+  keep_alive  = "10m"
+  think       = "low"
+}
+`
+	cfg, err := interpretConfigFile(parseHCLString(t, hcl, t.Name()+".hcl"), "/test/"+t.Name())
+	require.NoError(t, err)
+	require.NotNil(t, cfg.OllamaOptions)
+
+	seed := 7
+	options := cfg.ResolveOllamaOptions(OllamaOptionsBlock{Seed: &seed})
+	assert.Equal(t, map[string]any{"temperature": float64(0), "seed": 7, "stop": []string{"</answer>"}}, options.Options())
+
+	req := &api.ChatRequest{}
+	require.NoError(t, options.ApplyToChat(req))
+	assert.Equal(t, "low", req.Think.Value)
+	assert.Equal(t, 10*time.Minute, req.KeepAlive.Duration)
+}
+
+func TestLoadConfig_OllamaOptionsInvalidThink(t *testing.T) {
+	hcl := `
+ollama_options {
+  think = "sometimes"
+}
+`
+	_, err := interpretConfigFile(parseHCLString(t, hcl, t.Name()+".hcl"), "/test/"+t.Name())
+	assert.Error(t, err)
+}
+
+func TestLoadConfig_OpenAIBackend(t *testing.T) {
+	hcl := `
+backend "openai" {
+  url = "http://localhost:8080/v1"
+  api_key_env = "MARVIN_TEST_KEY"
+  timeout = "30s"
+}
+`
+	cfg, err := interpretConfigFile(parseHCLString(t, hcl, t.Name()+".hcl"), "/test/"+t.Name())
+	require.NoError(t, err)
+	require.NotNil(t, cfg.Backend)
+	assert.Equal(t, BackendOpenAI, cfg.Backend.Provider)
+	assert.Equal(t, "http://localhost:8080/v1", cfg.Backend.URL)
+
+	opened, err := cfg.OpenBackend()
+	require.NoError(t, err)
+	assert.IsType(t, &backend.OpenAI{}, opened)
+}
+
+func TestLoadConfig_OllamaBackendHonorsTimeout(t *testing.T) {
+	stalled := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-stalled
+	}))
+	t.Cleanup(server.Close)
+	t.Cleanup(func() { close(stalled) })
+	hcl := fmt.Sprintf(`
+backend "ollama" {
+  url     = %q
+  timeout = "50ms"
+}
+`, server.URL)
+	cfg, err := interpretConfigFile(parseHCLString(t, hcl, t.Name()+".hcl"), "/test/"+t.Name())
+	require.NoError(t, err)
+
+	opened, err := cfg.OpenBackend()
+	require.NoError(t, err)
+	_, err = opened.Embed(context.Background(), &api.EmbeddingRequest{Model: "nomic-embed-text", Prompt: "hello"})
+	assert.ErrorContains(t, err, "Client.Timeout")
+}
+
+func TestLoadConfig_BackendRequiresKnownProvider(t *testing.T) {
+	hcl := `
+backend "bedrock" {}
+`
+	_, err := interpretConfigFile(parseHCLString(t, hcl, t.Name()+".hcl"), "/test/"+t.Name())
+	assert.ErrorContains(t, err, "unknown provider")
+}
+
+func writeEvalFile(t *testing.T, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "suite.hcl")
+	require.NoError(t, os.WriteFile(path, []byte(contents), 0o644))
+	return path
+}
+
+func TestLoadEvalFile(t *testing.T) {
+	path := writeEvalFile(t, `
+eval "utc-time" {
+  prompt = "What time is it in UTC?"
+  config = "time.hcl"
+  runs = 3
+  pass_rate = 0.6
+  max_turns = 4
+
+  tool "time.get_current_time" {
+    arguments = { timezone = "UTC" }
+    argument_patterns = { timezone = "^U" }
+  }
+  tool "time.convert_time" {
+    called = false
+  }
+  answer {
+    matches = "\\d+:\\d+"
+    schema_file = "answer.schema.json"
+  }
+}
+
+eval "greeting" {
+  prompt = "Hello"
+}
+`)
+	suite, err := LoadEvalFile(path)
+	require.NoError(t, err)
+	require.Len(t, suite.Evals, 2)
+
+	utc := suite.Evals[0]
+	assert.Equal(t, filepath.Join(filepath.Dir(path), "time.hcl"), utc.Config)
+	assert.Equal(t, 3, utc.ResolveRuns(0))
+	assert.Equal(t, 5, utc.ResolveRuns(5))
+	assert.Equal(t, 0.6, utc.ResolvePassRate())
+	require.Len(t, utc.Tools, 2)
+	assert.True(t, utc.Tools[0].ExpectCalled())
+	assert.Equal(t, map[string]string{"timezone": "UTC"}, utc.Tools[0].Arguments)
+	assert.False(t, utc.Tools[1].ExpectCalled())
+	assert.Equal(t, filepath.Join(filepath.Dir(path), "answer.schema.json"), utc.Answer.ResponseFormat().SchemaFile)
+
+	greeting := suite.Evals[1]
+	assert.Equal(t, 1, greeting.ResolveRuns(0))
+	assert.Equal(t, 1.0, greeting.ResolvePassRate())
+	format := greeting.Answer.ResponseFormat()
+	assert.False(t, format.Enabled())
+}
+
+func TestLoadEvalFile_Rejects(t *testing.T) {
+	for name, contents := range map[string]string{
+		"no cases":      ``,
+		"duplicate":     `eval "a" { prompt = "x" }` + "\n" + `eval "a" { prompt = "y" }`,
+		"empty prompt":  `eval "a" { prompt = "" }`,
+		"pass rate":     `eval "a" { prompt = "x" ` + "\n" + `pass_rate = 1.5 }`,
+		"bad pattern":   `eval "a" { prompt = "x" ` + "\n" + `answer { matches = "(" } }`,
+		"two schemas":   `eval "a" { prompt = "x" ` + "\n" + `answer { ` + "\n" + `schema = "{}"` + "\n" + `schema_file = "s.json" } }`,
+		"bad arguments": `eval "a" { prompt = "x" ` + "\n" + `tool "t" { argument_patterns = { q = "[" } } }`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := LoadEvalFile(writeEvalFile(t, contents))
+			var loadErr *LoadError
+			assert.ErrorAs(t, err, &loadErr)
+		})
+	}
+}
+
+func TestLoadAnswersFile(t *testing.T) {
+	answers, err := LoadAnswersFile(writeEvalFile(t, `
+answer {
+  pattern = "(?i)which day"
+  answer  = "Tuesday"
+}
+answer {
+  pattern = "."
+  answer  = "Use your best judgement"
+}
+`))
+	require.NoError(t, err)
+	require.Len(t, answers.Answers, 2)
+	assert.Equal(t, "(?i)which day", answers.Answers[0].Pattern)
+	assert.Equal(t, "Tuesday", answers.Answers[0].Answer)
+
+	for name, contents := range map[string]string{
+		"no answers":  ``,
+		"bad pattern": `answer { ` + "\n" + `pattern = "("` + "\n" + `answer = "x" }`,
+		"no answer":   `answer { pattern = "x" }`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := LoadAnswersFile(writeEvalFile(t, contents))
+			var loadErr *LoadError
+			assert.ErrorAs(t, err, &loadErr)
+		})
+	}
+}
+
+func TestLoadConfig_Agents(t *testing.T) {
+	hcl := `
+model = "ministral-3:3b"
+system_prompt {
+  from_string = "You are helpful."
+}
+local_program "echo" {
+  program = "/bin/echo"
+}
+docker_mcp "imap" "mcp/imap" {}
+docker_mcp "gitea" "mcp/gitea" {}
+documents "handbook" "docs" {}
+agent "triage" {
+  model = "qwen3:8b"
+  system_prompt {
+    from_string = "You triage issues."
+  }
+  tools = ["gitea", "echo"]
+  documents = []
+}
+agent "everything" {}
+`
+	cfg, err := interpretConfigFile(parseHCLString(t, hcl, t.Name()+".hcl"), "/test/"+t.Name())
+	require.NoError(t, err)
+
+	triage, err := cfg.ForAgent("triage")
+	require.NoError(t, err)
+	assert.Equal(t, "qwen3:8b", triage.LanguageModel())
+	assert.Equal(t, "You triage issues.", triage.SystemPrompt.FromString)
+	require.Len(t, triage.DockerMCPBlock, 1)
+	assert.Equal(t, "gitea", triage.DockerMCPBlock[0].Name)
+	require.Len(t, triage.LocalPrograms, 1)
+	assert.Empty(t, triage.Documents)
+	assert.Len(t, cfg.DockerMCPBlock, 2, "the shared definitions are unchanged")
+
+	everything, err := cfg.ForAgent("everything")
+	require.NoError(t, err)
+	assert.Equal(t, "ministral-3:3b", everything.LanguageModel())
+	assert.Len(t, everything.DockerMCPBlock, 2)
+	assert.Len(t, everything.Documents, 1)
+
+	_, err = cfg.ForAgent("absent")
+	assert.EqualError(t, err, `no agent "absent", expected one of: everything, triage`)
+}
+
+func TestLoadConfig_AgentsRejectUnknownReferences(t *testing.T) {
+	for name, hcl := range map[string]string{
+		"tool":      `agent "a" { tools = ["missing"] }`,
+		"documents": `agent "a" { documents = ["missing"] }`,
+		"duplicate": `agent "a" {}` + "\n" + `agent "a" {}`,
+		"delegate":  `agent "a" { delegates = ["missing"] }`,
+		"self":      `agent "a" { delegates = ["a"] }`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := interpretConfigFile(parseHCLString(t, hcl, "agents.hcl"), "/test/agents")
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestLoadConfig_AgentDelegates(t *testing.T) {
+	hcl := `
+limits {
+  max_turns = 10
+}
+agent "coordinator" {
+  delegates = ["summarizer"]
+}
+agent "summarizer" {
+  description = "Summarizes email"
+  limits {
+    max_turns = 3
+    max_agent_depth = 1
+  }
+}
+agent "reviewer" {}
+`
+	cfg, err := interpretConfigFile(parseHCLString(t, hcl, t.Name()+".hcl"), "/test/"+t.Name())
+	require.NoError(t, err)
+	assert.Empty(t, cfg.Delegates(), "delegation is offered only by agents naming delegates")
+
+	coordinator, err := cfg.ForAgent("coordinator")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"summarizer"}, delegateNames(coordinator.Delegates()))
+	assert.Equal(t, DefaultMaxAgentDepth, coordinator.ResolveLimits(LimitsBlock{}).ResolveMaxAgentDepth())
+
+	summarizer, err := coordinator.ForAgent("summarizer")
+	require.NoError(t, err)
+	assert.Empty(t, summarizer.Delegates(), "unset delegates are none")
+	limits := summarizer.ResolveLimits(LimitsBlock{})
+	assert.Equal(t, 3, limits.ResolveMaxTurns())
+	assert.Equal(t, 1, limits.ResolveMaxAgentDepth())
+}
+
+func delegateNames(agents []*AgentBlock) []string {
+	var names []string
+	for _, agent := range agents {
+		names = append(names, agent.Name)
+	}
+	return names
+}
+
+func TestLoadConfig_HTTPMCP(t *testing.T) {
+	hcl := `
+http_mcp "search" {
+  url     = "https://mcp.example.com/mcp"
+  headers = { Authorization = "Bearer secret" }
+  timeout = "30s"
+}
+http_mcp "legacy" {
+  url       = "http://localhost:8080/sse"
+  transport = "sse"
+}
+agent "searcher" {
+  tools = ["search"]
+}
+`
+	cfg, err := interpretConfigFile(parseHCLString(t, hcl, t.Name()+".hcl"), "/test/"+t.Name())
+	require.NoError(t, err)
+	require.Len(t, cfg.HTTPMCP, 2)
+	search := cfg.HTTPMCP[0]
+	assert.Equal(t, HTTPTransportStreamable, search.ResolveTransport())
+	assert.Equal(t, map[string]string{"Authorization": "Bearer secret"}, search.Headers)
+	timeout, err := search.ResolveTimeout()
+	require.NoError(t, err)
+	assert.Equal(t, 30*time.Second, timeout)
+	assert.Equal(t, HTTPTransportSSE, cfg.HTTPMCP[1].ResolveTransport())
+
+	searcher, err := cfg.ForAgent("searcher")
+	require.NoError(t, err)
+	require.Len(t, searcher.HTTPMCP, 1)
+	assert.Equal(t, "search", searcher.HTTPMCP[0].Name)
+}
+
+func TestLoadConfig_HTTPMCPRejectsInvalid(t *testing.T) {
+	for name, hcl := range map[string]string{
+		"url":       `http_mcp "a" { url = "ftp://example.com" }`,
+		"transport": "http_mcp \"a\" {\n  url = \"http://example.com\"\n  transport = \"websocket\"\n}",
+		"timeout":   "http_mcp \"a\" {\n  url = \"http://example.com\"\n  timeout = \"soon\"\n}",
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := interpretConfigFile(parseHCLString(t, hcl, "http.hcl"), "/test/http")
+			assert.ErrorContains(t, err, name)
+		})
+	}
+}
+
+func TestLoadConfig_Sampling(t *testing.T) {
+	hcl := `
+local_program "summarizer" {
+  program = "summarizer"
+  sampling {
+    model      = "llama3.2"
+    models     = { claude = "qwen3:32b", "claude-3-haiku" = "qwen3:4b" }
+    max_tokens = 512
+    approve    = true
+  }
+}
+http_mcp "search" {
+  url = "http://localhost:8080/mcp"
+  sampling {
+    allow = false
+  }
+}
+`
+	cfg, err := interpretConfigFile(parseHCLString(t, hcl, t.Name()+".hcl"), "/test/"+t.Name())
+	require.NoError(t, err)
+	sampling := cfg.LocalPrograms[0].Sampling
+	require.NotNil(t, sampling)
+	assert.True(t, sampling.Allowed())
+	assert.True(t, sampling.Approve)
+	assert.Equal(t, "qwen3:4b", sampling.ResolveModel([]string{"gpt-4o", "claude-3-haiku-20240307"}, "fallback"), "the longest matching key wins")
+	assert.Equal(t, "qwen3:32b", sampling.ResolveModel([]string{"claude-3-5-sonnet"}, "fallback"))
+	assert.Equal(t, "llama3.2", sampling.ResolveModel([]string{"gpt-4o"}, "fallback"))
+	assert.Equal(t, 512, sampling.ResolveMaxTokens(0))
+	assert.Equal(t, 512, sampling.ResolveMaxTokens(4096))
+	assert.Equal(t, 100, sampling.ResolveMaxTokens(100))
+
+	assert.False(t, cfg.HTTPMCP[0].Sampling.Allowed())
+	assert.False(t, (*SamplingBlock)(nil).Allowed(), "servers without a block may not sample")
+	assert.Equal(t, "fallback", (&SamplingBlock{}).ResolveModel(nil, "fallback"))
+}
+
+func TestLoadConfig_SamplingRejectsInvalid(t *testing.T) {
+	for name, hcl := range map[string]string{
+		"max_tokens": "local_program \"a\" {\n  program = \"a\"\n  sampling {\n    max_tokens = -1\n  }\n}",
+		"models":     "docker_mcp \"a\" \"a\" {\n  sampling {\n    models = { claude = \"\" }\n  }\n}",
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := interpretConfigFile(parseHCLString(t, hcl, "sampling.hcl"), "/test/sampling")
+			assert.ErrorContains(t, err, name)
+		})
+	}
+}
+
+func TestLoadConfig_Elicitation(t *testing.T) {
+	cfg, err := interpretConfigFile(parseHCLString(t, "elicitation {\n  non_interactive = \"defaults\"\n}", t.Name()+".hcl"), "/test/"+t.Name())
+	require.NoError(t, err)
+	assert.Equal(t, ElicitationDefaults, cfg.Elicitation.ResolveNonInteractive())
+	assert.Equal(t, ElicitationDecline, (&File{}).Elicitation.ResolveNonInteractive())
+
+	_, err = interpretConfigFile(parseHCLString(t, "elicitation {\n  non_interactive = \"accept\"\n}", "elicitation.hcl"), "/test/elicitation")
+	assert.ErrorContains(t, err, "non_interactive")
+}
+
+func TestOllamaOptions_EmbeddingOnlyCarriesKeepAlive(t *testing.T) {
+	hcl := `
+ollama_options {
+  temperature = 0.2
+  num_ctx     = 32768
+  stop        = ["END"]
+  keep_alive  = "5m"
+}
+documents "handbook" "docs" {}
+`
+	cfg, err := interpretConfigFile(parseHCLString(t, hcl, t.Name()+".hcl"), "/test/"+t.Name())
+	require.NoError(t, err)
+
+	req := &api.EmbeddingRequest{}
+	require.NoError(t, cfg.Documents[0].options.ApplyToEmbedding(req))
+	assert.Nil(t, req.Options, "generation options do not apply to embeddings")
+	assert.Equal(t, 5*time.Minute, req.KeepAlive.Duration)
+
+	overridden := cfg.WithOllamaOverrides(OllamaOptionsBlock{KeepAlive: "1h"})
+	req = &api.EmbeddingRequest{}
+	require.NoError(t, overridden.Documents[0].options.ApplyToEmbedding(req))
+	assert.Equal(t, time.Hour, req.KeepAlive.Duration, "command line overrides reach the embedding requests")
+	assert.Equal(t, "5m", cfg.Documents[0].options.KeepAlive, "the original configuration is unchanged")
+}
@@ -0,0 +1,73 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+const defaultSchemaRetries = 2
+
+// ResponseFormatBlock constrains the final answer of the model to JSON matching a schema
+type ResponseFormatBlock struct {
+	// Schema is an inline JSON schema
+	Schema string `hcl:"schema,optional"`
+	// SchemaFile is a path to a JSON schema
+	SchemaFile string `hcl:"schema_file,optional"`
+	// MaxRetries is how many times the model is asked to correct an answer which does not match the schema
+	MaxRetries *int `hcl:"max_retries,optional"`
+}
+
+// Override returns a copy of the response format with values set within overrides replacing the configured values.
+// An inline schema is replaced by an overriding schema file.
+func (r *ResponseFormatBlock) Override(overrides ResponseFormatBlock) ResponseFormatBlock {
+	out := ResponseFormatBlock{}
+	if r != nil {
+		out = *r
+	}
+	if overrides.Schema != "" || overrides.SchemaFile != "" {
+		out.Schema = overrides.Schema
+		out.SchemaFile = overrides.SchemaFile
+	}
+	if overrides.MaxRetries != nil {
+		out.MaxRetries = overrides.MaxRetries
+	}
+	return out
+}
+
+// Enabled is true when a schema has been provided
+func (r *ResponseFormatBlock) Enabled() bool {
+	return r != nil && (r.Schema != "" || r.SchemaFile != "")
+}
+
+// LoadSchema returns the content of the schema
+func (r *ResponseFormatBlock) LoadSchema() ([]byte, error) {
+	if r.Schema != "" && r.SchemaFile != "" {
+		return nil, errors.New("only schema or schema_file can be set, not both")
+	}
+	if r.Schema != "" {
+		return []byte(r.Schema), nil
+	}
+	content, err := os.ReadFile(r.SchemaFile)
+	if err != nil {
+		return nil, fmt.Errorf("reading schema file %q: %w", r.SchemaFile, err)
+	}
+	return content, nil
+}
+
+// ResolveMaxRetries returns the number of corrections to request, defaulting to a small number
+func (r *ResponseFormatBlock) ResolveMaxRetries() int {
+	if r.MaxRetries == nil || *r.MaxRetries < 0 {
+		return defaultSchemaRetries
+	}
+	return *r.MaxRetries
+}
+
+// PersistentFlags registers command line overrides for the response format
+func (r *ResponseFormatBlock) PersistentFlags(forCommand *cobra.Command) {
+	pflags := forCommand.PersistentFlags()
+	pflags.StringVar(&r.SchemaFile, "schema", "", "path to a JSON schema the answer must match; only the validated JSON is written to stdout")
+	pflags.Var(optionalInt{&r.MaxRetries}, "schema-retries", "times the model may correct an answer not matching the schema")
+}
@@ -0,0 +1,82 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// SamplingBlock lets an MCP server request completions from the configured backend.  Servers without a block may not
+// sample.
+type SamplingBlock struct {
+	// Allow permits sampling, defaulting to true.  Setting it to false denies the server while keeping the settings.
+	Allow *bool `hcl:"allow,optional"`
+	// Model answers the requests of the server, defaulting to the model of the file
+	Model string `hcl:"model,optional"`
+	// Models maps the model hints of the server to local models.  A hint containing a key selects its model, the
+	// longest key winning.
+	Models map[string]string `hcl:"models,optional"`
+	// MaxTokens caps the tokens generated for each request.  Zero leaves the cap to the server.
+	MaxTokens int `hcl:"max_tokens,optional"`
+	// Approve asks the person at the terminal before each request is sent to the model
+	Approve bool `hcl:"approve,optional"`
+}
+
+// Validate reports negative caps and empty model mappings
+func (s *SamplingBlock) Validate() error {
+	if s == nil {
+		return nil
+	}
+	if s.MaxTokens < 0 {
+		return fmt.Errorf("max_tokens must not be negative, got %d", s.MaxTokens)
+	}
+	for hint, model := range s.Models {
+		if hint == "" {
+			return errors.New("models: hints must not be empty")
+		}
+		if model == "" {
+			return fmt.Errorf("models: hint %q maps to no model", hint)
+		}
+	}
+	return nil
+}
+
+// Allowed is true when the block permits sampling
+func (s *SamplingBlock) Allowed() bool {
+	return s != nil && (s.Allow == nil || *s.Allow)
+}
+
+// ResolveModel selects the model for a request with the hints, in order of preference.  The first hint containing a
+// mapped key selects the mapped model, otherwise the model of the block or fallback is used.
+func (s *SamplingBlock) ResolveModel(hints []string, fallback string) string {
+	keys := make([]string, 0, len(s.Models))
+	for key := range s.Models {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if len(keys[i]) != len(keys[j]) {
+			return len(keys[i]) > len(keys[j])
+		}
+		return keys[i] < keys[j]
+	})
+	for _, hint := range hints {
+		for _, key := range keys {
+			if strings.Contains(hint, key) {
+				return s.Models[key]
+			}
+		}
+	}
+	if s.Model != "" {
+		return s.Model
+	}
+	return fallback
+}
+
+// ResolveMaxTokens caps the tokens requested by the server, returning zero when neither sets a limit
+func (s *SamplingBlock) ResolveMaxTokens(requested int) int {
+	if s.MaxTokens > 0 && (requested <= 0 || requested > s.MaxTokens) {
+		return s.MaxTokens
+	}
+	return requested
+}
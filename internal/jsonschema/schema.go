@@ -0,0 +1,125 @@
+// Package jsonschema validates decoded JSON documents against JSON Schema using
+// github.com/santhosh-tekuri/jsonschema.  Schemas default to draft 2020-12 unless they name another with $schema.
+// References are resolved within the schema itself, such as "#/$defs/name"; references to other documents are
+// rejected when compiled rather than fetched.
+package jsonschema
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	validator "github.com/santhosh-tekuri/jsonschema/v6"
+	"github.com/santhosh-tekuri/jsonschema/v6/kind"
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+)
+
+// location names the schema while compiling.  No loader is registered, so references to any other document fail.
+const location = "file:///marvin/schema.json"
+
+// printer renders the descriptions of violations
+var printer = message.NewPrinter(language.English)
+
+// Schema is a compiled JSON schema
+type Schema struct {
+	raw      json.RawMessage
+	compiled *validator.Schema
+}
+
+// Compile parses the JSON schema, ensuring it is a valid schema whose references resolve within it.
+func Compile(raw []byte) (*Schema, error) {
+	doc, err := validator.UnmarshalJSON(bytes.NewReader(raw))
+	if err != nil {
+		return nil, fmt.Errorf("schema is not JSON: %w", err)
+	}
+	if _, ok := doc.(map[string]any); !ok {
+		return nil, errors.New("schema is not a JSON object")
+	}
+	compiler := validator.NewCompiler()
+	// nothing outside of the schema is loaded
+	compiler.UseLoader(validator.SchemeURLLoader{})
+	if err := compiler.AddResource(location, doc); err != nil {
+		return nil, err
+	}
+	compiled, err := compiler.Compile(location)
+	if err != nil {
+		var invalid *validator.SchemaValidationError
+		var violation *validator.ValidationError
+		if errors.As(err, &invalid) && errors.As(invalid.Err, &violation) {
+			var problems []string
+			describe(violation, &problems)
+			return nil, fmt.Errorf("invalid schema: %s", strings.Join(problems, "; "))
+		}
+		return nil, err
+	}
+	return &Schema{raw: append(json.RawMessage(nil), raw...), compiled: compiled}, nil
+}
+
+// Raw returns the schema as originally provided
+func (s *Schema) Raw() json.RawMessage {
+	return s.raw
+}
+
+// ValidateJSON decodes the document and validates it.  A document which is not JSON is reported as a single problem.
+func (s *Schema) ValidateJSON(document []byte) []string {
+	value, err := validator.UnmarshalJSON(bytes.NewReader(document))
+	if err != nil {
+		return []string{fmt.Sprintf("not valid JSON: %s", err.Error())}
+	}
+	return s.validate(value)
+}
+
+// Validate checks a decoded JSON value, returning a description of each violation prefixed by its JSON pointer.
+func (s *Schema) Validate(value any) []string {
+	// numbers are compared exactly as JSON numbers rather than as the float64 of encoding/json
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return []string{fmt.Sprintf("not representable as JSON: %s", err.Error())}
+	}
+	return s.ValidateJSON(encoded)
+}
+
+func (s *Schema) validate(value any) []string {
+	err := s.compiled.Validate(value)
+	if err == nil {
+		return nil
+	}
+	violation, ok := err.(*validator.ValidationError)
+	if !ok {
+		return []string{err.Error()}
+	}
+	var problems []string
+	describe(violation, &problems)
+	return problems
+}
+
+// describe reports the violations at the leaves of the error.  A failed anyOf or oneOf is reported as a whole rather
+// than by the failures of each alternative.
+func describe(violation *validator.ValidationError, problems *[]string) {
+	switch violation.ErrorKind.(type) {
+	case *kind.AnyOf, *kind.OneOf:
+	default:
+		if len(violation.Causes) > 0 {
+			for _, cause := range violation.Causes {
+				describe(cause, problems)
+			}
+			return
+		}
+	}
+	*problems = append(*problems, pointer(violation.InstanceLocation)+": "+violation.ErrorKind.LocalizedString(printer))
+}
+
+// pointer is the JSON pointer of the location within the document
+func pointer(location []string) string {
+	if len(location) == 0 {
+		return "/"
+	}
+	escaped := make([]string, len(location))
+	for i, token := range location {
+		escaped[i] = strings.ReplaceAll(strings.ReplaceAll(token, "~", "~0"), "/", "~1")
+	}
+	return "/" + strings.Join(escaped, "/")
+}
@@ -0,0 +1,88 @@
+package jsonschema
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const personSchema = `{
+  "type": "object",
+  "required": ["name", "age"],
+  "additionalProperties": false,
+  "properties": {
+    "name": {"type": "string", "minLength": 1},
+    "age": {"type": "integer", "minimum": 0},
+    "email": {"type": "string", "pattern": "^[^@]+@[^@]+$"},
+    "tags": {"type": "array", "items": {"enum": ["admin", "user"]}, "maxItems": 2}
+  }
+}`
+
+func TestSchema_Valid(t *testing.T) {
+	schema, err := Compile([]byte(personSchema))
+	require.NoError(t, err)
+	assert.Empty(t, schema.ValidateJSON([]byte(`{"name":"Marvin","age":42,"tags":["admin"]}`)))
+}
+
+func TestSchema_Violations(t *testing.T) {
+	schema, err := Compile([]byte(personSchema))
+	require.NoError(t, err)
+	problems := schema.ValidateJSON([]byte(`{"age":4.5,"email":"nope","tags":["root","user","admin"],"extra":true}`))
+	assert.ElementsMatch(t, []string{
+		`/: missing property 'name'`,
+		`/age: got number, want integer`,
+		`/email: 'nope' does not match pattern '^[^@]+@[^@]+$'`,
+		`/: additional properties 'extra' not allowed`,
+		`/tags: maxItems: got 3, want 2`,
+		`/tags/0: value must be one of 'admin', 'user'`,
+	}, problems)
+}
+
+func TestSchema_ValidatesDecodedValues(t *testing.T) {
+	schema, err := Compile([]byte(`{"type":"integer","minimum":1}`))
+	require.NoError(t, err)
+	assert.Empty(t, schema.Validate(float64(3)))
+	assert.Equal(t, []string{"/: minimum: got 0, want 1"}, schema.Validate(float64(0)))
+}
+
+func TestSchema_NotJSON(t *testing.T) {
+	schema, err := Compile([]byte(`{"type":"object"}`))
+	require.NoError(t, err)
+	problems := schema.ValidateJSON([]byte("Sure! Here is the JSON"))
+	assert.Len(t, problems, 1)
+}
+
+func TestSchema_Combinators(t *testing.T) {
+	schema, err := Compile([]byte(`{"oneOf":[{"type":"string"},{"type":["integer","null"]}]}`))
+	require.NoError(t, err)
+	assert.Empty(t, schema.ValidateJSON([]byte(`"text"`)))
+	assert.Empty(t, schema.ValidateJSON([]byte(`null`)))
+	assert.Equal(t, []string{"/: 'oneOf' failed, none matched"}, schema.ValidateJSON([]byte(`true`)))
+}
+
+func TestSchema_ResolvesLocalReferences(t *testing.T) {
+	schema, err := Compile([]byte(`{
+  "$defs": {"address": {"type": "object", "required": ["city"], "properties": {"city": {"type": "string"}}}},
+  "properties": {"home": {"$ref": "#/$defs/address"}, "note": {"not": {"type": "null"}}},
+  "patternProperties": {"^x-": {"type": "boolean"}}
+}`))
+	require.NoError(t, err)
+	assert.Empty(t, schema.ValidateJSON([]byte(`{"home":{"city":"Oslo"},"x-draft":true}`)))
+	assert.ElementsMatch(t, []string{
+		`/home: missing property 'city'`,
+		`/note: 'not' failed`,
+		`/x-draft: got string, want boolean`,
+	}, schema.ValidateJSON([]byte(`{"home":{},"note":null,"x-draft":"yes"}`)))
+}
+
+func TestCompile_Rejects(t *testing.T) {
+	_, err := Compile([]byte(`[1,2]`))
+	assert.Error(t, err)
+	_, err = Compile([]byte(`{"properties":{"a":{"pattern":"("}}}`))
+	assert.ErrorContains(t, err, "invalid schema: /properties/a/pattern: '(' is not valid regex")
+	_, err = Compile([]byte(`{"properties":{"a":{"$ref":"#/$defs/missing"}}}`))
+	assert.Error(t, err)
+	_, err = Compile([]byte(`{"properties":{"a":{"$ref":"address.json"}}}`))
+	assert.Error(t, err, "other documents are never loaded")
+}
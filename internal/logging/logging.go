@@ -0,0 +1,129 @@
+// Package logging configures the leveled diagnostics written to stderr, keeping stdout free for the output of commands.
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/spf13/cobra"
+)
+
+// Component is the attribute naming the part of marvin producing a message.  It is rendered as a prefix.
+const Component = "component"
+
+// Options selects how much is logged
+type Options struct {
+	Quiet   bool
+	Verbose bool
+}
+
+// PersistentFlags registers -q/--quiet and -v/--verbose
+func (o *Options) PersistentFlags(forCommand *cobra.Command) {
+	pflags := forCommand.PersistentFlags()
+	pflags.BoolVarP(&o.Quiet, "quiet", "q", false, "only report warnings and errors")
+	pflags.BoolVarP(&o.Verbose, "verbose", "v", false, "report debugging details such as tool discovery and MCP server output")
+	forCommand.MarkFlagsMutuallyExclusive("quiet", "verbose")
+}
+
+// Level is the minimum level logged
+func (o *Options) Level() slog.Level {
+	switch {
+	case o.Quiet:
+		return slog.LevelWarn
+	case o.Verbose:
+		return slog.LevelDebug
+	default:
+		return slog.LevelInfo
+	}
+}
+
+// Install makes a logger writing to out the default
+func (o *Options) Install(out io.Writer) {
+	slog.SetDefault(slog.New(NewHandler(out, o.Level())))
+}
+
+// DebugEnabled is true when debugging details are logged by the default logger
+func DebugEnabled(ctx context.Context) bool {
+	return slog.Default().Enabled(ctx, slog.LevelDebug)
+}
+
+// handler writes a single line per record: `component\t> message key=value`.  Levels other than info are noted.
+type handler struct {
+	lock   *sync.Mutex
+	out    io.Writer
+	level  slog.Leveler
+	attrs  []slog.Attr
+	prefix string
+}
+
+// NewHandler creates a handler writing records at or above level to out
+func NewHandler(out io.Writer, level slog.Leveler) slog.Handler {
+	return &handler{lock: &sync.Mutex{}, out: out, level: level}
+}
+
+func (h *handler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *handler) Handle(_ context.Context, record slog.Record) error {
+	var component string
+	var fields strings.Builder
+	appendAttr := func(a slog.Attr) bool {
+		if a.Key == Component {
+			component = a.Value.String()
+			return true
+		}
+		fields.WriteString(" ")
+		fields.WriteString(h.prefix + a.Key)
+		fields.WriteString("=")
+		fields.WriteString(formatValue(a.Value))
+		return true
+	}
+	for _, a := range h.attrs {
+		appendAttr(a)
+	}
+	record.Attrs(appendAttr)
+
+	var line strings.Builder
+	if component != "" {
+		line.WriteString(component)
+		line.WriteString("\t> ")
+	}
+	if record.Level != slog.LevelInfo {
+		line.WriteString(strings.ToLower(record.Level.String()))
+		line.WriteString(": ")
+	}
+	line.WriteString(record.Message)
+	line.WriteString(fields.String())
+	line.WriteString("\n")
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	_, err := io.WriteString(h.out, line.String())
+	return err
+}
+
+func (h *handler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	out := *h
+	out.attrs = append(append([]slog.Attr(nil), h.attrs...), attrs...)
+	return &out
+}
+
+func (h *handler) WithGroup(name string) slog.Handler {
+	out := *h
+	out.prefix = h.prefix + name + "."
+	return &out
+}
+
+func formatValue(v slog.Value) string {
+	s := fmt.Sprint(v.Resolve().Any())
+	if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+		return strconv.Quote(s)
+	}
+	return s
+}
@@ -0,0 +1,30 @@
+package logging
+
+import (
+	"bytes"
+	"log/slog"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHandler_Format(t *testing.T) {
+	var out bytes.Buffer
+	logger := slog.New(NewHandler(&out, slog.LevelInfo))
+	logger.Info("discovered tool", Component, "mcp-time", "tool", "get_time")
+	logger.With(Component, "config").Warn("verbose is deprecated", "file", "my config.hcl")
+	assert.Equal(t, "mcp-time\t> discovered tool tool=get_time\nconfig\t> warn: verbose is deprecated file=\"my config.hcl\"\n", out.String())
+}
+
+func TestOptions_Level(t *testing.T) {
+	var out bytes.Buffer
+	opts := &Options{Quiet: true}
+	logger := slog.New(NewHandler(&out, opts.Level()))
+	logger.Info("hidden")
+	logger.Debug("hidden")
+	logger.Error("shown")
+	assert.Equal(t, "error: shown\n", out.String())
+
+	assert.Equal(t, slog.LevelDebug, (&Options{Verbose: true}).Level())
+	assert.Equal(t, slog.LevelInfo, (&Options{}).Level())
+}
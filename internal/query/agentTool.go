@@ -0,0 +1,195 @@
+package query
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+
+	"github.com/meschbach/marvin/internal/backend"
+	"github.com/meschbach/marvin/internal/cassette"
+	"github.com/meschbach/marvin/internal/config"
+	"github.com/meschbach/marvin/internal/logging"
+	"github.com/ollama/ollama/api"
+)
+
+const agentToolPrefix = "agent."
+const agentTaskParameter = "task"
+
+// agentTool offers each agent a conversation may delegate to as a tool named `agent.<name>`.  A call runs the task in a
+// conversation of its own with the model, system prompt, tools and limits of the agent, answering with the final answer
+// of the agent.  The delegated conversation shares the MCP servers of the conversation delegating to it, and its tokens
+// are charged to the budget of that conversation.
+type agentTool struct {
+	cfg       *config.File
+	delegates []*config.AgentBlock
+	client    backend.Backend
+	events    eventSink
+	traffic   *cassette.Deck
+	// opts are the options of the conversation offering the tool
+	opts    *ChatOptions
+	servers *mcpServers
+	// depth is how many agents deep the conversation offering the tool is, zero for the conversation of the user
+	depth int
+	// maxDepth is the deepest a delegated conversation may be
+	maxDepth int
+
+	// lock guards the token usage of parent, which concurrent delegations charge
+	lock sync.Mutex
+	// parent is the conversation offering the tool
+	parent *ollamaConversation
+}
+
+// newAgentTool offers the delegates of the configuration, returning nil when there are none or delegating any deeper
+// would exceed the depth limit
+func newAgentTool(client backend.Backend, cfg *config.File, opts *ChatOptions, events eventSink, traffic *cassette.Deck, servers *mcpServers) *agentTool {
+	maxDepth := cfg.ResolveLimits(opts.Limits).ResolveMaxAgentDepth()
+	if opts.agentDepthLimit > 0 && opts.agentDepthLimit < maxDepth {
+		maxDepth = opts.agentDepthLimit
+	}
+	delegates := cfg.Delegates()
+	if len(delegates) == 0 || opts.agentDepth >= maxDepth {
+		return nil
+	}
+	return &agentTool{
+		cfg:       cfg,
+		delegates: delegates,
+		client:    client,
+		events:    events,
+		traffic:   traffic,
+		opts:      opts,
+		servers:   servers,
+		depth:     opts.agentDepth,
+		maxDepth:  maxDepth,
+	}
+}
+
+func (a *agentTool) defineAPI(ctx context.Context) (definition *toolDefinition, problem error) {
+	definition = &toolDefinition{}
+	var names []string
+	for _, agent := range a.delegates {
+		description := agent.Description
+		if description == "" {
+			description = fmt.Sprintf("Hands a task to the %s agent and returns its answer", agent.Name)
+		}
+		definition.tool = append(definition.tool, api.Tool{
+			Type: ToolTypeFunction,
+			Function: api.ToolFunction{
+				Name:        agentToolPrefix + agent.Name,
+				Description: description,
+				Parameters: api.ToolFunctionParameters{
+					Type:     mcpParameterTypeObject,
+					Required: []string{agentTaskParameter},
+					Properties: map[string]api.ToolProperty{
+						agentTaskParameter: {
+							Type:        ToolPropTypeString,
+							Description: "the complete task for the agent, including everything it needs to know",
+						},
+					},
+				},
+			},
+		})
+		names = append(names, "`"+agentToolPrefix+agent.Name+"`")
+	}
+	definition.appendInstruction(fmt.Sprintf("The tools %s hand a task to a specialized agent.  The agent does not see this conversation, so describe the task completely.", strings.Join(names, ", ")))
+	return definition, nil
+}
+
+func (a *agentTool) invoke(ctx context.Context, call api.ToolCall) (out []api.Message, problem error) {
+	name := strings.TrimPrefix(call.Function.Name, agentToolPrefix)
+	task, _ := call.Function.Arguments[agentTaskParameter].(string)
+	if task == "" {
+		return []api.Message{toolResponseMessage(call, fmt.Sprintf("{\"error\":%q}", "a task is required"))}, nil
+	}
+	cfg, err := a.cfg.ForAgent(name)
+	if err != nil {
+		return []api.Message{toolResponseMessage(call, fmt.Sprintf("{\"error\":%q}", err.Error()))}, nil
+	}
+
+	remaining, limited := a.remainingTokens()
+	if limited && remaining <= 0 {
+		return []api.Message{toolResponseMessage(call, fmt.Sprintf("{\"error\":%q}", "the token budget is exhausted"))}, nil
+	}
+
+	events := &agentEvents{next: a.events, agent: name}
+	opts := &ChatOptions{
+		Limits:            a.opts.Limits,
+		Ollama:            a.opts.Ollama,
+		ParallelToolCalls: a.opts.ParallelToolCalls,
+		agentDepth:        a.depth + 1,
+		agentDepthLimit:   a.maxDepth,
+		servers:           a.servers,
+	}
+	conversation, toolset, err := startConversationWith(ctx, a.client, cfg, opts, events, a.traffic)
+	if err != nil {
+		return nil, &operationalError{fmt.Sprintf("starting agent %q", name), err}
+	}
+	defer func() {
+		if err := toolset.Shutdown(ctx); err != nil {
+			slog.Warn("shutting down tools", logging.Component, "agent", "agent", name, "err", err)
+		}
+	}()
+	if limited {
+		conversation.budget.limitTokens(remaining)
+	}
+	conversation.hideContent = true
+	conversation.messages = append(conversation.messages, api.Message{Role: roleUser, Content: task})
+
+	err = conversation.runAIToConclusion(ctx, cfg.LanguageModel(), toolset.APITools())
+	a.charge(conversation)
+	events.emit(noticeEvent("agent", "answered using %d tokens", conversation.totalTokens()))
+	var exceeded *budgetExceededError
+	var mismatch *cassette.MismatchError
+	switch {
+	case err == nil, errors.As(err, &exceeded):
+		return []api.Message{toolResponseMessage(call, conversation.finalAnswer())}, nil
+	case errors.As(err, &mismatch):
+		// A replay which diverged from its recording can not be recovered by the model
+		return nil, err
+	default:
+		return []api.Message{toolResponseMessage(call, fmt.Sprintf("{\"error\":%q}", err.Error()))}, nil
+	}
+}
+
+// remainingTokens is how many more tokens the conversation offering the tool may consume, or false when unlimited
+func (a *agentTool) remainingTokens() (int, bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.parent == nil {
+		return 0, false
+	}
+	return a.parent.budget.remainingTokens(a.parent.totalTokens())
+}
+
+// charge adds the tokens used by a delegated conversation to those of the conversation offering the tool
+func (a *agentTool) charge(delegated *ollamaConversation) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if a.parent == nil {
+		return
+	}
+	a.parent.promptTokens += delegated.promptTokens
+	a.parent.responseTokens += delegated.responseTokens
+}
+
+// agentEvents attributes the events of a delegated conversation to its agent.  The answer of the agent is the result
+// of the tool call, so its content is not passed on.
+type agentEvents struct {
+	next  eventSink
+	agent string
+}
+
+func (a *agentEvents) emit(e Event) {
+	switch e.Type {
+	case EventContent, EventDone:
+		return
+	}
+	if e.Agent == "" {
+		e.Agent = a.agent
+	} else {
+		e.Agent = a.agent + "/" + e.Agent
+	}
+	a.next.emit(e)
+}
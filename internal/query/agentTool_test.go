@@ -0,0 +1,183 @@
+package query
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/meschbach/marvin/internal/backend"
+	"github.com/meschbach/marvin/internal/config"
+	"github.com/ollama/ollama/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func delegationConfig(limits *config.LimitsBlock) *config.File {
+	return &config.File{
+		Model:  "large",
+		Limits: limits,
+		Agents: []*config.AgentBlock{
+			{Name: "coordinator", Delegates: []string{"summarizer"}},
+			{Name: "summarizer", Model: "small", Description: "Summarizes the inbox", Delegates: []string{"coordinator"}},
+		},
+	}
+}
+
+// delegate runs the coordinator of the configuration, which hands a task to the summarizer before answering
+func delegate(t *testing.T, cfg *config.File, opts *ChatOptions) (*backend.Scripted, *ollamaConversation, *recordedEvents) {
+	script := backend.NewScripted(
+		backend.ScriptedReply{
+			ToolCalls:      []api.ToolCall{backend.ToolCall("1", "agent.summarizer", map[string]any{"task": "Summarize my inbox"})},
+			PromptTokens:   10,
+			ResponseTokens: 5,
+		},
+		backend.ScriptedReply{Parts: []string{"Two unread messages."}, PromptTokens: 20, ResponseTokens: 10},
+		backend.Reply("You have two unread messages."),
+	)
+	coordinator, err := cfg.ForAgent("coordinator")
+	require.NoError(t, err)
+	events := &recordedEvents{}
+	ctx := context.Background()
+	conversation, toolset, err := startConversationWith(ctx, script, coordinator, opts, events, nil)
+	require.NoError(t, err)
+	defer toolset.Shutdown(ctx)
+	conversation.messages = append(conversation.messages, api.Message{Role: roleUser, Content: "What is in my inbox?"})
+	err = conversation.runAIToConclusion(ctx, coordinator.LanguageModel(), toolset.APITools())
+	if opts.Limits.MaxTokens == 0 {
+		require.NoError(t, err)
+	}
+	assert.Equal(t, 0, script.Remaining())
+	return script, conversation, events
+}
+
+func toolNames(tools api.Tools) []string {
+	var names []string
+	for _, tool := range tools {
+		names = append(names, tool.Function.Name)
+	}
+	return names
+}
+
+func TestAgentTool_DelegatesTask(t *testing.T) {
+	script, conversation, events := delegate(t, delegationConfig(nil), &ChatOptions{})
+
+	requests := script.Requests()
+	require.Len(t, requests, 3)
+	assert.Equal(t, "large", requests[0].Model)
+	assert.Equal(t, []string{"agent.summarizer"}, toolNames(requests[0].Tools))
+	assert.Equal(t, "Summarizes the inbox", requests[0].Tools[0].Function.Description)
+
+	nested := requests[1]
+	assert.Equal(t, "small", nested.Model)
+	assert.Equal(t, []string{"agent.coordinator"}, toolNames(nested.Tools), "the delegates of the summarizer")
+	last := nested.Messages[len(nested.Messages)-1]
+	assert.Equal(t, roleUser, last.Role)
+	assert.Equal(t, "Summarize my inbox", last.Content)
+
+	result := conversation.messages[len(conversation.messages)-2]
+	assert.Equal(t, roleTool, result.Role)
+	assert.Equal(t, "Two unread messages.", result.Content)
+	assert.Equal(t, "You have two unread messages.", conversation.finalAnswer())
+
+	for _, e := range events.ofType(EventContent) {
+		assert.Empty(t, e.Agent, "the content of the agent is only its answer")
+	}
+	var attributed bool
+	for _, e := range events.ofType(EventUsage) {
+		attributed = attributed || e.Agent == "summarizer"
+	}
+	assert.True(t, attributed, "the usage of the agent is attributed to it")
+	assert.Equal(t, 45, conversation.totalTokens(), "the tokens of the agent are charged to the coordinator")
+}
+
+func TestAgentTool_OnlyOfferedWhenDelegating(t *testing.T) {
+	ctx := context.Background()
+	_, toolset, err := startConversationWith(ctx, backend.NewScripted(), delegationConfig(nil), &ChatOptions{}, &recordedEvents{}, nil)
+	require.NoError(t, err)
+	defer toolset.Shutdown(ctx)
+	assert.Empty(t, toolset.APITools(), "without --agent no agent is offered")
+}
+
+func TestAgentTool_InheritsOptionsAndBudget(t *testing.T) {
+	seed := 7
+	opts := &ChatOptions{Limits: config.LimitsBlock{MaxTokens: 40}, Ollama: config.OllamaOptionsBlock{Seed: &seed}}
+	script, conversation, events := delegate(t, delegationConfig(nil), opts)
+
+	requests := script.Requests()
+	require.Len(t, requests, 3)
+	assert.EqualValues(t, 7, requests[1].Options["seed"], "the agent uses the overrides of the command line")
+	assert.Empty(t, requests[2].Tools, "the tokens of the agent exhaust the budget of the coordinator")
+	var exhausted bool
+	for _, e := range events.ofType(EventNotice) {
+		exhausted = exhausted || strings.Contains(e.Content, "45 tokens of the 40 token budget")
+	}
+	assert.True(t, exhausted)
+	assert.Equal(t, 45, conversation.totalTokens())
+}
+
+func TestAgentTool_RefusesOnceTheBudgetIsExhausted(t *testing.T) {
+	cfg := delegationConfig(nil)
+	coordinator, err := cfg.ForAgent("coordinator")
+	require.NoError(t, err)
+	ctx := context.Background()
+	conversation, toolset, err := startConversationWith(ctx, backend.NewScripted(), coordinator, &ChatOptions{Limits: config.LimitsBlock{MaxTokens: 10}}, &recordedEvents{}, nil)
+	require.NoError(t, err)
+	defer toolset.Shutdown(ctx)
+	conversation.promptTokens = 10
+
+	replies, err := toolset.HandleCall(ctx, backend.ToolCall("1", "agent.summarizer", map[string]any{"task": "Summarize my inbox"}))
+	require.NoError(t, err)
+	require.Len(t, replies, 1)
+	assert.Contains(t, replies[0].Content, "the token budget is exhausted")
+}
+
+func TestAgentTool_LimitsDepth(t *testing.T) {
+	script, _, _ := delegate(t, delegationConfig(&config.LimitsBlock{MaxAgentDepth: 1}), &ChatOptions{})
+
+	requests := script.Requests()
+	require.Len(t, requests, 3)
+	assert.Empty(t, requests[1].Tools, "the summarizer may not delegate any further")
+}
+
+func TestAgentEvents_NestsAgents(t *testing.T) {
+	events := &recordedEvents{}
+	outer := &agentEvents{next: events, agent: "coordinator"}
+	inner := &agentEvents{next: outer, agent: "summarizer"}
+	inner.emit(Event{Type: EventToolCall, ToolName: "imap.list"})
+	inner.emit(Event{Type: EventContent, Content: "hidden"})
+
+	require.Len(t, events.events, 1)
+	assert.Equal(t, "coordinator/summarizer", events.events[0].Agent)
+	assert.Equal(t, "    [coordinator/summarizer] ", agentPrefix(events.events[0]))
+}
+
+// countingSpec counts the starts of the server
+type countingSpec struct {
+	programRuntimeSpec
+	starts int
+}
+
+func (c *countingSpec) start(ctx context.Context) (runningProgram, error) {
+	c.starts++
+	return c.programRuntimeSpec.start(ctx)
+}
+
+func TestAgentTool_SharesRunningServers(t *testing.T) {
+	cfg := delegationConfig(nil)
+	cfg.LocalPrograms = []config.LocalProgramBlock{{Name: "imap", Program: "imap-mcp"}}
+	spec := &countingSpec{programRuntimeSpec: &pipedSpec{archiveServer()}}
+	servers := &mcpServers{running: map[string]*Mark3labsTool{}, owner: &Container{name: "shared"}}
+	servers.use("imap", func() *Mark3labsTool {
+		return &Mark3labsTool{Name: "imap", spec: spec}
+	})
+	t.Cleanup(func() {
+		assert.NoError(t, servers.owner.Shutdown(context.Background()))
+	})
+
+	script, _, _ := delegate(t, cfg, &ChatOptions{servers: servers})
+
+	requests := script.Requests()
+	require.Len(t, requests, 3)
+	assert.Contains(t, toolNames(requests[1].Tools), "imap.archive")
+	assert.Equal(t, 1, spec.starts, "the agent uses the server already running")
+}
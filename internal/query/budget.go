@@ -0,0 +1,105 @@
+package query
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/meschbach/marvin/internal/config"
+	"github.com/ollama/ollama/api"
+)
+
+// conversationBudget tracks tool usage while running a conversation to conclusion against the configured limits.  A nil
+// budget is unlimited.
+type conversationBudget struct {
+	limits      config.LimitsBlock
+	turns       int
+	toolCalls   int
+	perTool     map[string]int
+	identical   map[string]int
+	tokenOffset int
+}
+
+func newConversationBudget(limits config.LimitsBlock) *conversationBudget {
+	return &conversationBudget{limits: limits}
+}
+
+// reset begins tracking a new run with usedTokens already consumed by earlier runs of the conversation.
+func (b *conversationBudget) reset(usedTokens int) {
+	if b == nil {
+		return
+	}
+	b.turns = 0
+	b.toolCalls = 0
+	b.perTool = map[string]int{}
+	b.identical = map[string]int{}
+	b.tokenOffset = usedTokens
+}
+
+// beforeTurn checks the limits which must be satisfied prior to requesting another turn from the model.  Returns a
+// description of the exhausted limit or an empty string when the model may continue.
+func (b *conversationBudget) beforeTurn(usedTokens int) string {
+	if b == nil {
+		return ""
+	}
+	if maxTurns := b.limits.ResolveMaxTurns(); maxTurns > 0 && b.turns >= maxTurns {
+		return fmt.Sprintf("reached the maximum of %d turns", maxTurns)
+	}
+	if b.limits.MaxTokens > 0 && usedTokens-b.tokenOffset >= b.limits.MaxTokens {
+		return fmt.Sprintf("consumed %d tokens of the %d token budget", usedTokens-b.tokenOffset, b.limits.MaxTokens)
+	}
+	b.turns++
+	return ""
+}
+
+// remainingTokens is how many more tokens the run may consume, or false when tokens are unlimited
+func (b *conversationBudget) remainingTokens(usedTokens int) (int, bool) {
+	if b == nil || b.limits.MaxTokens <= 0 {
+		return 0, false
+	}
+	return b.limits.MaxTokens - (usedTokens - b.tokenOffset), true
+}
+
+// limitTokens lowers the token limit to at most remaining
+func (b *conversationBudget) limitTokens(remaining int) {
+	if b == nil {
+		return
+	}
+	if b.limits.MaxTokens <= 0 || remaining < b.limits.MaxTokens {
+		b.limits.MaxTokens = remaining
+	}
+}
+
+// admit accounts for the tool calls requested by the model.  Returns a description of the exhausted limit when the
+// calls may not be executed.
+func (b *conversationBudget) admit(calls []api.ToolCall) string {
+	if b == nil {
+		return ""
+	}
+	for _, call := range calls {
+		b.toolCalls++
+		if b.limits.MaxToolCalls > 0 && b.toolCalls > b.limits.MaxToolCalls {
+			return fmt.Sprintf("reached the maximum of %d tool calls", b.limits.MaxToolCalls)
+		}
+		name := call.Function.Name
+		b.perTool[name]++
+		if b.limits.MaxCallsPerTool > 0 && b.perTool[name] > b.limits.MaxCallsPerTool {
+			return fmt.Sprintf("reached the maximum of %d calls to %s", b.limits.MaxCallsPerTool, name)
+		}
+		signature := callSignature(call)
+		b.identical[signature]++
+		if maxIdentical := b.limits.ResolveMaxIdenticalCalls(); maxIdentical > 0 && b.identical[signature] > maxIdentical {
+			return fmt.Sprintf("repeated the identical call %s more than %d times", signature, maxIdentical)
+		}
+	}
+	return ""
+}
+
+// callSignature identifies a call by name and arguments.  Arguments are encoded as JSON which orders map keys, so
+// equivalent arguments produce the same signature.
+func callSignature(call api.ToolCall) string {
+	args, err := json.Marshal(call.Function.Arguments)
+	if err != nil {
+		return call.Function.Name
+	}
+	return call.Function.Name + string(args)
+}
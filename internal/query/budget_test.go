@@ -0,0 +1,86 @@
+package query
+
+import (
+	"testing"
+
+	"github.com/meschbach/marvin/internal/config"
+	"github.com/ollama/ollama/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func budgetTestCall(name string, args map[string]any) api.ToolCall {
+	return api.ToolCall{Function: api.ToolCallFunction{Name: name, Arguments: args}}
+}
+
+func TestConversationBudget_Unlimited(t *testing.T) {
+	var unlimited *conversationBudget
+	unlimited.reset(0)
+	assert.Empty(t, unlimited.beforeTurn(1000))
+	assert.Empty(t, unlimited.admit([]api.ToolCall{budgetTestCall("a", nil)}))
+
+	zero := 0
+	budget := newConversationBudget(config.LimitsBlock{MaxTurns: &zero, MaxIdenticalCalls: &zero})
+	budget.reset(0)
+	for i := 0; i < 100; i++ {
+		assert.Empty(t, budget.beforeTurn(i*1000))
+		assert.Empty(t, budget.admit([]api.ToolCall{budgetTestCall("a", map[string]any{"x": 1})}))
+	}
+}
+
+func TestConversationBudget_DefaultsStopRepeatedCalls(t *testing.T) {
+	budget := newConversationBudget(config.LimitsBlock{})
+	budget.reset(0)
+	call := []api.ToolCall{budgetTestCall("a", map[string]any{"x": 1})}
+	for i := 0; i < config.DefaultMaxIdenticalCalls; i++ {
+		assert.Empty(t, budget.admit(call))
+	}
+	assert.NotEmpty(t, budget.admit(call))
+
+	for i := 0; i < config.DefaultMaxTurns; i++ {
+		assert.Empty(t, budget.beforeTurn(0))
+	}
+	assert.NotEmpty(t, budget.beforeTurn(0))
+}
+
+func TestConversationBudget_Turns(t *testing.T) {
+	turns := 2
+	budget := newConversationBudget(config.LimitsBlock{MaxTurns: &turns})
+	budget.reset(0)
+	assert.Empty(t, budget.beforeTurn(0))
+	assert.Empty(t, budget.beforeTurn(0))
+	assert.NotEmpty(t, budget.beforeTurn(0))
+
+	budget.reset(0)
+	assert.Empty(t, budget.beforeTurn(0), "reset begins a new run")
+}
+
+func TestConversationBudget_TokensRelativeToRun(t *testing.T) {
+	budget := newConversationBudget(config.LimitsBlock{MaxTokens: 100})
+	budget.reset(500)
+	assert.Empty(t, budget.beforeTurn(550))
+	assert.NotEmpty(t, budget.beforeTurn(600))
+}
+
+func TestConversationBudget_ToolCalls(t *testing.T) {
+	budget := newConversationBudget(config.LimitsBlock{MaxToolCalls: 2})
+	budget.reset(0)
+	assert.Empty(t, budget.admit([]api.ToolCall{budgetTestCall("a", nil), budgetTestCall("b", nil)}))
+	assert.NotEmpty(t, budget.admit([]api.ToolCall{budgetTestCall("c", nil)}))
+}
+
+func TestConversationBudget_CallsPerTool(t *testing.T) {
+	budget := newConversationBudget(config.LimitsBlock{MaxCallsPerTool: 1})
+	budget.reset(0)
+	assert.Empty(t, budget.admit([]api.ToolCall{budgetTestCall("a", nil), budgetTestCall("b", nil)}))
+	assert.Contains(t, budget.admit([]api.ToolCall{budgetTestCall("a", nil)}), "calls to a")
+}
+
+func TestConversationBudget_IdenticalCalls(t *testing.T) {
+	identical := 2
+	budget := newConversationBudget(config.LimitsBlock{MaxIdenticalCalls: &identical})
+	budget.reset(0)
+	assert.Empty(t, budget.admit([]api.ToolCall{budgetTestCall("time.now", map[string]any{"zone": "UTC", "format": "iso"})}))
+	assert.Empty(t, budget.admit([]api.ToolCall{budgetTestCall("time.now", map[string]any{"zone": "PST"})}))
+	assert.Empty(t, budget.admit([]api.ToolCall{budgetTestCall("time.now", map[string]any{"format": "iso", "zone": "UTC"})}))
+	assert.Contains(t, budget.admit([]api.ToolCall{budgetTestCall("time.now", map[string]any{"zone": "UTC", "format": "iso"})}), "identical")
+}
@@ -0,0 +1,222 @@
+package query
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/meschbach/marvin/internal/config"
+	"github.com/meschbach/marvin/internal/logging"
+	"github.com/ollama/ollama/api"
+)
+
+const chatPrompt = "you> "
+
+// chatSession holds the state of an interactive chat which survives between user turns.
+type chatSession struct {
+	conversation *ollamaConversation
+	toolset      *ToolSet
+	model        string
+	// initial is the conversation as it was before the first user turn, used to reset the chat.
+	initial []api.Message
+	out     io.Writer
+}
+
+// ChatWithConfig runs an interactive multi-turn chat reading user turns from input until end of input or `/exit`.
+// The toolset is started once and kept alive for the whole chat.  Failures of individual turns are reported and the chat
+// continues; only failures ending the chat are returned.
+func ChatWithConfig(ctx context.Context, cfg *config.File, input io.Reader, opts *ChatOptions) (problem error) {
+	events, err := newEventSink(opts.Output, opts.display())
+	if err != nil {
+		return err
+	}
+	defer func() {
+		problem = report(events, problem)
+	}()
+	cfg, err = selectAgent(cfg, opts.Agent)
+	if err != nil {
+		return err
+	}
+	traffic, err := openTraffic(&opts.Traffic)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		problem = closeTraffic(traffic, problem)
+	}()
+	conversation, toolset, err := startConversation(ctx, cfg, opts, events, traffic)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		slog.Debug("shutting down", logging.Component, "tools")
+		if err := toolset.Shutdown(context.WithoutCancel(ctx)); err != nil {
+			problem = errors.Join(problem, &operationalError{"shutting down tools", err})
+		}
+	}()
+
+	session := &chatSession{
+		conversation: conversation,
+		toolset:      toolset,
+		model:        cfg.LanguageModel(),
+		initial:      append([]api.Message(nil), conversation.messages...),
+		out:          os.Stdout,
+	}
+	if opts.Output == OutputJSONL {
+		// stdout carries only events so programs may parse it; replies to commands are for the person typing them
+		session.out = os.Stderr
+	}
+	if err := resumeSession(conversation, opts.Session); err != nil {
+		return err
+	}
+	fmt.Fprintf(session.out, "Chatting with %s.  Type /help for commands.\n", session.model)
+
+	return session.run(ctx, linesOf(input), events)
+}
+
+// run reads user turns and commands from input until end of input or `/exit`.  Failures of individual turns are
+// reported through events and the chat continues.
+func (c *chatSession) run(ctx context.Context, input *lineReader, events eventSink) error {
+	for {
+		fmt.Fprint(c.out, chatPrompt)
+		read, err := input.readLine(ctx)
+		if err != nil && !(errors.Is(err, io.EOF) && read != "") {
+			fmt.Fprintln(c.out)
+			// end of input and an interrupt at the prompt both end the chat
+			if errors.Is(err, io.EOF) || ctx.Err() != nil {
+				return nil
+			}
+			return &operationalError{"reading input", err}
+		}
+		line := strings.TrimSpace(read)
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "/") {
+			var exit bool
+			if exit, err = c.command(ctx, line); exit {
+				return nil
+			}
+		} else {
+			err = c.turn(ctx, line)
+		}
+		if err != nil {
+			if ctx.Err() != nil {
+				return err
+			}
+			// the budget notice has already explained why the turn ended early
+			var budget *budgetExceededError
+			if !errors.As(err, &budget) {
+				events.emit(errorEvent(err))
+			}
+		}
+	}
+}
+
+// turn sends a single user message through the conversation, running any tool calls to conclusion.
+func (c *chatSession) turn(ctx context.Context, userInput string) error {
+	c.conversation.messages = append(c.conversation.messages, api.Message{Role: roleUser, Content: userInput})
+	return c.conversation.runAIToConclusion(ctx, c.model, c.toolset.APITools())
+}
+
+// prompt runs a turn starting with the messages of an MCP prompt.  The argument names the prompt followed by any
+// `name=value` arguments.
+func (c *chatSession) prompt(ctx context.Context, argument string) error {
+	name, rest, _ := strings.Cut(strings.TrimSpace(argument), " ")
+	if name == "" {
+		fmt.Fprintln(c.out, "Usage: /prompt <server>.<prompt> [name=value...]")
+		return nil
+	}
+	arguments, err := parsePromptArguments(splitPromptArguments(rest))
+	if err != nil {
+		return err
+	}
+	messages, err := c.toolset.renderPrompt(ctx, name, arguments)
+	if err != nil {
+		return err
+	}
+	c.conversation.messages = append(c.conversation.messages, messages...)
+	return c.conversation.runAIToConclusion(ctx, c.model, c.toolset.APITools())
+}
+
+// promptArgumentStart matches the start of each name=value argument of /prompt
+var promptArgumentStart = regexp.MustCompile(`(?:^|\s)[^\s=]+=`)
+
+// splitPromptArguments splits the arguments of /prompt into name=value pairs.  A value runs until the next name=, so it
+// may contain spaces.  Words before the first name= are kept as an argument of their own to be reported.
+func splitPromptArguments(arguments string) []string {
+	var out []string
+	last := 0
+	for _, match := range promptArgumentStart.FindAllStringIndex(arguments, -1) {
+		if word := strings.TrimSpace(arguments[last:match[0]]); word != "" {
+			out = append(out, word)
+		}
+		last = match[0]
+	}
+	if word := strings.TrimSpace(arguments[last:]); word != "" {
+		out = append(out, word)
+	}
+	return out
+}
+
+// command interprets a slash command.  Returns true when the chat should end, or the failure of a turn the command ran.
+func (c *chatSession) command(ctx context.Context, line string) (exit bool, problem error) {
+	name, argument, _ := strings.Cut(line, " ")
+	argument = strings.TrimSpace(argument)
+	switch name {
+	case "/exit", "/quit":
+		return true, nil
+	case "/help":
+		fmt.Fprintln(c.out, "Commands:")
+		fmt.Fprintln(c.out, "\t/tools\t\tlist the tools available to the model")
+		fmt.Fprintln(c.out, "\t/reset\t\tforget the conversation so far")
+		fmt.Fprintln(c.out, "\t/model [name]\tshow or change the model")
+		fmt.Fprintln(c.out, "\t/prompts\tlist the prompts offered by the MCP servers")
+		fmt.Fprintln(c.out, "\t/prompt <name> [arg=value...]\n\t\t\tstart a turn with an MCP prompt")
+		fmt.Fprintln(c.out, "\t/exit\t\tend the chat")
+	case "/tools":
+		tools := c.toolset.APITools()
+		if len(tools) == 0 {
+			fmt.Fprintln(c.out, "No tools available")
+		}
+		for _, tool := range tools {
+			fmt.Fprintf(c.out, "\t%s: %s\n", tool.Function.Name, tool.Function.Description)
+		}
+	case "/prompts":
+		prompts := c.toolset.sortedPrompts()
+		if len(prompts) == 0 {
+			fmt.Fprintln(c.out, "No prompts available")
+		}
+		for _, prompt := range prompts {
+			fmt.Fprintf(c.out, "\t%s: %s\n", prompt.name, prompt.description)
+			for _, argument := range prompt.arguments {
+				required := ""
+				if argument.Required {
+					required = " (required)"
+				}
+				fmt.Fprintf(c.out, "\t\t%s: %s%s\n", argument.Name, argument.Description, required)
+			}
+		}
+	case "/prompt":
+		return false, c.prompt(ctx, argument)
+	case "/reset":
+		c.conversation.messages = append([]api.Message(nil), c.initial...)
+		c.conversation.forgetCompaction()
+		c.conversation.promptTokens = 0
+		c.conversation.responseTokens = 0
+		fmt.Fprintln(c.out, "Conversation reset")
+	case "/model":
+		if argument != "" {
+			c.model = argument
+		}
+		fmt.Fprintf(c.out, "model: %s\n", c.model)
+	default:
+		fmt.Fprintf(c.out, "Unknown command %q.  Type /help for commands.\n", name)
+	}
+	return false, nil
+}
@@ -0,0 +1,91 @@
+package query
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/meschbach/marvin/internal/backend"
+	"github.com/ollama/ollama/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// scriptedChat is a chat answered by the script, with the tools of the probe available
+func scriptedChat(t *testing.T, script *backend.Scripted) (*chatSession, *strings.Builder) {
+	t.Helper()
+	tools := probeToolSet(t, &concurrencyProbeTool{names: []string{"lookup"}})
+	conversation, _ := scriptedConversation(script, tools)
+	conversation.messages = []api.Message{{Role: roleSystem, Content: "Be brief."}}
+	out := &strings.Builder{}
+	return &chatSession{
+		conversation: conversation,
+		toolset:      tools,
+		model:        "llama3.2",
+		initial:      append([]api.Message(nil), conversation.messages...),
+		out:          out,
+	}, out
+}
+
+func TestChatSession_TurnsAndCommands(t *testing.T) {
+	script := backend.NewScripted(backend.Reply("Hi."), backend.Reply("Hello again."))
+	chat, out := scriptedChat(t, script)
+
+	input := "hello\n/tools\n/model qwen3\n\nanother\n/frobnicate\n/exit\nnever sent\n"
+	require.NoError(t, chat.run(context.Background(), newLineReader(strings.NewReader(input)), &recordedEvents{}))
+
+	requests := script.Requests()
+	require.Len(t, requests, 2, "nothing after /exit is sent")
+	assert.Equal(t, "llama3.2", requests[0].Model)
+	assert.Equal(t, []api.Message{{Role: roleSystem, Content: "Be brief."}, {Role: roleUser, Content: "hello"}}, requests[0].Messages)
+	assert.Equal(t, "qwen3", requests[1].Model, "/model changes the model of later turns")
+	assert.Equal(t, []api.Message{
+		{Role: roleSystem, Content: "Be brief."},
+		{Role: roleUser, Content: "hello"},
+		{Role: roleAssistant, Content: "Hi."},
+		{Role: roleUser, Content: "another"},
+	}, requests[1].Messages, "turns build on the history")
+
+	shown := out.String()
+	assert.Contains(t, shown, "\tlookup: ")
+	assert.Contains(t, shown, "model: qwen3")
+	assert.Contains(t, shown, `Unknown command "/frobnicate"`)
+}
+
+func TestChatSession_ResetRestoresTheInitialConversation(t *testing.T) {
+	script := backend.NewScripted(backend.ScriptedReply{Parts: []string{"Hi."}, PromptTokens: 10, ResponseTokens: 2}, backend.Reply("Hello."))
+	chat, out := scriptedChat(t, script)
+
+	require.NoError(t, chat.run(context.Background(), newLineReader(strings.NewReader("hello\n/reset\nfresh start")), &recordedEvents{}))
+
+	requests := script.Requests()
+	require.Len(t, requests, 2)
+	assert.Equal(t, []api.Message{{Role: roleSystem, Content: "Be brief."}, {Role: roleUser, Content: "fresh start"}}, requests[1].Messages)
+	assert.Contains(t, out.String(), "Conversation reset")
+	assert.Zero(t, chat.conversation.promptTokens+chat.conversation.responseTokens, "usage before the reset is forgotten")
+}
+
+func TestChatSession_ContinuesAfterAFailedTurn(t *testing.T) {
+	script := backend.NewScripted(backend.ScriptedReply{Err: errors.New("model unavailable")}, backend.Reply("Recovered."))
+	chat, _ := scriptedChat(t, script)
+	events := &recordedEvents{}
+
+	require.NoError(t, chat.run(context.Background(), newLineReader(strings.NewReader("first\nsecond\n")), events))
+
+	assert.Len(t, script.Requests(), 2)
+	failures := events.ofType(EventError)
+	require.Len(t, failures, 1)
+	assert.Contains(t, failures[0].Error, "model unavailable")
+	assert.Equal(t, api.Message{Role: roleAssistant, Content: "Recovered."}, chat.conversation.messages[len(chat.conversation.messages)-1])
+}
+
+func TestChatSession_InterruptAtThePromptEndsTheChat(t *testing.T) {
+	chat, _ := scriptedChat(t, backend.NewScripted())
+	in, _ := io.Pipe()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	assert.NoError(t, chat.run(ctx, newLineReader(in), &recordedEvents{}))
+}
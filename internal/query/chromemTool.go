@@ -3,15 +3,20 @@ package query
 import (
 	"context"
 	"fmt"
+	"log/slog"
 	"os"
 	"path/filepath"
 
+	"github.com/meschbach/marvin/internal/backend"
 	"github.com/meschbach/marvin/internal/config"
+	"github.com/meschbach/marvin/internal/logging"
 	"github.com/ollama/ollama/api"
 )
 
 type chromemTool struct {
-	config          *config.DocumentsBlock
+	config *config.DocumentsBlock
+	// client embeds the search queries
+	client          backend.Backend
 	showInvocations bool
 }
 
@@ -82,7 +87,7 @@ func (c *chromemTool) defineAPI(ctx context.Context) (definition *toolDefinition
 
 func (c *chromemTool) invoke(ctx context.Context, call api.ToolCall) (out []api.Message, problem error) {
 	if c.showInvocations {
-		fmt.Printf("rag> invoked chromem tool %s\n", call.Function.Name)
+		slog.Debug("invoked chromem tool", logging.Component, "rag", "tool", call.Function.Name)
 	}
 	functionName := call.Function.Name
 
@@ -112,7 +117,7 @@ func (c *chromemTool) search(ctx context.Context, call api.ToolCall) (out []api.
 		}, nil
 	}
 
-	matches, err := c.config.Query(ctx, unwrappedQuery)
+	matches, err := c.config.QueryWith(ctx, c.client, unwrappedQuery)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,224 @@
+package query
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/meschbach/marvin/internal/config"
+	"github.com/ollama/ollama/api"
+)
+
+// Modes answering the clarifying questions of the planner
+const (
+	// ClarifyAuto asks at the terminal when there is one and fails otherwise
+	ClarifyAuto = "auto"
+	// ClarifyTTY asks the person at the terminal
+	ClarifyTTY = "tty"
+	// ClarifyAssume tells the model to proceed on reasonable assumptions
+	ClarifyAssume = "assume"
+	// ClarifyFail stops the goal
+	ClarifyFail = "fail"
+)
+
+// assumeDefaultsAnswer is the reply to questions when the model is left to assume defaults
+const assumeDefaultsAnswer = "No one is available to answer.  Proceed using reasonable default assumptions and state each assumption as part of the plan."
+
+// clarificationAnswerer replies to a question from the model
+type clarificationAnswerer interface {
+	answer(ctx context.Context, question string) (string, error)
+}
+
+// clarificationRequiredError reports a question no one was available to answer
+type clarificationRequiredError struct {
+	question string
+}
+
+func (c *clarificationRequiredError) Error() string {
+	return fmt.Sprintf("the model asked %q and answering is disabled; supply an answers file with --answers or use --clarify assume", c.question)
+}
+
+// terminalAnswerer asks the person at the terminal through out and reads the answer from in
+type terminalAnswerer struct {
+	in  *lineReader
+	out io.Writer
+}
+
+func (t *terminalAnswerer) answer(ctx context.Context, question string) (string, error) {
+	fmt.Fprintf(t.out, "ai> %s\n", question)
+	input, err := t.in.readLine(ctx)
+	if err != nil && !(errors.Is(err, io.EOF) && input != "") {
+		return "", err
+	}
+	return strings.TrimSpace(input), nil
+}
+
+// assumeDefaults lets the model proceed on its own assumptions
+type assumeDefaults struct{}
+
+func (assumeDefaults) answer(ctx context.Context, question string) (string, error) {
+	return assumeDefaultsAnswer, nil
+}
+
+// failClarification refuses to answer, stopping the goal
+type failClarification struct{}
+
+func (failClarification) answer(ctx context.Context, question string) (string, error) {
+	return "", &clarificationRequiredError{question: question}
+}
+
+// suppliedAnswers replies with the first answer whose pattern matches the question, deferring to otherwise when none do
+type suppliedAnswers struct {
+	patterns  []*regexp.Regexp
+	answers   []string
+	otherwise clarificationAnswerer
+}
+
+func newSuppliedAnswers(file *config.AnswersFile, otherwise clarificationAnswerer) (*suppliedAnswers, error) {
+	supplied := &suppliedAnswers{otherwise: otherwise}
+	for _, block := range file.Answers {
+		pattern, err := regexp.Compile(block.Pattern)
+		if err != nil {
+			return nil, &configError{operationalError{"answer pattern", err}}
+		}
+		supplied.patterns = append(supplied.patterns, pattern)
+		supplied.answers = append(supplied.answers, block.Answer)
+	}
+	return supplied, nil
+}
+
+func (s *suppliedAnswers) answer(ctx context.Context, question string) (string, error) {
+	for i, pattern := range s.patterns {
+		if pattern.MatchString(question) {
+			return s.answers[i], nil
+		}
+	}
+	return s.otherwise.answer(ctx, question)
+}
+
+// newClarificationAnswerer builds the answerer for the mode, consulting the answers file first when one is given.
+// Interactive is whether a person is at the terminal reached through in and out.
+func newClarificationAnswerer(mode, answersPath string, in *lineReader, out io.Writer, interactive bool) (clarificationAnswerer, error) {
+	var answerer clarificationAnswerer
+	switch mode {
+	case "", ClarifyAuto:
+		if interactive {
+			answerer = &terminalAnswerer{in: in, out: out}
+		} else {
+			answerer = failClarification{}
+		}
+	case ClarifyTTY:
+		answerer = &terminalAnswerer{in: in, out: out}
+	case ClarifyAssume:
+		answerer = assumeDefaults{}
+	case ClarifyFail:
+		answerer = failClarification{}
+	default:
+		return nil, &configError{operationalError{"clarify", fmt.Errorf("unknown mode %q, expected %s, %s, %s or %s", mode, ClarifyAuto, ClarifyTTY, ClarifyAssume, ClarifyFail)}}
+	}
+	if answersPath == "" {
+		return answerer, nil
+	}
+	file, err := config.LoadAnswersFile(answersPath)
+	if err != nil {
+		return nil, err
+	}
+	return newSuppliedAnswers(file, answerer)
+}
+
+// isTerminal is true when the file is a character device such as a terminal rather than a pipe or regular file
+func isTerminal(file *os.File) bool {
+	info, err := file.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// questionForUser answers the clarifying questions of the model through the answerer
+type questionForUser struct {
+	answerer clarificationAnswerer
+}
+
+func (q *questionForUser) invoke(ctx context.Context, call api.ToolCall) (out []api.Message, problem error) {
+	prompt, hasPrompt := call.Function.Arguments["prompt"]
+	if !hasPrompt {
+		return nil, fmt.Errorf("missing required argument 'prompt'")
+	}
+	reply, err := q.answerer.answer(ctx, fmt.Sprint(prompt))
+	if err != nil {
+		return nil, err
+	}
+	return []api.Message{toolResponseMessage(call, reply)}, nil
+}
+
+func (q *questionForUser) defineAPI(ctx context.Context) (definition *toolDefinition, problem error) {
+	definitions := &toolDefinition{}
+	definitions.tool = api.Tools{
+		{
+			Type: "function",
+			Function: api.ToolFunction{
+				Name:        clarifyingQuestionTool,
+				Description: "Request clarification from the user or to better understand what the instructions are",
+				Parameters: api.ToolFunctionParameters{
+					Type:     mcpParameterTypeObject,
+					Required: []string{"prompt"},
+					Properties: map[string]api.ToolProperty{
+						"prompt": {
+							Type:        []string{mcpParameterTypeString},
+							Description: "The prompt to ask the user",
+						},
+					},
+				},
+			},
+		},
+	}
+	definitions.instructions = append(definitions.instructions, api.Message{
+		Role:    roleSystem,
+		Content: "Use the tool reasoning_clairifying_question to ask the user for additional details when you are unsure, need more information, or are otherwise not certain.",
+	})
+	return definitions, nil
+}
+
+// clarifyingQuestionTool is the name the model asks clarifying questions through
+const clarifyingQuestionTool = "reasoning_clairifying_question"
+
+// clarificationRecorder forwards the events of the planner, recording each clarifying question with its answer
+type clarificationRecorder struct {
+	next eventSink
+	plan *goalPlan
+	// pending holds the questions awaiting an answer by tool call id
+	pending map[string]string
+	// changed is told when an answer is recorded
+	changed func()
+}
+
+func (c *clarificationRecorder) emit(e Event) {
+	c.next.emit(e)
+	if e.ToolName != clarifyingQuestionTool {
+		return
+	}
+	switch e.Type {
+	case EventToolCall:
+		if c.pending == nil {
+			c.pending = map[string]string{}
+		}
+		c.pending[e.ToolCallID] = fmt.Sprint(e.Arguments["prompt"])
+	case EventToolResult:
+		question, ok := c.pending[e.ToolCallID]
+		if !ok {
+			return
+		}
+		delete(c.pending, e.ToolCallID)
+		clarification := &goalClarification{Question: question, Answer: e.Content, Error: e.Error, Time: time.Now()}
+		c.plan.Clarifications = append(c.plan.Clarifications, clarification)
+		if e.Error != "" {
+			c.next.emit(noticeEvent("clarification", "%q was not answered: %s", question, e.Error))
+		} else {
+			c.next.emit(noticeEvent("clarification", "%q answered %q", question, e.Content))
+		}
+		c.changed()
+	}
+}
@@ -0,0 +1,57 @@
+package query
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewClarificationAnswerer_Modes(t *testing.T) {
+	var asked bytes.Buffer
+	terminal, err := newClarificationAnswerer(ClarifyAuto, "", newLineReader(strings.NewReader("Tuesday\n")), &asked, true)
+	require.NoError(t, err)
+	answer, err := terminal.answer(context.Background(), "Which day?")
+	require.NoError(t, err)
+	assert.Equal(t, "Tuesday", answer)
+	assert.Equal(t, "ai> Which day?\n", asked.String())
+
+	unattended, err := newClarificationAnswerer(ClarifyAuto, "", newLineReader(strings.NewReader("")), &asked, false)
+	require.NoError(t, err)
+	_, err = unattended.answer(context.Background(), "Which day?")
+	var required *clarificationRequiredError
+	assert.ErrorAs(t, err, &required)
+
+	assuming, err := newClarificationAnswerer(ClarifyAssume, "", nil, nil, false)
+	require.NoError(t, err)
+	answer, err = assuming.answer(context.Background(), "Which day?")
+	require.NoError(t, err)
+	assert.Equal(t, assumeDefaultsAnswer, answer)
+
+	_, err = newClarificationAnswerer("guess", "", nil, nil, false)
+	assert.Equal(t, ExitConfig, ExitCode(err))
+}
+
+func TestNewClarificationAnswerer_AnswersFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "answers.hcl")
+	require.NoError(t, os.WriteFile(path, []byte(`
+answer {
+  pattern = "(?i)which day"
+  answer  = "Tuesday"
+}
+`), 0o644))
+	answerer, err := newClarificationAnswerer(ClarifyFail, path, nil, nil, false)
+	require.NoError(t, err)
+
+	answer, err := answerer.answer(context.Background(), "Which DAY works best?")
+	require.NoError(t, err)
+	assert.Equal(t, "Tuesday", answer)
+
+	_, err = answerer.answer(context.Background(), "How many people?")
+	assert.ErrorContains(t, err, `the model asked "How many people?"`)
+}
@@ -0,0 +1,90 @@
+package query
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+
+	"github.com/meschbach/marvin/internal/backend"
+	"github.com/meschbach/marvin/internal/config"
+	"github.com/meschbach/marvin/internal/logging"
+)
+
+// CompareOptions controls how models are compared
+type CompareOptions struct {
+	//Models are the language models the query is run against, in the order they are reported
+	Models []string
+	//Report is the path the comparison is saved to: JSON when it ends with .json and Markdown otherwise
+	Report string
+	//Limits overrides the configured conversation limits
+	Limits config.LimitsBlock
+	//Ollama overrides the configured generation options
+	Ollama config.OllamaOptionsBlock
+	//ResponseFormat overrides the configured JSON schema constraining the answer
+	ResponseFormat config.ResponseFormatBlock
+}
+
+// modelComparison is the outcome of running the query against a single model
+type modelComparison struct {
+	model string
+	run   *promptRun
+}
+
+// PerformCompare runs the query against each model in turn with the same configuration, writing the answers, tool
+// calls, latencies and token counts side by side to out and saving them as a report.
+func PerformCompare(ctx context.Context, cfg *config.File, actualQuery string, out io.Writer, opts *CompareOptions) error {
+	if len(opts.Models) == 0 {
+		return &configError{operationalError{"comparing models", errors.New("no models given")}}
+	}
+	client, err := cfg.OpenBackend()
+	if err != nil {
+		return &configError{operationalError{"opening backend", err}}
+	}
+	results := compareModels(ctx, client, cfg, actualQuery, opts)
+	if err := writeComparison(out, results); err != nil {
+		return &operationalError{"writing comparison", err}
+	}
+
+	reportPath := opts.Report
+	if reportPath == "" {
+		reportPath = fmt.Sprintf("marvin-compare-%s.md", time.Now().Format("20060102-150405"))
+	}
+	if err := saveComparison(reportPath, actualQuery, results); err != nil {
+		return &operationalError{"saving comparison report", err}
+	}
+	slog.Info("saved comparison report", logging.Component, "compare", "path", reportPath)
+
+	var failures []error
+	for _, result := range results {
+		if result.run.err != nil {
+			failures = append(failures, fmt.Errorf("%s: %w", result.model, result.run.err))
+		}
+	}
+	if len(failures) > 0 {
+		return &operationalError{fmt.Sprintf("%d of %d models failed", len(failures), len(results)), errors.Join(failures...)}
+	}
+	return nil
+}
+
+// compareModels runs the query against each model one after another, so the models do not compete for the backend.
+// Each model is given a toolset of its own.
+func compareModels(ctx context.Context, client backend.Backend, cfg *config.File, actualQuery string, opts *CompareOptions) []*modelComparison {
+	chatOpts := &ChatOptions{Limits: opts.Limits, Ollama: opts.Ollama, ResponseFormat: opts.ResponseFormat}
+	results := make([]*modelComparison, 0, len(opts.Models))
+	for i, model := range opts.Models {
+		slog.Info(fmt.Sprintf("running %s %d/%d", model, i+1, len(opts.Models)), logging.Component, "compare")
+		modelConfig := config.File{}
+		if cfg != nil {
+			modelConfig = *cfg
+		}
+		modelConfig.Model = model
+		results = append(results, &modelComparison{
+			model: model,
+			run:   runPrompt(ctx, client, &modelConfig, chatOpts, actualQuery),
+		})
+	}
+	return results
+}
@@ -0,0 +1,155 @@
+package query
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+)
+
+// writeComparison writes a table of the latency and usage of each model followed by each model's tool calls and answer
+func writeComparison(out io.Writer, results []*modelComparison) error {
+	table := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "MODEL\tTIME\tTURNS\tTOOL CALLS\tPROMPT TOKENS\tRESPONSE TOKENS\tRESULT")
+	for _, result := range results {
+		run := result.run
+		fmt.Fprintf(table, "%s\t%s\t%d\t%d\t%d\t%d\t%s\n", result.model, formatLatency(run), run.turns, len(run.calls),
+			run.promptTokens, run.responseTokens, comparisonVerdict(run))
+	}
+	if err := table.Flush(); err != nil {
+		return err
+	}
+	for _, result := range results {
+		if _, err := fmt.Fprintf(out, "\n=== %s ===\n", result.model); err != nil {
+			return err
+		}
+		for i, traced := range result.run.calls {
+			fmt.Fprintf(out, "call %d> %s\n", i+1, describeTracedCall(traced))
+		}
+		if result.run.err != nil {
+			fmt.Fprintf(out, "error: %s\n", result.run.err)
+		}
+		if _, err := fmt.Fprintln(out, strings.TrimSpace(result.run.answer)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func formatLatency(run *promptRun) string {
+	return fmt.Sprintf("%.1fs", run.duration.Seconds())
+}
+
+func comparisonVerdict(run *promptRun) string {
+	if run.err != nil {
+		return "ERROR"
+	}
+	return "ok"
+}
+
+func describeTracedCall(traced tracedCall) string {
+	description := fmt.Sprintf("%s %s", traced.call.Function.Name, brief(traced.call.Function.Arguments))
+	if traced.err != "" {
+		description += " failed: " + traced.err
+	}
+	return description
+}
+
+// comparisonReport is the saved form of a comparison
+type comparisonReport struct {
+	Query  string          `json:"query"`
+	Models []comparedModel `json:"models"`
+}
+
+type comparedModel struct {
+	Model          string         `json:"model"`
+	Answer         string         `json:"answer"`
+	ToolCalls      []comparedCall `json:"tool_calls,omitempty"`
+	Turns          int            `json:"turns"`
+	PromptTokens   int            `json:"prompt_tokens"`
+	ResponseTokens int            `json:"response_tokens"`
+	Seconds        float64        `json:"seconds"`
+	Error          string         `json:"error,omitempty"`
+}
+
+type comparedCall struct {
+	Name      string         `json:"name"`
+	Arguments map[string]any `json:"arguments,omitempty"`
+	Error     string         `json:"error,omitempty"`
+}
+
+func newComparisonReport(actualQuery string, results []*modelComparison) *comparisonReport {
+	report := &comparisonReport{Query: actualQuery}
+	for _, result := range results {
+		run := result.run
+		compared := comparedModel{
+			Model:          result.model,
+			Answer:         run.answer,
+			Turns:          run.turns,
+			PromptTokens:   run.promptTokens,
+			ResponseTokens: run.responseTokens,
+			Seconds:        run.duration.Seconds(),
+		}
+		for _, traced := range run.calls {
+			compared.ToolCalls = append(compared.ToolCalls, comparedCall{Name: traced.call.Function.Name, Arguments: traced.call.Function.Arguments, Error: traced.err})
+		}
+		if run.err != nil {
+			compared.Error = run.err.Error()
+		}
+		report.Models = append(report.Models, compared)
+	}
+	return report
+}
+
+// saveComparison writes the comparison to path as JSON when the path ends with .json and as Markdown otherwise
+func saveComparison(path string, actualQuery string, results []*modelComparison) error {
+	report := newComparisonReport(actualQuery, results)
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		encoded, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return err
+		}
+		return os.WriteFile(path, append(encoded, '\n'), 0o644)
+	}
+	return os.WriteFile(path, []byte(report.markdown()), 0o644)
+}
+
+func (c *comparisonReport) markdown() string {
+	var out strings.Builder
+	fmt.Fprintf(&out, "# Model comparison\n\n%s\n\n", quoteMarkdown(c.Query))
+	out.WriteString("| Model | Time | Turns | Tool calls | Prompt tokens | Response tokens | Result |\n")
+	out.WriteString("|---|---|---|---|---|---|---|\n")
+	for _, m := range c.Models {
+		result := "ok"
+		if m.Error != "" {
+			result = "error"
+		}
+		fmt.Fprintf(&out, "| %s | %.1fs | %d | %d | %d | %d | %s |\n", m.Model, m.Seconds, m.Turns, len(m.ToolCalls), m.PromptTokens, m.ResponseTokens, result)
+	}
+	for _, m := range c.Models {
+		fmt.Fprintf(&out, "\n## %s\n", m.Model)
+		if m.Error != "" {
+			fmt.Fprintf(&out, "\n**Error:** %s\n", m.Error)
+		}
+		if len(m.ToolCalls) > 0 {
+			out.WriteString("\n### Tool calls\n\n")
+			for i, call := range m.ToolCalls {
+				fmt.Fprintf(&out, "%d. `%s` `%s`", i+1, call.Name, brief(call.Arguments))
+				if call.Error != "" {
+					fmt.Fprintf(&out, " failed: %s", call.Error)
+				}
+				out.WriteString("\n")
+			}
+		}
+		fmt.Fprintf(&out, "\n### Answer\n\n%s\n", strings.TrimSpace(m.Answer))
+	}
+	return out.String()
+}
+
+// quoteMarkdown renders text as a Markdown block quote
+func quoteMarkdown(text string) string {
+	return "> " + strings.ReplaceAll(strings.TrimSpace(text), "\n", "\n> ")
+}
@@ -0,0 +1,96 @@
+package query
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"regexp"
+	"testing"
+
+	"github.com/meschbach/marvin/internal/backend"
+	"github.com/meschbach/marvin/internal/config"
+	"github.com/ollama/ollama/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompareModels_RunsEachModel(t *testing.T) {
+	script := backend.NewScripted(
+		// the first model calls a tool, which is not available, before answering
+		backend.ScriptedReply{ToolCalls: []api.ToolCall{backend.ToolCall("1", "time.now", map[string]any{"zone": "UTC"})}, PromptTokens: 10, ResponseTokens: 4},
+		backend.ScriptedReply{Parts: []string{"It is noon."}, PromptTokens: 20, ResponseTokens: 3},
+		// the second answers straight away
+		backend.ScriptedReply{Parts: []string{"I do not know."}, PromptTokens: 8, ResponseTokens: 5},
+	)
+	cfg := &config.File{Model: "configured"}
+
+	results := compareModels(context.Background(), script, cfg, "What time is it?", &CompareOptions{Models: []string{"small", "large"}})
+	require.Len(t, results, 2)
+	assert.Equal(t, 0, script.Remaining())
+	var models []string
+	for _, req := range script.Requests() {
+		models = append(models, req.Model)
+	}
+	assert.Equal(t, []string{"small", "small", "large"}, models)
+	assert.Equal(t, "configured", cfg.Model, "the configuration is not changed")
+
+	small := results[0].run
+	require.NoError(t, small.err)
+	assert.Equal(t, "It is noon.", small.answer)
+	assert.Equal(t, 2, small.turns)
+	assert.Equal(t, 30, small.promptTokens)
+	assert.Equal(t, 7, small.responseTokens)
+	require.Len(t, small.calls, 1)
+	assert.Equal(t, "time.now", small.calls[0].call.Function.Name)
+	assert.Equal(t, "I do not know.", results[1].run.answer)
+
+	var out bytes.Buffer
+	require.NoError(t, writeComparison(&out, results))
+	assert.Regexp(t, regexp.MustCompile(`(?m)^MODEL\s+TIME\s+TURNS\s+TOOL CALLS\s+PROMPT TOKENS\s+RESPONSE TOKENS\s+RESULT$`), out.String())
+	assert.Regexp(t, regexp.MustCompile(`(?m)^small\s+\d+\.\ds\s+2\s+1\s+30\s+7\s+ok$`), out.String())
+	assert.Regexp(t, regexp.MustCompile(`(?m)^large\s+\d+\.\ds\s+1\s+0\s+8\s+5\s+ok$`), out.String())
+	assert.Contains(t, out.String(), "=== small ===\ncall 1> time.now {\"zone\":\"UTC\"}\nIt is noon.\n")
+	assert.Contains(t, out.String(), "=== large ===\nI do not know.\n")
+}
+
+func TestSaveComparison(t *testing.T) {
+	results := []*modelComparison{
+		{model: "small", run: &promptRun{answer: "noon", turns: 1, promptTokens: 3, responseTokens: 1}},
+		{model: "large", run: &promptRun{err: assert.AnError}},
+	}
+	dir := t.TempDir()
+
+	markdownPath := filepath.Join(dir, "report.md")
+	require.NoError(t, saveComparison(markdownPath, "What time is it?", results))
+	markdown, err := os.ReadFile(markdownPath)
+	require.NoError(t, err)
+	assert.Contains(t, string(markdown), "> What time is it?")
+	assert.Contains(t, string(markdown), "| small | 0.0s | 1 | 0 | 3 | 1 | ok |")
+	assert.Contains(t, string(markdown), "## large\n\n**Error:** "+assert.AnError.Error())
+
+	jsonPath := filepath.Join(dir, "report.json")
+	require.NoError(t, saveComparison(jsonPath, "What time is it?", results))
+	encoded, err := os.ReadFile(jsonPath)
+	require.NoError(t, err)
+	var report comparisonReport
+	require.NoError(t, json.Unmarshal(encoded, &report))
+	assert.Equal(t, "What time is it?", report.Query)
+	require.Len(t, report.Models, 2)
+	assert.Equal(t, "noon", report.Models[0].Answer)
+	assert.Equal(t, assert.AnError.Error(), report.Models[1].Error)
+}
+
+func TestPromptTrace_RecordsFailedCalls(t *testing.T) {
+	trace := &promptTrace{}
+	call := backend.ToolCall("1", "mail.search", map[string]any{"query": "bob"})
+	trace.emit(toolCallEvent(call))
+	trace.emit(Event{Type: EventToolResult, ToolCallID: "1", ToolName: "mail.search", Error: "connection refused"})
+	trace.emit(Event{Type: EventUsage})
+
+	calls, turns := trace.summary()
+	assert.Equal(t, 1, turns)
+	require.Len(t, calls, 1)
+	assert.Equal(t, "mail.search {\"query\":\"bob\"} failed: connection refused", describeTracedCall(calls[0]))
+}
@@ -0,0 +1,212 @@
+package query
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/meschbach/marvin/internal/backend"
+	"github.com/meschbach/marvin/internal/config"
+	"github.com/ollama/ollama/api"
+)
+
+// defaultContextWindow is assumed when neither the configuration nor the backend specifies the context window
+const defaultContextWindow = 4096
+
+// charsPerToken is a rough average for English text and JSON across common tokenizers
+const charsPerToken = 4
+
+// messageOverheadTokens accounts for role markers and template framing of each message
+const messageOverheadTokens = 4
+
+const droppedToolResultContent = "[tool result removed to conserve context]"
+
+// estimateTokens approximates the number of tokens a message occupies within the prompt
+func estimateTokens(m api.Message) int {
+	chars := len(m.Content) + len(m.Thinking)
+	for _, call := range m.ToolCalls {
+		chars += len(callSignature(call))
+	}
+	return chars/charsPerToken + messageOverheadTokens
+}
+
+// estimatePromptTokens approximates the size of a request consisting of the messages and tool definitions
+func estimatePromptTokens(messages []api.Message, tools api.Tools) int {
+	total := 0
+	for _, m := range messages {
+		total += estimateTokens(m)
+	}
+	if len(tools) > 0 {
+		if encoded, err := json.Marshal(tools); err == nil {
+			total += len(encoded) / charsPerToken
+		}
+	}
+	return total
+}
+
+// contextManager compacts a conversation history once it approaches the context window of the model
+type contextManager struct {
+	client    backend.Backend
+	strategy  string
+	threshold float64
+	keep      int
+	numCtx    int
+	options   *config.OllamaOptionsBlock
+	// windows caches the context window discovered for each model
+	windows map[string]int
+}
+
+// newContextManager creates a manager from the configuration.  Without configuration no compaction is performed and
+// nil is returned.  The generation options are used when summarizing and provide num_ctx when not configured.
+func newContextManager(client backend.Backend, cfg *config.ContextBlock, options *config.OllamaOptionsBlock) (*contextManager, error) {
+	if cfg == nil {
+		return nil, nil
+	}
+	strategy, err := cfg.ResolveStrategy()
+	if err != nil {
+		return nil, &configError{operationalError{"context", err}}
+	}
+	numCtx := cfg.NumCtx
+	if numCtx == 0 && options != nil && options.NumCtx != nil {
+		numCtx = *options.NumCtx
+	}
+	return &contextManager{
+		client:    client,
+		strategy:  strategy,
+		threshold: cfg.ResolveThreshold(),
+		keep:      cfg.ResolveKeepRecent(),
+		numCtx:    numCtx,
+		options:   options,
+		windows:   map[string]int{},
+	}, nil
+}
+
+// contextWindow determines the effective num_ctx of the model.  An explicitly configured size wins, otherwise the
+// backend is asked for the context window of the model.
+func (c *contextManager) contextWindow(ctx context.Context, model string) int {
+	if c.numCtx > 0 {
+		return c.numCtx
+	}
+	if window, ok := c.windows[model]; ok {
+		return window
+	}
+	window := defaultContextWindow
+	if discovered, err := c.client.ContextWindow(ctx, model); err == nil && discovered > 0 {
+		window = discovered
+	}
+	c.windows[model] = window
+	return window
+}
+
+// compactable returns the range of messages eligible for compaction.  Leading system messages carry instructions and
+// are pinned, as are the most recent messages.  The recent range never begins with a tool result so tool calls stay
+// paired with their results.
+func (c *contextManager) compactable(messages []api.Message) (start, end int) {
+	for start < len(messages) && messages[start].Role == roleSystem {
+		start++
+	}
+	end = len(messages) - c.keep
+	for end > start && messages[end].Role == roleTool {
+		end--
+	}
+	if end < start {
+		end = start
+	}
+	return start, end
+}
+
+// manage compacts the prompt of the conversation when its estimate exceeds the threshold of the context window.  The
+// history of the conversation is left intact.
+func (c *contextManager) manage(ctx context.Context, o *ollamaConversation, model string, tools api.Tools) error {
+	if c == nil {
+		return nil
+	}
+	window := c.contextWindow(ctx, model)
+	limit := int(float64(window) * c.threshold)
+	prompt := o.prompt()
+	before := estimatePromptTokens(prompt, tools)
+	if before <= limit {
+		return nil
+	}
+	start, end := c.compactable(prompt)
+	if start == end {
+		o.events.emit(noticeEvent("context", "estimated %d of %d tokens but no messages are eligible for compaction", before, window))
+		return nil
+	}
+
+	var compacted []api.Message
+	switch c.strategy {
+	case config.CompactionSummarize:
+		summary, err := c.summarize(ctx, model, prompt[start:end])
+		if err != nil {
+			return &operationalError{"summarizing conversation", err}
+		}
+		compacted = append(compacted, prompt[:start]...)
+		compacted = append(compacted, api.Message{Role: roleSystem, Content: "Summary of the earlier conversation:\n" + summary})
+		compacted = append(compacted, prompt[end:]...)
+	case config.CompactionSlidingWindow:
+		compacted = slideWindow(prompt, start, end, limit, tools)
+	default:
+		compacted = dropToolResults(prompt, start, end)
+	}
+	o.compacted = compacted
+	o.compactedThrough = len(o.messages)
+	o.events.emit(noticeEvent("context", "compacted via %s from an estimated %d to %d of %d tokens", c.strategy, before, estimatePromptTokens(compacted, tools), window))
+	return nil
+}
+
+// dropToolResults replaces the content of tool results within [start, end) with a placeholder
+func dropToolResults(messages []api.Message, start, end int) []api.Message {
+	out := append([]api.Message(nil), messages...)
+	for i := start; i < end; i++ {
+		if out[i].Role == roleTool && out[i].Content != droppedToolResultContent {
+			out[i].Content = droppedToolResultContent
+		}
+	}
+	return out
+}
+
+// slideWindow forgets the oldest messages within [start, end) until the estimate fits within limit.  Tool results are
+// forgotten along with the call which produced them.
+func slideWindow(messages []api.Message, start, end, limit int, tools api.Tools) []api.Message {
+	cut := start
+	for cut < end && estimatePromptTokens(append(append([]api.Message(nil), messages[:start]...), messages[cut:]...), tools) > limit {
+		cut++
+		for cut < end && messages[cut].Role == roleTool {
+			cut++
+		}
+	}
+	out := append([]api.Message(nil), messages[:start]...)
+	return append(out, messages[cut:]...)
+}
+
+// summarize asks the model to condense the given messages into a summary retaining the facts needed to continue
+func (c *contextManager) summarize(ctx context.Context, model string, messages []api.Message) (string, error) {
+	var transcript strings.Builder
+	for _, m := range messages {
+		fmt.Fprintf(&transcript, "%s: %s\n", m.Role, m.Content)
+		for _, call := range m.ToolCalls {
+			fmt.Fprintf(&transcript, "%s called tool %s\n", m.Role, callSignature(call))
+		}
+	}
+	req := &api.ChatRequest{
+		Model: model,
+		Messages: []api.Message{
+			{Role: roleSystem, Content: "Summarize the following conversation between a user, an assistant and its tools.  Retain every fact, decision, identifier and tool result needed to continue the conversation.  Respond with the summary only."},
+			{Role: roleUser, Content: transcript.String()},
+		},
+	}
+	if err := c.options.ApplyToChat(req); err != nil {
+		return "", err
+	}
+	var summary strings.Builder
+	err := c.client.Chat(ctx, req, func(resp api.ChatResponse) error {
+		summary.WriteString(resp.Message.Content)
+		return nil
+	})
+	if err != nil {
+		return "", backendError("requesting summary", model, err)
+	}
+	return summary.String(), nil
+}
@@ -0,0 +1,118 @@
+package query
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/meschbach/marvin/internal/backend"
+	"github.com/meschbach/marvin/internal/config"
+	"github.com/ollama/ollama/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func compactionTestConversation() *ollamaConversation {
+	large := strings.Repeat("x", 4000)
+	call := api.ToolCall{ID: "1", Function: api.ToolCallFunction{Name: "mail.read"}}
+	return &ollamaConversation{events: &recordedEvents{}, messages: []api.Message{
+		{Role: roleSystem, Content: "instructions"},
+		{Role: roleUser, Content: "first question"},
+		{Role: roleAssistant, ToolCalls: []api.ToolCall{call}},
+		toolResponseMessage(call, large),
+		{Role: roleAssistant, Content: "first answer"},
+		{Role: roleUser, Content: "second question"},
+		{Role: roleAssistant, Content: "second answer"},
+	}}
+}
+
+func TestContextManager_DisabledWithoutConfig(t *testing.T) {
+	manager, err := newContextManager(nil, nil, nil)
+	require.NoError(t, err)
+	conversation := compactionTestConversation()
+	require.NoError(t, manager.manage(context.Background(), conversation, "model", nil))
+	assert.Len(t, conversation.messages, 7)
+}
+
+func TestContextManager_UnderThreshold(t *testing.T) {
+	manager, err := newContextManager(nil, &config.ContextBlock{NumCtx: 100000, KeepRecent: 2}, nil)
+	require.NoError(t, err)
+	conversation := compactionTestConversation()
+	require.NoError(t, manager.manage(context.Background(), conversation, "model", nil))
+	assert.Len(t, conversation.prompt()[3].Content, 4000)
+}
+
+func TestContextManager_DropToolResults(t *testing.T) {
+	manager, err := newContextManager(nil, &config.ContextBlock{NumCtx: 1000, KeepRecent: 2}, nil)
+	require.NoError(t, err)
+	conversation := compactionTestConversation()
+	require.NoError(t, manager.manage(context.Background(), conversation, "model", nil))
+	prompt := conversation.prompt()
+	require.Len(t, prompt, 7)
+	assert.Equal(t, droppedToolResultContent, prompt[3].Content)
+	assert.Equal(t, "first answer", prompt[4].Content)
+	assert.Len(t, conversation.messages[3].Content, 4000, "the history keeps the tool result")
+	events := conversation.events.(*recordedEvents).events
+	require.Len(t, events, 1)
+	assert.Equal(t, "context", events[0].Source)
+}
+
+func TestContextManager_SlidingWindowKeepsToolPairs(t *testing.T) {
+	manager, err := newContextManager(nil, &config.ContextBlock{NumCtx: 1000, KeepRecent: 2, Strategy: config.CompactionSlidingWindow}, nil)
+	require.NoError(t, err)
+	conversation := compactionTestConversation()
+	require.NoError(t, manager.manage(context.Background(), conversation, "model", nil))
+	prompt := conversation.prompt()
+	for _, m := range prompt {
+		assert.NotEqual(t, roleTool, m.Role, "tool results must be forgotten with their call")
+	}
+	assert.Equal(t, "instructions", prompt[0].Content)
+	assert.Equal(t, "second answer", prompt[len(prompt)-1].Content)
+	assert.Len(t, conversation.messages, 7, "the history keeps every message")
+}
+
+func TestContextManager_CheckpointsTheFullHistory(t *testing.T) {
+	manager, err := newContextManager(nil, &config.ContextBlock{NumCtx: 1000, KeepRecent: 2}, nil)
+	require.NoError(t, err)
+	script := backend.NewScripted(backend.Reply("third answer"))
+	conversation := compactionTestConversation()
+	conversation.client = script
+	conversation.contextWindow = manager
+	var checkpointed []api.Message
+	conversation.checkpoint = func(model string, messages []api.Message) error {
+		checkpointed = append([]api.Message(nil), messages...)
+		return nil
+	}
+	conversation.messages = append(conversation.messages, api.Message{Role: roleUser, Content: "third question"})
+
+	require.NoError(t, conversation.runAIToConclusion(context.Background(), "model", nil))
+
+	requests := script.Requests()
+	require.Len(t, requests, 1)
+	assert.Equal(t, droppedToolResultContent, requests[0].Messages[3].Content, "the model is sent the compacted prompt")
+	assert.Equal(t, "third question", requests[0].Messages[7].Content)
+	require.Len(t, checkpointed, 9)
+	assert.Len(t, checkpointed[3].Content, 4000, "the session persists the full history")
+	assert.Equal(t, "third answer", checkpointed[8].Content)
+}
+
+func TestContextManager_RecentToolResultsProtected(t *testing.T) {
+	manager, err := newContextManager(nil, &config.ContextBlock{NumCtx: 100, KeepRecent: 4}, nil)
+	require.NoError(t, err)
+	conversation := compactionTestConversation()
+	start, end := manager.compactable(conversation.messages)
+	assert.Equal(t, 1, start)
+	assert.Equal(t, 2, end, "the boundary moves before the call whose result would otherwise be split")
+}
+
+func TestContextManager_RejectsUnknownStrategy(t *testing.T) {
+	_, err := newContextManager(nil, &config.ContextBlock{Strategy: "forget_everything"}, nil)
+	assert.Error(t, err)
+}
+
+func TestContextManager_NumCtxFromOptions(t *testing.T) {
+	numCtx := 2048
+	manager, err := newContextManager(nil, &config.ContextBlock{}, &config.OllamaOptionsBlock{NumCtx: &numCtx})
+	require.NoError(t, err)
+	assert.Equal(t, 2048, manager.contextWindow(context.Background(), "model"))
+}
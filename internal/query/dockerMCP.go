@@ -6,6 +6,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"strings"
 	"time"
 
@@ -14,14 +15,17 @@ import (
 	dockerclient "github.com/docker/docker/client"
 	"github.com/docker/docker/pkg/stdcopy"
 	"github.com/mark3labs/mcp-go/client/transport"
+	"github.com/meschbach/marvin/internal/cassette"
 	"github.com/meschbach/marvin/internal/config"
+	"github.com/meschbach/marvin/internal/logging"
 )
 
 func FromDockerSpec(cfg *config.DockerMCPBlock) *Mark3labsTool {
 	spec := &dockerRuntimeSpec{cfg: cfg}
 	return &Mark3labsTool{
-		Name: cfg.Name,
-		spec: spec,
+		Name:   cfg.Name,
+		spec:   spec,
+		serial: cfg.Serial,
 	}
 }
 
@@ -30,7 +34,7 @@ type dockerRuntimeSpec struct {
 }
 
 func (d *dockerRuntimeSpec) start(ctx context.Context) (program runningProgram, problem error) {
-	verbose := d.cfg.ResolveVerbose()
+	logger := slog.With(logging.Component, "docker-"+d.cfg.Name)
 	cli, err := dockerclient.NewClientWithOpts(dockerclient.FromEnv, dockerclient.WithAPIVersionNegotiation())
 	if err != nil {
 		return nil, &operationalError{"failed to create docker client", err}
@@ -47,7 +51,7 @@ func (d *dockerRuntimeSpec) start(ctx context.Context) (program runningProgram,
 	_, _, err = cli.ImageInspectWithRaw(ctx, d.cfg.Image)
 	if err != nil {
 		if dockerclient.IsErrNotFound(err) {
-			fmt.Printf("Pulling image %s...\n", d.cfg.Image)
+			logger.Info("pulling image", "image", d.cfg.Image)
 			pullOut, err := cli.ImagePull(ctx, d.cfg.Image, image.PullOptions{})
 			if err != nil {
 				return nil, &operationalError{"failed to pull docker image", err}
@@ -77,9 +81,7 @@ func (d *dockerRuntimeSpec) start(ctx context.Context) (program runningProgram,
 		}
 
 		spec := fmt.Sprintf("%s=%s", key, value)
-		if verbose {
-			fmt.Printf("docker-%s >{env} %s\n", d.cfg.Name, spec)
-		}
+		logger.Debug("setting environment", "key", key)
 		envs = append(envs, spec)
 	}
 
@@ -101,10 +103,7 @@ func (d *dockerRuntimeSpec) start(ctx context.Context) (program runningProgram,
 		containerArgs = append(containerArgs, a.Strings...)
 	}
 
-	if verbose {
-		dockerArgs := strings.Join(containerArgs, " ")
-		fmt.Printf("docker-%s > `docker run --rm -i %s %s`\n", d.cfg.Name, d.cfg.Image, dockerArgs)
-	}
+	logger.Debug(fmt.Sprintf("`docker run --rm -i %s %s`", d.cfg.Image, strings.Join(containerArgs, " ")))
 
 	createContainerReply, err := cli.ContainerCreate(ctx, &container.Config{
 		Image:     d.cfg.Image,
@@ -151,10 +150,10 @@ func (d *dockerRuntimeSpec) start(ctx context.Context) (program runningProgram,
 
 	go func() {
 		close(startedStderrPump) //todo: very bad practice
-		if verbose {
+		if logging.DebugEnabled(ctx) {
 			scanner := bufio.NewScanner(stderrReader)
 			for scanner.Scan() {
-				fmt.Printf("docker-%s >{stderr} %s\n", d.cfg.Name, scanner.Text())
+				logger.Debug(scanner.Text(), "stream", "stderr")
 			}
 			//todo: handle errors.
 		} else {
@@ -165,8 +164,7 @@ func (d *dockerRuntimeSpec) start(ctx context.Context) (program runningProgram,
 
 	bridge := transport.NewIO(stdoutReader, attach.Conn, stderrReader)
 	return &dockerContainer{
-		name:         d.cfg.Name,
-		verbose:      verbose,
+		logger:       logger,
 		bridge:       bridge,
 		dockerClient: cli,
 		containerID:  createContainerReply.ID,
@@ -174,8 +172,7 @@ func (d *dockerRuntimeSpec) start(ctx context.Context) (program runningProgram,
 }
 
 type dockerContainer struct {
-	verbose      bool
-	name         string
+	logger       *slog.Logger
 	bridge       transport.Interface
 	dockerClient *dockerclient.Client
 	containerID  string
@@ -186,35 +183,26 @@ func (d dockerContainer) transport() transport.Interface {
 }
 
 func (d dockerContainer) stop(ctx context.Context) (problem error) {
-	if d.verbose {
-		fmt.Printf("docker-%s > Shutting down container...\n", d.name)
-	}
-	if d.verbose {
-		defer func() {
-			if problem != nil {
-				fmt.Printf("docker-%s > Shut down with errors %s.\n", d.name, problem.Error())
-			} else {
-				fmt.Printf("docker-%s > Shut down complete with no errors.\n", d.name)
-			}
-		}()
-	}
-	verbose := d.verbose
+	d.logger.Debug("shutting down container")
+	defer func() {
+		if problem != nil {
+			d.logger.Debug("shut down with errors", "error", problem)
+		} else {
+			d.logger.Debug("shut down complete with no errors")
+		}
+	}()
 	stopCtx, cancel := context.WithTimeout(ctx, 15*time.Second)
 	defer cancel()
 
 	// Stop and remove the container
 	stopTimeout := 10
-	if d.verbose {
-		fmt.Printf("docker-%s > Stopping container...\n", d.name)
-	}
+	d.logger.Debug("stopping container")
 	if err := d.dockerClient.ContainerStop(stopCtx, d.containerID, container.StopOptions{Timeout: &stopTimeout}); err != nil {
 		problem = errors.Join(problem, &operationalError{"failed to stop container", err})
 	}
 
 	//Ensure the container is removed.
-	if d.verbose {
-		fmt.Printf("docker-%s > Stopped.  Ensuring container is removed...\n", d.name)
-	}
+	d.logger.Debug("stopped, ensuring container is removed")
 	containers, err := d.dockerClient.ContainerList(stopCtx, container.ListOptions{})
 	if err != nil {
 		problem = errors.Join(problem, &operationalError{"failed to list containers", err})
@@ -222,9 +210,7 @@ func (d dockerContainer) stop(ctx context.Context) (problem error) {
 		for _, c := range containers {
 			if c.ID == d.containerID {
 				if err := d.dockerClient.ContainerRemove(stopCtx, d.containerID, container.RemoveOptions{Force: true}); err != nil {
-					if verbose {
-						fmt.Printf("(normal) Docker reported container removal error which is normal after stop for a conflict.  Please confirm %s\n", err.Error())
-					}
+					d.logger.Debug("(normal) Docker reported container removal error which is normal after stop for a conflict", "error", err)
 				}
 			}
 		}
@@ -235,15 +221,17 @@ func (d dockerContainer) stop(ctx context.Context) (problem error) {
 	return nil
 }
 
-func (ts *ToolSet) loadToolsFromDocker(ctx context.Context, cfg *config.File) (problem error) {
+func (ts *ToolSet) loadToolsFromDocker(ctx context.Context, cfg *config.File, traffic *cassette.Deck) (problem error) {
 	for _, mcpCfg := range cfg.DockerMCPBlock {
-		tool := FromDockerSpec(mcpCfg)
-		ts.container.Register(tool)
+		tool := ts.servers.use(mcpCfg.Name, func() *Mark3labsTool {
+			tool := FromDockerSpec(mcpCfg)
+			tool.sampler = newMCPSampler(mcpCfg.Name, mcpCfg.Sampling, cfg, traffic)
+			tool.elicitor = ts.elicitation.forServer(mcpCfg.Name)
+			tool.recordTo(traffic)
+			return tool
+		})
 		if err := ts.registerTool(ctx, tool); err != nil {
-			return &operationalError{
-				description: fmt.Sprintf("failed to register %s", mcpCfg.Name),
-				underlying:  err,
-			}
+			return &toolStartupError{name: mcpCfg.Name, underlying: err}
 		}
 	}
 	return problem
@@ -0,0 +1,146 @@
+package query
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+
+	"github.com/meschbach/marvin/internal/config"
+	"github.com/ollama/ollama/api"
+)
+
+// Exit codes reported by marvin for each kind of failure
+const (
+	ExitSuccess            = 0
+	ExitFailure            = 1
+	ExitConfig             = 2
+	ExitBackendUnreachable = 3
+	ExitModelMissing       = 4
+	ExitToolStartup        = 5
+	ExitToolInvocation     = 6
+	ExitBudgetExceeded     = 7
+)
+
+// exitCoder is implemented by errors with a distinct exit code
+type exitCoder interface {
+	exitCode() int
+}
+
+// ExitCode maps the error to the exit code of the process
+func ExitCode(err error) int {
+	if err == nil {
+		return ExitSuccess
+	}
+	var coder exitCoder
+	if errors.As(err, &coder) {
+		return coder.exitCode()
+	}
+	var loadError *config.LoadError
+	if errors.As(err, &loadError) {
+		return ExitConfig
+	}
+	return ExitFailure
+}
+
+// configError is an invalid configuration or command line option
+type configError struct {
+	operationalError
+}
+
+func (c *configError) exitCode() int { return ExitConfig }
+
+// backendUnreachableError indicates the model backend could not be contacted
+type backendUnreachableError struct {
+	operationalError
+}
+
+func (b *backendUnreachableError) exitCode() int { return ExitBackendUnreachable }
+
+// modelMissingError indicates the backend does not have the requested model
+type modelMissingError struct {
+	model      string
+	underlying error
+}
+
+func (m *modelMissingError) Error() string {
+	if m.model == "" {
+		return fmt.Sprintf("model is not available: %s", m.underlying.Error())
+	}
+	return fmt.Sprintf("model %q is not available: %s", m.model, m.underlying.Error())
+}
+
+func (m *modelMissingError) Unwrap() error { return m.underlying }
+
+func (m *modelMissingError) exitCode() int { return ExitModelMissing }
+
+// toolStartupError indicates a tool could not be started or its API discovered
+type toolStartupError struct {
+	name       string
+	underlying error
+}
+
+func (t *toolStartupError) Error() string {
+	return fmt.Sprintf("failed to start tool %q: %s", t.name, t.underlying.Error())
+}
+
+func (t *toolStartupError) Unwrap() error { return t.underlying }
+
+func (t *toolStartupError) exitCode() int { return ExitToolStartup }
+
+func (l *localProgramDiscoveryError) exitCode() int { return ExitToolStartup }
+
+// toolInvocationError indicates one or more tool calls failed
+type toolInvocationError struct {
+	operationalError
+}
+
+func (t *toolInvocationError) exitCode() int { return ExitToolInvocation }
+
+// budgetExceededError indicates the conversation was concluded early because a limit was reached
+type budgetExceededError struct {
+	reason string
+}
+
+func (b *budgetExceededError) Error() string {
+	return fmt.Sprintf("budget exceeded: %s", b.reason)
+}
+
+func (b *budgetExceededError) exitCode() int { return ExitBudgetExceeded }
+
+// backendError classifies a failure talking to the backend as unreachable or a missing model where possible
+func backendError(description, model string, err error) error {
+	var status api.StatusError
+	if errors.As(err, &status) && status.StatusCode == http.StatusNotFound {
+		return &modelMissingError{model: model, underlying: err}
+	}
+	var urlError *url.Error
+	var netError *net.OpError
+	if errors.As(err, &urlError) || errors.As(err, &netError) {
+		return &backendUnreachableError{operationalError{description, err}}
+	}
+	return &operationalError{description, err}
+}
+
+// reportedError marks an error which has already been presented through the events of a command
+type reportedError struct {
+	error
+}
+
+func (r *reportedError) Unwrap() error { return r.error }
+
+// Reported is true when the error has already been presented to the user
+func Reported(err error) bool {
+	var reported *reportedError
+	return errors.As(err, &reported)
+}
+
+// report emits the error through the events of the command and marks it as reported
+func report(events eventSink, err error) error {
+	if err == nil || Reported(err) {
+		return err
+	}
+	events.emit(errorEvent(err))
+	return &reportedError{err}
+}
@@ -0,0 +1,65 @@
+package query
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/meschbach/marvin/internal/config"
+	"github.com/ollama/ollama/api"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExitCode(t *testing.T) {
+	cause := errors.New("cause")
+	for name, example := range map[string]struct {
+		err      error
+		expected int
+	}{
+		"success":           {nil, ExitSuccess},
+		"unclassified":      {cause, ExitFailure},
+		"config file":       {&config.LoadError{Path: ".marvin.hcl", Underlying: cause}, ExitConfig},
+		"config option":     {&configError{operationalError{"output", cause}}, ExitConfig},
+		"model missing":     {&modelMissingError{"llama", cause}, ExitModelMissing},
+		"local program":     {&localProgramDiscoveryError{"mail", cause}, ExitToolStartup},
+		"tool startup":      {&operationalError{"initializing tools", &toolStartupError{"time", cause}}, ExitToolStartup},
+		"tool invocation":   {&toolInvocationError{operationalError{"invoking tools", cause}}, ExitToolInvocation},
+		"budget exceeded":   {fmt.Errorf("turn: %w", &budgetExceededError{"max turns"}), ExitBudgetExceeded},
+		"reported":          {&reportedError{&budgetExceededError{"max turns"}}, ExitBudgetExceeded},
+		"joined with cause": {errors.Join(&toolStartupError{"time", cause}, &operationalError{"shutting down tools", cause}), ExitToolStartup},
+	} {
+		t.Run(name, func(t *testing.T) {
+			assert.Equal(t, example.expected, ExitCode(example.err))
+		})
+	}
+}
+
+func TestBackendError_Classifies(t *testing.T) {
+	unreachable := backendError("querying", "llama", &url.Error{Op: "Post", URL: "http://127.0.0.1:11434/api/chat", Err: errors.New("connection refused")})
+	assert.Equal(t, ExitBackendUnreachable, ExitCode(unreachable))
+
+	missing := backendError("querying", "llama", api.StatusError{StatusCode: http.StatusNotFound, ErrorMessage: `model "llama" not found`})
+	assert.Equal(t, ExitModelMissing, ExitCode(missing))
+	assert.Contains(t, missing.Error(), `"llama"`)
+
+	other := backendError("querying", "llama", api.StatusError{StatusCode: http.StatusInternalServerError})
+	assert.Equal(t, ExitFailure, ExitCode(other))
+}
+
+func TestReport_EmitsOnce(t *testing.T) {
+	events := &recordedEvents{}
+	err := report(events, errors.New("boom"))
+	assert.True(t, Reported(err))
+	assert.Same(t, err, report(events, err))
+	assert.Len(t, events.events, 1)
+	assert.Nil(t, report(events, nil))
+}
+
+func TestQueryRAG_UnknownStoreIsAConfigError(t *testing.T) {
+	err := QueryRAG(context.Background(), &config.File{}, "mail", "invoices", OutputJSONL)
+	assert.ErrorContains(t, err, `no documents block with name "mail"`)
+	assert.Equal(t, ExitConfig, ExitCode(err))
+}
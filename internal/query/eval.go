@@ -0,0 +1,317 @@
+package query
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/meschbach/marvin/internal/backend"
+	"github.com/meschbach/marvin/internal/config"
+	"github.com/meschbach/marvin/internal/jsonschema"
+	"github.com/meschbach/marvin/internal/logging"
+	"github.com/ollama/ollama/api"
+)
+
+// EvalOptions controls how evaluation suites are run
+type EvalOptions struct {
+	//Runs overrides the number of times every case is run
+	Runs int
+	//JUnit is the path a JUnit XML report is written to
+	JUnit string
+}
+
+// evalFailedError reports cases which did not reach their pass rate
+type evalFailedError struct {
+	failed int
+	cases  int
+}
+
+func (e *evalFailedError) Error() string {
+	return fmt.Sprintf("%d of %d eval cases failed", e.failed, e.cases)
+}
+
+func (e *evalFailedError) exitCode() int { return ExitFailure }
+
+// PerformEval runs every case of the suites through the query pipeline, writing a table of the pass rates to out.
+// Cases without a configuration of their own are run with the one produced by defaultConfig.
+func PerformEval(ctx context.Context, suites []*config.EvalFile, defaultConfig func() (*config.File, error), out io.Writer, opts *EvalOptions) error {
+	e := &evaluator{
+		defaultConfig: defaultConfig,
+		openBackend: func(cfg *config.File) (backend.Backend, error) {
+			return cfg.OpenBackend()
+		},
+	}
+	return e.perform(ctx, suites, out, opts)
+}
+
+// evaluator runs eval cases
+type evaluator struct {
+	defaultConfig func() (*config.File, error)
+	// openBackend connects to the backend serving the models of the configuration
+	openBackend func(cfg *config.File) (backend.Backend, error)
+	// configs caches loaded configuration by path, the empty path being the default configuration
+	configs map[string]*config.File
+}
+
+func (e *evaluator) perform(ctx context.Context, suites []*config.EvalFile, out io.Writer, opts *EvalOptions) error {
+	var results []*evalCaseResult
+	for _, suite := range suites {
+		for _, c := range suite.Evals {
+			results = append(results, e.runCase(ctx, suite.Path, c, opts.Runs))
+		}
+	}
+	if err := writeEvalTable(out, results); err != nil {
+		return &operationalError{"writing eval report", err}
+	}
+	if opts.JUnit != "" {
+		if err := writeJUnitReport(opts.JUnit, results); err != nil {
+			return &operationalError{"writing JUnit report", err}
+		}
+	}
+	failed := 0
+	for _, result := range results {
+		if !result.passed() {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return &evalFailedError{failed: failed, cases: len(results)}
+	}
+	return nil
+}
+
+// config loads the configuration at path, or the default configuration when path is empty
+func (e *evaluator) config(path string) (*config.File, error) {
+	if cfg, ok := e.configs[path]; ok {
+		return cfg, nil
+	}
+	var cfg *config.File
+	var err error
+	if path == "" {
+		cfg, err = e.defaultConfig()
+	} else {
+		cfg, err = (&config.CommandLineOptions{ConfigFile: path}).Load()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if e.configs == nil {
+		e.configs = map[string]*config.File{}
+	}
+	e.configs[path] = cfg
+	return cfg, nil
+}
+
+// evalCaseResult is the outcome of every run of a case
+type evalCaseResult struct {
+	suite string
+	block *config.EvalBlock
+	runs  []*evalRun
+	// err prevented the case from being run at all
+	err error
+}
+
+func (r *evalCaseResult) passedRuns() (count int) {
+	for _, run := range r.runs {
+		if run.passed() {
+			count++
+		}
+	}
+	return count
+}
+
+func (r *evalCaseResult) passRate() float64 {
+	if len(r.runs) == 0 {
+		return 0
+	}
+	return float64(r.passedRuns()) / float64(len(r.runs))
+}
+
+func (r *evalCaseResult) passed() bool {
+	// tolerate rounding of rates such as 2/3 against a required 0.66
+	const tolerance = 1e-9
+	return r.err == nil && len(r.runs) > 0 && r.passRate()+tolerance >= r.block.ResolvePassRate()
+}
+
+func (r *evalCaseResult) duration() (total time.Duration) {
+	for _, run := range r.runs {
+		total += run.duration
+	}
+	return total
+}
+
+// evalRun is a single run of a case
+type evalRun struct {
+	answer   string
+	calls    []api.ToolCall
+	turns    int
+	tokens   int
+	duration time.Duration
+	// failures describe each assertion the run did not satisfy
+	failures []string
+}
+
+func (r *evalRun) passed() bool {
+	return len(r.failures) == 0
+}
+
+func (e *evaluator) runCase(ctx context.Context, suite string, c *config.EvalBlock, runsOverride int) *evalCaseResult {
+	result := &evalCaseResult{suite: suite, block: c}
+	cfg, err := e.config(c.Config)
+	if err != nil {
+		result.err = err
+		return result
+	}
+	expectations, err := newEvalExpectations(c)
+	if err != nil {
+		result.err = err
+		return result
+	}
+	runs := c.ResolveRuns(runsOverride)
+	for i := 0; i < runs; i++ {
+		slog.Info(fmt.Sprintf("running %s %d/%d", c.Name, i+1, runs), logging.Component, "eval")
+		run := e.runOnce(ctx, cfg, c.Prompt)
+		run.failures = append(run.failures, expectations.check(run)...)
+		result.runs = append(result.runs, run)
+	}
+	return result
+}
+
+// runOnce runs the prompt to conclusion with fresh tools, as a query would
+func (e *evaluator) runOnce(ctx context.Context, cfg *config.File, prompt string) *evalRun {
+	client, err := e.openBackend(cfg)
+	if err != nil {
+		return &evalRun{failures: []string{"run failed: " + err.Error()}}
+	}
+	outcome := runPrompt(ctx, client, cfg, &ChatOptions{}, prompt)
+	run := &evalRun{
+		answer:   outcome.answer,
+		calls:    outcome.toolCalls(),
+		turns:    outcome.turns,
+		tokens:   outcome.totalTokens(),
+		duration: outcome.duration,
+	}
+	if outcome.err != nil {
+		run.failures = append(run.failures, "run failed: "+outcome.err.Error())
+	}
+	return run
+}
+
+// evalExpectations are the assertions of a case along with the schema its answer must satisfy
+type evalExpectations struct {
+	block  *config.EvalBlock
+	schema *jsonschema.Schema
+}
+
+// newEvalExpectations loads the answer schema of the case.  The patterns of the case were compiled as it was validated.
+func newEvalExpectations(c *config.EvalBlock) (*evalExpectations, error) {
+	schema, err := loadResponseSchema(c.Answer.ResponseFormat())
+	if err != nil {
+		return nil, err
+	}
+	return &evalExpectations{block: c, schema: schema}, nil
+}
+
+// check returns a description of each assertion the run does not satisfy
+func (x *evalExpectations) check(run *evalRun) (failures []string) {
+	for _, tool := range x.block.Tools {
+		if failure := x.checkTool(tool, run.calls); failure != "" {
+			failures = append(failures, failure)
+		}
+	}
+	if matches := x.block.Answer.MatchesPattern(); matches != nil && !matches.MatchString(run.answer) {
+		failures = append(failures, fmt.Sprintf("answer does not match /%s/", matches))
+	}
+	if notMatches := x.block.Answer.NotMatchesPattern(); notMatches != nil && notMatches.MatchString(run.answer) {
+		failures = append(failures, fmt.Sprintf("answer matches /%s/", notMatches))
+	}
+	if x.schema != nil {
+		if problems := x.schema.ValidateJSON([]byte(run.answer)); len(problems) > 0 {
+			failures = append(failures, "answer does not match the schema: "+strings.Join(problems, "; "))
+		}
+	}
+	if limit := x.block.MaxTurns; limit > 0 && run.turns > limit {
+		failures = append(failures, fmt.Sprintf("took %d turns, more than the maximum of %d", run.turns, limit))
+	}
+	if limit := x.block.MaxTokens; limit > 0 && run.tokens > limit {
+		failures = append(failures, fmt.Sprintf("consumed %d tokens, more than the maximum of %d", run.tokens, limit))
+	}
+	return failures
+}
+
+func (x *evalExpectations) checkTool(tool *config.EvalToolBlock, calls []api.ToolCall) string {
+	named := 0
+	mismatch := ""
+	for _, call := range calls {
+		if call.Function.Name != tool.Name {
+			continue
+		}
+		named++
+		reason := x.argumentMismatch(tool, call.Function.Arguments)
+		if reason == "" {
+			if !tool.ExpectCalled() {
+				return fmt.Sprintf("tool %q was called with %s", tool.Name, brief(call.Function.Arguments))
+			}
+			return ""
+		}
+		if mismatch == "" {
+			mismatch = reason
+		}
+	}
+	if !tool.ExpectCalled() {
+		return ""
+	}
+	if named == 0 {
+		return fmt.Sprintf("tool %q was not called", tool.Name)
+	}
+	return fmt.Sprintf("tool %q was not called with matching arguments in %d calls: %s", tool.Name, named, mismatch)
+}
+
+// argumentMismatch describes the first argument not matching the expectations of the tool, or is empty when all match
+func (x *evalExpectations) argumentMismatch(tool *config.EvalToolBlock, arguments map[string]any) string {
+	for _, name := range sortedKeys(tool.Arguments) {
+		actual, ok := argumentText(arguments, name)
+		if !ok {
+			return fmt.Sprintf("argument %q is missing", name)
+		}
+		if actual != tool.Arguments[name] {
+			return fmt.Sprintf("argument %q is %q, expected %q", name, actual, tool.Arguments[name])
+		}
+	}
+	patterns := tool.CompiledArgumentPatterns()
+	for _, name := range sortedKeys(patterns) {
+		actual, ok := argumentText(arguments, name)
+		if !ok {
+			return fmt.Sprintf("argument %q is missing", name)
+		}
+		if !patterns[name].MatchString(actual) {
+			return fmt.Sprintf("argument %q is %q, which does not match /%s/", name, actual, patterns[name])
+		}
+	}
+	return ""
+}
+
+// argumentText renders the argument as text: strings as they are and anything else as JSON
+func argumentText(arguments map[string]any, name string) (string, bool) {
+	value, ok := arguments[name]
+	if !ok {
+		return "", false
+	}
+	if text, isText := value.(string); isText {
+		return text, true
+	}
+	return brief(value), true
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
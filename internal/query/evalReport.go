@@ -0,0 +1,131 @@
+package query
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// writeEvalTable writes the pass rate of each case followed by the failures of each run
+func writeEvalTable(out io.Writer, results []*evalCaseResult) error {
+	table := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(table, "CASE\tRUNS\tPASSED\tRATE\tREQUIRED\tRESULT")
+	for _, result := range results {
+		fmt.Fprintf(table, "%s\t%d\t%d\t%.0f%%\t%.0f%%\t%s\n", result.block.Name, len(result.runs), result.passedRuns(),
+			result.passRate()*100, result.block.ResolvePassRate()*100, evalVerdict(result))
+	}
+	if err := table.Flush(); err != nil {
+		return err
+	}
+	for _, result := range results {
+		for _, line := range evalFailureLines(result) {
+			if _, err := fmt.Fprintf(out, "%s: %s\n", result.block.Name, line); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func evalVerdict(result *evalCaseResult) string {
+	switch {
+	case result.err != nil:
+		return "ERROR"
+	case result.passed():
+		return "pass"
+	default:
+		return "FAIL"
+	}
+}
+
+// evalFailureLines describes why the case or each of its runs failed
+func evalFailureLines(result *evalCaseResult) (lines []string) {
+	if result.err != nil {
+		return []string{result.err.Error()}
+	}
+	for i, run := range result.runs {
+		for _, failure := range run.failures {
+			lines = append(lines, fmt.Sprintf("run %d: %s", i+1, failure))
+		}
+	}
+	return lines
+}
+
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name     string          `xml:"name,attr"`
+	Tests    int             `xml:"tests,attr"`
+	Failures int             `xml:"failures,attr"`
+	Errors   int             `xml:"errors,attr"`
+	Time     string          `xml:"time,attr"`
+	Cases    []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitProblem `xml:"failure,omitempty"`
+	Error     *junitProblem `xml:"error,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitProblem struct {
+	Message string `xml:"message,attr"`
+	Body    string `xml:",chardata"`
+}
+
+// writeJUnitReport writes each eval file as a test suite with a test case for each eval case
+func writeJUnitReport(path string, results []*evalCaseResult) error {
+	report := junitTestSuites{}
+	bySuite := map[string]int{}
+	var durations []time.Duration
+	for _, result := range results {
+		index, ok := bySuite[result.suite]
+		if !ok {
+			index = len(report.Suites)
+			bySuite[result.suite] = index
+			report.Suites = append(report.Suites, junitTestSuite{Name: result.suite})
+			durations = append(durations, 0)
+		}
+		suite := &report.Suites[index]
+		testCase := junitTestCase{
+			Name:      result.block.Name,
+			ClassName: strings.TrimSuffix(filepath.Base(result.suite), filepath.Ext(result.suite)),
+			Time:      fmt.Sprintf("%.3f", result.duration().Seconds()),
+			SystemOut: fmt.Sprintf("passed %d of %d runs", result.passedRuns(), len(result.runs)),
+		}
+		switch {
+		case result.err != nil:
+			suite.Errors++
+			testCase.Error = &junitProblem{Message: result.err.Error()}
+		case !result.passed():
+			suite.Failures++
+			testCase.Failure = &junitProblem{
+				Message: fmt.Sprintf("passed %d of %d runs, %.0f%% required", result.passedRuns(), len(result.runs), result.block.ResolvePassRate()*100),
+				Body:    strings.Join(evalFailureLines(result), "\n"),
+			}
+		}
+		suite.Tests++
+		suite.Cases = append(suite.Cases, testCase)
+		durations[index] += result.duration()
+	}
+	for i := range report.Suites {
+		report.Suites[i].Time = fmt.Sprintf("%.3f", durations[i].Seconds())
+	}
+
+	encoded, err := xml.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(path, append([]byte(xml.Header), append(encoded, '\n')...), 0o644)
+}
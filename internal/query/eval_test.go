@@ -0,0 +1,133 @@
+package query
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/meschbach/marvin/internal/backend"
+	"github.com/meschbach/marvin/internal/config"
+	"github.com/ollama/ollama/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func scriptedEvaluator(script *backend.Scripted) *evaluator {
+	return &evaluator{
+		defaultConfig: func() (*config.File, error) {
+			return &config.File{Model: "scripted"}, nil
+		},
+		openBackend: func(cfg *config.File) (backend.Backend, error) {
+			return script, nil
+		},
+	}
+}
+
+func TestEvaluator_ReportsPassRates(t *testing.T) {
+	script := backend.NewScripted(
+		// first run of utc-time calls the tool and answers with a time
+		backend.ScriptedReply{ToolCalls: []api.ToolCall{backend.ToolCall("1", "time.now", map[string]any{"zone": "UTC"})}, PromptTokens: 10, ResponseTokens: 5},
+		backend.Reply("It is 12:00."),
+		// second run of utc-time answers without the tool
+		backend.Reply("I can not tell."),
+		// the only run of polite answers rudely
+		backend.Reply("Go away."),
+	)
+	passRate := 0.5
+	suite := &config.EvalFile{Path: "suites/clock.hcl", Evals: []*config.EvalBlock{
+		{
+			Name:     "utc-time",
+			Prompt:   "What time is it in UTC?",
+			Runs:     2,
+			PassRate: &passRate,
+			Tools:    []*config.EvalToolBlock{{Name: "time.now", Arguments: map[string]string{"zone": "UTC"}}},
+			Answer:   &config.EvalAnswerBlock{Matches: `\d+:\d+`},
+		},
+		{
+			Name:   "polite",
+			Prompt: "Hello",
+			Answer: &config.EvalAnswerBlock{NotMatches: "(?i)go away"},
+		},
+	}}
+	for _, c := range suite.Evals {
+		require.NoError(t, c.Validate("suites"))
+	}
+	var out bytes.Buffer
+	junit := filepath.Join(t.TempDir(), "report.xml")
+
+	err := scriptedEvaluator(script).perform(context.Background(), []*config.EvalFile{suite}, &out, &EvalOptions{JUnit: junit})
+	var failed *evalFailedError
+	require.ErrorAs(t, err, &failed)
+	assert.Equal(t, 1, failed.failed)
+	assert.Equal(t, ExitFailure, ExitCode(err))
+	assert.Equal(t, 0, script.Remaining())
+
+	assert.Equal(t, `CASE      RUNS  PASSED  RATE  REQUIRED  RESULT
+utc-time  2     1       50%   50%       pass
+polite    1     0       0%    100%      FAIL
+utc-time: run 2: tool "time.now" was not called
+utc-time: run 2: answer does not match /\d+:\d+/
+polite: run 1: answer matches /(?i)go away/
+`, out.String())
+
+	report, err := os.ReadFile(junit)
+	require.NoError(t, err)
+	assert.Contains(t, string(report), `<testsuite name="suites/clock.hcl" tests="2" failures="1" errors="0"`)
+	assert.Contains(t, string(report), `<testcase name="utc-time" classname="clock"`)
+	assert.Contains(t, string(report), `<failure message="passed 0 of 1 runs, 100% required">run 1: answer matches /(?i)go away/</failure>`)
+}
+
+func TestEvaluator_CaseConfigurationErrors(t *testing.T) {
+	suite := &config.EvalFile{Path: "suite.hcl", Evals: []*config.EvalBlock{
+		{Name: "missing", Prompt: "x", Config: filepath.Join(t.TempDir(), "absent.hcl")},
+	}}
+	var out bytes.Buffer
+	err := scriptedEvaluator(backend.NewScripted()).perform(context.Background(), []*config.EvalFile{suite}, &out, &EvalOptions{})
+	assert.Error(t, err)
+	assert.Contains(t, out.String(), "ERROR")
+	assert.Contains(t, out.String(), "missing: loading config")
+}
+
+func TestEvalExpectations_Check(t *testing.T) {
+	forbidden := false
+	block := &config.EvalBlock{
+		Prompt: "How many messages are from Bob?",
+		Tools: []*config.EvalToolBlock{
+			{Name: "mail.search", ArgumentPatterns: map[string]string{"query": "^from:"}},
+			{Name: "mail.delete", Called: &forbidden},
+		},
+		Answer:    &config.EvalAnswerBlock{Schema: `{"type":"object","required":["count"]}`},
+		MaxTurns:  2,
+		MaxTokens: 100,
+	}
+	require.NoError(t, block.Validate(""))
+	expectations, err := newEvalExpectations(block)
+	require.NoError(t, err)
+
+	passing := &evalRun{
+		answer: `{"count":3}`,
+		calls:  []api.ToolCall{backend.ToolCall("1", "mail.search", map[string]any{"query": "from:bob"})},
+		turns:  2,
+		tokens: 100,
+	}
+	assert.Empty(t, expectations.check(passing))
+
+	failing := &evalRun{
+		answer: `{}`,
+		calls: []api.ToolCall{
+			backend.ToolCall("1", "mail.search", map[string]any{"query": "bob"}),
+			backend.ToolCall("2", "mail.delete", map[string]any{"id": 7}),
+		},
+		turns:  3,
+		tokens: 101,
+	}
+	assert.Equal(t, []string{
+		`tool "mail.search" was not called with matching arguments in 1 calls: argument "query" is "bob", which does not match /^from:/`,
+		`tool "mail.delete" was called with {"id":7}`,
+		`answer does not match the schema: /: missing property 'count'`,
+		"took 3 turns, more than the maximum of 2",
+		"consumed 101 tokens, more than the maximum of 100",
+	}, expectations.check(failing))
+}
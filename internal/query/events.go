@@ -0,0 +1,244 @@
+package query
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/meschbach/marvin/internal/logging"
+	"github.com/ollama/ollama/api"
+)
+
+const (
+	// OutputText renders progress for humans
+	OutputText = "text"
+	// OutputJSONL writes each event as a line of JSON
+	OutputJSONL = "jsonl"
+)
+
+// Event types emitted while running commands
+const (
+	EventContent     = "content"
+	EventThinking    = "thinking"
+	EventToolCall    = "tool_call"
+	EventToolResult  = "tool_result"
+	EventUsage       = "usage"
+	EventError       = "error"
+	EventDone        = "done"
+	EventAnswer      = "answer"
+	EventNotice      = "notice"
+	EventInstruction = "instruction"
+	EventTool        = "tool"
+	EventDocument    = "document"
+	EventStep        = "step"
+	EventPrompt      = "prompt"
+)
+
+// Event describes a single step of progress.  Only the fields relevant to the type are set.
+type Event struct {
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+	// Source identifies the component which produced a notice
+	Source  string `json:"source,omitempty"`
+	Content string `json:"content,omitempty"`
+	// ToolCallID, ToolName and Arguments describe tool calls and their results.  ToolName also names listed prompts.
+	ToolCallID string         `json:"tool_call_id,omitempty"`
+	ToolName   string         `json:"tool_name,omitempty"`
+	Arguments  map[string]any `json:"arguments,omitempty"`
+	// Parameters describes the inputs of a tool definition or the arguments of a prompt
+	Parameters *api.ToolFunctionParameters `json:"parameters,omitempty"`
+	// Path and Similarity describe a matching document
+	Path       string  `json:"path,omitempty"`
+	Similarity float32 `json:"similarity,omitempty"`
+	// PromptTokens and ResponseTokens count usage of a single response or, when done, the total
+	PromptTokens   int    `json:"prompt_tokens,omitempty"`
+	ResponseTokens int    `json:"response_tokens,omitempty"`
+	DoneReason     string `json:"done_reason,omitempty"`
+	Error          string `json:"error,omitempty"`
+	// Step and Status describe the progress of a step of a goal, numbered from one
+	Step   int    `json:"step,omitempty"`
+	Status string `json:"status,omitempty"`
+	// Agent names the delegated agent producing the event, outermost first and separated by slashes
+	Agent string `json:"agent,omitempty"`
+}
+
+// eventSink receives the events of a command
+type eventSink interface {
+	emit(e Event)
+}
+
+// DisplayOptions controls which events are rendered as text
+type DisplayOptions struct {
+	ShowThinking bool
+	ShowTools    bool
+	ShowDone     bool
+}
+
+// newEventSink creates a sink for the requested output format
+func newEventSink(format string, display DisplayOptions) (eventSink, error) {
+	switch format {
+	case "", OutputText:
+		return &textRenderer{out: os.Stdout, diagnostics: os.Stderr, display: display}, nil
+	case OutputJSONL:
+		return &jsonlWriter{encoder: json.NewEncoder(os.Stdout)}, nil
+	default:
+		return nil, &configError{operationalError{"output", fmt.Errorf("unknown format %q, expected %s or %s", format, OutputText, OutputJSONL)}}
+	}
+}
+
+func noticeEvent(source, format string, args ...any) Event {
+	return Event{Type: EventNotice, Source: source, Content: fmt.Sprintf(format, args...)}
+}
+
+func errorEvent(err error) Event {
+	return Event{Type: EventError, Error: err.Error()}
+}
+
+func toolCallEvent(call api.ToolCall) Event {
+	return Event{Type: EventToolCall, ToolCallID: call.ID, ToolName: call.Function.Name, Arguments: call.Function.Arguments}
+}
+
+func toolResultEvent(reply api.Message) Event {
+	return Event{Type: EventToolResult, ToolCallID: reply.ToolCallID, ToolName: reply.ToolName, Content: reply.Content}
+}
+
+// jsonlWriter encodes each event as a single line of JSON
+type jsonlWriter struct {
+	lock    sync.Mutex
+	encoder *json.Encoder
+}
+
+func (j *jsonlWriter) emit(e Event) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	if err := j.encoder.Encode(e); err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing event: %v\n", err)
+	}
+}
+
+// textRenderer presents events for a person at a terminal.  Only the answer and listings are written to out; thinking
+// and tool usage requested through the display options are written to diagnostics while notices, errors and usage are
+// logged.  Streamed content and thinking are written a line at a time.
+type textRenderer struct {
+	lock        sync.Mutex
+	out         io.Writer
+	diagnostics io.Writer
+	display     DisplayOptions
+	line        strings.Builder
+	thinking    strings.Builder
+}
+
+func (t *textRenderer) emit(e Event) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	switch e.Type {
+	case EventContent:
+		writeLines(t.out, &t.line, "", e.Content)
+	case EventThinking:
+		if !t.display.ShowThinking {
+			return
+		}
+		writeLines(t.diagnostics, &t.thinking, "Thinking: ", e.Content)
+	case EventUsage:
+		if t.display.ShowDone {
+			fmt.Fprintf(t.diagnostics, "%s<Done> (%d) %s\n", agentPrefix(e), e.ResponseTokens, e.DoneReason)
+		}
+		t.flush()
+	case EventToolCall:
+		if t.display.ShowTools {
+			fmt.Fprintf(t.diagnostics, "%scall %s> Function %s with argument %#v\n", agentPrefix(e), e.ToolCallID, e.ToolName, e.Arguments)
+		}
+	case EventToolResult:
+		if !t.display.ShowTools {
+			return
+		}
+		if e.Error != "" {
+			fmt.Fprintf(t.diagnostics, "%scall %s> error: %s\n", agentPrefix(e), e.ToolCallID, e.Error)
+		} else if e.Content == "" {
+			fmt.Fprintf(t.diagnostics, "%scall %s> no response\n", agentPrefix(e), e.ToolCallID)
+		} else {
+			fmt.Fprintf(t.diagnostics, "%scall %s>\t%s: %s\n", agentPrefix(e), e.ToolCallID, e.ToolName, e.Content)
+		}
+	case EventDone:
+		t.flush()
+		slog.Info(fmt.Sprintf("total tokens: %d = (prompt tokens: %d) + (response tokens: %d)", e.PromptTokens+e.ResponseTokens, e.PromptTokens, e.ResponseTokens), logging.Component, "usage")
+	case EventAnswer:
+		t.flush()
+		fmt.Fprintln(t.out, e.Content)
+	case EventError:
+		t.flush()
+		slog.Error(e.Error)
+	case EventNotice:
+		slog.Info(agentPrefix(e)+e.Content, logging.Component, e.Source)
+	case EventInstruction:
+		fmt.Fprintf(t.out, "Instruction: %s\n=== End instruction ===\n", e.Content)
+	case EventTool:
+		fmt.Fprintf(t.out, "%s: %s\n", e.ToolName, e.Content)
+		if e.Parameters != nil {
+			renderParameters(t.out, "\t\t", *e.Parameters)
+		}
+	case EventPrompt:
+		fmt.Fprintf(t.out, "prompt %s: %s\n", e.ToolName, e.Content)
+		if e.Parameters != nil {
+			renderParameters(t.out, "\t\t", *e.Parameters)
+		}
+	case EventDocument:
+		fmt.Fprintf(t.out, "%s\t%f\n", e.Path, e.Similarity)
+	case EventStep:
+		if e.Error != "" {
+			slog.Warn(fmt.Sprintf("step %d %s: %s: %s", e.Step, e.Status, e.Content, e.Error), logging.Component, "goal")
+		} else {
+			slog.Info(fmt.Sprintf("step %d %s: %s", e.Step, e.Status, e.Content), logging.Component, "goal")
+		}
+	}
+}
+
+// agentPrefix marks the output of a delegated agent, indenting it by the depth of delegation
+func agentPrefix(e Event) string {
+	if e.Agent == "" {
+		return ""
+	}
+	return strings.Repeat("  ", strings.Count(e.Agent, "/")+1) + "[" + e.Agent + "] "
+}
+
+// writeLines appends the fragment to the buffer, writing everything up to the final newline
+func writeLines(out io.Writer, buffer *strings.Builder, prefix, fragment string) {
+	buffer.WriteString(fragment)
+	pending := buffer.String()
+	last := strings.LastIndex(pending, "\n")
+	if last < 0 {
+		return
+	}
+	fmt.Fprint(out, prefix+pending[:last+1])
+	buffer.Reset()
+	buffer.WriteString(pending[last+1:])
+}
+
+// brief renders a value, such as the arguments of a tool call, as compact JSON on a single line
+func brief(value any) string {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprintf("%v", value)
+	}
+	return string(encoded)
+}
+
+// flush writes any partial lines of thinking or content
+func (t *textRenderer) flush() {
+	if t.thinking.Len() > 0 {
+		fmt.Fprintf(t.diagnostics, "Thinking: %s\n\n", t.thinking.String())
+		t.thinking.Reset()
+	}
+	if t.line.Len() > 0 {
+		fmt.Fprintln(t.out, t.line.String())
+		t.line.Reset()
+	}
+}
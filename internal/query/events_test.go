@@ -0,0 +1,66 @@
+package query
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/ollama/ollama/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordedEvents captures emitted events for inspection
+type recordedEvents struct {
+	lock   sync.Mutex
+	events []Event
+}
+
+func (r *recordedEvents) emit(e Event) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.events = append(r.events, e)
+}
+
+func TestJSONLWriter_OneEventPerLine(t *testing.T) {
+	var out bytes.Buffer
+	sink := &jsonlWriter{encoder: json.NewEncoder(&out)}
+	args := api.ToolCallFunctionArguments{"path": "README.md"}
+	sink.emit(toolCallEvent(api.ToolCall{ID: "1", Function: api.ToolCallFunction{Name: "read", Arguments: args}}))
+	sink.emit(errorEvent(errors.New("boom")))
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 2)
+	var call map[string]any
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &call))
+	assert.Equal(t, EventToolCall, call["type"])
+	assert.Equal(t, "read", call["tool_name"])
+	assert.Equal(t, map[string]any{"path": "README.md"}, call["arguments"])
+	assert.NotEmpty(t, call["time"])
+
+	var failure Event
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &failure))
+	assert.Equal(t, EventError, failure.Type)
+	assert.Equal(t, "boom", failure.Error)
+}
+
+func TestTextRenderer_BuffersContentByLine(t *testing.T) {
+	var out bytes.Buffer
+	sink := &textRenderer{out: &out}
+	sink.emit(Event{Type: EventContent, Content: "Hello"})
+	sink.emit(Event{Type: EventThinking, Content: "hidden"})
+	assert.Empty(t, out.String())
+	sink.emit(Event{Type: EventContent, Content: " world\nand"})
+	assert.Equal(t, "Hello world\n", out.String())
+	sink.emit(Event{Type: EventUsage, ResponseTokens: 3})
+	sink.emit(Event{Type: EventToolCall, ToolName: "hidden"})
+	assert.Equal(t, "Hello world\nand\n", out.String())
+}
+
+func TestNewEventSink_RejectsUnknownFormat(t *testing.T) {
+	_, err := newEventSink("xml", DisplayOptions{})
+	assert.Error(t, err)
+}
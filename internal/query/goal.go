@@ -1,57 +1,150 @@
 package query
 
 import (
-	"bufio"
 	"context"
+	"errors"
 	"fmt"
+	"log/slog"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
+	"github.com/meschbach/marvin/internal/backend"
+	"github.com/meschbach/marvin/internal/cassette"
 	"github.com/meschbach/marvin/internal/config"
+	"github.com/meschbach/marvin/internal/logging"
 	"github.com/ollama/ollama/api"
 )
 
 const roleSystem = "system"
 const roleUser = "user"
 const roleAssistant = "assistant"
-const roleToolResult = "tool_result"
+const roleTool = "tool"
 
 const mcpParameterTypeObject = "object"
 const mcpParameterTypeString = "string"
 
-func PerformGoalWithConfig(cfg *config.File, goal string) {
-	ctx, done := context.WithCancel(context.Background())
+// GoalOptions controls how a goal is pursued
+type GoalOptions struct {
+	//Session names a persisted planning conversation to resume and update after each turn
+	Session string
+	//Limits overrides the configured conversation limits
+	Limits config.LimitsBlock
+	//Ollama overrides the configured generation options
+	Ollama config.OllamaOptionsBlock
+	//ParallelToolCalls overrides the configured number of tool calls run concurrently by each step
+	ParallelToolCalls int
+	//Output selects how progress is written: text for people or jsonl for programs
+	Output string
+	//Traffic records the model and MCP traffic to cassettes or replays it from them
+	Traffic cassette.Options
+	//AutoApprove carries out plans without asking for approval
+	AutoApprove bool
+	//MaxReplans is the number of times the goal may be re-planned after a step fails
+	MaxReplans int
+	//Clarify selects how clarifying questions from the planner are answered: auto, tty, assume or fail
+	Clarify string
+	//Answers is the path of an answers file consulted before the clarify mode
+	Answers string
+}
+
+// PerformGoalWithConfig plans the steps to achieve the goal then, once the plan is approved, carries out each step.
+// The plan is persisted to the goal store after every change.  Failures are reported through the events of the goal
+// before being returned.
+func PerformGoalWithConfig(cfg *config.File, goal string, opts *GoalOptions) error {
+	plan := &goalPlan{ID: newGoalID(time.Now()), Goal: goal, Status: goalPlanning}
+	return performGoal(cfg, plan, opts)
+}
+
+// ResumeGoalWithConfig continues the persisted goal from where it stopped.  Steps interrupted while running are
+// carried out again, as is the step a failed goal stopped at.
+func ResumeGoalWithConfig(cfg *config.File, id string, opts *GoalOptions) error {
+	plan, err := NewGoalStore(DefaultGoalDirectory).load(id)
+	if err != nil {
+		return err
+	}
+	return performGoal(cfg, plan, opts)
+}
+
+func performGoal(cfg *config.File, plan *goalPlan, opts *GoalOptions) (problem error) {
+	ctx, done := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer done()
 
-	realToolSet, err := NewToolSet(ctx, cfg)
+	events, err := newEventSink(opts.Output, DisplayOptions{})
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error loading MCP servers: %v\n", err)
-		return
+		return err
 	}
-	defer realToolSet.Shutdown(ctx)
+	defer func() {
+		problem = report(events, problem)
+	}()
 
-	reasoningToolset, err := NewToolSet(ctx, nil)
+	traffic, err := openTraffic(&opts.Traffic)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error creating Ollama client: %v\n", err)
-		return
+		return err
 	}
-	defer reasoningToolset.Shutdown(ctx)
-	//if err := reasoningToolset.registerTool(ctx, &reasoningStep{}); err != nil {
-	//	fmt.Fprintf(os.Stderr, "Error registering reasoning step tool: %v\n", err)
-	//	return err
-	//}
-	if err := reasoningToolset.registerTool(ctx, &questionForUser{}); err != nil {
-		fmt.Fprintf(os.Stderr, "Error registering question for user tool: %v\n", err)
-		return
+	defer func() {
+		problem = closeTraffic(traffic, problem)
+	}()
+
+	client, err := cfg.OpenBackend()
+	if err != nil {
+		return &configError{operationalError{"opening backend", err}}
 	}
+	var approver planApprover = &terminalApprover{in: stdinLines(), out: os.Stderr}
+	if opts.AutoApprove {
+		approver = approveAll{}
+	}
+	answerer, err := newClarificationAnswerer(opts.Clarify, opts.Answers, stdinLines(), os.Stderr, isTerminal(os.Stdin))
+	if err != nil {
+		return err
+	}
+	store := NewGoalStore(DefaultGoalDirectory)
+	events.emit(noticeEvent("goal", "pursuing goal %s, which may be resumed with `marvin goal resume %s`", plan.ID, plan.ID))
+	err = pursueGoal(ctx, traffic.Backend(client), cfg, plan, opts, events, &questionForUser{answerer: answerer}, approver, store, traffic)
+	if err != nil && ctx.Err() != nil {
+		return &operationalError{fmt.Sprintf("goal %s interrupted, continue it with `marvin goal resume %s`", plan.ID, plan.ID), err}
+	}
+	return err
+}
 
-	fmt.Printf("Goal: %s\n", goal)
+// pursueGoal plans the goal with the model served by client, asking the user through clarifier when the model needs
+// more details, then carries out each step approved by approver.  A plan which already has steps is resumed.  The plan
+// is saved to store, when not nil, after every change.  Traffic with the MCP servers is recorded or replayed through
+// the traffic deck, which may be nil.
+func pursueGoal(ctx context.Context, client backend.Backend, cfg *config.File, plan *goalPlan, opts *GoalOptions, events eventSink, clarifier Tool, approver planApprover, store *GoalStore, traffic *cassette.Deck) (problem error) {
+	// Tools are shut down even once the goal is interrupted
+	shutdownContext := context.WithoutCancel(ctx)
+	realToolSet, err := NewToolSet(ctx, cfg, traffic)
+	if err != nil {
+		return &operationalError{"loading MCP servers", err}
+	}
+	defer func() {
+		if err := realToolSet.Shutdown(shutdownContext); err != nil {
+			problem = errors.Join(problem, &operationalError{"shutting down tools", err})
+		}
+	}()
+	failure := &stepFailure{}
+	if err := realToolSet.registerTool(ctx, failure); err != nil {
+		return &operationalError{"registering step failure tool", err}
+	}
 
-	// QueryRAGDocuments Ollama for a response
-	client, err := api.ClientFromEnvironment()
+	reasoningToolset, err := NewToolSet(ctx, nil, nil)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error creating Ollama client: %v\n", err)
-		return
+		return &operationalError{"creating reasoning tools", err}
+	}
+	defer func() {
+		if err := reasoningToolset.Shutdown(shutdownContext); err != nil {
+			problem = errors.Join(problem, &operationalError{"shutting down reasoning tools", err})
+		}
+	}()
+	proposed := &reasoningStep{}
+	if err := reasoningToolset.registerTool(ctx, proposed); err != nil {
+		return &operationalError{"registering reasoning step tool", err}
+	}
+	if err := reasoningToolset.registerTool(ctx, clarifier); err != nil {
+		return &operationalError{"registering question for user tool", err}
 	}
 
 	//generate a message of available MCP tools
@@ -60,124 +153,279 @@ func PerformGoalWithConfig(cfg *config.File, goal string) {
 		availableTools += fmt.Sprintf("\t%s: %s\n", tool.Function.Name, tool.Function.Description)
 	}
 
-	// QueryRAGDocuments the AI model for the steps required to complete the goal
-	stepsConversation := ollamaConversation{
+	options := cfg.ResolveOllamaOptions(opts.Ollama)
+	if err := options.Validate(); err != nil {
+		return &configError{operationalError{"ollama options", err}}
+	}
+	stepPrompt, err := systemPrompt(cfg)
+	if err != nil {
+		return err
+	}
+	var compaction *config.ContextBlock
+	if cfg != nil {
+		compaction = cfg.Context
+	}
+	contextWindow, err := newContextManager(client, compaction, &options)
+	if err != nil {
+		return err
+	}
+
+	// The planner is asked for the steps required to complete the goal
+	planner := &ollamaConversation{
 		client: client,
 		messages: []api.Message{
 			{
 				Role:    roleSystem,
-				Content: "You are an expert system in reasoning through problems.  You are building an instruction list for another AI and may only call steps starting with 'reasoning' .  Enumerate each step to be achieved via the reasoning_step tool.  When you need further clarification or more information request this via reasoning_clairifying_question tool.  If instructions are clear then do not ask any clairifying questions.",
+				Content: "You are an expert system in reasoning through problems.  You are building an instruction list for another AI and may only call tools starting with 'reasoning'.  Enumerate each step to be achieved, in order, via the reasoning_step tool.  When you need further clarification or more information request this via reasoning_clairifying_question tool.  If instructions are clear then do not ask any clairifying questions.",
 			},
 			{Role: roleSystem, Content: availableTools},
-			{Role: roleUser, Content: goal},
 		},
-		tools: reasoningToolset,
+		tools:         reasoningToolset,
+		events:        events,
+		budget:        newConversationBudget(cfg.ResolveLimits(opts.Limits)),
+		options:       &options,
+		contextWindow: contextWindow,
+	}
+	if len(plan.Planner) > 0 {
+		planner.messages = plan.Planner
+	} else if err := resumeSession(planner, opts.Session); err != nil {
+		return err
+	}
+
+	pursuit := &goalPursuit{
+		client:        client,
+		cfg:           cfg,
+		opts:          opts,
+		events:        events,
+		approver:      approver,
+		store:         store,
+		model:         cfg.LanguageModel(),
+		options:       &options,
+		contextWindow: contextWindow,
+		tools:         realToolSet,
+		stepPrompt:    stepPrompt,
+		planner:       planner,
+		proposed:      proposed,
+		failure:       failure,
+		plan:          plan,
 	}
+	planner.events = &clarificationRecorder{next: events, plan: plan, changed: pursuit.saveQuietly}
+	return pursuit.pursue(ctx)
+}
+
+// goalPursuit carries a goal from planning through each of its steps
+type goalPursuit struct {
+	client   backend.Backend
+	cfg      *config.File
+	opts     *GoalOptions
+	events   eventSink
+	approver planApprover
+	// store persists the plan after every change, when not nil
+	store   *GoalStore
+	model   string
+	options *config.OllamaOptionsBlock
+	// contextWindow compacts the histories of the planner and the steps, nil when not configured
+	contextWindow *contextManager
+	// tools are the configured tools each step is carried out with
+	tools *ToolSet
+	// stepPrompt is the system prompt of the conversations carrying out the steps
+	stepPrompt string
+	// planner proposes the steps, keeping its history across re-plans
+	planner  *ollamaConversation
+	proposed *reasoningStep
+	failure  *stepFailure
+	plan     *goalPlan
+}
 
-	model := "ministral-3:3b"
-	if cfg != nil && cfg.Model != "" {
-		model = cfg.Model
+func (g *goalPursuit) pursue(ctx context.Context) error {
+	g.events.emit(noticeEvent("goal", "%s", g.plan.Goal))
+	g.plan.Model = g.model
+	switch {
+	case len(g.plan.Steps) == 0:
+		g.plan.Status = goalPlanning
+		if err := g.save(); err != nil {
+			return err
+		}
+		steps, err := g.propose(ctx, g.plan.Goal)
+		if err != nil {
+			return err
+		}
+		if err := g.adopt(ctx, steps); err != nil {
+			return err
+		}
+	case g.plan.Status == goalAwaitingApproval || g.plan.Status == goalDeclined:
+		if err := g.approve(ctx); err != nil {
+			return err
+		}
+	case g.plan.Status == goalFailed:
+		g.plan.retryFailed()
+	}
+	g.plan.resetInterrupted()
+	g.plan.Status = goalRunning
+	if err := g.save(); err != nil {
+		return err
 	}
 
-	if err := stepsConversation.runAIToConclusion(ctx, model, reasoningToolset.defs); err != nil {
-		fmt.Fprintf(os.Stderr, "Error running AI: %v\n", err)
-		return
+	for {
+		index, step := g.plan.next()
+		if step == nil {
+			break
+		}
+		if err := g.execute(ctx, index, step); err != nil {
+			return err
+		}
+		if step.Status != stepFailed {
+			continue
+		}
+		if g.plan.Replans >= g.opts.MaxReplans {
+			g.plan.Status = goalFailed
+			g.events.emit(Event{Type: EventAnswer, Content: g.plan.summary()})
+			return errors.Join(&operationalError{"pursuing goal", fmt.Errorf("step %d failed: %s", index+1, step.Failure)}, g.save())
+		}
+		g.plan.Replans++
+		g.events.emit(noticeEvent("goal", "re-planning after step %d failed (%d of %d)", index+1, g.plan.Replans, g.opts.MaxReplans))
+		steps, err := g.propose(ctx, g.replanRequest(index, step))
+		if err != nil {
+			return err
+		}
+		g.plan.skipPending()
+		if err := g.adopt(ctx, steps); err != nil {
+			return err
+		}
 	}
+	g.plan.Status = goalDone
+	g.events.emit(Event{Type: EventAnswer, Content: g.plan.summary()})
+	return g.save()
 }
 
-type reasoningStep struct {
-	steps []string
+// save persists the plan along with the planning conversation
+func (g *goalPursuit) save() error {
+	if g.store == nil {
+		return nil
+	}
+	g.plan.Planner = g.planner.messages
+	return g.store.save(g.plan)
 }
 
-func (r reasoningStep) invoke(ctx context.Context, call api.ToolCall) (out []api.Message, problem error) {
-	fmt.Printf("invoked reasoning step with %s\n", call.Function.Arguments.String())
-	return []api.Message{
-		{
-			Role:       "tool_result",
-			Content:    call.Function.Arguments.String(),
-			ToolName:   call.Function.Name,
-			ToolCallID: call.ID,
-		},
-	}, nil
+// saveQuietly saves the plan in the midst of a conversation, where failing to do so is only worth a warning
+func (g *goalPursuit) saveQuietly() {
+	if err := g.save(); err != nil {
+		slog.Warn("saving goal", logging.Component, "goal", "err", err)
+	}
 }
 
-func (r reasoningStep) defineAPI(ctx context.Context) (tool api.Tools, problem error) {
-	return api.Tools{
-		{
-			Type: "function",
-			Function: api.ToolFunction{
-				Name:        "reasoning_step",
-				Description: "Defines a small and finite step to approach the problem",
-				Parameters: api.ToolFunctionParameters{
-					Type:     "object",
-					Required: []string{"step"},
-					Properties: map[string]api.ToolProperty{
-						"step": {
-							Type:        []string{"string"},
-							Description: "Defines the step to be taken",
-						},
-					},
-				},
-			},
-		},
-	}, nil
+// propose sends the request to the planner, returning the steps it proposes.  Planners which answer with a list
+// instead of calling reasoning_step have the entries of the list taken as the steps.
+func (g *goalPursuit) propose(ctx context.Context, request string) ([]string, error) {
+	g.planner.messages = append(g.planner.messages, api.Message{Role: roleUser, Content: request})
+	if err := g.planner.runAIToConclusion(ctx, g.model, g.planner.tools.APITools()); err != nil {
+		return nil, err
+	}
+	steps := g.proposed.take()
+	if len(steps) == 0 {
+		steps = listedSteps(g.planner.finalAnswer())
+	}
+	if len(steps) == 0 {
+		return nil, &operationalError{"planning goal", errors.New("the planner did not propose any steps")}
+	}
+	return steps, nil
 }
 
-type questionForUser struct {
+// replanRequest asks the planner for the remaining steps after the step at index failed
+func (g *goalPursuit) replanRequest(index int, failed *goalStep) string {
+	var request strings.Builder
+	fmt.Fprintf(&request, "Step %d, %q, failed: %s\n", index+1, failed.Description, failed.Failure)
+	request.WriteString("The steps completed so far are:\n")
+	completed := 0
+	for i, step := range g.plan.Steps {
+		if step.Status == stepDone {
+			fmt.Fprintf(&request, "%d. %s\n", i+1, step.Description)
+			completed++
+		}
+	}
+	if completed == 0 {
+		request.WriteString("none\n")
+	}
+	request.WriteString("Enumerate the remaining steps needed to achieve the goal via the reasoning_step tool.")
+	return request.String()
 }
 
-func (q questionForUser) invoke(ctx context.Context, call api.ToolCall) (out []api.Message, problem error) {
-	args := call.Function.Arguments
-	prompt, hasPrompt := args["prompt"]
-	if !hasPrompt {
-		return nil, fmt.Errorf("missing required argument 'prompt'")
+// adopt appends the proposed steps to the plan once it is approved
+func (g *goalPursuit) adopt(ctx context.Context, steps []string) error {
+	first := len(g.plan.Steps)
+	g.plan.add(steps)
+	for i, step := range g.plan.Steps[first:] {
+		g.events.emit(stepEvent(first+i, step))
 	}
+	return g.approve(ctx)
+}
 
-	fmt.Printf("ai> %s\n", prompt)
-	reader := bufio.NewReader(os.Stdin)
-	input, err := reader.ReadString('\n')
+// approve asks the approver whether to carry out the plan, recording the decision
+func (g *goalPursuit) approve(ctx context.Context) error {
+	g.plan.Status = goalAwaitingApproval
+	if err := g.save(); err != nil {
+		return err
+	}
+	approved, err := g.approver.approve(ctx, g.plan)
 	if err != nil {
-		return nil, err
+		return &operationalError{"approving plan", err}
 	}
-	trimmedInput := strings.TrimSpace(input)
-	return []api.Message{
-		{
-			Role:       roleToolResult,
-			Content:    "",
-			ToolName:   call.Function.Name,
-			ToolCallID: call.ID,
-		},
-		{
-			Role:    roleUser,
-			Content: trimmedInput,
-		},
-	}, nil
+	if !approved {
+		g.plan.Status = goalDeclined
+		return errors.Join(&operationalError{"pursuing goal", errPlanDeclined}, g.save())
+	}
+	g.plan.Status = goalRunning
+	return g.save()
 }
 
-func (q questionForUser) defineAPI(ctx context.Context) (definition *toolDefinition, problem error) {
-	definitions := &toolDefinition{}
-	definitions.tool = api.Tools{
-		{
-			Type: "function",
-			Function: api.ToolFunction{
-				Name:        "reasoning_clairifying_question",
-				Description: "Request clarification from the user or to better understand what the instructions are",
-				Parameters: api.ToolFunctionParameters{
-					Type:     mcpParameterTypeObject,
-					Required: []string{"prompt"},
-					Properties: map[string]api.ToolProperty{
-						"prompt": {
-							Type:        []string{mcpParameterTypeString},
-							Description: "The prompt to ask the user",
-						},
-					},
-				},
-			},
-		},
+// execute carries out the step at index in a conversation of its own with the configured tools, recording whether it
+// was done or failed.  Only cancellation of the goal, or failing to save the plan, is returned as an error.
+func (g *goalPursuit) execute(ctx context.Context, index int, step *goalStep) error {
+	started := time.Now()
+	step.Status, step.StartedAt = stepRunning, &started
+	g.events.emit(stepEvent(index, step))
+	if err := g.save(); err != nil {
+		return err
+	}
+
+	recorder := &stepRecorder{next: g.events, step: step, changed: g.saveQuietly}
+	conversation := &ollamaConversation{
+		client:        g.client,
+		messages:      initialMessages(g.tools, g.stepPrompt),
+		tools:         g.tools,
+		events:        recorder,
+		budget:        newConversationBudget(g.cfg.ResolveLimits(g.opts.Limits)),
+		toolWorkers:   g.cfg.ResolveParallelToolCalls(g.opts.ParallelToolCalls),
+		options:       g.options,
+		contextWindow: g.contextWindow,
+		hideContent:   true,
+	}
+	conversation.messages = append(conversation.messages, api.Message{Role: roleSystem, Content: g.plan.progress(index)})
+	if called := step.alreadyCalled(); called != "" {
+		g.events.emit(noticeEvent("goal", "step %d was interrupted after these tool calls, continuing from them:\n%s", index+1, called))
+		conversation.messages = append(conversation.messages, api.Message{Role: roleSystem, Content: "This step was " +
+			"interrupted after making the following tool calls.  Their effects have already taken place, so do not " +
+			"repeat them; continue the step from where they left off.\n" + called})
+	}
+	conversation.messages = append(conversation.messages,
+		api.Message{Role: roleUser, Content: fmt.Sprintf("Carry out step %d: %s", index+1, step.Description)})
+	err := conversation.runAIToConclusion(ctx, g.model, g.tools.APITools())
+	if ctx.Err() != nil {
+		// the step is left running to be carried out again when the goal is resumed
+		return errors.Join(ctx.Err(), g.save())
+	}
+	step.Result = conversation.finalAnswer()
+	reported := g.failure.take()
+	switch {
+	case err != nil:
+		step.Status, step.Failure = stepFailed, err.Error()
+	case reported != "":
+		step.Status, step.Failure = stepFailed, reported
+	default:
+		step.Status = stepDone
 	}
-	definitions.instructions = append(definitions.instructions, api.Message{
-		Role:    roleSystem,
-		Content: "Use the tool reasoning_clairifying_question to ask the user for additional details when you are unsure, need more information, or are otherwise not certain.",
-	})
-	return definitions, nil
+	finished := time.Now()
+	step.FinishedAt = &finished
+	g.events.emit(stepEvent(index, step))
+	return g.save()
 }
@@ -0,0 +1,439 @@
+package query
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/meschbach/marvin/internal/logging"
+	"github.com/ollama/ollama/api"
+)
+
+// Status of a step within a goal plan
+const (
+	stepPending = "pending"
+	stepRunning = "running"
+	stepDone    = "done"
+	stepFailed  = "failed"
+	// stepSkipped steps were replaced when the goal was re-planned
+	stepSkipped = "skipped"
+)
+
+// Status of a goal as a whole
+const (
+	goalPlanning         = "planning"
+	goalAwaitingApproval = "awaiting_approval"
+	goalDeclined         = "declined"
+	goalRunning          = "running"
+	goalDone             = "done"
+	goalFailed           = "failed"
+)
+
+// errPlanDeclined is returned when the plan for a goal is not approved
+var errPlanDeclined = errors.New("the plan was not approved")
+
+// goalPlan is the ordered steps toward a goal along with the progress of each.  It is persisted after every change so
+// an interrupted goal may be resumed.
+type goalPlan struct {
+	ID        string      `json:"id"`
+	Goal      string      `json:"goal"`
+	Model     string      `json:"model,omitempty"`
+	Status    string      `json:"status"`
+	CreatedAt time.Time   `json:"created_at"`
+	UpdatedAt time.Time   `json:"updated_at"`
+	Steps     []*goalStep `json:"steps"`
+	// Replans counts the times the goal was re-planned after a step failed
+	Replans int `json:"replans,omitempty"`
+	// Clarifications are the questions the planner asked along with their answers
+	Clarifications []*goalClarification `json:"clarifications,omitempty"`
+	// Planner is the history of the planning conversation
+	Planner []api.Message `json:"planner,omitempty"`
+}
+
+// goalClarification is a question asked by the planner and how it was answered
+type goalClarification struct {
+	Question string    `json:"question"`
+	Answer   string    `json:"answer,omitempty"`
+	Error    string    `json:"error,omitempty"`
+	Time     time.Time `json:"time"`
+}
+
+// goalStep is a single step of a plan
+type goalStep struct {
+	Description string     `json:"description"`
+	Status      string     `json:"status"`
+	StartedAt   *time.Time `json:"started_at,omitempty"`
+	FinishedAt  *time.Time `json:"finished_at,omitempty"`
+	// ToolCalls are the tools called while carrying out the step
+	ToolCalls []*goalToolCall `json:"tool_calls,omitempty"`
+	// Result is the final answer of the conversation carrying out the step
+	Result string `json:"result,omitempty"`
+	// Failure describes why the step failed
+	Failure string `json:"failure,omitempty"`
+}
+
+// goalToolCall is a tool called while carrying out a step along with its output
+type goalToolCall struct {
+	ID        string         `json:"id,omitempty"`
+	Name      string         `json:"name"`
+	Arguments map[string]any `json:"arguments,omitempty"`
+	Output    string         `json:"output,omitempty"`
+	Error     string         `json:"error,omitempty"`
+	Time      time.Time      `json:"time"`
+}
+
+// newGoalID names a goal by the time it was started with a random suffix to tell apart goals started together
+func newGoalID(now time.Time) string {
+	suffix := make([]byte, 2)
+	_, _ = rand.Read(suffix)
+	return fmt.Sprintf("%s-%s", now.Format("20060102-150405"), hex.EncodeToString(suffix))
+}
+
+// add appends pending steps to the plan
+func (p *goalPlan) add(descriptions []string) {
+	for _, description := range descriptions {
+		p.Steps = append(p.Steps, &goalStep{Description: description, Status: stepPending})
+	}
+}
+
+// next is the first pending step and its index, or nil when none remain
+func (p *goalPlan) next() (int, *goalStep) {
+	for i, step := range p.Steps {
+		if step.Status == stepPending {
+			return i, step
+		}
+	}
+	return -1, nil
+}
+
+// resetInterrupted returns steps left running by an interrupted goal to pending so they are carried out again.  The
+// tool calls the step already made are kept so it may continue from them rather than repeat them.
+func (p *goalPlan) resetInterrupted() {
+	for _, step := range p.Steps {
+		if step.Status == stepRunning {
+			step.Status = stepPending
+			step.StartedAt = nil
+		}
+	}
+}
+
+// retryFailed returns the last failed step to pending so a failed goal may be retried from it
+func (p *goalPlan) retryFailed() {
+	for i := len(p.Steps) - 1; i >= 0; i-- {
+		step := p.Steps[i]
+		if step.Status != stepFailed {
+			continue
+		}
+		step.Status = stepPending
+		step.StartedAt, step.FinishedAt = nil, nil
+		step.ToolCalls = nil
+		step.Result, step.Failure = "", ""
+		return
+	}
+}
+
+// skipPending marks the steps not yet run as skipped so a revised plan may replace them
+func (p *goalPlan) skipPending() {
+	for _, step := range p.Steps {
+		if step.Status == stepPending {
+			step.Status = stepSkipped
+		}
+	}
+}
+
+// describe lists each step with its status
+func (p *goalPlan) describe() string {
+	var out strings.Builder
+	fmt.Fprintf(&out, "Goal: %s\n", p.Goal)
+	for i, step := range p.Steps {
+		fmt.Fprintf(&out, "%d. [%s] %s\n", i+1, step.Status, step.Description)
+	}
+	return out.String()
+}
+
+// summary reports the outcome of each step
+func (p *goalPlan) summary() string {
+	var out strings.Builder
+	fmt.Fprintf(&out, "Goal: %s\n", p.Goal)
+	for i, step := range p.Steps {
+		fmt.Fprintf(&out, "%d. [%s] %s\n", i+1, step.Status, step.Description)
+		if step.Failure != "" {
+			fmt.Fprintf(&out, "   failure: %s\n", step.Failure)
+		}
+		if result := strings.TrimSpace(step.Result); result != "" {
+			fmt.Fprintf(&out, "   %s\n", strings.ReplaceAll(result, "\n", "\n   "))
+		}
+	}
+	return out.String()
+}
+
+// details reports the goal with the timestamps, tool calls, outputs and results of each step
+func (p *goalPlan) details() string {
+	var out strings.Builder
+	fmt.Fprintf(&out, "Goal: %s\nID: %s\nStatus: %s\n", p.Goal, p.ID, p.Status)
+	if p.Model != "" {
+		fmt.Fprintf(&out, "Model: %s\n", p.Model)
+	}
+	fmt.Fprintf(&out, "Created: %s\nUpdated: %s\n", p.CreatedAt.Format(time.RFC3339), p.UpdatedAt.Format(time.RFC3339))
+	if p.Replans > 0 {
+		fmt.Fprintf(&out, "Re-planned: %d times\n", p.Replans)
+	}
+	for _, clarification := range p.Clarifications {
+		fmt.Fprintf(&out, "\nQuestion: %s\n", clarification.Question)
+		if clarification.Error != "" {
+			fmt.Fprintf(&out, "Unanswered: %s\n", clarification.Error)
+		} else {
+			fmt.Fprintf(&out, "Answer: %s\n", clarification.Answer)
+		}
+	}
+	for i, step := range p.Steps {
+		fmt.Fprintf(&out, "\n%d. [%s] %s\n", i+1, step.Status, step.Description)
+		if step.StartedAt != nil {
+			fmt.Fprintf(&out, "   started:  %s\n", step.StartedAt.Format(time.RFC3339))
+		}
+		if step.FinishedAt != nil {
+			fmt.Fprintf(&out, "   finished: %s\n", step.FinishedAt.Format(time.RFC3339))
+		}
+		for _, call := range step.ToolCalls {
+			fmt.Fprintf(&out, "   call %s %s\n", call.Name, brief(call.Arguments))
+			if call.Error != "" {
+				fmt.Fprintf(&out, "     error: %s\n", call.Error)
+			} else if call.Output != "" {
+				fmt.Fprintf(&out, "     output: %s\n", strings.ReplaceAll(strings.TrimSpace(call.Output), "\n", "\n             "))
+			}
+		}
+		if step.Failure != "" {
+			fmt.Fprintf(&out, "   failure: %s\n", step.Failure)
+		}
+		if result := strings.TrimSpace(step.Result); result != "" {
+			fmt.Fprintf(&out, "   result: %s\n", strings.ReplaceAll(result, "\n", "\n           "))
+		}
+	}
+	return out.String()
+}
+
+// progress describes the plan to the conversation carrying out the step at index
+func (p *goalPlan) progress(index int) string {
+	var out strings.Builder
+	fmt.Fprintf(&out, "You are carrying out one step of a plan to achieve the goal: %s\nThe plan is:\n", p.Goal)
+	for i, step := range p.Steps {
+		if step.Status == stepSkipped {
+			continue
+		}
+		fmt.Fprintf(&out, "%d. [%s] %s\n", i+1, step.Status, step.Description)
+	}
+	for i, step := range p.Steps[:index] {
+		if step.Status == stepDone && step.Result != "" {
+			fmt.Fprintf(&out, "\nOutcome of step %d:\n%s\n", i+1, step.Result)
+		}
+	}
+	out.WriteString("\nUse the available tools to carry out only the step you are given, then answer with its outcome.  " +
+		"If the step can not be carried out, call the step_failed tool with the reason.")
+	return out.String()
+}
+
+// alreadyCalled describes the tool calls made by the step before it was interrupted, or is empty when none were
+func (s *goalStep) alreadyCalled() string {
+	if len(s.ToolCalls) == 0 {
+		return ""
+	}
+	var out strings.Builder
+	for _, call := range s.ToolCalls {
+		fmt.Fprintf(&out, "- %s %s", call.Name, brief(call.Arguments))
+		switch {
+		case call.Error != "":
+			fmt.Fprintf(&out, " failed: %s\n", call.Error)
+		case call.Output != "":
+			fmt.Fprintf(&out, " returned: %s\n", strings.TrimSpace(call.Output))
+		default:
+			out.WriteString(" was interrupted before returning\n")
+		}
+	}
+	return out.String()
+}
+
+func stepEvent(index int, step *goalStep) Event {
+	return Event{Type: EventStep, Step: index + 1, Status: step.Status, Content: step.Description, Error: step.Failure}
+}
+
+// stepRecorder forwards the events of the conversation carrying out a step, recording its tool calls and outputs
+type stepRecorder struct {
+	lock sync.Mutex
+	next eventSink
+	step *goalStep
+	// changed is told when a tool call is recorded or completes
+	changed func()
+}
+
+func (s *stepRecorder) emit(e Event) {
+	s.next.emit(e)
+	switch e.Type {
+	case EventToolCall:
+		s.lock.Lock()
+		s.step.ToolCalls = append(s.step.ToolCalls, &goalToolCall{ID: e.ToolCallID, Name: e.ToolName, Arguments: e.Arguments, Time: time.Now()})
+		s.lock.Unlock()
+	case EventToolResult:
+		s.lock.Lock()
+		for _, call := range s.step.ToolCalls {
+			if call.ID == e.ToolCallID && call.Name == e.ToolName {
+				call.Output += e.Content
+				if e.Error != "" {
+					call.Error = e.Error
+				}
+			}
+		}
+		s.lock.Unlock()
+		s.changed()
+	}
+}
+
+// reasoningStep collects the steps proposed by the planner
+type reasoningStep struct {
+	lock  sync.Mutex
+	steps []string
+}
+
+func (r *reasoningStep) invoke(ctx context.Context, call api.ToolCall) (out []api.Message, problem error) {
+	slog.Debug("invoked reasoning step", logging.Component, "goal", "arguments", call.Function.Arguments.String())
+	step, ok := call.Function.Arguments["step"].(string)
+	if !ok || strings.TrimSpace(step) == "" {
+		return []api.Message{toolResponseMessage(call, `{"error":"the step argument must be a non-empty string"}`)}, nil
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.steps = append(r.steps, strings.TrimSpace(step))
+	return []api.Message{toolResponseMessage(call, fmt.Sprintf("recorded step %d", len(r.steps)))}, nil
+}
+
+func (r *reasoningStep) defineAPI(ctx context.Context) (definition *toolDefinition, problem error) {
+	return &toolDefinition{tool: api.Tools{
+		{
+			Type: "function",
+			Function: api.ToolFunction{
+				Name:        "reasoning_step",
+				Description: "Defines a small and finite step to approach the problem.  Call once for each step, in order.",
+				Parameters: api.ToolFunctionParameters{
+					Type:     mcpParameterTypeObject,
+					Required: []string{"step"},
+					Properties: map[string]api.ToolProperty{
+						"step": {
+							Type:        []string{mcpParameterTypeString},
+							Description: "Defines the step to be taken",
+						},
+					},
+				},
+			},
+		},
+	}}, nil
+}
+
+// take returns the steps proposed since it was last called
+func (r *reasoningStep) take() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	steps := r.steps
+	r.steps = nil
+	return steps
+}
+
+// listedStep matches an entry of a numbered or bulleted list
+var listedStep = regexp.MustCompile(`^\s*(?:\d+[.)]|[-*])\s+(.+)$`)
+
+// listedSteps extracts the entries of a list from the answer of a planner which did not call reasoning_step
+func listedSteps(answer string) (steps []string) {
+	for _, line := range strings.Split(answer, "\n") {
+		if match := listedStep.FindStringSubmatch(line); match != nil {
+			steps = append(steps, strings.TrimSpace(match[1]))
+		}
+	}
+	return steps
+}
+
+// stepFailure lets the conversation carrying out a step report it could not be done
+type stepFailure struct {
+	lock   sync.Mutex
+	reason string
+}
+
+func (s *stepFailure) invoke(ctx context.Context, call api.ToolCall) (out []api.Message, problem error) {
+	reason, _ := call.Function.Arguments["reason"].(string)
+	if strings.TrimSpace(reason) == "" {
+		reason = "no reason given"
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.reason = reason
+	return []api.Message{toolResponseMessage(call, "recorded the failure; stop and answer with what was attempted")}, nil
+}
+
+func (s *stepFailure) defineAPI(ctx context.Context) (definition *toolDefinition, problem error) {
+	return &toolDefinition{tool: api.Tools{
+		{
+			Type: "function",
+			Function: api.ToolFunction{
+				Name:        "step_failed",
+				Description: "Reports the current step of the plan can not be carried out",
+				Parameters: api.ToolFunctionParameters{
+					Type:     mcpParameterTypeObject,
+					Required: []string{"reason"},
+					Properties: map[string]api.ToolProperty{
+						"reason": {
+							Type:        []string{mcpParameterTypeString},
+							Description: "Why the step can not be carried out",
+						},
+					},
+				},
+			},
+		},
+	}}, nil
+}
+
+// take returns the reported failure, if any, clearing it for the next step
+func (s *stepFailure) take() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	reason := s.reason
+	s.reason = ""
+	return reason
+}
+
+// planApprover decides whether a plan is carried out
+type planApprover interface {
+	approve(ctx context.Context, plan *goalPlan) (bool, error)
+}
+
+// terminalApprover shows the plan through out and reads the decision from in
+type terminalApprover struct {
+	in  *lineReader
+	out io.Writer
+}
+
+func (t *terminalApprover) approve(ctx context.Context, plan *goalPlan) (bool, error) {
+	fmt.Fprint(t.out, plan.describe())
+	fmt.Fprint(t.out, "Carry out this plan? [y/N] ")
+	input, err := t.in.readLine(ctx)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return false, err
+	}
+	switch strings.ToLower(strings.TrimSpace(input)) {
+	case "y", "yes":
+		return true, nil
+	default:
+		return false, nil
+	}
+}
+
+// approveAll carries out every plan without asking
+type approveAll struct{}
+
+func (approveAll) approve(ctx context.Context, plan *goalPlan) (bool, error) {
+	return true, nil
+}
@@ -0,0 +1,135 @@
+package query
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// DefaultGoalDirectory is where goal plans are persisted relative to the working directory.
+const DefaultGoalDirectory = ".marvin/goals"
+
+const goalFileExtension = ".json"
+
+// GoalSummary describes a persisted goal without the details of each step.
+type GoalSummary struct {
+	ID        string
+	Goal      string
+	Status    string
+	Steps     int
+	Done      int
+	UpdatedAt time.Time
+}
+
+// GoalStore persists goal plans as JSON documents within a directory.
+type GoalStore struct {
+	directory string
+}
+
+func NewGoalStore(directory string) *GoalStore {
+	return &GoalStore{directory: directory}
+}
+
+func (s *GoalStore) path(id string) (string, error) {
+	if id == "" || id == "." || id == ".." || strings.ContainsAny(id, `/\`) {
+		return "", fmt.Errorf("invalid goal id %q", id)
+	}
+	return filepath.Join(s.directory, id+goalFileExtension), nil
+}
+
+// load retrieves the plan of the goal, failing when it does not exist.
+func (s *GoalStore) load(id string) (*goalPlan, error) {
+	path, err := s.path(id)
+	if err != nil {
+		return nil, err
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, fmt.Errorf("no such goal %q", id)
+		}
+		return nil, &operationalError{fmt.Sprintf("reading goal %q", id), err}
+	}
+	plan := &goalPlan{}
+	if err := json.Unmarshal(content, plan); err != nil {
+		return nil, &operationalError{fmt.Sprintf("parsing goal %q", id), err}
+	}
+	return plan, nil
+}
+
+// save writes the plan, replacing any previous version atomically.
+func (s *GoalStore) save(plan *goalPlan) error {
+	path, err := s.path(plan.ID)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.directory, 0o755); err != nil {
+		return &operationalError{"creating goal directory", err}
+	}
+	now := time.Now()
+	if plan.CreatedAt.IsZero() {
+		plan.CreatedAt = now
+	}
+	plan.UpdatedAt = now
+	content, err := json.MarshalIndent(plan, "", "  ")
+	if err != nil {
+		return &operationalError{fmt.Sprintf("encoding goal %q", plan.ID), err}
+	}
+	temporary := path + ".tmp"
+	if err := os.WriteFile(temporary, content, 0o644); err != nil {
+		return &operationalError{fmt.Sprintf("writing goal %q", plan.ID), err}
+	}
+	if err := os.Rename(temporary, path); err != nil {
+		return &operationalError{fmt.Sprintf("replacing goal %q", plan.ID), err}
+	}
+	return nil
+}
+
+// List summarizes all goals within the store ordered by id, which is the order they were started in.
+func (s *GoalStore) List() ([]GoalSummary, error) {
+	entries, err := os.ReadDir(s.directory)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, &operationalError{"listing goals", err}
+	}
+	var out []GoalSummary
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != goalFileExtension {
+			continue
+		}
+		plan, err := s.load(strings.TrimSuffix(entry.Name(), goalFileExtension))
+		if err != nil {
+			return nil, err
+		}
+		summary := GoalSummary{ID: plan.ID, Goal: plan.Goal, Status: plan.Status, UpdatedAt: plan.UpdatedAt}
+		for _, step := range plan.Steps {
+			if step.Status == stepSkipped {
+				continue
+			}
+			summary.Steps++
+			if step.Status == stepDone {
+				summary.Done++
+			}
+		}
+		out = append(out, summary)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].ID < out[j].ID })
+	return out, nil
+}
+
+// Details reports the goal with the timestamps, tool calls, outputs and results of each step.
+func (s *GoalStore) Details(id string) (string, error) {
+	plan, err := s.load(id)
+	if err != nil {
+		return "", err
+	}
+	return plan.details(), nil
+}
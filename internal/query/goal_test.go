@@ -0,0 +1,316 @@
+package query
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/meschbach/marvin/internal/backend"
+	"github.com/meschbach/marvin/internal/config"
+	"github.com/ollama/ollama/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func planSteps(steps ...string) backend.ScriptedReply {
+	reply := backend.ScriptedReply{}
+	for i, step := range steps {
+		reply.ToolCalls = append(reply.ToolCalls, backend.ToolCall(fmt.Sprintf("step-%d", i), "reasoning_step", map[string]any{"step": step}))
+	}
+	return reply
+}
+
+// stepsOf returns the step events in the order they were emitted as "number status" pairs
+func stepsOf(events *recordedEvents) (progress []string) {
+	for _, e := range events.ofType(EventStep) {
+		progress = append(progress, fmt.Sprintf("%d %s", e.Step, e.Status))
+	}
+	return progress
+}
+
+func TestPursueGoal_AsksForClarification(t *testing.T) {
+	script := backend.NewScripted(
+		backend.CallTools(backend.ToolCall("q", "reasoning_clairifying_question", map[string]any{"prompt": "Which day?"})),
+		backend.Reply("1. Book the room for Tuesday"),
+		backend.Reply("Booked."),
+	)
+	var prompted bytes.Buffer
+	clarifier := &questionForUser{answerer: &terminalAnswerer{in: newLineReader(strings.NewReader("Tuesday\n")), out: &prompted}}
+	events := &recordedEvents{}
+	plan := &goalPlan{Goal: "book a meeting room"}
+
+	err := pursueGoal(context.Background(), script, &config.File{Model: "planner"}, plan, &GoalOptions{}, events, clarifier, approveAll{}, nil, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "ai> Which day?\n", prompted.String())
+	require.Len(t, plan.Clarifications, 1)
+	assert.Equal(t, "Which day?", plan.Clarifications[0].Question)
+	assert.Equal(t, "Tuesday", plan.Clarifications[0].Answer)
+
+	requests := script.Requests()
+	require.Len(t, requests, 3)
+	assert.Equal(t, "planner", requests[0].Model)
+	var planningTools []string
+	for _, tool := range requests[0].Tools {
+		planningTools = append(planningTools, tool.Function.Name)
+	}
+	assert.Equal(t, []string{"reasoning_step", "reasoning_clairifying_question"}, planningTools)
+	first := requests[0].Messages
+	assert.Equal(t, "book a meeting room", first[len(first)-1].Content)
+
+	followUp := requests[1].Messages
+	answer := followUp[len(followUp)-1]
+	assert.Equal(t, roleTool, answer.Role)
+	assert.Equal(t, "q", answer.ToolCallID)
+	assert.Equal(t, "Tuesday", answer.Content)
+
+	execution := requests[2].Messages
+	assert.Equal(t, "Carry out step 1: Book the room for Tuesday", execution[len(execution)-1].Content)
+
+	notices := events.ofType(EventNotice)
+	require.Len(t, notices, 2)
+	assert.Equal(t, "book a meeting room", notices[0].Content)
+	assert.Equal(t, `"Which day?" answered "Tuesday"`, notices[1].Content)
+}
+
+func TestPursueGoal_ClarificationRequiresPrompt(t *testing.T) {
+	script := backend.NewScripted(backend.CallTools(backend.ToolCall("q", "reasoning_clairifying_question", nil)))
+	clarifier := &questionForUser{answerer: failClarification{}}
+
+	err := pursueGoal(context.Background(), script, nil, &goalPlan{Goal: "anything"}, &GoalOptions{}, &recordedEvents{}, clarifier, approveAll{}, nil, nil)
+	assert.Equal(t, ExitToolInvocation, ExitCode(err))
+}
+
+func TestPursueGoal_CarriesOutApprovedPlan(t *testing.T) {
+	script := backend.NewScripted(
+		planSteps("Find a free room", "Book it"),
+		backend.Reply("The plan is ready."),
+		backend.Reply("Room 4 is free."),
+		backend.Reply("Booked room 4."),
+	)
+	var shown bytes.Buffer
+	approver := &terminalApprover{in: newLineReader(strings.NewReader("y\n")), out: &shown}
+	events := &recordedEvents{}
+
+	err := pursueGoal(context.Background(), script, nil, &goalPlan{Goal: "book a meeting room"}, &GoalOptions{}, events, &questionForUser{}, approver, nil, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "Goal: book a meeting room\n1. [pending] Find a free room\n2. [pending] Book it\nCarry out this plan? [y/N] ", shown.String())
+	assert.Equal(t, []string{"1 pending", "2 pending", "1 running", "1 done", "2 running", "2 done"}, stepsOf(events))
+
+	requests := script.Requests()
+	require.Len(t, requests, 4)
+	var executionTools []string
+	for _, tool := range requests[3].Tools {
+		executionTools = append(executionTools, tool.Function.Name)
+	}
+	assert.Equal(t, []string{"step_failed"}, executionTools)
+	second := requests[3].Messages
+	assert.Equal(t, "Carry out step 2: Book it", second[len(second)-1].Content)
+	assert.Contains(t, second[len(second)-2].Content, "Outcome of step 1:\nRoom 4 is free.")
+
+	answers := events.ofType(EventAnswer)
+	require.Len(t, answers, 1)
+	assert.Equal(t, "Goal: book a meeting room\n1. [done] Find a free room\n   Room 4 is free.\n2. [done] Book it\n   Booked room 4.\n", answers[0].Content)
+}
+
+func TestPursueGoal_CompactsTheStepConversations(t *testing.T) {
+	script := backend.NewScripted(
+		planSteps("Read the inbox", "Reply to each message"),
+		backend.Reply("The plan is ready."),
+		backend.Reply(strings.Repeat("A long message. ", 500)),
+		backend.Reply("Replied."),
+	)
+	approver := &terminalApprover{in: newLineReader(strings.NewReader("y\n")), out: io.Discard}
+	events := &recordedEvents{}
+	cfg := &config.File{Context: &config.ContextBlock{NumCtx: 1000, Strategy: "sliding_window", KeepRecent: 1}}
+
+	err := pursueGoal(context.Background(), script, cfg, &goalPlan{Goal: "answer my mail"}, &GoalOptions{}, events, &questionForUser{}, approver, nil, nil)
+	require.NoError(t, err)
+	var compacted bool
+	for _, e := range events.ofType(EventNotice) {
+		compacted = compacted || e.Source == "context"
+	}
+	assert.True(t, compacted, "the outcome of the first step overflows the context window of the second")
+	second := script.Requests()[3].Messages
+	assert.Equal(t, "Carry out step 2: Reply to each message", second[len(second)-1].Content)
+}
+
+func TestPursueGoal_ReplansFailedStep(t *testing.T) {
+	script := backend.NewScripted(
+		planSteps("Book room 4", "Send the invitation"),
+		backend.Reply("Planned."),
+		backend.CallTools(backend.ToolCall("f", "step_failed", map[string]any{"reason": "room 4 is taken"})),
+		backend.Reply("Room 4 could not be booked."),
+		planSteps("Book room 5", "Send the invitation"),
+		backend.Reply("Re-planned."),
+		backend.Reply("Booked room 5."),
+		backend.Reply("Invitation sent."),
+	)
+	events := &recordedEvents{}
+
+	err := pursueGoal(context.Background(), script, nil, &goalPlan{Goal: "book a meeting room"}, &GoalOptions{MaxReplans: 1}, events, &questionForUser{}, approveAll{}, nil, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 0, script.Remaining())
+
+	replan := script.Requests()[4].Messages
+	assert.Equal(t, "Step 1, \"Book room 4\", failed: room 4 is taken\nThe steps completed so far are:\nnone\nEnumerate the remaining steps needed to achieve the goal via the reasoning_step tool.", replan[len(replan)-1].Content)
+
+	answers := events.ofType(EventAnswer)
+	require.Len(t, answers, 1)
+	assert.Equal(t, `Goal: book a meeting room
+1. [failed] Book room 4
+   failure: room 4 is taken
+   Room 4 could not be booked.
+2. [skipped] Send the invitation
+3. [done] Book room 5
+   Booked room 5.
+4. [done] Send the invitation
+   Invitation sent.
+`, answers[0].Content)
+}
+
+func TestPursueGoal_StopsWhenOutOfReplans(t *testing.T) {
+	script := backend.NewScripted(
+		planSteps("Book room 4"),
+		backend.Reply("Planned."),
+		backend.CallTools(backend.ToolCall("f", "step_failed", map[string]any{"reason": "room 4 is taken"})),
+		backend.Reply("Room 4 could not be booked."),
+	)
+
+	err := pursueGoal(context.Background(), script, nil, &goalPlan{Goal: "book a meeting room"}, &GoalOptions{}, &recordedEvents{}, &questionForUser{}, approveAll{}, nil, nil)
+	assert.ErrorContains(t, err, "step 1 failed: room 4 is taken")
+}
+
+func TestPursueGoal_DeclinedPlan(t *testing.T) {
+	script := backend.NewScripted(planSteps("Delete every message"), backend.Reply("Planned."))
+	approver := &terminalApprover{in: newLineReader(strings.NewReader("n\n")), out: &bytes.Buffer{}}
+
+	err := pursueGoal(context.Background(), script, nil, &goalPlan{Goal: "clean up my inbox"}, &GoalOptions{}, &recordedEvents{}, &questionForUser{}, approver, nil, nil)
+	assert.ErrorIs(t, err, errPlanDeclined)
+	assert.Len(t, script.Requests(), 2, "no step is carried out")
+}
+
+// interruptingBackend cancels the goal in place of the chat request numbered interruptAt, counted from one
+type interruptingBackend struct {
+	backend.Backend
+	cancel      context.CancelFunc
+	interruptAt int
+	requests    int
+}
+
+func (i *interruptingBackend) Chat(ctx context.Context, req *api.ChatRequest, fn api.ChatResponseFunc) error {
+	i.requests++
+	if i.requests == i.interruptAt {
+		i.cancel()
+		return ctx.Err()
+	}
+	return i.Backend.Chat(ctx, req, fn)
+}
+
+func TestPursueGoal_PersistsAndResumesFailedGoal(t *testing.T) {
+	store := NewGoalStore(t.TempDir())
+	plan := &goalPlan{ID: "meeting", Goal: "book a meeting room"}
+	script := backend.NewScripted(
+		planSteps("Find a free room", "Book it"),
+		backend.Reply("Planned."),
+		backend.CallTools(backend.ToolCall("c", "rooms.free", map[string]any{"floor": 2})),
+		backend.Reply("Room 4 is free."),
+		backend.ScriptedReply{Err: errors.New("model unloaded")},
+	)
+
+	err := pursueGoal(context.Background(), script, nil, plan, &GoalOptions{}, &recordedEvents{}, &questionForUser{}, approveAll{}, store, nil)
+	assert.ErrorContains(t, err, "step 2 failed")
+
+	saved, err := store.load("meeting")
+	require.NoError(t, err)
+	assert.Equal(t, goalFailed, saved.Status)
+	assert.Equal(t, config.DefaultLanguageModel, saved.Model)
+	assert.NotEmpty(t, saved.Planner)
+	require.Len(t, saved.Steps, 2)
+	found := saved.Steps[0]
+	assert.Equal(t, stepDone, found.Status)
+	assert.NotNil(t, found.StartedAt)
+	assert.NotNil(t, found.FinishedAt)
+	assert.Equal(t, "Room 4 is free.", found.Result)
+	require.Len(t, found.ToolCalls, 1)
+	assert.Equal(t, "rooms.free", found.ToolCalls[0].Name)
+	assert.Contains(t, found.ToolCalls[0].Output, "tool not found")
+	assert.Equal(t, stepFailed, saved.Steps[1].Status)
+
+	summaries, err := store.List()
+	require.NoError(t, err)
+	assert.Equal(t, []GoalSummary{{ID: "meeting", Goal: "book a meeting room", Status: goalFailed, Steps: 2, Done: 1, UpdatedAt: saved.UpdatedAt}}, summaries)
+	details, err := store.Details("meeting")
+	require.NoError(t, err)
+	assert.Contains(t, details, "1. [done] Find a free room\n   started:  ")
+	assert.Contains(t, details, "   call rooms.free {\"floor\":2}\n     output: ")
+	assert.Contains(t, details, "2. [failed] Book it\n")
+
+	resumed := backend.NewScripted(backend.Reply("Booked room 4."))
+	err = pursueGoal(context.Background(), resumed, nil, saved, &GoalOptions{}, &recordedEvents{}, &questionForUser{}, approveAll{}, store, nil)
+	require.NoError(t, err)
+	requests := resumed.Requests()
+	require.Len(t, requests, 1, "only the failed step is carried out again")
+	assert.Equal(t, "Carry out step 2: Book it", requests[0].Messages[len(requests[0].Messages)-1].Content)
+
+	finished, err := store.load("meeting")
+	require.NoError(t, err)
+	assert.Equal(t, goalDone, finished.Status)
+	assert.Equal(t, "Booked room 4.", finished.Steps[1].Result)
+	assert.Empty(t, finished.Steps[1].Failure)
+}
+
+func TestPursueGoal_ResumesInterruptedStep(t *testing.T) {
+	store := NewGoalStore(t.TempDir())
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	client := &interruptingBackend{
+		Backend: backend.NewScripted(
+			planSteps("Find a free room"),
+			backend.Reply("Planned."),
+			backend.CallTools(backend.ToolCall("c", "rooms.free", map[string]any{"floor": 2})),
+		),
+		cancel:      cancel,
+		interruptAt: 4,
+	}
+
+	err := pursueGoal(ctx, client, nil, &goalPlan{ID: "meeting", Goal: "book a meeting room"}, &GoalOptions{}, &recordedEvents{}, &questionForUser{}, approveAll{}, store, nil)
+	assert.ErrorIs(t, err, context.Canceled)
+	saved, err := store.load("meeting")
+	require.NoError(t, err)
+	assert.Equal(t, goalRunning, saved.Status)
+	assert.Equal(t, stepRunning, saved.Steps[0].Status)
+
+	require.Len(t, saved.Steps[0].ToolCalls, 1)
+
+	resumed := backend.NewScripted(backend.Reply("Room 4 is free."))
+	events := &recordedEvents{}
+	err = pursueGoal(context.Background(), resumed, nil, saved, &GoalOptions{}, events, &questionForUser{}, approveAll{}, store, nil)
+	require.NoError(t, err)
+	require.Len(t, resumed.Requests(), 1)
+	messages := resumed.Requests()[0].Messages
+	assert.Contains(t, messages[len(messages)-2].Content, "- rooms.free {\"floor\":2} returned: ", "the model is told what the step already did")
+	var notices []string
+	for _, notice := range events.ofType(EventNotice) {
+		notices = append(notices, notice.Content)
+	}
+	assert.Contains(t, strings.Join(notices, "\n"), "step 1 was interrupted after these tool calls", "the person is shown what was already done")
+	finished, err := store.load("meeting")
+	require.NoError(t, err)
+	assert.Equal(t, stepDone, finished.Steps[0].Status)
+	assert.Len(t, finished.Steps[0].ToolCalls, 1, "the calls made before the interruption are kept")
+}
+
+func TestGoalStore_RejectsUnknownGoals(t *testing.T) {
+	store := NewGoalStore(t.TempDir())
+	_, err := store.Details("absent")
+	assert.EqualError(t, err, `no such goal "absent"`)
+	_, err = store.load("../escape")
+	assert.Error(t, err)
+	goals, err := store.List()
+	require.NoError(t, err)
+	assert.Empty(t, goals)
+}
@@ -0,0 +1,77 @@
+package query
+
+import (
+	"context"
+
+	"github.com/mark3labs/mcp-go/client/transport"
+	"github.com/meschbach/marvin/internal/cassette"
+	"github.com/meschbach/marvin/internal/config"
+)
+
+// FromHTTPSpec constructs a tool reaching the MCP server at the URL of the configuration.  The configuration is
+// expected to have been validated.
+func FromHTTPSpec(cfg *config.HTTPMCPBlock) *Mark3labsTool {
+	timeout, _ := cfg.ResolveTimeout()
+	return &Mark3labsTool{
+		Name: cfg.Name,
+		spec: &httpRuntimeSpec{
+			url:       cfg.URL,
+			transport: cfg.ResolveTransport(),
+			headers:   cfg.Headers,
+		},
+		serial:  cfg.Serial,
+		timeout: timeout,
+	}
+}
+
+// httpRuntimeSpec connects to an MCP server already running as an HTTP service
+type httpRuntimeSpec struct {
+	url       string
+	transport string
+	headers   map[string]string
+}
+
+func (h *httpRuntimeSpec) start(ctx context.Context) (runningProgram, error) {
+	var mcpTransport transport.Interface
+	var err error
+	switch h.transport {
+	case config.HTTPTransportSSE:
+		mcpTransport, err = transport.NewSSE(h.url, transport.WithHeaders(h.headers))
+	default:
+		mcpTransport, err = transport.NewStreamableHTTP(h.url, transport.WithHTTPHeaders(h.headers))
+	}
+	if err != nil {
+		return nil, &operationalError{"connecting to " + h.url, err}
+	}
+	return &httpConnection{mcpTransport}, nil
+}
+
+// httpConnection is the session with the HTTP service.  The service outlives marvin, so stopping leaves it running and
+// the MCP client closes the session.
+type httpConnection struct {
+	mcpTransport transport.Interface
+}
+
+func (h *httpConnection) transport() transport.Interface {
+	return h.mcpTransport
+}
+
+func (h *httpConnection) stop(ctx context.Context) error {
+	return nil
+}
+
+func (ts *ToolSet) loadToolsFromHTTP(ctx context.Context, cfg *config.File, traffic *cassette.Deck) error {
+	for _, server := range cfg.HTTPMCP {
+		tool := ts.servers.use(server.Name, func() *Mark3labsTool {
+			tool := FromHTTPSpec(server)
+			tool.sampler = newMCPSampler(server.Name, server.Sampling, cfg, traffic)
+			tool.elicitor = ts.elicitation.forServer(server.Name)
+			tool.recordTo(traffic)
+			return tool
+		})
+		if err := ts.registerTool(ctx, tool); err != nil {
+			return &toolStartupError{name: server.Name, underlying: err}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+package query
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"testing"
+
+	"github.com/mark3labs/mcp-go/server"
+	"github.com/meschbach/marvin/internal/backend"
+	"github.com/meschbach/marvin/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// askTheHTTPClock asks the clock served over HTTP for the time through a toolset built from the block
+func askTheHTTPClock(t *testing.T, block *config.HTTPMCPBlock) *ollamaConversation {
+	t.Helper()
+	require.NoError(t, block.Validate())
+	ctx := context.Background()
+	tools, err := NewToolSet(ctx, &config.File{HTTPMCP: []*config.HTTPMCPBlock{block}}, nil)
+	require.NoError(t, err)
+	defer func() {
+		assert.NoError(t, tools.Shutdown(ctx))
+	}()
+	assert.Contains(t, toolNames(tools.APITools()), "clock.now")
+
+	script := backend.NewScripted(
+		backend.CallTools(backend.ToolCall("1", "clock.now", map[string]any{"zone": "UTC"})),
+		backend.Reply("It is noon."),
+	)
+	conversation, _ := scriptedConversation(script, tools)
+	require.NoError(t, conversation.runAIToConclusion(ctx, "scripted", tools.APITools()))
+	return conversation
+}
+
+func TestHTTPMCP_StreamableHTTP(t *testing.T) {
+	var lock sync.Mutex
+	var authorization []string
+	service := server.NewTestStreamableHTTPServer(clockServer(), server.WithHTTPContextFunc(func(ctx context.Context, r *http.Request) context.Context {
+		lock.Lock()
+		defer lock.Unlock()
+		authorization = append(authorization, r.Header.Get("Authorization"))
+		return ctx
+	}))
+	defer service.Close()
+
+	conversation := askTheHTTPClock(t, &config.HTTPMCPBlock{
+		Name:    "clock",
+		URL:     service.URL + "/mcp",
+		Headers: map[string]string{"Authorization": "Bearer secret"},
+		Timeout: "5s",
+	})
+	assert.Equal(t, "12:00 UTC", conversation.messages[len(conversation.messages)-2].Content)
+	lock.Lock()
+	defer lock.Unlock()
+	require.NotEmpty(t, authorization)
+	for _, header := range authorization {
+		assert.Equal(t, "Bearer secret", header)
+	}
+}
+
+func TestHTTPMCP_SSE(t *testing.T) {
+	service := server.NewTestServer(clockServer())
+	defer service.Close()
+
+	conversation := askTheHTTPClock(t, &config.HTTPMCPBlock{
+		Name:      "clock",
+		URL:       service.URL + "/sse",
+		Transport: config.HTTPTransportSSE,
+	})
+	assert.Equal(t, "12:00 UTC", conversation.messages[len(conversation.messages)-2].Content)
+}
+
+func TestHTTPMCP_UnreachableServerFailsStartup(t *testing.T) {
+	_, err := NewToolSet(context.Background(), &config.File{HTTPMCP: []*config.HTTPMCPBlock{{Name: "clock", URL: "http://127.0.0.1:1/mcp", Timeout: "1s"}}}, nil)
+	require.Error(t, err)
+	assert.Equal(t, ExitToolStartup, ExitCode(err))
+}
@@ -0,0 +1,138 @@
+package query
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mark3labs/mcp-go/client"
+	"github.com/mark3labs/mcp-go/mcp"
+)
+
+// invocationDeadlines bound the tool calls in progress on an MCP server.  While answering a call the server may make
+// requests of its own, such as sampling the model or asking the person at the terminal.  The time taken to answer them
+// does not count against the calls, and they are given up once no call is left waiting on them.
+type invocationDeadlines struct {
+	lock sync.Mutex
+	// calls are the deadlines of the calls in progress
+	calls map[*invocationDeadline]struct{}
+	// requests are the requests of the server being answered
+	requests map[*serverRequest]struct{}
+}
+
+// invocationDeadline is the time remaining to a single call
+type invocationDeadline struct {
+	timer     *time.Timer
+	expires   time.Time
+	remaining time.Duration
+	paused    bool
+}
+
+// serverRequest is a request of the server being answered
+type serverRequest struct {
+	cancel context.CancelFunc
+}
+
+// start bounds a call to timeout, excluding the time spent answering the requests of the server.  The returned function
+// ends the call.
+func (d *invocationDeadlines) start(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	call, cancel := context.WithCancelCause(ctx)
+	expired := fmt.Errorf("%w: no reply within %s", context.DeadlineExceeded, timeout)
+	deadline := &invocationDeadline{
+		timer:   time.AfterFunc(timeout, func() { cancel(expired) }),
+		expires: time.Now().Add(timeout),
+	}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.calls == nil {
+		d.calls = map[*invocationDeadline]struct{}{}
+	}
+	d.calls[deadline] = struct{}{}
+	if len(d.requests) > 0 {
+		deadline.pause()
+	}
+	return call, func() {
+		d.lock.Lock()
+		defer d.lock.Unlock()
+		deadline.timer.Stop()
+		delete(d.calls, deadline)
+		if len(d.calls) == 0 {
+			for request := range d.requests {
+				request.cancel()
+			}
+		}
+		cancel(nil)
+	}
+}
+
+// serverRequest pauses the deadlines of the calls in progress while the server's request is answered.  The returned
+// context is done once no call is waiting on the answer; the returned function resumes the deadlines.
+func (d *invocationDeadlines) serverRequest(ctx context.Context) (context.Context, func()) {
+	answering, cancel := context.WithCancel(ctx)
+	request := &serverRequest{cancel: cancel}
+
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.requests == nil {
+		d.requests = map[*serverRequest]struct{}{}
+	}
+	if len(d.requests) == 0 {
+		for call := range d.calls {
+			call.pause()
+		}
+	}
+	d.requests[request] = struct{}{}
+	return answering, func() {
+		d.lock.Lock()
+		defer d.lock.Unlock()
+		delete(d.requests, request)
+		if len(d.requests) == 0 {
+			for call := range d.calls {
+				call.resume()
+			}
+		}
+		cancel()
+	}
+}
+
+func (i *invocationDeadline) pause() {
+	if i.timer.Stop() {
+		i.remaining = time.Until(i.expires)
+		i.paused = true
+	}
+}
+
+func (i *invocationDeadline) resume() {
+	if !i.paused {
+		return
+	}
+	i.paused = false
+	i.expires = time.Now().Add(i.remaining)
+	i.timer.Reset(i.remaining)
+}
+
+// pausingSampler answers the sampling requests of a server with the deadlines of its calls paused
+type pausingSampler struct {
+	handler   client.SamplingHandler
+	deadlines *invocationDeadlines
+}
+
+func (p *pausingSampler) CreateMessage(ctx context.Context, request mcp.CreateMessageRequest) (*mcp.CreateMessageResult, error) {
+	ctx, done := p.deadlines.serverRequest(ctx)
+	defer done()
+	return p.handler.CreateMessage(ctx, request)
+}
+
+// pausingElicitor answers the elicitation requests of a server with the deadlines of its calls paused
+type pausingElicitor struct {
+	handler   client.ElicitationHandler
+	deadlines *invocationDeadlines
+}
+
+func (p *pausingElicitor) Elicit(ctx context.Context, request mcp.ElicitationRequest) (*mcp.ElicitationResult, error) {
+	ctx, done := p.deadlines.serverRequest(ctx)
+	defer done()
+	return p.handler.Elicit(ctx, request)
+}
@@ -0,0 +1,48 @@
+package query
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInvocationDeadlines_ExpireCalls(t *testing.T) {
+	var deadlines invocationDeadlines
+	call, done := deadlines.start(context.Background(), 20*time.Millisecond)
+	defer done()
+
+	<-call.Done()
+	assert.ErrorIs(t, context.Cause(call), context.DeadlineExceeded)
+	assert.ErrorContains(t, context.Cause(call), "no reply within 20ms")
+}
+
+func TestInvocationDeadlines_PauseWhileTheServerAsks(t *testing.T) {
+	var deadlines invocationDeadlines
+	call, done := deadlines.start(context.Background(), 50*time.Millisecond)
+	defer done()
+
+	request, answered := deadlines.serverRequest(context.Background())
+	time.Sleep(100 * time.Millisecond)
+	require.NoError(t, call.Err(), "the time spent answering is not counted")
+	answered()
+	assert.Error(t, request.Err(), "the request ends once answered")
+
+	select {
+	case <-call.Done():
+	case <-time.After(time.Second):
+		t.Fatal("the deadline did not resume")
+	}
+}
+
+func TestInvocationDeadlines_GiveUpRequestsWithTheirCalls(t *testing.T) {
+	var deadlines invocationDeadlines
+	_, done := deadlines.start(context.Background(), time.Minute)
+	request, answered := deadlines.serverRequest(context.Background())
+	defer answered()
+
+	done()
+	assert.ErrorIs(t, request.Err(), context.Canceled, "no call is waiting on the answer")
+}
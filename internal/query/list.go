@@ -2,51 +2,70 @@ package query
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"os"
+	"io"
 	"slices"
 
 	"github.com/meschbach/marvin/internal/config"
 	"github.com/ollama/ollama/api"
 )
 
-func ListMCPTools(ctx context.Context, cfg *config.File, detailed bool) {
-	tools, err := NewToolSet(ctx, cfg)
+// ListMCPTools emits the instructions, tools and prompts of the configured MCP servers
+func ListMCPTools(ctx context.Context, cfg *config.File, detailed bool, output string) (problem error) {
+	events, err := newEventSink(output, DisplayOptions{})
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error loading tools: %v\n", err)
-		return
+		return err
+	}
+	defer func() {
+		problem = report(events, problem)
+	}()
+	tools, err := NewToolSet(ctx, cfg, nil)
+	if err != nil {
+		return &operationalError{"loading tools", err}
 	}
 	defer func() {
 		if err := tools.Shutdown(ctx); err != nil {
-			fmt.Printf("Error shutting down tools: %v\n", err)
+			problem = errors.Join(problem, &operationalError{"shutting down tools", err})
 		}
 	}()
 
 	for _, instruction := range tools.instructions {
-		fmt.Printf("Instruction: %s\n=== End instruction ===\n", instruction.Content)
+		events.emit(Event{Type: EventInstruction, Content: instruction.Content})
 	}
 	if len(tools.instructions) == 0 {
-		fmt.Println("No instructions found")
+		events.emit(noticeEvent("instructions", "none found"))
 	}
-	fmt.Println()
 
 	for _, tool := range tools.defs {
-		fmt.Printf("%s: %s\n", tool.Function.Name, tool.Function.Description)
-		dumpLayer := func(prefix string, p api.ToolFunctionParameters) {
-			prefix = prefix + "\t"
-			fmt.Printf("%s%s\n", prefix, p.Type)
-			for name, prop := range p.Properties {
-				var optionalRequiredText string
-				if slices.Contains(p.Required, name) {
-					optionalRequiredText = "(required)"
-				} else {
-					optionalRequiredText = ""
-				}
-				fmt.Printf("%s%s: %s %s\n", prefix, name, prop.Description, optionalRequiredText)
-			}
+		e := Event{Type: EventTool, ToolName: tool.Function.Name, Content: tool.Function.Description}
+		if detailed {
+			e.Parameters = &tool.Function.Parameters
 		}
+		events.emit(e)
+	}
+
+	for _, prompt := range tools.sortedPrompts() {
+		e := Event{Type: EventPrompt, ToolName: prompt.name, Content: prompt.description}
 		if detailed {
-			dumpLayer("\t", tool.Function.Parameters)
+			e.Parameters = prompt.parameters()
+		}
+		events.emit(e)
+	}
+	return nil
+}
+
+// renderParameters writes the type and properties of tool parameters, one per line
+func renderParameters(out io.Writer, prefix string, p api.ToolFunctionParameters) {
+	prefix = prefix + "\t"
+	fmt.Fprintf(out, "%s%s\n", prefix, p.Type)
+	for name, prop := range p.Properties {
+		var optionalRequiredText string
+		if slices.Contains(p.Required, name) {
+			optionalRequiredText = "(required)"
+		} else {
+			optionalRequiredText = ""
 		}
+		fmt.Fprintf(out, "%s%s: %s %s\n", prefix, name, prop.Description, optionalRequiredText)
 	}
 }
@@ -16,8 +16,9 @@ func FromLocalProgram(lp config.LocalProgramBlock) *Mark3labsTool {
 		Args:    lp.Args,
 	}
 	return &Mark3labsTool{
-		Name: lp.Name,
-		spec: spec,
+		Name:   lp.Name,
+		spec:   spec,
+		serial: lp.Serial,
 	}
 }
 
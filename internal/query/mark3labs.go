@@ -5,12 +5,16 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log/slog"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/mark3labs/mcp-go/client"
 	"github.com/mark3labs/mcp-go/client/transport"
 	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/meschbach/marvin/internal/cassette"
+	"github.com/meschbach/marvin/internal/logging"
 	"github.com/ollama/ollama/api"
 	"github.com/yosida95/uritemplate/v3"
 )
@@ -26,6 +30,41 @@ type runningProgram interface {
 	stop(ctx context.Context) error
 }
 
+// recordedSpec records the MCP traffic of a program, or stands in for the program with the recording when replaying
+type recordedSpec struct {
+	name string
+	spec programRuntimeSpec
+	deck *cassette.Deck
+}
+
+func (r *recordedSpec) start(ctx context.Context) (runningProgram, error) {
+	if r.deck.Replaying() {
+		return &recordedProgram{mcpTransport: r.deck.Transport(r.name, nil)}, nil
+	}
+	program, err := r.spec.start(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &recordedProgram{mcpTransport: r.deck.Transport(r.name, program.transport()), program: program}, nil
+}
+
+type recordedProgram struct {
+	mcpTransport transport.Interface
+	// program is the running program, nil when replaying
+	program runningProgram
+}
+
+func (r *recordedProgram) transport() transport.Interface {
+	return r.mcpTransport
+}
+
+func (r *recordedProgram) stop(ctx context.Context) error {
+	if r.program == nil {
+		return nil
+	}
+	return r.program.stop(ctx)
+}
+
 type Mark3labsTool struct {
 	Name                 string
 	spec                 programRuntimeSpec
@@ -33,21 +72,68 @@ type Mark3labsTool struct {
 	mcpClient            *client.Client
 	resourceInstructions []api.Message
 	resourceTemplates    []*uritemplate.Template
+	// serial indicates the server can not service concurrent requests
+	serial bool
+	// session guards establishing the MCP session, which concurrent invocations share
+	session sync.Mutex
+	// timeout bounds discovery and each invocation, defaultMCPTimeout when zero
+	timeout time.Duration
+	// sampler answers the sampling requests of the server, nil when the server may not sample
+	sampler *mcpSampler
+	// elicitor answers the requests of the server for input, nil when the server may not ask
+	elicitor *mcpElicitor
+	// deadlines bound the calls in progress, excluding the time taken to answer the requests of the server
+	deadlines invocationDeadlines
+	// discovery guards definition, the tools, prompts and resources of the server once discovered
+	discovery  sync.Mutex
+	definition *toolDefinition
+}
+
+// defaultMCPTimeout bounds discovery and each invocation of servers without a timeout of their own
+const defaultMCPTimeout = 15 * time.Second
+
+func (m *Mark3labsTool) resolveTimeout() time.Duration {
+	if m.timeout > 0 {
+		return m.timeout
+	}
+	return defaultMCPTimeout
 }
 
 func (m *Mark3labsTool) ensureRunning(ctx context.Context) (problem error) {
 	if m.active != nil {
 		return nil
 	}
-	m.active, problem = m.spec.start(ctx)
-	m.mcpClient = client.NewClient(m.active.transport())
+	active, err := m.spec.start(ctx)
+	if err != nil {
+		return &operationalError{"failed to start program", err}
+	}
+	m.active = active
+	var options []client.ClientOption
+	if m.sampler != nil {
+		options = append(options, client.WithSamplingHandler(&pausingSampler{handler: m.sampler, deadlines: &m.deadlines}))
+	}
+	if m.elicitor != nil {
+		options = append(options, client.WithElicitationHandler(&pausingElicitor{handler: m.elicitor, deadlines: &m.deadlines}))
+	}
+	m.mcpClient = client.NewClient(m.active.transport(), options...)
 	if err := m.mcpClient.Start(ctx); err != nil {
-		problem = errors.Join(problem, &operationalError{"failed to start MCP client", err})
-		return problem
+		return &operationalError{"failed to start MCP client", err}
 	}
 	return nil
 }
 
+// recordTo records the traffic of the tool through the deck, or replays it from the deck.  A nil deck leaves the tool
+// unchanged.
+func (m *Mark3labsTool) recordTo(deck *cassette.Deck) {
+	if deck != nil {
+		m.spec = &recordedSpec{name: m.Name, spec: m.spec, deck: deck}
+	}
+}
+
+func (m *Mark3labsTool) serialOnly() bool {
+	return m.serial
+}
+
 func (m *Mark3labsTool) Describe() string {
 	return fmt.Sprintf("mcp via mark3labs for %s", m.Name)
 }
@@ -63,14 +149,29 @@ func (m *Mark3labsTool) Shutdown(shutdownContext context.Context) (problem error
 }
 
 // defineAPI queries the MCP server for available operations and returns Ollama tool
-// definitions using namespaced names: "<toolName>.<operationName>".
-func (m *Mark3labsTool) defineAPI(ctx context.Context) (definitions *toolDefinition, problem error) {
+// definitions using namespaced names: "<toolName>.<operationName>".  The server is queried once; toolsets of delegated
+// agents sharing the server are answered from the first discovery.
+func (m *Mark3labsTool) defineAPI(ctx context.Context) (*toolDefinition, error) {
+	m.discovery.Lock()
+	defer m.discovery.Unlock()
+	if m.definition != nil {
+		return m.definition, nil
+	}
+	definition, err := m.discover(ctx)
+	if err != nil {
+		return definition, err
+	}
+	m.definition = definition
+	return definition, nil
+}
+
+func (m *Mark3labsTool) discover(ctx context.Context) (definitions *toolDefinition, problem error) {
 	if err := m.ensureRunning(ctx); err != nil {
 		return nil, err
 	}
 	definitions = &toolDefinition{}
 
-	discoveryContext, done := context.WithTimeout(ctx, 15*time.Second)
+	discoveryContext, done := context.WithTimeout(ctx, m.resolveTimeout())
 	defer done()
 
 	init, err := m.mcpClient.Initialize(discoveryContext, mcp.InitializeRequest{})
@@ -115,12 +216,32 @@ func (m *Mark3labsTool) defineAPI(ctx context.Context) (definitions *toolDefinit
 		}
 	}
 
+	if init.Capabilities.Prompts != nil {
+		prompts, err := m.mcpClient.ListPrompts(discoveryContext, mcp.ListPromptsRequest{})
+		if err != nil {
+			return definitions, &operationalError{"list prompts", err}
+		}
+		for _, p := range prompts.Prompts {
+			slog.Debug("discovered prompt", logging.Component, "mcp-"+m.Name, "prompt", p.Name)
+			definitions.prompts = append(definitions.prompts, &mcpPrompt{
+				name:        m.namespaced(p.Name),
+				description: p.Description,
+				arguments:   p.Arguments,
+				source:      m,
+			})
+		}
+	}
+
+	if init.Capabilities.Tools == nil {
+		// servers offering only prompts or resources reject listing tools
+		return definitions, nil
+	}
 	discovered, err := m.mcpClient.ListTools(discoveryContext, mcp.ListToolsRequest{})
 	if err != nil {
 		return definitions, &operationalError{"list tools", err}
 	}
 	for _, d := range discovered.Tools {
-		fmt.Printf("mcp-%s\t>\tDiscovered tool %s\n", m.Name, d.Name)
+		slog.Debug("discovered tool", logging.Component, "mcp-"+m.Name, "tool", d.Name)
 		//todo: likely drift here -- will cause problems in the future
 		var params api.ToolFunctionParameters
 		bytes, err := json.Marshal(d.InputSchema)
@@ -165,15 +286,10 @@ func (m *Mark3labsTool) invoke(ctx context.Context, call api.ToolCall) (out []ap
 	}
 
 	c := m.mcpClient
-	invocationContext, done := context.WithTimeout(ctx, 15*time.Second)
+	invocationContext, done := m.deadlines.start(ctx, m.resolveTimeout())
 	defer done()
-	if err := c.Start(invocationContext); err != nil {
-		return nil, &operationalError{"failed to start client", err}
-	}
-
-	_, err := c.Initialize(invocationContext, mcp.InitializeRequest{})
-	if err != nil {
-		return nil, &operationalError{"failed to initialize client", err}
+	if err := m.establishSession(invocationContext); err != nil {
+		return nil, err
 	}
 
 	//fmt.Printf("<\ttool\t%s\t%#v\n", opName, call.Function.Arguments)
@@ -183,7 +299,15 @@ func (m *Mark3labsTool) invoke(ctx context.Context, call api.ToolCall) (out []ap
 			Arguments: call.Function.Arguments,
 		},
 	})
+	if err != nil && invocationContext.Err() != nil && ctx.Err() == nil {
+		err = context.Cause(invocationContext)
+	}
 	if err != nil {
+		// A replay which diverged from its recording can not be recovered by the model
+		var mismatch *cassette.MismatchError
+		if errors.As(err, &mismatch) {
+			return nil, err
+		}
 		return []api.Message{
 			toolResponseMessage(call, fmt.Sprintf("{\"error\":%q}", err.Error())),
 		}, nil
@@ -196,6 +320,41 @@ func (m *Mark3labsTool) invoke(ctx context.Context, call api.ToolCall) (out []ap
 	return out, nil
 }
 
+// getPrompt retrieves the messages of the prompt, named "<toolName>.<promptName>", with the arguments filled in
+func (m *Mark3labsTool) getPrompt(ctx context.Context, name string, arguments map[string]string) ([]api.Message, error) {
+	if err := m.ensureRunning(ctx); err != nil {
+		return nil, err
+	}
+	promptContext, done := context.WithTimeout(ctx, m.resolveTimeout())
+	defer done()
+	if err := m.establishSession(promptContext); err != nil {
+		return nil, err
+	}
+	result, err := m.mcpClient.GetPrompt(promptContext, mcp.GetPromptRequest{
+		Params: mcp.GetPromptParams{
+			Name:      strings.TrimPrefix(name, m.Name+"."),
+			Arguments: arguments,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	return promptMessages(result), nil
+}
+
+// establishSession starts and initializes the client, serializing concurrent invocations while doing so.
+func (m *Mark3labsTool) establishSession(ctx context.Context) error {
+	m.session.Lock()
+	defer m.session.Unlock()
+	if err := m.mcpClient.Start(ctx); err != nil {
+		return &operationalError{"failed to start client", err}
+	}
+	if _, err := m.mcpClient.Initialize(ctx, mcp.InitializeRequest{}); err != nil {
+		return &operationalError{"failed to initialize client", err}
+	}
+	return nil
+}
+
 func (m *Mark3labsTool) matches() []*uritemplate.Template {
 	return m.resourceTemplates
 }
@@ -0,0 +1,75 @@
+package query
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/mark3labs/mcp-go/client/transport"
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/mark3labs/mcp-go/server"
+	"github.com/meschbach/marvin/internal/backend"
+	"github.com/meschbach/marvin/internal/cassette"
+	"github.com/ollama/ollama/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// inProcessSpec serves an MCP server within the test process
+type inProcessSpec struct {
+	server *server.MCPServer
+}
+
+func (i *inProcessSpec) start(ctx context.Context) (runningProgram, error) {
+	return &localRunningProgram{transport.NewInProcessTransport(i.server)}, nil
+}
+
+// unavailableSpec fails to start, standing in for a program which is not installed
+type unavailableSpec struct{}
+
+func (unavailableSpec) start(ctx context.Context) (runningProgram, error) {
+	return nil, errors.New("program is not available")
+}
+
+func clockServer() *server.MCPServer {
+	clock := server.NewMCPServer("clock", "1.0.0")
+	clock.AddTool(mcp.NewTool("now", mcp.WithString("zone")), func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		return mcp.NewToolResultText("12:00 " + request.GetString("zone", "")), nil
+	})
+	return clock
+}
+
+// askTheClock runs a conversation in which the model asks the clock for the time
+func askTheClock(t *testing.T, client backend.Backend, spec programRuntimeSpec, deck *cassette.Deck) (*ollamaConversation, error) {
+	t.Helper()
+	tool := &Mark3labsTool{Name: "clock", spec: spec}
+	tool.recordTo(deck)
+	tools := probeToolSet(t, tool)
+	defer tool.Shutdown(context.Background())
+	conversation, _ := scriptedConversation(nil, tools)
+	conversation.client = deck.Backend(client)
+	err := conversation.runAIToConclusion(context.Background(), "scripted", tools.defs)
+	return conversation, err
+}
+
+func TestMark3labsTool_ReplaysRecordedSession(t *testing.T) {
+	dir := t.TempDir()
+	recorder, err := cassette.Record(dir)
+	require.NoError(t, err)
+	script := backend.NewScripted(
+		backend.CallTools(backend.ToolCall("1", "clock.now", map[string]any{"zone": "UTC"})),
+		backend.Reply("It is noon."),
+	)
+	recorded, err := askTheClock(t, script, &inProcessSpec{clockServer()}, recorder)
+	require.NoError(t, err)
+	require.NoError(t, recorder.Close())
+	assert.FileExists(t, dir+"/mcp-clock.json")
+
+	player, err := cassette.Replay(dir)
+	require.NoError(t, err)
+	replayed, err := askTheClock(t, backend.NewScripted(), unavailableSpec{}, player)
+	require.NoError(t, err, "neither the model nor the program are contacted when replaying")
+	assert.Equal(t, recorded.messages, replayed.messages)
+	toolResult := replayed.messages[len(replayed.messages)-2]
+	assert.Equal(t, api.Message{Role: roleTool, ToolName: "clock.now", ToolCallID: "1", Content: "12:00 UTC"}, toolResult)
+}
@@ -0,0 +1,323 @@
+package query
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/meschbach/marvin/internal/config"
+	"github.com/meschbach/marvin/internal/jsonschema"
+	"github.com/meschbach/marvin/internal/logging"
+)
+
+// Replies which may be entered in place of any field of an elicitation
+const (
+	elicitDeclineCommand = "/decline"
+	elicitCancelCommand  = "/cancel"
+)
+
+// mcpElicitation answers the elicitation requests of every MCP server of a toolset
+type mcpElicitation struct {
+	// terminal asks the person at the terminal, nil when there is no one to ask
+	terminal *terminalElicitor
+	// nonInteractive is the reply when there is no one to ask
+	nonInteractive string
+}
+
+// newMCPElicitation asks at the terminal when there is one, otherwise replying as configured
+func newMCPElicitation(cfg *config.File) *mcpElicitation {
+	elicitation := &mcpElicitation{nonInteractive: cfg.Elicitation.ResolveNonInteractive()}
+	if isTerminal(os.Stdin) {
+		elicitation.terminal = &terminalElicitor{in: stdinLines(), out: os.Stderr}
+	}
+	return elicitation
+}
+
+// forServer is the elicitation handler of the named server
+func (e *mcpElicitation) forServer(server string) *mcpElicitor {
+	if e == nil {
+		return nil
+	}
+	return &mcpElicitor{server: server, elicitation: e}
+}
+
+// mcpElicitor answers the elicitation requests of a single MCP server
+type mcpElicitor struct {
+	server      string
+	elicitation *mcpElicitation
+}
+
+func (m *mcpElicitor) Elicit(ctx context.Context, request mcp.ElicitationRequest) (*mcp.ElicitationResult, error) {
+	form, err := newElicitationForm(request.Params.RequestedSchema)
+	if err != nil {
+		return nil, &operationalError{fmt.Sprintf("elicitation for %q", m.server), err}
+	}
+	if m.elicitation.terminal != nil {
+		return m.elicitation.terminal.elicit(ctx, m.server, request.Params.Message, form)
+	}
+	logger := slog.With(logging.Component, "mcp-"+m.server)
+	switch m.elicitation.nonInteractive {
+	case config.ElicitationCancel:
+		logger.Info("cancelled elicitation, no one is at the terminal", "message", request.Params.Message)
+		return elicitationReply(mcp.ElicitationResponseActionCancel, nil), nil
+	case config.ElicitationDefaults:
+		if content, ok := form.defaults(); ok {
+			logger.Info("accepted the defaults of elicitation, no one is at the terminal", "message", request.Params.Message)
+			return elicitationReply(mcp.ElicitationResponseActionAccept, content), nil
+		}
+	}
+	logger.Info("declined elicitation, no one is at the terminal", "message", request.Params.Message)
+	return elicitationReply(mcp.ElicitationResponseActionDecline, nil), nil
+}
+
+func elicitationReply(action mcp.ElicitationResponseAction, content map[string]any) *mcp.ElicitationResult {
+	result := &mcp.ElicitationResult{ElicitationResponse: mcp.ElicitationResponse{Action: action}}
+	if content != nil {
+		result.Content = content
+	}
+	return result
+}
+
+// elicitationForm is the flat object of primitive fields an MCP server may request
+type elicitationForm struct {
+	schema *jsonschema.Schema
+	fields []*elicitationField
+}
+
+// elicitationField is a single property of the requested schema
+type elicitationField struct {
+	name     string
+	required bool
+	property map[string]any
+	schema   *jsonschema.Schema
+}
+
+// newElicitationForm interprets the requested schema.  Fields are ordered required first, then by name.
+func newElicitationForm(requested any) (*elicitationForm, error) {
+	raw, err := json.Marshal(requested)
+	if err != nil {
+		return nil, fmt.Errorf("encoding the requested schema: %w", err)
+	}
+	var decoded struct {
+		Properties map[string]map[string]any `json:"properties"`
+		Required   []string                  `json:"required"`
+	}
+	if err := json.Unmarshal(raw, &decoded); err != nil {
+		return nil, fmt.Errorf("requested schema: %w", err)
+	}
+	schema, err := jsonschema.Compile(raw)
+	if err != nil {
+		return nil, fmt.Errorf("requested schema: %w", err)
+	}
+	form := &elicitationForm{schema: schema}
+	for name, property := range decoded.Properties {
+		encoded, err := json.Marshal(property)
+		if err != nil {
+			return nil, fmt.Errorf("property %q: %w", name, err)
+		}
+		compiled, err := jsonschema.Compile(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("property %q: %w", name, err)
+		}
+		form.fields = append(form.fields, &elicitationField{
+			name:     name,
+			required: slices.Contains(decoded.Required, name),
+			property: property,
+			schema:   compiled,
+		})
+	}
+	sort.Slice(form.fields, func(i, j int) bool {
+		if form.fields[i].required != form.fields[j].required {
+			return form.fields[i].required
+		}
+		return form.fields[i].name < form.fields[j].name
+	})
+	return form, nil
+}
+
+// defaults fills each field with its default, failing when a required field has none
+func (f *elicitationForm) defaults() (map[string]any, bool) {
+	content := map[string]any{}
+	for _, field := range f.fields {
+		if value, ok := field.property["default"]; ok {
+			content[field.name] = value
+		} else if field.required {
+			return nil, false
+		}
+	}
+	return content, len(f.schema.Validate(content)) == 0
+}
+
+func (f *elicitationField) kind() string {
+	kind, _ := f.property["type"].(string)
+	return kind
+}
+
+func (f *elicitationField) options() []any {
+	options, _ := f.property["enum"].([]any)
+	return options
+}
+
+// numbered is true when options may be selected by their number, which would be mistaken for the values of numeric
+// fields
+func (f *elicitationField) numbered() bool {
+	kind := f.kind()
+	return kind != "integer" && kind != "number"
+}
+
+// describe labels the prompt of the field with its title, description, options and default
+func (f *elicitationField) describe() string {
+	var label strings.Builder
+	label.WriteString(f.name)
+	if title, ok := f.property["title"].(string); ok && title != "" {
+		fmt.Fprintf(&label, " (%s)", title)
+	}
+	if description, ok := f.property["description"].(string); ok && description != "" {
+		fmt.Fprintf(&label, ": %s", description)
+	}
+	if options := f.options(); len(options) > 0 {
+		names, _ := f.property["enumNames"].([]any)
+		choices := make([]string, len(options))
+		for i, option := range options {
+			label := option
+			if i < len(names) {
+				label = names[i]
+			}
+			choices[i] = fmt.Sprint(label)
+			if f.numbered() {
+				choices[i] = fmt.Sprintf("%d) %v", i+1, label)
+			}
+		}
+		fmt.Fprintf(&label, " [%s]", strings.Join(choices, ", "))
+	} else if f.kind() == "boolean" {
+		label.WriteString(" [y/n]")
+	}
+	if value, ok := f.property["default"]; ok {
+		fmt.Fprintf(&label, " (default %v)", value)
+	}
+	if f.required {
+		label.WriteString(" *")
+	}
+	return label.String()
+}
+
+// parse interprets the input according to the type of the field, selecting options by value, or by number when the
+// field is not numeric
+func (f *elicitationField) parse(input string) (any, error) {
+	if options := f.options(); len(options) > 0 {
+		for _, option := range options {
+			if fmt.Sprint(option) == input {
+				return option, nil
+			}
+		}
+		if index, err := strconv.Atoi(input); err == nil && f.numbered() && index >= 1 && index <= len(options) {
+			return options[index-1], nil
+		}
+	}
+	switch f.kind() {
+	case "boolean":
+		switch strings.ToLower(input) {
+		case "y", "yes", "true":
+			return true, nil
+		case "n", "no", "false":
+			return false, nil
+		}
+		return nil, errors.New("expected y or n")
+	case "integer":
+		value, err := strconv.ParseInt(input, 10, 64)
+		if err != nil {
+			return nil, errors.New("expected a whole number")
+		}
+		return float64(value), nil
+	case "number":
+		value, err := strconv.ParseFloat(input, 64)
+		if err != nil {
+			return nil, errors.New("expected a number")
+		}
+		return value, nil
+	}
+	return input, nil
+}
+
+// terminalElicitor asks the person at the terminal through out, reading the answers from in.  Servers may ask
+// concurrently, so requests are asked one at a time.
+type terminalElicitor struct {
+	in  *lineReader
+	out io.Writer
+}
+
+func (t *terminalElicitor) elicit(ctx context.Context, server, message string, form *elicitationForm) (*mcp.ElicitationResult, error) {
+	release, err := t.in.hold(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer release()
+
+	fmt.Fprintf(t.out, "MCP server %q asks: %s\n", server, message)
+	if len(form.fields) == 0 {
+		fmt.Fprint(t.out, "Accept? [y/N] ")
+		input, err := t.in.readLine(ctx)
+		if err != nil && !errors.Is(err, io.EOF) {
+			return nil, err
+		}
+		switch strings.ToLower(strings.TrimSpace(input)) {
+		case "y", "yes":
+			return elicitationReply(mcp.ElicitationResponseActionAccept, map[string]any{}), nil
+		default:
+			return elicitationReply(mcp.ElicitationResponseActionDecline, nil), nil
+		}
+	}
+	fmt.Fprintf(t.out, "  (%s or %s to refuse, * marks required fields)\n", elicitDeclineCommand, elicitCancelCommand)
+	content := map[string]any{}
+	for _, field := range form.fields {
+		for {
+			fmt.Fprintf(t.out, "%s: ", field.describe())
+			input, err := t.in.readLine(ctx)
+			if err != nil && !(errors.Is(err, io.EOF) && input != "") {
+				if errors.Is(err, io.EOF) {
+					return elicitationReply(mcp.ElicitationResponseActionCancel, nil), nil
+				}
+				return nil, err
+			}
+			input = strings.TrimSpace(input)
+			switch input {
+			case elicitDeclineCommand:
+				return elicitationReply(mcp.ElicitationResponseActionDecline, nil), nil
+			case elicitCancelCommand:
+				return elicitationReply(mcp.ElicitationResponseActionCancel, nil), nil
+			case "":
+				if value, ok := field.property["default"]; ok {
+					content[field.name] = value
+				} else if field.required {
+					fmt.Fprintln(t.out, "  a value is required")
+					continue
+				}
+			default:
+				value, err := field.parse(input)
+				if err != nil {
+					fmt.Fprintf(t.out, "  %s\n", err.Error())
+					continue
+				}
+				if problems := field.schema.Validate(value); len(problems) > 0 {
+					fmt.Fprintf(t.out, "  %s\n", strings.Join(problems, "; "))
+					continue
+				}
+				content[field.name] = value
+			}
+			break
+		}
+	}
+	if problems := form.schema.Validate(content); len(problems) > 0 {
+		return nil, fmt.Errorf("answers do not match the requested schema: %s", strings.Join(problems, "; "))
+	}
+	return elicitationReply(mcp.ElicitationResponseActionAccept, content), nil
+}
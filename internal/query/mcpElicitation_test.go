@@ -0,0 +1,162 @@
+package query
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/mark3labs/mcp-go/server"
+	"github.com/meschbach/marvin/internal/backend"
+	"github.com/meschbach/marvin/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// archiveServer offers a tool which asks which folder to archive into before replying with the answer
+func archiveServer() *server.MCPServer {
+	archive := server.NewMCPServer("imap", "1.0.0", server.WithElicitation())
+	archive.AddTool(mcp.NewTool("archive"), func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		result, err := archive.RequestElicitation(ctx, mcp.ElicitationRequest{Params: mcp.ElicitationParams{
+			Message: "Which folder should the messages be archived to?",
+			RequestedSchema: map[string]any{
+				"type": "object",
+				"properties": map[string]any{
+					"folder":  map[string]any{"type": "string", "enum": []string{"Archive", "Old"}, "default": "Archive"},
+					"confirm": map[string]any{"type": "boolean", "description": "really archive"},
+					"days":    map[string]any{"type": "integer", "minimum": 1, "default": 30},
+				},
+				"required": []string{"confirm"},
+			},
+		}})
+		if err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+		content, err := json.Marshal(result.Content)
+		if err != nil {
+			return nil, err
+		}
+		return mcp.NewToolResultText(string(result.Action) + " " + string(content)), nil
+	})
+	return archive
+}
+
+func archive(t *testing.T, elicitation *mcpElicitation) string {
+	t.Helper()
+	return archiveWithin(t, elicitation, 0)
+}
+
+// archiveWithin calls the archive tool, its calls bounded by timeout or the default when zero
+func archiveWithin(t *testing.T, elicitation *mcpElicitation, timeout time.Duration) string {
+	t.Helper()
+	tool := &Mark3labsTool{Name: "imap", spec: &pipedSpec{archiveServer()}, elicitor: elicitation.forServer("imap"), timeout: timeout}
+	t.Cleanup(func() {
+		assert.NoError(t, tool.Shutdown(context.Background()))
+	})
+	_, err := tool.defineAPI(context.Background())
+	require.NoError(t, err)
+	replies, err := tool.invoke(context.Background(), backend.ToolCall("1", "imap.archive", nil))
+	require.NoError(t, err)
+	require.Len(t, replies, 1)
+	return replies[0].Content
+}
+
+func TestMCPElicitor_AsksAtTheTerminal(t *testing.T) {
+	var shown strings.Builder
+	terminal := &terminalElicitor{in: newLineReader(strings.NewReader("maybe\ny\n0\n7\n2\n")), out: &shown}
+
+	assert.Equal(t, `accept {"confirm":true,"days":7,"folder":"Old"}`, archive(t, &mcpElicitation{terminal: terminal}))
+	assert.Contains(t, shown.String(), `MCP server "imap" asks: Which folder should the messages be archived to?`)
+	assert.Contains(t, shown.String(), "confirm: really archive [y/n] *: ")
+	assert.Contains(t, shown.String(), "expected y or n")
+	assert.Contains(t, shown.String(), "minimum: got 0, want 1")
+	assert.Contains(t, shown.String(), "folder [1) Archive, 2) Old] (default Archive): ")
+}
+
+func TestMCPElicitor_AnsweringIsNotBoundByTheTimeout(t *testing.T) {
+	in, typed := io.Pipe()
+	terminal := &terminalElicitor{in: newLineReader(in), out: io.Discard}
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		_, _ = typed.Write([]byte("y\n\n\n"))
+	}()
+
+	assert.Equal(t, `accept {"confirm":true,"days":30,"folder":"Archive"}`, archiveWithin(t, &mcpElicitation{terminal: terminal}, 50*time.Millisecond))
+}
+
+func TestMCPElicitor_GivesUpWithTheCall(t *testing.T) {
+	in, typed := io.Pipe()
+	lines := newLineReader(in)
+	terminal := &terminalElicitor{in: lines, out: io.Discard}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	_, err := terminal.elicit(ctx, "imap", "Which folder?", &elicitationForm{fields: []*elicitationField{{name: "folder"}}})
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	go func() {
+		_, _ = typed.Write([]byte("hello\n"))
+	}()
+	line, err := lines.readLine(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "hello\n", line, "the line typed after giving up is left for the chat")
+}
+
+func TestMCPElicitor_TakesDefaultsAtTheTerminal(t *testing.T) {
+	terminal := &terminalElicitor{in: newLineReader(strings.NewReader("\nno\n\n\n")), out: io.Discard}
+
+	assert.Equal(t, `accept {"confirm":false,"days":30,"folder":"Archive"}`, archive(t, &mcpElicitation{terminal: terminal}))
+}
+
+func TestMCPElicitor_Refused(t *testing.T) {
+	for input, expected := range map[string]string{
+		"/decline\n": "decline null",
+		"y\n/cancel": "cancel null",
+		"y\n":        "cancel null",
+	} {
+		t.Run(expected, func(t *testing.T) {
+			terminal := &terminalElicitor{in: newLineReader(strings.NewReader(input)), out: io.Discard}
+			assert.Equal(t, expected, archive(t, &mcpElicitation{terminal: terminal}))
+		})
+	}
+}
+
+func TestMCPElicitor_NonInteractive(t *testing.T) {
+	assert.Equal(t, "decline null", archive(t, &mcpElicitation{nonInteractive: config.ElicitationDecline}))
+	assert.Equal(t, "cancel null", archive(t, &mcpElicitation{nonInteractive: config.ElicitationCancel}))
+	assert.Equal(t, "decline null", archive(t, &mcpElicitation{nonInteractive: config.ElicitationDefaults}),
+		"the required confirmation has no default")
+}
+
+func TestElicitationField_SelectsNumericOptionsByValue(t *testing.T) {
+	field := &elicitationField{name: "priority", property: map[string]any{"type": "integer", "enum": []any{2.0, 1.0}}}
+	value, err := field.parse("1")
+	require.NoError(t, err)
+	assert.Equal(t, 1.0, value, "numbers are values rather than the position of an option")
+	assert.Equal(t, "priority [2, 1]", field.describe())
+
+	named := &elicitationField{name: "folder", property: map[string]any{"type": "string", "enum": []any{"2024", "Archive"}}}
+	value, err = named.parse("2")
+	require.NoError(t, err)
+	assert.Equal(t, "Archive", value)
+	value, err = named.parse("2024")
+	require.NoError(t, err)
+	assert.Equal(t, "2024", value, "an option matching exactly wins over its number")
+}
+
+func TestElicitationForm_Defaults(t *testing.T) {
+	form, err := newElicitationForm(map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"folder": map[string]any{"type": "string", "default": "Archive"},
+			"note":   map[string]any{"type": "string"},
+		},
+		"required": []any{"folder"},
+	})
+	require.NoError(t, err)
+	content, ok := form.defaults()
+	require.True(t, ok)
+	assert.Equal(t, map[string]any{"folder": "Archive"}, content)
+}
@@ -0,0 +1,131 @@
+package query
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/ollama/ollama/api"
+)
+
+// mcpPrompt is a prompt template offered by an MCP server
+type mcpPrompt struct {
+	// name is namespaced by the server: "<server>.<prompt>"
+	name        string
+	description string
+	arguments   []mcp.PromptArgument
+	source      promptSource
+}
+
+// promptSource retrieves the messages of the prompts it offers
+type promptSource interface {
+	getPrompt(ctx context.Context, name string, arguments map[string]string) ([]api.Message, error)
+}
+
+// parameters describes the arguments of the prompt as tool parameters for listing
+func (p *mcpPrompt) parameters() *api.ToolFunctionParameters {
+	parameters := &api.ToolFunctionParameters{Type: mcpParameterTypeObject, Properties: map[string]api.ToolProperty{}}
+	for _, argument := range p.arguments {
+		parameters.Properties[argument.Name] = api.ToolProperty{Type: ToolPropTypeString, Description: argument.Description}
+		if argument.Required {
+			parameters.Required = append(parameters.Required, argument.Name)
+		}
+	}
+	return parameters
+}
+
+// render fetches the messages of the prompt, ensuring each required argument has been supplied
+func (p *mcpPrompt) render(ctx context.Context, arguments map[string]string) ([]api.Message, error) {
+	var missing []string
+	for _, argument := range p.arguments {
+		if _, ok := arguments[argument.Name]; argument.Required && !ok {
+			missing = append(missing, argument.Name)
+		}
+	}
+	if len(missing) > 0 {
+		return nil, &configError{operationalError{fmt.Sprintf("prompt %q", p.name), fmt.Errorf("missing required arguments: %s", strings.Join(missing, ", "))}}
+	}
+	for name := range arguments {
+		if !slices.ContainsFunc(p.arguments, func(argument mcp.PromptArgument) bool { return argument.Name == name }) {
+			return nil, &configError{operationalError{fmt.Sprintf("prompt %q", p.name), fmt.Errorf("unknown argument %q", name)}}
+		}
+	}
+	messages, err := p.source.getPrompt(ctx, p.name, arguments)
+	if err != nil {
+		return nil, &operationalError{fmt.Sprintf("getting prompt %q", p.name), err}
+	}
+	return messages, nil
+}
+
+// sortedPrompts are the prompts offered by the MCP servers of the toolset ordered by name
+func (ts *ToolSet) sortedPrompts() []*mcpPrompt {
+	out := make([]*mcpPrompt, 0, len(ts.promptsByName))
+	for _, prompt := range ts.promptsByName {
+		out = append(out, prompt)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].name < out[j].name })
+	return out
+}
+
+// renderPrompt fetches the messages of the named prompt with the arguments filled in
+func (ts *ToolSet) renderPrompt(ctx context.Context, name string, arguments map[string]string) ([]api.Message, error) {
+	prompt, ok := ts.promptsByName[name]
+	if !ok {
+		var names []string
+		for _, prompt := range ts.sortedPrompts() {
+			names = append(names, prompt.name)
+		}
+		if len(names) == 0 {
+			return nil, &configError{operationalError{"prompt", fmt.Errorf("no prompt %q, the MCP servers offer none", name)}}
+		}
+		return nil, &configError{operationalError{"prompt", fmt.Errorf("no prompt %q, expected one of: %s", name, strings.Join(names, ", "))}}
+	}
+	return prompt.render(ctx, arguments)
+}
+
+// parsePromptArguments interprets each `name=value` argument of a prompt
+func parsePromptArguments(arguments []string) (map[string]string, error) {
+	out := map[string]string{}
+	for _, argument := range arguments {
+		name, value, ok := strings.Cut(argument, "=")
+		if !ok || name == "" {
+			return nil, &configError{operationalError{"prompt arguments", fmt.Errorf("expected name=value, got %q", argument)}}
+		}
+		out[name] = value
+	}
+	return out, nil
+}
+
+// promptMessages translates the messages of a prompt into the conversation.  Content other than text is described
+// rather than dropped so the model knows it was there.
+func promptMessages(result *mcp.GetPromptResult) []api.Message {
+	out := make([]api.Message, 0, len(result.Messages))
+	for _, message := range result.Messages {
+		role := roleUser
+		if message.Role == mcp.RoleAssistant {
+			role = roleAssistant
+		}
+		var content string
+		switch c := message.Content.(type) {
+		case mcp.TextContent:
+			content = c.Text
+		case mcp.EmbeddedResource:
+			if text, ok := c.Resource.(mcp.TextResourceContents); ok {
+				content = fmt.Sprintf("URI: %s\nContent-type: %s\n\n%s", text.URI, text.MIMEType, text.Text)
+			} else {
+				content = "(binary resource omitted)"
+			}
+		case mcp.ImageContent:
+			content = fmt.Sprintf("(%s image omitted)", c.MIMEType)
+		case mcp.AudioContent:
+			content = fmt.Sprintf("(%s audio omitted)", c.MIMEType)
+		default:
+			content = "(unsupported content omitted)"
+		}
+		out = append(out, api.Message{Role: role, Content: content})
+	}
+	return out
+}
@@ -0,0 +1,107 @@
+package query
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/mark3labs/mcp-go/server"
+	"github.com/meschbach/marvin/internal/backend"
+	"github.com/ollama/ollama/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func reviewServer() *server.MCPServer {
+	reviewer := server.NewMCPServer("reviewer", "1.0.0", server.WithPromptCapabilities(false))
+	reviewer.AddPrompt(mcp.NewPrompt("review",
+		mcp.WithPromptDescription("Reviews a file"),
+		mcp.WithArgument("file", mcp.RequiredArgument(), mcp.ArgumentDescription("file to review")),
+		mcp.WithArgument("focus"),
+	), func(ctx context.Context, request mcp.GetPromptRequest) (*mcp.GetPromptResult, error) {
+		return mcp.NewGetPromptResult("Reviews a file", []mcp.PromptMessage{
+			mcp.NewPromptMessage(mcp.RoleUser, mcp.NewTextContent("Review "+request.Params.Arguments["file"])),
+			mcp.NewPromptMessage(mcp.RoleAssistant, mcp.NewTextContent("Which aspects matter most?")),
+			mcp.NewPromptMessage(mcp.RoleUser, mcp.NewTextContent("Focus on "+request.Params.Arguments["focus"])),
+		}), nil
+	})
+	return reviewer
+}
+
+func reviewToolSet(t *testing.T) *ToolSet {
+	t.Helper()
+	tool := &Mark3labsTool{Name: "reviewer", spec: &inProcessSpec{reviewServer()}}
+	t.Cleanup(func() {
+		assert.NoError(t, tool.Shutdown(context.Background()))
+	})
+	return probeToolSet(t, tool)
+}
+
+func TestMark3labsTool_ListsPrompts(t *testing.T) {
+	tools := reviewToolSet(t)
+	prompts := tools.sortedPrompts()
+	require.Len(t, prompts, 1)
+	assert.Equal(t, "reviewer.review", prompts[0].name)
+	assert.Equal(t, "Reviews a file", prompts[0].description)
+	parameters := prompts[0].parameters()
+	assert.Equal(t, []string{"file"}, parameters.Required)
+	assert.Contains(t, parameters.Properties, "focus")
+}
+
+func TestToolSet_RenderPrompt(t *testing.T) {
+	tools := reviewToolSet(t)
+	messages, err := tools.renderPrompt(context.Background(), "reviewer.review", map[string]string{"file": "main.go", "focus": "errors"})
+	require.NoError(t, err)
+	assert.Equal(t, []api.Message{
+		{Role: roleUser, Content: "Review main.go"},
+		{Role: roleAssistant, Content: "Which aspects matter most?"},
+		{Role: roleUser, Content: "Focus on errors"},
+	}, messages)
+
+	_, err = tools.renderPrompt(context.Background(), "reviewer.review", map[string]string{"focus": "errors"})
+	assert.ErrorContains(t, err, "missing required arguments: file")
+	assert.Equal(t, ExitConfig, ExitCode(err))
+	_, err = tools.renderPrompt(context.Background(), "reviewer.review", map[string]string{"file": "main.go", "tone": "kind"})
+	assert.ErrorContains(t, err, `unknown argument "tone"`)
+	_, err = tools.renderPrompt(context.Background(), "reviewer.summarize", nil)
+	assert.ErrorContains(t, err, `no prompt "reviewer.summarize", expected one of: reviewer.review`)
+}
+
+func TestParsePromptArguments(t *testing.T) {
+	arguments, err := parsePromptArguments([]string{"file=main.go", "query=a=b"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"file": "main.go", "query": "a=b"}, arguments)
+	_, err = parsePromptArguments([]string{"file"})
+	assert.Equal(t, ExitConfig, ExitCode(err))
+}
+
+func TestSplitPromptArguments_ValuesMayContainSpaces(t *testing.T) {
+	assert.Equal(t, []string{"file=main.go", "focus=error handling"}, splitPromptArguments("file=main.go focus=error handling"))
+	assert.Equal(t, []string{"query=a=b  c"}, splitPromptArguments(" query=a=b  c "))
+	assert.Equal(t, []string{"stray", "file=main.go"}, splitPromptArguments("stray file=main.go"))
+	assert.Empty(t, splitPromptArguments(""))
+}
+
+func TestChatSession_PromptCommand(t *testing.T) {
+	tools := reviewToolSet(t)
+	script := backend.NewScripted(backend.Reply("Looks good."))
+	conversation, _ := scriptedConversation(script, tools)
+	conversation.messages = nil
+	var out bytes.Buffer
+	session := &chatSession{conversation: conversation, toolset: tools, model: "scripted", out: &out}
+
+	exit, err := session.command(context.Background(), "/prompt reviewer.review file=main.go focus=error handling")
+	require.NoError(t, err)
+	assert.False(t, exit)
+	requests := script.Requests()
+	require.Len(t, requests, 1)
+	require.Len(t, requests[0].Messages, 3)
+	assert.Equal(t, "Review main.go", requests[0].Messages[0].Content)
+	assert.Equal(t, "Focus on error handling", requests[0].Messages[2].Content)
+	assert.Equal(t, "Looks good.", conversation.finalAnswer())
+
+	_, err = session.command(context.Background(), "/prompts")
+	require.NoError(t, err)
+	assert.Contains(t, out.String(), "\treviewer.review: Reviews a file\n\t\tfile: file to review (required)\n")
+}
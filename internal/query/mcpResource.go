@@ -3,7 +3,9 @@ package query
 import (
 	"context"
 	"fmt"
+	"log/slog"
 
+	"github.com/meschbach/marvin/internal/logging"
 	"github.com/ollama/ollama/api"
 	"github.com/yosida95/uritemplate/v3"
 )
@@ -28,7 +30,6 @@ func (m *mcpResourceGateway) register(gateway mcpResource) {
 }
 
 func (m *mcpResourceGateway) defineAPI(ctx context.Context) (definition *toolDefinition, problem error) {
-	fmt.Printf("gateway\t\t> defining API with %d services\n", len(m.resourceServices))
 	definition = &toolDefinition{}
 	definition.tool = append(definition.tool, api.Tool{
 		Type: ToolTypeFunction,
@@ -52,13 +53,14 @@ func (m *mcpResourceGateway) defineAPI(ctx context.Context) (definition *toolDef
 		Content: "Use the tool read_resource to access resources identified by a URI.",
 	})
 
-	fmt.Printf("gateway\t\t> defining API with %d services\n", len(m.resourceServices))
+	logger := slog.With(logging.Component, "gateway")
+	logger.Debug(fmt.Sprintf("defining API with %d services", len(m.resourceServices)))
 	for _, rs := range m.resourceServices {
 		msg := rs.describeMessages()
-		fmt.Printf("gateway\t\t> adding %d instructions\n", len(msg))
+		logger.Debug(fmt.Sprintf("adding %d instructions", len(msg)))
 		definition.instructions = append(definition.instructions, msg...)
 	}
-	fmt.Printf("gateway\t\t> done defining API with %d instructions\n\n", len(definition.instructions))
+	logger.Debug(fmt.Sprintf("done defining API with %d instructions", len(definition.instructions)))
 	return definition, nil
 }
 
@@ -74,8 +76,10 @@ func (m *mcpResourceGateway) invoke(ctx context.Context, call api.ToolCall) (out
 	}
 
 	for _, rs := range m.resourceServices {
-		if matches := rs.matches(); len(matches) > 0 {
-			return rs.readResource(ctx, call, uri)
+		for _, template := range rs.matches() {
+			if template.Match(uri) != nil {
+				return rs.readResource(ctx, call, uri)
+			}
 		}
 	}
 	return []api.Message{toolResponseMessage(call, "no resource service found for uri")}, nil
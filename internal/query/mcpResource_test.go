@@ -0,0 +1,77 @@
+package query
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ollama/ollama/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/yosida95/uritemplate/v3"
+)
+
+// fakeResources serves resources matching its templates, remembering which URIs were read
+type fakeResources struct {
+	templates []*uritemplate.Template
+	read      []string
+}
+
+func (f *fakeResources) matches() []*uritemplate.Template {
+	return f.templates
+}
+
+func (f *fakeResources) describeMessages() []api.Message {
+	return []api.Message{{Role: roleSystem, Content: "resources of " + f.templates[0].Raw()}}
+}
+
+func (f *fakeResources) readResource(ctx context.Context, invocation api.ToolCall, uri string) ([]api.Message, error) {
+	f.read = append(f.read, uri)
+	return []api.Message{toolResponseMessage(invocation, "contents of "+uri)}, nil
+}
+
+func readResourceCall(args map[string]any) api.ToolCall {
+	return api.ToolCall{ID: "1", Function: api.ToolCallFunction{Name: "read_resource", Arguments: args}}
+}
+
+func TestMCPResourceGateway_DispatchesByTemplate(t *testing.T) {
+	mail := &fakeResources{templates: []*uritemplate.Template{uritemplate.MustNew("mail://{folder}/{id}")}}
+	notes := &fakeResources{templates: []*uritemplate.Template{uritemplate.MustNew("notes://{name}")}}
+	gateway := newMCPResourceGateway()
+	gateway.register(mail)
+	gateway.register(notes)
+
+	definition, err := gateway.defineAPI(context.Background())
+	require.NoError(t, err)
+	require.Len(t, definition.tool, 1)
+	assert.Equal(t, "read_resource", definition.tool[0].Function.Name)
+	assert.Len(t, definition.instructions, 3)
+
+	replies, err := gateway.invoke(context.Background(), readResourceCall(map[string]any{"uri": "notes://todo"}))
+	require.NoError(t, err)
+	require.Len(t, replies, 1)
+	assert.Equal(t, "contents of notes://todo", replies[0].Content)
+	assert.Empty(t, mail.read)
+	assert.Equal(t, []string{"notes://todo"}, notes.read)
+}
+
+func TestMCPResourceGateway_RejectsBadArguments(t *testing.T) {
+	gateway := newMCPResourceGateway()
+	gateway.register(&fakeResources{templates: []*uritemplate.Template{uritemplate.MustNew("notes://{name}")}})
+
+	for name, example := range map[string]struct {
+		args     map[string]any
+		expected string
+	}{
+		"missing":   {map[string]any{}, "required parameter uri is missing"},
+		"not text":  {map[string]any{"uri": 42}, "required parameter uri can not be cast to a string"},
+		"unmatched": {map[string]any{"uri": "mail://inbox/1"}, "no resource service found for uri"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			replies, err := gateway.invoke(context.Background(), readResourceCall(example.args))
+			require.NoError(t, err)
+			require.Len(t, replies, 1)
+			assert.Equal(t, example.expected, replies[0].Content)
+			assert.Equal(t, "1", replies[0].ToolCallID)
+		})
+	}
+}
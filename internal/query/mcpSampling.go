@@ -0,0 +1,215 @@
+package query
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/meschbach/marvin/internal/backend"
+	"github.com/meschbach/marvin/internal/cassette"
+	"github.com/meschbach/marvin/internal/config"
+	"github.com/meschbach/marvin/internal/logging"
+	"github.com/ollama/ollama/api"
+)
+
+// Reasons a sampled completion stopped, as named by MCP
+const (
+	samplingStopEndTurn   = "endTurn"
+	samplingStopMaxTokens = "maxTokens"
+)
+
+// mcpSampler answers the sampling requests of an MCP server with the configured backend
+type mcpSampler struct {
+	server   string
+	settings *config.SamplingBlock
+	// model answers requests when neither the hints nor the settings select one
+	model string
+	// open connects to the backend on the first request
+	open     func() (backend.Backend, error)
+	opening  sync.Once
+	client   backend.Backend
+	problem  error
+	approver samplingApprover
+}
+
+// newMCPSampler builds the sampler of the named server, nil when the settings do not permit sampling.  Requests are
+// recorded or replayed through the traffic deck, which may be nil.
+func newMCPSampler(server string, settings *config.SamplingBlock, cfg *config.File, traffic *cassette.Deck) *mcpSampler {
+	if !settings.Allowed() {
+		return nil
+	}
+	sampler := &mcpSampler{
+		server:   server,
+		settings: settings,
+		model:    cfg.LanguageModel(),
+		open: func() (backend.Backend, error) {
+			client, err := cfg.OpenBackend()
+			if err != nil {
+				return nil, err
+			}
+			return traffic.Backend(client), nil
+		},
+	}
+	if settings.Approve {
+		sampler.approver = newSamplingApprover()
+	}
+	return sampler
+}
+
+func (s *mcpSampler) backend() (backend.Backend, error) {
+	s.opening.Do(func() {
+		s.client, s.problem = s.open()
+	})
+	return s.client, s.problem
+}
+
+// CreateMessage completes the messages of the server with the model selected by its hints
+func (s *mcpSampler) CreateMessage(ctx context.Context, request mcp.CreateMessageRequest) (*mcp.CreateMessageResult, error) {
+	var hints []string
+	if request.ModelPreferences != nil {
+		for _, hint := range request.ModelPreferences.Hints {
+			hints = append(hints, hint.Name)
+		}
+	}
+	model := s.settings.ResolveModel(hints, s.model)
+	description := fmt.Sprintf("sampling for %q", s.server)
+
+	if s.approver != nil {
+		approved, err := s.approver.approveSampling(ctx, s.server, model, &request)
+		if err != nil {
+			return nil, &operationalError{description, err}
+		}
+		if !approved {
+			return nil, &operationalError{description, errors.New("declined")}
+		}
+	}
+
+	req, err := s.chatRequest(model, &request)
+	if err != nil {
+		return nil, &operationalError{description, err}
+	}
+	client, err := s.backend()
+	if err != nil {
+		return nil, &operationalError{description, err}
+	}
+	slog.Debug("sampling", logging.Component, "mcp-"+s.server, "model", model, "messages", len(req.Messages))
+
+	var content strings.Builder
+	stopReason := samplingStopEndTurn
+	err = client.Chat(ctx, req, func(resp api.ChatResponse) error {
+		content.WriteString(resp.Message.Content)
+		if resp.Done && resp.DoneReason == "length" {
+			stopReason = samplingStopMaxTokens
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, &operationalError{description, err}
+	}
+	return &mcp.CreateMessageResult{
+		SamplingMessage: mcp.SamplingMessage{Role: mcp.RoleAssistant, Content: mcp.NewTextContent(content.String())},
+		Model:           model,
+		StopReason:      stopReason,
+	}, nil
+}
+
+// chatRequest translates the request of the server into a chat with the model, capping the tokens generated
+func (s *mcpSampler) chatRequest(model string, request *mcp.CreateMessageRequest) (*api.ChatRequest, error) {
+	var messages []api.Message
+	if request.SystemPrompt != "" {
+		messages = append(messages, api.Message{Role: roleSystem, Content: request.SystemPrompt})
+	}
+	for i, message := range request.Messages {
+		role := roleUser
+		if message.Role == mcp.RoleAssistant {
+			role = roleAssistant
+		}
+		translated := api.Message{Role: role}
+		switch c := message.Content.(type) {
+		case mcp.TextContent:
+			translated.Content = c.Text
+		case mcp.ImageContent:
+			image, err := base64.StdEncoding.DecodeString(c.Data)
+			if err != nil {
+				return nil, fmt.Errorf("message %d: decoding image: %w", i, err)
+			}
+			translated.Images = []api.ImageData{image}
+		default:
+			return nil, fmt.Errorf("message %d: unsupported content %T", i, message.Content)
+		}
+		messages = append(messages, translated)
+	}
+
+	options := map[string]any{}
+	if maxTokens := s.settings.ResolveMaxTokens(request.MaxTokens); maxTokens > 0 {
+		options["num_predict"] = maxTokens
+	}
+	if request.Temperature > 0 {
+		options["temperature"] = request.Temperature
+	}
+	if len(request.StopSequences) > 0 {
+		options["stop"] = request.StopSequences
+	}
+	return &api.ChatRequest{Model: model, Messages: messages, Options: options}, nil
+}
+
+// samplingApprover decides whether a sampling request is sent to the model
+type samplingApprover interface {
+	approveSampling(ctx context.Context, server, model string, request *mcp.CreateMessageRequest) (bool, error)
+}
+
+// newSamplingApprover asks at the terminal when there is one, otherwise refusing every request
+func newSamplingApprover() samplingApprover {
+	if isTerminal(os.Stdin) {
+		return &terminalSamplingApprover{in: stdinLines(), out: os.Stderr}
+	}
+	return refuseSampling{}
+}
+
+// terminalSamplingApprover shows the request through out and reads the decision from in.  Servers may sample
+// concurrently, so requests are asked about one at a time.
+type terminalSamplingApprover struct {
+	in  *lineReader
+	out io.Writer
+}
+
+func (t *terminalSamplingApprover) approveSampling(ctx context.Context, server, model string, request *mcp.CreateMessageRequest) (bool, error) {
+	release, err := t.in.hold(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer release()
+
+	fmt.Fprintf(t.out, "MCP server %q asks %s to complete:\n", server, model)
+	if request.SystemPrompt != "" {
+		fmt.Fprintf(t.out, "  system: %s\n", request.SystemPrompt)
+	}
+	for _, message := range request.Messages {
+		fmt.Fprintf(t.out, "  %s: %s\n", message.Role, mcp.GetTextFromContent(message.Content))
+	}
+	fmt.Fprint(t.out, "Allow? [y/N] ")
+	input, err := t.in.readLine(ctx)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return false, err
+	}
+	switch strings.ToLower(strings.TrimSpace(input)) {
+	case "y", "yes":
+		return true, nil
+	default:
+		return false, nil
+	}
+}
+
+// refuseSampling stands in for the terminal when there is none to ask
+type refuseSampling struct{}
+
+func (refuseSampling) approveSampling(ctx context.Context, server, model string, request *mcp.CreateMessageRequest) (bool, error) {
+	return false, errors.New("approval is required and there is no terminal to ask")
+}
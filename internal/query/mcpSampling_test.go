@@ -0,0 +1,184 @@
+package query
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mark3labs/mcp-go/client/transport"
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/mark3labs/mcp-go/server"
+	"github.com/meschbach/marvin/internal/backend"
+	"github.com/meschbach/marvin/internal/config"
+	"github.com/ollama/ollama/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// pipedSpec serves an MCP server over a pair of pipes, allowing the server to make requests of the client
+type pipedSpec struct {
+	server *server.MCPServer
+}
+
+func (p *pipedSpec) start(ctx context.Context) (runningProgram, error) {
+	toServer, fromClient := io.Pipe()
+	toClient, fromServer := io.Pipe()
+	serving, stop := context.WithCancel(context.WithoutCancel(ctx))
+	go func() {
+		_ = server.NewStdioServer(p.server).Listen(serving, toServer, fromServer)
+	}()
+	return &pipedProgram{
+		mcpTransport: transport.NewIO(toClient, fromClient, io.NopCloser(&emptyReader{})),
+		cancel:       stop,
+	}, nil
+}
+
+type pipedProgram struct {
+	mcpTransport transport.Interface
+	cancel       context.CancelFunc
+}
+
+func (p *pipedProgram) transport() transport.Interface {
+	return p.mcpTransport
+}
+
+func (p *pipedProgram) stop(ctx context.Context) error {
+	p.cancel()
+	return nil
+}
+
+// summarizerServer offers a tool summarizing text by sampling the model of the client
+func summarizerServer() *server.MCPServer {
+	summarizer := server.NewMCPServer("summarizer", "1.0.0")
+	summarizer.EnableSampling()
+	summarizer.AddTool(mcp.NewTool("summarize", mcp.WithString("text")), func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		result, err := summarizer.RequestSampling(ctx, mcp.CreateMessageRequest{CreateMessageParams: mcp.CreateMessageParams{
+			Messages: []mcp.SamplingMessage{
+				{Role: mcp.RoleUser, Content: mcp.NewTextContent(request.GetString("text", ""))},
+			},
+			SystemPrompt:     "Summarize in one sentence.",
+			MaxTokens:        4096,
+			Temperature:      0.2,
+			ModelPreferences: &mcp.ModelPreferences{Hints: []mcp.ModelHint{{Name: "claude-3-haiku"}}},
+		}})
+		if err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+		return mcp.NewToolResultText(result.Model + ": " + mcp.GetTextFromContent(result.Content)), nil
+	})
+	return summarizer
+}
+
+func summarize(t *testing.T, sampler *mcpSampler) string {
+	t.Helper()
+	return summarizeWithin(t, context.Background(), sampler, 0)
+}
+
+// summarizeWithin calls the summarizer with ctx, its calls bounded by timeout or the default when zero
+func summarizeWithin(t *testing.T, ctx context.Context, sampler *mcpSampler, timeout time.Duration) string {
+	t.Helper()
+	tool := &Mark3labsTool{Name: "summarizer", spec: &pipedSpec{summarizerServer()}, sampler: sampler, timeout: timeout}
+	t.Cleanup(func() {
+		assert.NoError(t, tool.Shutdown(context.Background()))
+	})
+	_, err := tool.defineAPI(context.Background())
+	require.NoError(t, err)
+	replies, err := tool.invoke(ctx, backend.ToolCall("1", "summarizer.summarize", map[string]any{"text": "A long story."}))
+	require.NoError(t, err)
+	require.Len(t, replies, 1)
+	return replies[0].Content
+}
+
+func scriptedSampler(model *backend.Scripted, settings *config.SamplingBlock) *mcpSampler {
+	return &mcpSampler{
+		server:   "summarizer",
+		settings: settings,
+		model:    "llama3.2",
+		open:     func() (backend.Backend, error) { return model, nil },
+	}
+}
+
+func TestMCPSampler_CompletesWithTheBackend(t *testing.T) {
+	model := backend.NewScripted(backend.Reply("It was long."))
+	sampler := scriptedSampler(model, &config.SamplingBlock{Models: map[string]string{"haiku": "qwen3:4b"}, MaxTokens: 256})
+
+	assert.Equal(t, "qwen3:4b: It was long.", summarize(t, sampler))
+	requests := model.Requests()
+	require.Len(t, requests, 1)
+	assert.Equal(t, "qwen3:4b", requests[0].Model)
+	assert.Equal(t, []api.Message{
+		{Role: roleSystem, Content: "Summarize in one sentence."},
+		{Role: roleUser, Content: "A long story."},
+	}, requests[0].Messages)
+	assert.Equal(t, 256, requests[0].Options["num_predict"], "the cap of the configuration is lower than requested")
+	assert.Equal(t, 0.2, requests[0].Options["temperature"])
+}
+
+func TestMCPSampler_AsksForApproval(t *testing.T) {
+	model := backend.NewScripted(backend.Reply("It was long."))
+	sampler := scriptedSampler(model, &config.SamplingBlock{Approve: true})
+	var shown strings.Builder
+	sampler.approver = &terminalSamplingApprover{in: newLineReader(strings.NewReader("y\n")), out: &shown}
+
+	assert.Equal(t, "llama3.2: It was long.", summarize(t, sampler))
+	assert.Contains(t, shown.String(), `MCP server "summarizer" asks llama3.2 to complete`)
+	assert.Contains(t, shown.String(), "user: A long story.")
+}
+
+func TestMCPSampler_ApprovalIsNotBoundByTheTimeout(t *testing.T) {
+	model := backend.NewScripted(backend.Reply("It was long."))
+	sampler := scriptedSampler(model, &config.SamplingBlock{Approve: true})
+	in, typed := io.Pipe()
+	sampler.approver = &terminalSamplingApprover{in: newLineReader(in), out: io.Discard}
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		_, _ = typed.Write([]byte("y\n"))
+	}()
+
+	assert.Equal(t, "llama3.2: It was long.", summarizeWithin(t, context.Background(), sampler, 50*time.Millisecond))
+}
+
+func TestMCPSampler_ApprovalGivesUpWithTheCall(t *testing.T) {
+	model := backend.NewScripted()
+	sampler := scriptedSampler(model, &config.SamplingBlock{Approve: true})
+	in, _ := io.Pipe()
+	lines := newLineReader(in)
+	sampler.approver = &terminalSamplingApprover{in: lines, out: io.Discard}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	assert.Contains(t, summarizeWithin(t, ctx, sampler, 0), "context deadline exceeded")
+	asking, giveUp := context.WithTimeout(context.Background(), time.Second)
+	defer giveUp()
+	release, err := lines.hold(asking)
+	require.NoError(t, err, "the approval no longer holds the terminal")
+	release()
+	assert.Empty(t, model.Requests())
+}
+
+func TestMCPSampler_Declined(t *testing.T) {
+	model := backend.NewScripted()
+	sampler := scriptedSampler(model, &config.SamplingBlock{Approve: true})
+	sampler.approver = &terminalSamplingApprover{in: newLineReader(strings.NewReader("n\n")), out: io.Discard}
+
+	assert.Contains(t, summarize(t, sampler), "declined")
+	assert.Empty(t, model.Requests(), "declined requests are not sent to the model")
+}
+
+func TestMCPSampler_RefusedWithoutATerminal(t *testing.T) {
+	model := backend.NewScripted()
+	sampler := scriptedSampler(model, &config.SamplingBlock{Approve: true})
+	sampler.approver = refuseSampling{}
+
+	assert.Contains(t, summarize(t, sampler), "no terminal")
+	assert.Empty(t, model.Requests())
+}
+
+func TestNewMCPSampler_OnlyWhenAllowed(t *testing.T) {
+	denied := false
+	assert.Nil(t, newMCPSampler("a", nil, nil, nil), "servers without a block may not sample")
+	assert.Nil(t, newMCPSampler("a", &config.SamplingBlock{Allow: &denied}, nil, nil))
+	assert.NotNil(t, newMCPSampler("a", &config.SamplingBlock{}, nil, nil))
+}
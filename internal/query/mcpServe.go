@@ -0,0 +1,165 @@
+package query
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"runtime/debug"
+
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/mark3labs/mcp-go/server"
+	"github.com/meschbach/marvin/internal/backend"
+	"github.com/meschbach/marvin/internal/config"
+	"github.com/meschbach/marvin/internal/logging"
+	"github.com/ollama/ollama/api"
+)
+
+// Transports marvin serves MCP over
+const (
+	ServeStdio = "stdio"
+	ServeHTTP  = "http"
+)
+
+// ServeOptions controls how marvin is published as an MCP server
+type ServeOptions struct {
+	// Transport is stdio or http
+	Transport string
+	// Address is where the http transport listens, such as localhost:8080
+	Address string
+	// Proxy also publishes the tools of every configured MCP server
+	Proxy bool
+}
+
+// ServeMCP publishes the search and read_document operations of each documents block, and when proxying the tools of
+// the configured MCP servers, as an MCP server.  Serving stops once ctx is done or, over stdio, the client hangs up.
+func ServeMCP(ctx context.Context, cfg *config.File, opts *ServeOptions) (problem error) {
+	switch opts.Transport {
+	case ServeStdio, ServeHTTP:
+	default:
+		return &configError{operationalError{"transport", fmt.Errorf("unknown transport %q, expected %s or %s", opts.Transport, ServeStdio, ServeHTTP)}}
+	}
+	client, err := cfg.OpenBackend()
+	if err != nil {
+		return &configError{operationalError{"opening backend", err}}
+	}
+	published, tools, err := newMCPServer(ctx, client, cfg, opts.Proxy)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := tools.Shutdown(context.WithoutCancel(ctx)); err != nil {
+			problem = errors.Join(problem, &operationalError{"shutting down tools", err})
+		}
+	}()
+
+	if opts.Transport == ServeHTTP {
+		return serveHTTP(ctx, published, opts.Address)
+	}
+	return serveStdio(ctx, published, os.Stdin, os.Stdout)
+}
+
+// serveStdio serves a single client over in and out until the client hangs up or ctx is done
+func serveStdio(ctx context.Context, published *server.MCPServer, in io.Reader, out io.Writer) error {
+	slog.Info("serving MCP over stdio", logging.Component, "mcp-serve")
+	err := server.NewStdioServer(published).Listen(ctx, in, out)
+	if err != nil && !errors.Is(err, context.Canceled) && !errors.Is(err, io.EOF) {
+		return &operationalError{"serving MCP over stdio", err}
+	}
+	return nil
+}
+
+// serveHTTP serves clients over streamable HTTP at address until ctx is done
+func serveHTTP(ctx context.Context, published *server.MCPServer, address string) error {
+	service := server.NewStreamableHTTPServer(published)
+	stopped := make(chan error, 1)
+	go func() {
+		<-ctx.Done()
+		stopped <- service.Shutdown(context.WithoutCancel(ctx))
+	}()
+	slog.Info(fmt.Sprintf("serving MCP at http://%s/mcp", address), logging.Component, "mcp-serve")
+	if err := service.Start(address); !errors.Is(err, http.ErrServerClosed) {
+		return &operationalError{"serving MCP over HTTP", err}
+	}
+	if err := <-stopped; err != nil {
+		return &operationalError{"stopping the MCP server", err}
+	}
+	return nil
+}
+
+// newMCPServer builds the MCP server publishing the documents of the configuration and, when proxying, the tools of its
+// MCP servers.  The caller owns the returned ToolSet and must shut it down.
+func newMCPServer(ctx context.Context, client backend.Backend, cfg *config.File, proxy bool) (*server.MCPServer, *ToolSet, error) {
+	var proxied *config.File
+	if proxy {
+		proxied = cfg
+	}
+	tools, err := NewToolSet(ctx, proxied, nil)
+	if err != nil {
+		return nil, nil, &operationalError{"initializing tools", err}
+	}
+	published := server.NewMCPServer("marvin", marvinVersion(), server.WithToolCapabilities(false))
+	names := map[string]bool{}
+	publish := func(name string, tool api.Tool, invoke func(context.Context, api.ToolCall) ([]api.Message, error)) error {
+		if names[name] {
+			return &configError{operationalError{"publishing tools", fmt.Errorf("more than one tool is named %q", name)}}
+		}
+		names[name] = true
+		return publishTool(published, name, tool, invoke)
+	}
+
+	for _, documents := range cfg.Documents {
+		rag := &chromemTool{config: documents, client: client}
+		definition, err := rag.defineAPI(ctx)
+		if err != nil {
+			return nil, nil, joinShutdown(ctx, tools, &toolStartupError{documents.Name, err})
+		}
+		for _, tool := range definition.tool {
+			if err := publish(documents.Name+"."+tool.Function.Name, tool, rag.invoke); err != nil {
+				return nil, nil, joinShutdown(ctx, tools, err)
+			}
+		}
+	}
+	for _, tool := range tools.APITools() {
+		if err := publish(tool.Function.Name, tool, tools.HandleCall); err != nil {
+			return nil, nil, joinShutdown(ctx, tools, err)
+		}
+	}
+	return published, tools, nil
+}
+
+// publishTool adds the tool to the server under name.  Calls are passed to invoke with the name the tool was defined
+// with and the replies returned as text content.
+func publishTool(published *server.MCPServer, name string, tool api.Tool, invoke func(context.Context, api.ToolCall) ([]api.Message, error)) error {
+	parameters := tool.Function.Parameters
+	parameters.Type = mcpParameterTypeObject
+	schema, err := json.Marshal(parameters)
+	if err != nil {
+		return &operationalError{fmt.Sprintf("encoding the parameters of %q", name), err}
+	}
+	published.AddTool(mcp.NewToolWithRawSchema(name, tool.Function.Description, schema), func(ctx context.Context, request mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		call := api.ToolCall{Function: api.ToolCallFunction{Name: tool.Function.Name, Arguments: request.GetArguments()}}
+		replies, err := invoke(ctx, call)
+		if err != nil {
+			return mcp.NewToolResultError(err.Error()), nil
+		}
+		result := &mcp.CallToolResult{}
+		for _, reply := range replies {
+			result.Content = append(result.Content, mcp.NewTextContent(reply.Content))
+		}
+		return result, nil
+	})
+	return nil
+}
+
+// marvinVersion is the version of the module marvin was built from, if known
+func marvinVersion() string {
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		return info.Main.Version
+	}
+	return "(devel)"
+}
@@ -0,0 +1,102 @@
+package query
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mark3labs/mcp-go/client"
+	"github.com/mark3labs/mcp-go/client/transport"
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/mark3labs/mcp-go/server"
+	"github.com/meschbach/marvin/internal/backend"
+	"github.com/meschbach/marvin/internal/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// servedOverStdio serves the configuration over a pair of pipes, returning an initialized client of the server
+func servedOverStdio(t *testing.T, cfg *config.File, proxy bool) *client.Client {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	published, tools, err := newMCPServer(ctx, backend.NewScripted(), cfg, proxy)
+	require.NoError(t, err)
+
+	toServer, fromClient := io.Pipe()
+	toClient, fromServer := io.Pipe()
+	served := make(chan error, 1)
+	go func() {
+		served <- serveStdio(ctx, published, toServer, fromServer)
+	}()
+	mcpClient := client.NewClient(transport.NewIO(toClient, fromClient, io.NopCloser(&emptyReader{})))
+	require.NoError(t, mcpClient.Start(ctx))
+	_, err = mcpClient.Initialize(ctx, mcp.InitializeRequest{})
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		assert.NoError(t, mcpClient.Close())
+		cancel()
+		toServer.Close()
+		assert.NoError(t, <-served)
+		assert.NoError(t, tools.Shutdown(context.Background()))
+	})
+	return mcpClient
+}
+
+type emptyReader struct{}
+
+func (*emptyReader) Read([]byte) (int, error) { return 0, io.EOF }
+
+func callText(t *testing.T, mcpClient *client.Client, name string, arguments map[string]any) string {
+	t.Helper()
+	result, err := mcpClient.CallTool(context.Background(), mcp.CallToolRequest{Params: mcp.CallToolParams{Name: name, Arguments: arguments}})
+	require.NoError(t, err)
+	require.False(t, result.IsError, "%v", result.Content)
+	require.Len(t, result.Content, 1)
+	return result.Content[0].(mcp.TextContent).Text
+}
+
+func TestServeMCP_PublishesDocumentsAndProxiedTools(t *testing.T) {
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	documents := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(documents, "leave.md"), []byte("Take as much as you need."), 0o644))
+	relative, err := filepath.Rel(wd, documents)
+	require.NoError(t, err)
+
+	clock := server.NewTestStreamableHTTPServer(clockServer())
+	defer clock.Close()
+	cfg := &config.File{
+		Documents: []*config.DocumentsBlock{{Name: "handbook", DocumentPath: relative}},
+		HTTPMCP:   []*config.HTTPMCPBlock{{Name: "clock", URL: clock.URL + "/mcp"}},
+	}
+	mcpClient := servedOverStdio(t, cfg, true)
+
+	listed, err := mcpClient.ListTools(context.Background(), mcp.ListToolsRequest{})
+	require.NoError(t, err)
+	var names []string
+	for _, tool := range listed.Tools {
+		names = append(names, tool.Name)
+	}
+	assert.ElementsMatch(t, []string{"handbook.search", "handbook.read_document", "clock.now"}, names)
+
+	assert.Equal(t, "Take as much as you need.", callText(t, mcpClient, "handbook.read_document", map[string]any{"filename": "leave.md"}))
+	assert.Equal(t, "12:00 UTC", callText(t, mcpClient, "clock.now", map[string]any{"zone": "UTC"}))
+}
+
+func TestServeMCP_OnlyProxiesWhenAsked(t *testing.T) {
+	clock := server.NewTestStreamableHTTPServer(clockServer())
+	defer clock.Close()
+	cfg := &config.File{HTTPMCP: []*config.HTTPMCPBlock{{Name: "clock", URL: clock.URL + "/mcp"}}}
+	mcpClient := servedOverStdio(t, cfg, false)
+
+	listed, err := mcpClient.ListTools(context.Background(), mcp.ListToolsRequest{})
+	require.NoError(t, err)
+	assert.Empty(t, listed.Tools)
+}
+
+func TestServeMCP_RejectsUnknownTransport(t *testing.T) {
+	err := ServeMCP(context.Background(), &config.File{}, &ServeOptions{Transport: "carrier-pigeon"})
+	assert.Equal(t, ExitConfig, ExitCode(err))
+}
@@ -2,144 +2,229 @@ package query
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"os"
 	"strings"
 
+	"github.com/meschbach/marvin/internal/backend"
+	"github.com/meschbach/marvin/internal/config"
 	"github.com/ollama/ollama/api"
 )
 
 type ollamaConversation struct {
-	client         *api.Client
+	client         backend.Backend
 	messages       []api.Message
 	tools          *ToolSet
-	showThinking   bool
-	showDone       bool
-	showTools      bool
+	events         eventSink
 	responseTokens int
 	promptTokens   int
+	// checkpoint, when set, receives the full history after each completed turn so it may be persisted.
+	checkpoint func(model string, messages []api.Message) error
+	// budget limits tool usage within a single run to conclusion.  Nil is unlimited.
+	budget *conversationBudget
+	// toolWorkers is the number of tool calls from a single turn which may run concurrently
+	toolWorkers int
+	// options are the generation options sent with each request
+	options *config.OllamaOptionsBlock
+	// format constrains the output of the model, such as to a JSON schema
+	format json.RawMessage
+	// hideContent suppresses content events when the caller presents the answer instead
+	hideContent bool
+	// contextWindow compacts the history as it approaches the context window of the model.  Nil disables compaction.
+	contextWindow *contextManager
+	// compacted stands in for the first compactedThrough messages when prompting the model.  The history itself is kept
+	// whole so checkpoints persist every message.
+	compacted        []api.Message
+	compactedThrough int
+}
+
+// prompt is the history as sent to the model, with the compacted messages in place of those they replace
+func (o *ollamaConversation) prompt() []api.Message {
+	if o.compacted == nil || o.compactedThrough > len(o.messages) {
+		return o.messages
+	}
+	out := make([]api.Message, 0, len(o.compacted)+len(o.messages)-o.compactedThrough)
+	out = append(out, o.compacted...)
+	return append(out, o.messages[o.compactedThrough:]...)
+}
+
+// forgetCompaction prompts the model with the history as is, such as once it has been replaced
+func (o *ollamaConversation) forgetCompaction() {
+	o.compacted = nil
+	o.compactedThrough = 0
+}
+
+// recordTurn hands the history to the checkpoint, if any.
+func (o *ollamaConversation) recordTurn(model string) error {
+	if o.checkpoint == nil {
+		return nil
+	}
+	if err := o.checkpoint(model, o.messages); err != nil {
+		return &operationalError{"checkpointing conversation", err}
+	}
+	return nil
+}
+
+func (o *ollamaConversation) totalTokens() int {
+	return o.responseTokens + o.promptTokens
 }
 
 // runAIToConclusion executes the AI chat loop with tool-call handling until
 // the assistant produces a final answer (no further tool calls) or an error occurs.
+// When the budget is exhausted the model is asked for a final answer without access to tools.
 func (o *ollamaConversation) runAIToConclusion(ctx context.Context, model string, availableTools api.Tools) error {
-	//
-	//fmt.Printf("Tools (%d)\n", len(o.messages))
-	//for _, tool := range o.messages {
-	//	fmt.Printf("\t-%s %s\n", tool.Role, tool.Content)
-	//}
-	//
+	o.budget.reset(o.totalTokens())
 	for {
-		req := &api.ChatRequest{
-			Model:    model,
-			Messages: o.messages,
-			Tools:    availableTools,
+		if reason := o.budget.beforeTurn(o.totalTokens()); reason != "" {
+			return o.concludeWithoutTools(ctx, model, reason)
 		}
-
-		// Accumulate the assistant response and capture any tool calls
-		var assistantOut, thinkingBuffer strings.Builder
-		var thisLine strings.Builder
-		var thisThinking strings.Builder
-		var pendingCalls []api.ToolCall
-
-		err := o.client.Chat(ctx, req, func(resp api.ChatResponse) error {
-			if resp.Done {
-				if o.showDone {
-					fmt.Printf("<Done> (%d) %s\n", resp.EvalCount, resp.DoneReason)
-				}
-				o.responseTokens = o.responseTokens + resp.EvalCount
-				o.promptTokens = o.promptTokens + resp.PromptEvalCount
-			}
-			if s := resp.Message.Content; s != "" {
-				thisLine.WriteString(s)
-				if strings.Contains(s, "\n") {
-					fmt.Print(thisLine.String())
-					thisLine.Reset()
-				}
-
-				assistantOut.WriteString(s)
-			}
-			if len(resp.Message.Thinking) > 0 {
-				if o.showThinking {
-					thisThinking.WriteString(resp.Message.Thinking)
-					if strings.Contains(thisThinking.String(), "\n") {
-						fmt.Printf("Thinking: %s", thisThinking.String())
-						thisThinking.Reset()
-					}
-				}
-				thinkingBuffer.WriteString(resp.Message.Thinking)
-			}
-
-			if len(resp.Message.ToolCalls) > 0 {
-				if o.showTools {
-					fmt.Printf("tool call {%s} > %s\n\t%#v\n", resp.Message.ToolCalls[0].ID, resp.Message.ToolCalls[0].Function.Name, resp.Message.ToolCalls[0].Function.Arguments)
-				}
-				// Capture tool calls signaled by the model
-				pendingCalls = append(pendingCalls, resp.Message.ToolCalls...)
-			}
-			return nil
-		})
-
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "\nError querying Ollama: %v\nAssitant buffer:%q\nPending calls: %#v\nTools:\n", err, assistantOut.String(), pendingCalls)
-			for _, tool := range availableTools {
-				fmt.Fprintf(os.Stderr, "\t%s: %s\n", tool.Function.Name, tool.Function.Description)
-			}
+		if err := o.contextWindow.manage(ctx, o, model, availableTools); err != nil {
 			return err
 		}
-		lastThought := thisThinking.String()
-		if lastThought != "" {
-			fmt.Printf("Thinking: %s\n\n", lastThought)
-		}
-		lastLine := thisLine.String()
-		if lastLine != "" {
-			fmt.Println(lastLine)
+		assistantMsg, err := o.exchange(ctx, model, availableTools)
+		if err != nil {
+			return err
 		}
+		pendingCalls := assistantMsg.ToolCalls
 
 		// Record the assistant turn (including tool calls, if any)
-		assistantMsg := api.Message{
-			Role:      roleAssistant,
-			Content:   assistantOut.String(),
-			ToolCalls: pendingCalls,
-			Thinking:  thinkingBuffer.String(),
-		}
 		o.messages = append(o.messages, assistantMsg)
-
-		if o.showTools {
-			fmt.Println()
-			fmt.Printf("tools > %d pending invocations\n", len(pendingCalls))
+		if err := o.recordTurn(model); err != nil {
+			return err
 		}
+
 		// If there are no tool calls, we are done for this turn
 		if len(pendingCalls) == 0 {
-			fmt.Println()
-			fmt.Printf("Total tokens: %d = (prompt tokens: %d) + (response tokens: %d)\n", o.responseTokens+o.promptTokens, o.promptTokens, o.responseTokens)
+			o.emitDone()
 			return nil
 		}
 
+		if reason := o.budget.admit(pendingCalls); reason != "" {
+			// Every call must be answered for the history to remain well-formed
+			for _, call := range pendingCalls {
+				o.messages = append(o.messages, toolResponseMessage(call, fmt.Sprintf("{\"error\":%q}", "not executed: "+reason)))
+			}
+			return o.concludeWithoutTools(ctx, model, reason)
+		}
+
 		var pendingCallsErrors error
-		// For each tool call, invoke via the toolset and append tool results
+		// Invoke each tool call via the toolset and append tool results in the order they were requested
 		for _, call := range pendingCalls {
-			if o.showTools {
-				fmt.Printf("call %s> Function %s with argument %#v\n", call.ID, call.Function.Name, call.Function.Arguments)
+			o.events.emit(toolCallEvent(call))
+		}
+		for _, result := range o.tools.HandleCalls(ctx, pendingCalls, o.toolWorkers) {
+			pendingCallsErrors = errors.Join(result.err, pendingCallsErrors)
+			for _, reply := range result.replies {
+				o.events.emit(toolResultEvent(reply))
 			}
-			reply, herr := o.tools.HandleCall(ctx, call)
-			pendingCallsErrors = errors.Join(herr, pendingCallsErrors)
-			if o.showTools {
-				for _, reply := range reply {
-					fmt.Printf("call %s>\t%s\t%s: %s\n", reply.ToolCallID, reply.Role, reply.ToolName, reply.Content)
-				}
-				if len(reply) == 0 {
-					fmt.Printf("call %s> no response\n", call.ID)
-				}
+			if result.err != nil {
+				o.events.emit(Event{Type: EventToolResult, ToolCallID: result.call.ID, ToolName: result.call.Function.Name, Error: result.err.Error()})
+			} else if len(result.replies) == 0 {
+				o.events.emit(Event{Type: EventToolResult, ToolCallID: result.call.ID, ToolName: result.call.Function.Name})
 			}
-			o.messages = append(o.messages, reply...)
+			o.messages = append(o.messages, result.replies...)
+		}
+		if err := o.recordTurn(model); err != nil {
+			return err
 		}
 		if pendingCallsErrors != nil {
-			fmt.Printf("\nError invoking tools: %v\n", pendingCallsErrors)
-			return pendingCallsErrors
+			return &toolInvocationError{operationalError{"invoking tools", pendingCallsErrors}}
 		}
 
 		// Loop continues: the next iteration sends messages including tool outputs
 	}
 }
+
+// concludeWithoutTools informs the model the budget has been exhausted and requests a final answer with tools disabled.
+// The budget error is returned once the answer has been given.
+func (o *ollamaConversation) concludeWithoutTools(ctx context.Context, model string, reason string) error {
+	o.events.emit(noticeEvent("budget", "%s; requesting a final answer", reason))
+	o.messages = append(o.messages, api.Message{
+		Role:    roleSystem,
+		Content: fmt.Sprintf("The tool budget for this request is exhausted: %s.  Do not call any more tools.  Give your final answer to the user based on what you have learned so far.", reason),
+	})
+	if err := o.contextWindow.manage(ctx, o, model, nil); err != nil {
+		return err
+	}
+	assistantMsg, err := o.exchange(ctx, model, nil)
+	if err != nil {
+		return err
+	}
+	// Tools were not offered; any calls the model attempted anyway can not be honored.
+	assistantMsg.ToolCalls = nil
+	o.messages = append(o.messages, assistantMsg)
+	if err := o.recordTurn(model); err != nil {
+		return err
+	}
+	o.emitDone()
+	return &budgetExceededError{reason}
+}
+
+func (o *ollamaConversation) emitDone() {
+	o.events.emit(Event{Type: EventDone, PromptTokens: o.promptTokens, ResponseTokens: o.responseTokens})
+}
+
+// exchange streams a single request to the model, emitting the response as it arrives, and returns the resulting
+// assistant message including any tool calls.
+func (o *ollamaConversation) exchange(ctx context.Context, model string, availableTools api.Tools) (api.Message, error) {
+	req := &api.ChatRequest{
+		Model:    model,
+		Messages: o.prompt(),
+		Tools:    availableTools,
+		Format:   o.format,
+	}
+	if err := o.options.ApplyToChat(req); err != nil {
+		return api.Message{}, err
+	}
+
+	// Accumulate the assistant response and capture any tool calls
+	var assistantOut, thinkingBuffer strings.Builder
+	var pendingCalls []api.ToolCall
+
+	err := o.client.Chat(ctx, req, func(resp api.ChatResponse) error {
+		if s := resp.Message.Content; s != "" {
+			if !o.hideContent {
+				o.events.emit(Event{Type: EventContent, Content: s})
+			}
+			assistantOut.WriteString(s)
+		}
+		if len(resp.Message.Thinking) > 0 {
+			o.events.emit(Event{Type: EventThinking, Content: resp.Message.Thinking})
+			thinkingBuffer.WriteString(resp.Message.Thinking)
+		}
+		if len(resp.Message.ToolCalls) > 0 {
+			// Capture tool calls signaled by the model
+			pendingCalls = append(pendingCalls, resp.Message.ToolCalls...)
+		}
+		if resp.Done {
+			o.responseTokens = o.responseTokens + resp.EvalCount
+			o.promptTokens = o.promptTokens + resp.PromptEvalCount
+			o.events.emit(Event{Type: EventUsage, PromptTokens: resp.PromptEvalCount, ResponseTokens: resp.EvalCount, DoneReason: resp.DoneReason})
+		}
+		return nil
+	})
+
+	if err != nil {
+		return api.Message{}, backendError(fmt.Sprintf("querying the model with %d tools after %s and %d pending calls", len(availableTools), describePartialOutput(assistantOut.String()), len(pendingCalls)), model, err)
+	}
+
+	return api.Message{
+		Role:      roleAssistant,
+		Content:   assistantOut.String(),
+		ToolCalls: pendingCalls,
+		Thinking:  thinkingBuffer.String(),
+	}, nil
+}
+
+// partialOutputExcerpt is how many characters of an interrupted answer are quoted when reporting the failure
+const partialOutputExcerpt = 64
+
+// describePartialOutput summarizes the answer streamed before a failure by its length and opening characters
+func describePartialOutput(output string) string {
+	runes := []rune(output)
+	if len(runes) <= partialOutputExcerpt {
+		return fmt.Sprintf("%d characters of output %q", len(runes), output)
+	}
+	return fmt.Sprintf("%d characters of output starting %q", len(runes), string(runes[:partialOutputExcerpt]))
+}
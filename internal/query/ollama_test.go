@@ -0,0 +1,146 @@
+package query
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/meschbach/marvin/internal/backend"
+	"github.com/meschbach/marvin/internal/config"
+	"github.com/ollama/ollama/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// failingTool fails every invocation
+type failingTool struct {
+	name string
+	err  error
+}
+
+func (f *failingTool) defineAPI(ctx context.Context) (*toolDefinition, error) {
+	return &toolDefinition{tool: api.Tools{{Type: ToolTypeFunction, Function: api.ToolFunction{Name: f.name}}}}, nil
+}
+
+func (f *failingTool) invoke(ctx context.Context, call api.ToolCall) ([]api.Message, error) {
+	return nil, f.err
+}
+
+func scriptedConversation(script *backend.Scripted, tools *ToolSet) (*ollamaConversation, *recordedEvents) {
+	events := &recordedEvents{}
+	return &ollamaConversation{
+		client:   script,
+		messages: []api.Message{{Role: roleUser, Content: "question"}},
+		tools:    tools,
+		events:   events,
+	}, events
+}
+
+func (r *recordedEvents) ofType(eventType string) (out []Event) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	for _, e := range r.events {
+		if e.Type == eventType {
+			out = append(out, e)
+		}
+	}
+	return out
+}
+
+func TestRunAIToConclusion_AnswersToolCalls(t *testing.T) {
+	script := backend.NewScripted(
+		backend.ScriptedReply{
+			Parts:        []string{"Let me check."},
+			ToolCalls:    []api.ToolCall{backend.ToolCall("a", "one", nil), backend.ToolCall("b", "two", nil)},
+			PromptTokens: 10, ResponseTokens: 4,
+		},
+		backend.ScriptedReply{Parts: []string{"The ", "answer."}, PromptTokens: 20, ResponseTokens: 2},
+	)
+	tools := probeToolSet(t, &concurrencyProbeTool{names: []string{"one", "two"}})
+	conversation, events := scriptedConversation(script, tools)
+
+	require.NoError(t, conversation.runAIToConclusion(context.Background(), "scripted", tools.defs))
+
+	requests := script.Requests()
+	require.Len(t, requests, 2)
+	assert.Equal(t, "scripted", requests[0].Model)
+	assert.Len(t, requests[0].Tools, 2)
+	followUp := requests[1].Messages
+	require.Len(t, followUp, 4)
+	assert.Equal(t, roleAssistant, followUp[1].Role)
+	assert.Len(t, followUp[1].ToolCalls, 2)
+	assert.Equal(t, toolResponseMessage(backend.ToolCall("a", "one", nil), "a"), followUp[2])
+	assert.Equal(t, "b", followUp[3].ToolCallID)
+
+	last := conversation.messages[len(conversation.messages)-1]
+	assert.Equal(t, roleAssistant, last.Role)
+	assert.Equal(t, "The answer.", last.Content)
+	assert.Equal(t, 30, conversation.promptTokens)
+	assert.Equal(t, 6, conversation.responseTokens)
+
+	assert.Len(t, events.ofType(EventToolCall), 2)
+	assert.Len(t, events.ofType(EventToolResult), 2)
+	done := events.ofType(EventDone)
+	require.Len(t, done, 1)
+	assert.Equal(t, 30, done[0].PromptTokens)
+}
+
+func TestRunAIToConclusion_ConcludesWithoutToolsOnceBudgetExhausted(t *testing.T) {
+	script := backend.NewScripted(
+		backend.CallTools(backend.ToolCall("a", "one", nil)),
+		backend.CallTools(backend.ToolCall("b", "one", nil)),
+		backend.Reply("Best effort."),
+	)
+	tools := probeToolSet(t, &concurrencyProbeTool{names: []string{"one"}})
+	conversation, _ := scriptedConversation(script, tools)
+	conversation.budget = newConversationBudget(config.LimitsBlock{MaxToolCalls: 1})
+
+	err := conversation.runAIToConclusion(context.Background(), "scripted", tools.defs)
+	var exceeded *budgetExceededError
+	require.ErrorAs(t, err, &exceeded)
+
+	requests := script.Requests()
+	require.Len(t, requests, 3)
+	assert.Empty(t, requests[2].Tools, "the final answer is requested without tools")
+	history := requests[2].Messages
+	assert.Equal(t, "b", history[len(history)-2].ToolCallID, "the rejected call is still answered")
+	assert.Equal(t, roleSystem, history[len(history)-1].Role)
+	assert.Equal(t, "Best effort.", conversation.messages[len(conversation.messages)-1].Content)
+}
+
+func TestRunAIToConclusion_ToolFailure(t *testing.T) {
+	cause := errors.New("disk on fire")
+	script := backend.NewScripted(backend.CallTools(backend.ToolCall("a", "broken", nil)))
+	tools := probeToolSet(t, &failingTool{name: "broken", err: cause})
+	conversation, events := scriptedConversation(script, tools)
+
+	err := conversation.runAIToConclusion(context.Background(), "scripted", tools.defs)
+	require.ErrorIs(t, err, cause)
+	assert.Equal(t, ExitToolInvocation, ExitCode(err))
+	results := events.ofType(EventToolResult)
+	require.Len(t, results, 1)
+	assert.Contains(t, results[0].Error, "disk on fire")
+	assert.Equal(t, 0, script.Remaining())
+}
+
+func TestRunAIToConclusion_BackendFailure(t *testing.T) {
+	script := backend.NewScripted(backend.ScriptedReply{Err: api.StatusError{StatusCode: 404, ErrorMessage: "model not found"}})
+	conversation, events := scriptedConversation(script, probeToolSet(t))
+
+	err := conversation.runAIToConclusion(context.Background(), "missing", nil)
+	assert.Equal(t, ExitModelMissing, ExitCode(err))
+	assert.Empty(t, events.ofType(EventDone))
+}
+
+func TestRunAIToConclusion_BackendFailureExcerptsThePartialAnswer(t *testing.T) {
+	long := strings.Repeat("Marvin is thinking. ", 50)
+	script := backend.NewScripted(backend.ScriptedReply{Parts: []string{long}, Err: errors.New("connection reset")})
+	conversation, _ := scriptedConversation(script, probeToolSet(t))
+
+	err := conversation.runAIToConclusion(context.Background(), "llama3.2", nil)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "1000 characters of output starting \"Marvin is thinking.")
+	assert.NotContains(t, err.Error(), long)
+	assert.Contains(t, err.Error(), "connection reset")
+}
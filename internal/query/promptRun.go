@@ -0,0 +1,104 @@
+package query
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/meschbach/marvin/internal/backend"
+	"github.com/meschbach/marvin/internal/config"
+	"github.com/meschbach/marvin/internal/logging"
+	"github.com/ollama/ollama/api"
+)
+
+// promptRun is the outcome of running a single prompt to conclusion with fresh tools
+type promptRun struct {
+	answer string
+	// calls are the tools the model called, in the order it called them
+	calls []tracedCall
+	// turns counts the responses of the model
+	turns          int
+	promptTokens   int
+	responseTokens int
+	duration       time.Duration
+	// err stopped the run before it concluded
+	err error
+}
+
+func (r *promptRun) totalTokens() int {
+	return r.promptTokens + r.responseTokens
+}
+
+// toolCalls are the calls made by the model without their outcomes
+func (r *promptRun) toolCalls() []api.ToolCall {
+	calls := make([]api.ToolCall, 0, len(r.calls))
+	for _, traced := range r.calls {
+		calls = append(calls, traced.call)
+	}
+	return calls
+}
+
+// tracedCall is a tool call along with the error it failed with, if any
+type tracedCall struct {
+	call api.ToolCall
+	err  string
+}
+
+// runPrompt runs the prompt to conclusion through the query pipeline, building the toolset for the run alone and
+// shutting it down afterward.
+func runPrompt(ctx context.Context, client backend.Backend, cfg *config.File, opts *ChatOptions, prompt string) (run *promptRun) {
+	run = &promptRun{}
+	started := time.Now()
+	defer func() {
+		run.duration = time.Since(started)
+	}()
+
+	trace := &promptTrace{}
+	conversation, answer, err := performQuery(ctx, client, cfg, prompt, opts, trace, nil)
+	run.answer, run.err = answer, err
+	run.calls, run.turns = trace.summary()
+	if conversation != nil {
+		run.promptTokens, run.responseTokens = conversation.promptTokens, conversation.responseTokens
+	}
+	return run
+}
+
+// promptTrace collects the tool calls and turns of a run from its events
+type promptTrace struct {
+	lock  sync.Mutex
+	calls []tracedCall
+	turns int
+}
+
+func (t *promptTrace) emit(e Event) {
+	if e.Agent != "" {
+		// Only the calls of the prompted model are traced, not those of the agents it delegates to
+		return
+	}
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	switch e.Type {
+	case EventToolCall:
+		t.calls = append(t.calls, tracedCall{call: api.ToolCall{ID: e.ToolCallID, Function: api.ToolCallFunction{Name: e.ToolName, Arguments: e.Arguments}}})
+	case EventToolResult:
+		if e.Error == "" {
+			return
+		}
+		for i := range t.calls {
+			if t.calls[i].call.ID == e.ToolCallID && t.calls[i].call.Function.Name == e.ToolName {
+				t.calls[i].err = e.Error
+			}
+		}
+	case EventUsage:
+		t.turns++
+	case EventError:
+		slog.Debug(e.Content, logging.Component, "run")
+	}
+}
+
+func (t *promptTrace) summary() ([]tracedCall, int) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.calls, t.turns
+}
@@ -2,10 +2,15 @@ package query
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"log/slog"
 	"os"
 
+	"github.com/meschbach/marvin/internal/backend"
+	"github.com/meschbach/marvin/internal/cassette"
 	"github.com/meschbach/marvin/internal/config"
+	"github.com/meschbach/marvin/internal/logging"
 	"github.com/ollama/ollama/api"
 )
 
@@ -18,40 +23,212 @@ type ChatOptions struct {
 	ShowThinking bool
 	//ShowDone will print out when the LLM issues a "Done" command
 	ShowDone bool
+	//Session names a persisted conversation to resume and update after each turn
+	Session string
+	//Limits overrides the configured conversation limits
+	Limits config.LimitsBlock
+	//Ollama overrides the configured generation options
+	Ollama config.OllamaOptionsBlock
+	//ResponseFormat overrides the configured JSON schema constraining the answer
+	ResponseFormat config.ResponseFormatBlock
+	//ParallelToolCalls overrides the configured number of tool calls run concurrently
+	ParallelToolCalls int
+	//Output selects how progress is written: text for people or jsonl for programs
+	Output string
+	//Traffic records the model and MCP traffic to cassettes or replays it from them
+	Traffic cassette.Options
+	//Agent selects a named agent profile of the configuration
+	Agent string
+	//Prompt names an MCP prompt, as `<server>.<prompt>`, starting the conversation
+	Prompt string
+	//PromptArguments fill in the prompt, each as `name=value`
+	PromptArguments []string
+
+	// agentDepth is how many agents deep a delegated conversation is, zero for the conversation of the user
+	agentDepth int
+	// agentDepthLimit is the deepest delegation permitted by the conversations delegating to this one, if any
+	agentDepthLimit int
+	// servers are the MCP servers of the conversation delegating to this one, nil for the conversation of the user
+	servers *mcpServers
 }
 
-// PerformWithConfig executes the search using the optional parsed configuration.
-func PerformWithConfig(cfg *config.File, actualQuery string, opts *ChatOptions) {
-	fmt.Printf("user search:\t%s\n", actualQuery)
+// display selects which events are rendered as text
+func (c *ChatOptions) display() DisplayOptions {
+	return DisplayOptions{ShowThinking: c.ShowThinking, ShowTools: c.ShowTools, ShowDone: c.ShowDone}
+}
 
-	// search Ollama for a response
-	client, err := api.ClientFromEnvironment()
+// PerformWithConfig executes the search using the optional parsed configuration.  When an MCP prompt is selected its
+// messages start the conversation ahead of the query, which may then be empty.  Failures are reported through the
+// events of the query before being returned.
+func PerformWithConfig(cfg *config.File, actualQuery string, opts *ChatOptions) (problem error) {
+	events, err := newEventSink(opts.Output, opts.display())
+	if err != nil {
+		return err
+	}
+	defer func() {
+		problem = report(events, problem)
+	}()
+	events.emit(noticeEvent("user search", "%s", actualQuery))
+	cfg, err = selectAgent(cfg, opts.Agent)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error creating Ollama client: %v\n", err)
-		return
+		return err
 	}
 
-	// Build tools from configuration (if provided)
+	traffic, err := openTraffic(&opts.Traffic)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		problem = closeTraffic(traffic, problem)
+	}()
+
 	ctx := context.Background()
-	toolset, tsErr := NewToolSet(ctx, cfg)
-	if tsErr != nil {
-		fmt.Fprintf(os.Stderr, "Error initializing tools: %v\n", tsErr)
-		return
+	client, err := cfg.OpenBackend()
+	if err != nil {
+		return &configError{operationalError{"opening backend", err}}
+	}
+	_, _, err = performQuery(ctx, traffic.Backend(client), cfg, actualQuery, opts, events, traffic)
+	return err
+}
+
+// performQuery runs the query to conclusion through client with tools started for the query alone, returning the
+// conversation and the answer it concluded with.  The answer is constrained to the configured response format, if any.
+// The conversation is nil when it could not be started.
+func performQuery(ctx context.Context, client backend.Backend, cfg *config.File, actualQuery string, opts *ChatOptions, events eventSink, traffic *cassette.Deck) (conversation *ollamaConversation, answer string, problem error) {
+	conversation, toolset, err := startConversationWith(ctx, client, cfg, opts, events, traffic)
+	if err != nil {
+		return nil, "", err
 	}
 	defer func() {
-		fmt.Println("Shutting down tools")
+		slog.Debug("shutting down", logging.Component, "tools")
 		if err := toolset.Shutdown(ctx); err != nil {
-			fmt.Printf("Error shutting down tools: %v\n", err)
+			problem = errors.Join(problem, &operationalError{"shutting down tools", err})
 		}
 	}()
-	for _, rag := range cfg.Documents {
-		tool := &chromemTool{config: rag, showInvocations: false}
+	if err := resumeSession(conversation, opts.Session); err != nil {
+		return conversation, "", err
+	}
+	if opts.Prompt != "" {
+		arguments, err := parsePromptArguments(opts.PromptArguments)
+		if err != nil {
+			return conversation, "", err
+		}
+		prompt, err := toolset.renderPrompt(ctx, opts.Prompt, arguments)
+		if err != nil {
+			return conversation, "", err
+		}
+		conversation.messages = append(conversation.messages, prompt...)
+	}
+	if actualQuery != "" {
+		conversation.messages = append(conversation.messages, api.Message{Role: roleUser, Content: actualQuery})
+	}
+
+	if opts.ShowTools {
+		for _, m := range conversation.messages {
+			events.emit(noticeEvent("initial", "%s: %s", m.Role, m.Content))
+		}
+	}
+
+	model := cfg.LanguageModel()
+	events.emit(noticeEvent("config", "model: %s", model))
+
+	responseFormat := cfg.ResolveResponseFormat(opts.ResponseFormat)
+	schema, err := loadResponseSchema(responseFormat)
+	if err != nil {
+		return conversation, "", err
+	}
+	if schema != nil {
+		answer, err := conversation.runToSchema(ctx, model, toolset.APITools(), schema, responseFormat.ResolveMaxRetries())
+		if answer != nil {
+			events.emit(Event{Type: EventAnswer, Content: string(answer)})
+		}
+		return conversation, string(answer), err
+	}
+
+	err = conversation.runAIToConclusion(ctx, model, toolset.APITools())
+	return conversation, conversation.finalAnswer(), err
+}
+
+// selectAgent narrows the configuration to the named agent profile, leaving it as is when no agent is named
+func selectAgent(cfg *config.File, name string) (*config.File, error) {
+	selected, err := cfg.ForAgent(name)
+	if err != nil {
+		return nil, &configError{operationalError{"selecting agent", err}}
+	}
+	return selected, nil
+}
+
+// startConversation builds the toolset and the initial system messages shared by single queries and interactive chats.
+// On success the caller owns the returned ToolSet and must shut it down.  Traffic with the backend and MCP servers is
+// recorded or replayed through the traffic deck, which may be nil.
+func startConversation(ctx context.Context, cfg *config.File, opts *ChatOptions, events eventSink, traffic *cassette.Deck) (*ollamaConversation, *ToolSet, error) {
+	client, err := cfg.OpenBackend()
+	if err != nil {
+		return nil, nil, &configError{operationalError{"opening backend", err}}
+	}
+	return startConversationWith(ctx, traffic.Backend(client), cfg, opts, events, traffic)
+}
+
+// startConversationWith builds the conversation as startConversation does, talking to the model through client.
+func startConversationWith(ctx context.Context, client backend.Backend, cfg *config.File, opts *ChatOptions, events eventSink, traffic *cassette.Deck) (*ollamaConversation, *ToolSet, error) {
+	// Build tools from configuration (if provided)
+	toolset, err := newToolSet(ctx, cfg, traffic, opts.servers)
+	if err != nil {
+		return nil, nil, &operationalError{"initializing tools", err}
+	}
+	for _, rag := range cfg.WithOllamaOverrides(opts.Ollama).Documents {
+		tool := &chromemTool{config: rag, client: client, showInvocations: false}
 		if err := toolset.registerTool(ctx, tool); err != nil {
-			fmt.Fprintf(os.Stderr, "Error registering RAG tool: %v\n", err)
-			return
+			return nil, nil, joinShutdown(ctx, toolset, &toolStartupError{rag.Name, err})
+		}
+	}
+
+	agents := newAgentTool(client, cfg, opts, events, traffic, toolset.servers)
+	if agents != nil {
+		if err := toolset.registerTool(ctx, agents); err != nil {
+			return nil, nil, joinShutdown(ctx, toolset, err)
+		}
+	}
+
+	systemMessageContent, err := systemPrompt(cfg)
+	if err != nil {
+		return nil, nil, joinShutdown(ctx, toolset, err)
+	}
+
+	options := cfg.ResolveOllamaOptions(opts.Ollama)
+	if err := options.Validate(); err != nil {
+		return nil, nil, joinShutdown(ctx, toolset, &configError{operationalError{"ollama options", err}})
+	}
+	contextWindow, err := newContextManager(client, cfg.Context, &options)
+	if err != nil {
+		return nil, nil, joinShutdown(ctx, toolset, err)
+	}
+
+	availableTools := toolset.APITools()
+	if opts.DumpTooling || opts.ShowTools {
+		for _, tool := range availableTools {
+			events.emit(noticeEvent("tools", "%s: %s", tool.Function.Name, tool.Function.Description))
 		}
 	}
 
+	conversation := &ollamaConversation{
+		client:        client,
+		messages:      initialMessages(toolset, systemMessageContent),
+		tools:         toolset,
+		events:        events,
+		budget:        newConversationBudget(cfg.ResolveLimits(opts.Limits)),
+		toolWorkers:   cfg.ResolveParallelToolCalls(opts.ParallelToolCalls),
+		contextWindow: contextWindow,
+		options:       &options,
+	}
+	if agents != nil {
+		agents.parent = conversation
+	}
+	return conversation, toolset, nil
+}
+
+// systemPrompt resolves the system prompt from the configuration, falling back to a generic assistant prompt.
+func systemPrompt(cfg *config.File) (string, error) {
 	systemMessageContent := "You are a helpful assistant."
 	if cfg != nil && cfg.SystemPrompt != nil {
 		if len(cfg.SystemPrompt.FromString) > 0 {
@@ -60,49 +237,58 @@ func PerformWithConfig(cfg *config.File, actualQuery string, opts *ChatOptions)
 		if len(cfg.SystemPrompt.FromFile) > 0 {
 			contents, err := os.ReadFile(cfg.SystemPrompt.FromFile)
 			if err != nil {
-				fmt.Fprintf(os.Stderr, "Error reading system prompt file %q: %v\n", cfg.SystemPrompt.FromFile, err)
-				return
+				return "", &configError{operationalError{fmt.Sprintf("reading system prompt file %q", cfg.SystemPrompt.FromFile), err}}
 			}
 			systemMessageContent = string(contents)
 		}
 	}
+	return systemMessageContent, nil
+}
 
-	systemMessage := api.Message{
-		Role: "system", Content: systemMessageContent,
-	}
+// initialMessages returns a fresh copy of the tool instructions followed by the system prompt.
+func initialMessages(toolset *ToolSet, systemMessageContent string) []api.Message {
+	messages := make([]api.Message, 0, len(toolset.instructions)+1)
+	messages = append(messages, toolset.instructions...)
+	return append(messages, api.Message{Role: roleSystem, Content: systemMessageContent})
+}
 
-	// Maintain the rolling chat messages to support tool-call loops
-	messages := append(toolset.instructions,
-		systemMessage,
-		api.Message{Role: "user", Content: actualQuery})
-	availableTools := toolset.APITools()
-	if opts.DumpTooling || opts.ShowTools {
-		fmt.Println("Available tools:")
-		for _, tool := range availableTools {
-			fmt.Printf("\t%s: %s\n", tool.Function.Name, tool.Function.Description)
-		}
+// resumeSession attaches the conversation to the named session when one is requested.
+func resumeSession(conversation *ollamaConversation, name string) error {
+	if name == "" {
+		return nil
 	}
+	resumed, err := NewSessionStore(DefaultSessionDirectory).attach(name, conversation)
+	if err != nil {
+		return err
+	}
+	if resumed {
+		conversation.events.emit(noticeEvent("session", "resuming %q with %d messages", name, len(conversation.messages)))
+	}
+	return nil
+}
 
-	if opts.ShowTools {
-		fmt.Printf("Initial Messages (%d):\n", len(messages))
-		for _, m := range messages {
-			fmt.Printf("\t%s: %s\n", m.Role, m.Content)
-		}
+// openTraffic opens the cassettes selected by the options.  The deck is nil when traffic is neither recorded nor
+// replayed.
+func openTraffic(opts *cassette.Options) (*cassette.Deck, error) {
+	deck, err := opts.Open()
+	if err != nil {
+		return nil, &configError{operationalError{"opening cassettes", err}}
 	}
+	return deck, nil
+}
 
-	// ctx already defined above
-	conversation := &ollamaConversation{
-		client:       client,
-		messages:     messages,
-		tools:        toolset,
-		showThinking: opts.ShowThinking,
-		showTools:    opts.ShowTools,
-		showDone:     opts.ShowDone,
+// closeTraffic writes any recorded cassettes, reporting a failure to do so alongside the problem.
+func closeTraffic(traffic *cassette.Deck, problem error) error {
+	if err := traffic.Close(); err != nil {
+		return errors.Join(problem, &operationalError{"closing cassettes", err})
 	}
-	model := cfg.LanguageModel()
-	fmt.Printf("config\t> model: %s\n", model)
+	return problem
+}
 
-	if err := conversation.runAIToConclusion(ctx, model, availableTools); err != nil {
-		return
+// joinShutdown shuts down the partially constructed toolset, reporting any shutdown failure alongside the cause.
+func joinShutdown(ctx context.Context, toolset *ToolSet, cause error) error {
+	if err := toolset.Shutdown(ctx); err != nil {
+		return errors.Join(cause, &operationalError{"shutting down tools", err})
 	}
+	return cause
 }
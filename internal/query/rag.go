@@ -0,0 +1,32 @@
+package query
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/meschbach/marvin/internal/config"
+)
+
+// QueryRAG searches the named documents store, emitting each matching document.
+func QueryRAG(ctx context.Context, cfg *config.File, storeName, query string, output string) (problem error) {
+	events, err := newEventSink(output, DisplayOptions{})
+	if err != nil {
+		return err
+	}
+	defer func() {
+		problem = report(events, problem)
+	}()
+	description := fmt.Sprintf("querying documents %q", storeName)
+	store := cfg.DocumentsNamed(storeName)
+	if store == nil {
+		return &configError{operationalError{description, fmt.Errorf("no documents block with name %q", storeName)}}
+	}
+	results, err := store.Query(ctx, query)
+	if err != nil {
+		return backendError(description, store.EmbeddingModel(), err)
+	}
+	for _, result := range results {
+		events.emit(Event{Type: EventDocument, Path: result.Path, Similarity: result.Similarity})
+	}
+	return nil
+}
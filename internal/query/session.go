@@ -0,0 +1,208 @@
+package query
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/ollama/ollama/api"
+)
+
+// DefaultSessionDirectory is where sessions are persisted relative to the working directory.
+const DefaultSessionDirectory = ".marvin/sessions"
+
+const sessionFileExtension = ".json"
+
+// sessionDocument is the on-disk representation of a conversation history.
+type sessionDocument struct {
+	Name string `json:"name"`
+	// Model is the last model used to advance the session.
+	Model string `json:"model,omitempty"`
+	// ForkedFrom names the session this session was branched from, if any.
+	ForkedFrom string        `json:"forked_from,omitempty"`
+	CreatedAt  time.Time     `json:"created_at"`
+	UpdatedAt  time.Time     `json:"updated_at"`
+	Messages   []api.Message `json:"messages"`
+}
+
+// SessionSummary describes a persisted session without the full history.
+type SessionSummary struct {
+	Name       string
+	Model      string
+	ForkedFrom string
+	UpdatedAt  time.Time
+	Messages   int
+}
+
+// SessionStore persists conversation histories as JSON documents within a directory.
+type SessionStore struct {
+	directory string
+}
+
+func NewSessionStore(directory string) *SessionStore {
+	return &SessionStore{directory: directory}
+}
+
+func (s *SessionStore) path(name string) (string, error) {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return "", fmt.Errorf("invalid session name %q", name)
+	}
+	return filepath.Join(s.directory, name+sessionFileExtension), nil
+}
+
+// load retrieves the named session.  A session which does not exist yet results in nil without an error.
+func (s *SessionStore) load(name string) (*sessionDocument, error) {
+	path, err := s.path(name)
+	if err != nil {
+		return nil, err
+	}
+	content, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, &operationalError{fmt.Sprintf("reading session %q", name), err}
+	}
+	doc := &sessionDocument{}
+	if err := json.Unmarshal(content, doc); err != nil {
+		return nil, &operationalError{fmt.Sprintf("parsing session %q", name), err}
+	}
+	return doc, nil
+}
+
+// save writes the session, replacing any previous version atomically.
+func (s *SessionStore) save(doc *sessionDocument) error {
+	path, err := s.path(doc.Name)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(s.directory, 0o755); err != nil {
+		return &operationalError{"creating session directory", err}
+	}
+	now := time.Now()
+	if doc.CreatedAt.IsZero() {
+		doc.CreatedAt = now
+	}
+	doc.UpdatedAt = now
+	content, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return &operationalError{fmt.Sprintf("encoding session %q", doc.Name), err}
+	}
+	temporary := path + ".tmp"
+	if err := os.WriteFile(temporary, content, 0o644); err != nil {
+		return &operationalError{fmt.Sprintf("writing session %q", doc.Name), err}
+	}
+	if err := os.Rename(temporary, path); err != nil {
+		return &operationalError{fmt.Sprintf("replacing session %q", doc.Name), err}
+	}
+	return nil
+}
+
+// List summarizes all sessions within the store ordered by name.
+func (s *SessionStore) List() ([]SessionSummary, error) {
+	entries, err := os.ReadDir(s.directory)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, &operationalError{"listing sessions", err}
+	}
+	var out []SessionSummary
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != sessionFileExtension {
+			continue
+		}
+		doc, err := s.load(strings.TrimSuffix(entry.Name(), sessionFileExtension))
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, SessionSummary{
+			Name:       doc.Name,
+			Model:      doc.Model,
+			ForkedFrom: doc.ForkedFrom,
+			UpdatedAt:  doc.UpdatedAt,
+			Messages:   len(doc.Messages),
+		})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out, nil
+}
+
+// Messages returns the history of the named session.
+func (s *SessionStore) Messages(name string) ([]api.Message, error) {
+	doc, err := s.load(name)
+	if err != nil {
+		return nil, err
+	}
+	if doc == nil {
+		return nil, fmt.Errorf("no such session %q", name)
+	}
+	return doc.Messages, nil
+}
+
+// Fork creates the session target from the history of source up to and including the message at index.  A negative
+// index copies the entire history.
+func (s *SessionStore) Fork(source, target string, index int) error {
+	doc, err := s.load(source)
+	if err != nil {
+		return err
+	}
+	if doc == nil {
+		return fmt.Errorf("no such session %q", source)
+	}
+	existing, err := s.load(target)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		return fmt.Errorf("session %q already exists", target)
+	}
+	messages := doc.Messages
+	if index >= 0 {
+		if index >= len(messages) {
+			return fmt.Errorf("session %q has %d messages, can not fork at %d", source, len(messages), index)
+		}
+		// keep the answers to the tool calls being cut after, so the fork never resumes with unanswered calls
+		end := index + 1
+		for end < len(messages) && messages[end].Role == roleTool {
+			end++
+		}
+		if last := messages[end-1]; last.Role == roleAssistant && len(last.ToolCalls) > 0 {
+			return fmt.Errorf("session %q has no answers to the tool calls of message %d, fork before or after them", source, end-1)
+		}
+		messages = messages[:end]
+	}
+	return s.save(&sessionDocument{
+		Name:       target,
+		Model:      doc.Model,
+		ForkedFrom: source,
+		Messages:   append([]api.Message(nil), messages...),
+	})
+}
+
+// attach resumes the named session within the conversation when it exists, otherwise the current history will seed
+// the session.  Each completed turn of the conversation is written back to the store.
+func (s *SessionStore) attach(name string, conversation *ollamaConversation) (resumed bool, problem error) {
+	doc, err := s.load(name)
+	if err != nil {
+		return false, err
+	}
+	if doc == nil {
+		doc = &sessionDocument{Name: name}
+	} else {
+		conversation.messages = doc.Messages
+		resumed = true
+	}
+	conversation.checkpoint = func(model string, messages []api.Message) error {
+		doc.Model = model
+		doc.Messages = messages
+		return s.save(doc)
+	}
+	return resumed, nil
+}
@@ -0,0 +1,77 @@
+package query
+
+import (
+	"testing"
+
+	"github.com/meschbach/marvin/internal/backend"
+	"github.com/ollama/ollama/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessionStore_ResumesCheckpointedHistory(t *testing.T) {
+	store := NewSessionStore(t.TempDir())
+
+	first := &ollamaConversation{messages: []api.Message{{Role: roleSystem, Content: "system"}}}
+	resumed, err := store.attach("example", first)
+	require.NoError(t, err)
+	assert.False(t, resumed)
+	first.messages = append(first.messages, api.Message{Role: roleUser, Content: "hello"}, api.Message{Role: roleAssistant, Content: "hi"})
+	require.NoError(t, first.recordTurn("test-model"))
+
+	second := &ollamaConversation{messages: []api.Message{{Role: roleSystem, Content: "replaced"}}}
+	resumed, err = store.attach("example", second)
+	require.NoError(t, err)
+	assert.True(t, resumed)
+	if assert.Len(t, second.messages, 3) {
+		assert.Equal(t, "system", second.messages[0].Content)
+		assert.Equal(t, "hi", second.messages[2].Content)
+	}
+
+	sessions, err := store.List()
+	require.NoError(t, err)
+	if assert.Len(t, sessions, 1) {
+		assert.Equal(t, "test-model", sessions[0].Model)
+		assert.Equal(t, 3, sessions[0].Messages)
+	}
+}
+
+func TestSessionStore_Fork(t *testing.T) {
+	store := NewSessionStore(t.TempDir())
+	require.NoError(t, store.save(&sessionDocument{Name: "source", Messages: []api.Message{
+		{Role: roleSystem, Content: "0"},
+		{Role: roleUser, Content: "1"},
+		{Role: roleAssistant, Content: "2"},
+	}}))
+
+	require.NoError(t, store.Fork("source", "branch", 1))
+	messages, err := store.Messages("branch")
+	require.NoError(t, err)
+	assert.Len(t, messages, 2)
+
+	assert.Error(t, store.Fork("source", "branch", 0), "fork must not overwrite an existing session")
+	assert.Error(t, store.Fork("source", "too-far", 3))
+	assert.Error(t, store.Fork("missing", "other", -1))
+	assert.Error(t, store.Fork("source", "../escape", -1))
+}
+
+func TestSessionStore_ForkKeepsTheAnswersToToolCalls(t *testing.T) {
+	store := NewSessionStore(t.TempDir())
+	call := backend.ToolCall("1", "mail.read", nil)
+	require.NoError(t, store.save(&sessionDocument{Name: "source", Messages: []api.Message{
+		{Role: roleUser, Content: "0"},
+		{Role: roleAssistant, ToolCalls: []api.ToolCall{call}},
+		toolResponseMessage(call, "2"),
+		{Role: roleAssistant, Content: "3"},
+		{Role: roleUser, Content: "4"},
+		{Role: roleAssistant, ToolCalls: []api.ToolCall{call}},
+	}}))
+
+	require.NoError(t, store.Fork("source", "branch", 1))
+	messages, err := store.Messages("branch")
+	require.NoError(t, err)
+	require.Len(t, messages, 3, "the fork extends through the answer to the call")
+	assert.Equal(t, roleTool, messages[2].Role)
+
+	assert.ErrorContains(t, store.Fork("source", "unanswered", 5), "no answers to the tool calls of message 5")
+}
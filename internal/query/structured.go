@@ -0,0 +1,85 @@
+package query
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/meschbach/marvin/internal/config"
+	"github.com/meschbach/marvin/internal/jsonschema"
+	"github.com/ollama/ollama/api"
+)
+
+// schemaViolationError reports an answer which still did not match the schema once all corrections were used
+type schemaViolationError struct {
+	attempts int
+	problems []string
+}
+
+func (s *schemaViolationError) Error() string {
+	return fmt.Sprintf("answer did not match the schema after %d attempts: %s", s.attempts, strings.Join(s.problems, "; "))
+}
+
+// loadResponseSchema compiles the schema of an enabled response format, otherwise returns nil
+func loadResponseSchema(format config.ResponseFormatBlock) (*jsonschema.Schema, error) {
+	if !format.Enabled() {
+		return nil, nil
+	}
+	raw, err := format.LoadSchema()
+	if err != nil {
+		return nil, &configError{operationalError{"loading response schema", err}}
+	}
+	schema, err := jsonschema.Compile(raw)
+	if err != nil {
+		return nil, &configError{operationalError{"compiling response schema", err}}
+	}
+	return schema, nil
+}
+
+// finalAnswer is the content of the most recent assistant message
+func (o *ollamaConversation) finalAnswer() string {
+	for i := len(o.messages) - 1; i >= 0; i-- {
+		if o.messages[i].Role == roleAssistant {
+			return o.messages[i].Content
+		}
+	}
+	return ""
+}
+
+// runToSchema constrains the model output to the schema and runs the conversation to conclusion, asking the model to
+// correct its answer up to retries times.  Returns the validated answer as compact JSON.  When the budget is exceeded
+// no corrections are requested; a valid answer is returned alongside the budget error.
+func (o *ollamaConversation) runToSchema(ctx context.Context, model string, availableTools api.Tools, schema *jsonschema.Schema, retries int) (json.RawMessage, error) {
+	o.format = schema.Raw()
+	o.hideContent = true
+	for attempt := 0; ; attempt++ {
+		runErr := o.runAIToConclusion(ctx, model, availableTools)
+		var budget *budgetExceededError
+		if runErr != nil && !errors.As(runErr, &budget) {
+			return nil, runErr
+		}
+		answer := strings.TrimSpace(o.finalAnswer())
+		problems := schema.ValidateJSON([]byte(answer))
+		if len(problems) == 0 {
+			var compacted bytes.Buffer
+			if err := json.Compact(&compacted, []byte(answer)); err != nil {
+				return nil, &operationalError{"compacting answer", err}
+			}
+			return compacted.Bytes(), runErr
+		}
+		if runErr != nil {
+			return nil, errors.Join(runErr, &schemaViolationError{attempts: attempt + 1, problems: problems})
+		}
+		if attempt >= retries {
+			return nil, &schemaViolationError{attempts: attempt + 1, problems: problems}
+		}
+		o.events.emit(noticeEvent("schema", "answer did not match the schema, requesting correction %d of %d", attempt+1, retries))
+		o.messages = append(o.messages, api.Message{
+			Role:    roleUser,
+			Content: "Your answer does not match the required JSON schema:\n- " + strings.Join(problems, "\n- ") + "\nRespond again with only JSON matching the schema.",
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package query
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"os"
+	"sync"
+)
+
+// lineRead is the outcome of reading a single line
+type lineRead struct {
+	line string
+	err  error
+}
+
+// lineReader reads the lines typed at a terminal for every prompt of the process.  A single buffer is shared so lines
+// read ahead from a pipe are not lost between prompts.  Reads happen in the background so a prompt may give up once its
+// context is done; the line it was waiting on is kept for the next prompt.
+type lineReader struct {
+	source *bufio.Reader
+	// turn is held by the prompt currently reading
+	turn chan struct{}
+	// pending is the read in progress, nil when none
+	pending chan lineRead
+	// asking is held by the prompt currently asking a question, so the questions of concurrent prompts do not interleave
+	asking chan struct{}
+}
+
+func newLineReader(in io.Reader) *lineReader {
+	return &lineReader{source: bufio.NewReader(in), turn: make(chan struct{}, 1), asking: make(chan struct{}, 1)}
+}
+
+// stdinLines reads the lines of standard input
+var stdinLines = sync.OnceValue(func() *lineReader {
+	return newLineReader(os.Stdin)
+})
+
+// linesOf reads the lines of in, sharing the reader of standard input with every other prompt
+func linesOf(in io.Reader) *lineReader {
+	if file, ok := in.(*os.File); ok && file == os.Stdin {
+		return stdinLines()
+	}
+	return newLineReader(in)
+}
+
+// hold waits until no other prompt is asking a question, giving up once the context is done.  The returned function lets
+// the next prompt ask.
+func (l *lineReader) hold(ctx context.Context) (func(), error) {
+	select {
+	case l.asking <- struct{}{}:
+		return func() { <-l.asking }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// readLine returns the next line including its line ending as bufio.Reader.ReadString does, or the error of the context
+// once done.
+func (l *lineReader) readLine(ctx context.Context) (string, error) {
+	select {
+	case l.turn <- struct{}{}:
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+	defer func() { <-l.turn }()
+
+	if l.pending == nil {
+		pending := make(chan lineRead, 1)
+		go func() {
+			line, err := l.source.ReadString('\n')
+			pending <- lineRead{line: line, err: err}
+		}()
+		l.pending = pending
+	}
+	select {
+	case read := <-l.pending:
+		l.pending = nil
+		return read.line, read.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
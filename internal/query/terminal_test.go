@@ -0,0 +1,50 @@
+package query
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/mark3labs/mcp-go/mcp"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLineReader_SharesPipedInputBetweenPrompts(t *testing.T) {
+	lines := newLineReader(strings.NewReader("y\nTuesday\ny\n"))
+	approver := &terminalApprover{in: lines, out: io.Discard}
+	answerer := &terminalAnswerer{in: lines, out: io.Discard}
+	sampling := &terminalSamplingApprover{in: lines, out: io.Discard}
+
+	approved, err := approver.approve(context.Background(), &goalPlan{Goal: "plan the week"})
+	require.NoError(t, err)
+	assert.True(t, approved)
+	answer, err := answerer.answer(context.Background(), "Which day?")
+	require.NoError(t, err)
+	assert.Equal(t, "Tuesday", answer, "lines buffered by the first prompt reach the next")
+	allowed, err := sampling.approveSampling(context.Background(), "imap", "llama3.2", &mcp.CreateMessageRequest{})
+	require.NoError(t, err)
+	assert.True(t, allowed)
+}
+
+func TestLineReader_KeepsTheLineOfACancelledPrompt(t *testing.T) {
+	in, typed := io.Pipe()
+	lines := newLineReader(in)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	gaveUp := make(chan error)
+	go func() {
+		_, err := lines.readLine(ctx)
+		gaveUp <- err
+	}()
+	cancel()
+	assert.ErrorIs(t, <-gaveUp, context.Canceled)
+
+	go func() {
+		_, _ = typed.Write([]byte("later\n"))
+	}()
+	line, err := lines.readLine(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "later\n", line)
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"sync"
 
+	"github.com/meschbach/marvin/internal/cassette"
 	"github.com/meschbach/marvin/internal/config"
 	"github.com/ollama/ollama/api"
 )
@@ -18,6 +19,7 @@ type toolDefinition struct {
 	//todo: rename to `tools`
 	tool       api.Tools
 	uriHandler mcpResource
+	prompts    []*mcpPrompt
 }
 
 func (t *toolDefinition) appendInstruction(message string) {
@@ -29,6 +31,11 @@ type Tool interface {
 	invoke(ctx context.Context, call api.ToolCall) (out []api.Message, problem error)
 }
 
+// serialTool is implemented by tools which may declare they are unable to service concurrent invocations.
+type serialTool interface {
+	serialOnly() bool
+}
+
 // ToolSet manages a collection of tools and provides helpers for chat integration.
 type ToolSet struct {
 	instructions []api.Message
@@ -36,14 +43,50 @@ type ToolSet struct {
 	defs         api.Tools
 	container    *Container
 	gateway      *mcpResourceGateway
+	// promptsByName maps namespaced prompt name -> prompt
+	promptsByName map[string]*mcpPrompt
+	// elicitation answers the MCP servers asking for input during a tool call
+	elicitation *mcpElicitation
+	// servers are the MCP servers of the toolset, shared with the toolsets of delegated agents
+	servers *mcpServers
+}
+
+// mcpServers are the MCP servers started for a conversation, by name.  They are shared with the conversations of the
+// agents it delegates to so each server is started once, and are shut down along with the toolset which created them.
+type mcpServers struct {
+	lock    sync.Mutex
+	running map[string]*Mark3labsTool
+	// owner shuts the servers down
+	owner       *Container
+	elicitation *mcpElicitation
+}
+
+// use returns the named server, creating it when it is not yet running
+func (s *mcpServers) use(name string, create func() *Mark3labsTool) *Mark3labsTool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if server, ok := s.running[name]; ok {
+		return server
+	}
+	server := create()
+	s.running[name] = server
+	s.owner.Register(server)
+	return server
 }
 
 // NewToolSet builds a ToolSet from the parsed configuration. Nil cfg or empty
 // content yields an empty ToolSet.
-func NewToolSet(ctx context.Context, cfg *config.File) (*ToolSet, error) {
+func NewToolSet(ctx context.Context, cfg *config.File, traffic *cassette.Deck) (*ToolSet, error) {
+	return newToolSet(ctx, cfg, traffic, nil)
+}
+
+// newToolSet builds a ToolSet from the configuration using the servers already running in shared, when not nil.
+// Servers started by a toolset sharing the servers of another are shut down with the other toolset.
+func newToolSet(ctx context.Context, cfg *config.File, traffic *cassette.Deck, shared *mcpServers) (*ToolSet, error) {
 	ts := &ToolSet{
-		byName:  map[string]Tool{},
-		gateway: newMCPResourceGateway(),
+		byName:        map[string]Tool{},
+		gateway:       newMCPResourceGateway(),
+		promptsByName: map[string]*mcpPrompt{},
 		container: &Container{
 			name:  "tool container",
 			state: sync.Mutex{},
@@ -52,9 +95,19 @@ func NewToolSet(ctx context.Context, cfg *config.File) (*ToolSet, error) {
 	if cfg == nil {
 		return ts, nil
 	}
+	ts.servers = shared
+	if ts.servers == nil {
+		ts.servers = &mcpServers{running: map[string]*Mark3labsTool{}, owner: ts.container, elicitation: newMCPElicitation(cfg)}
+	}
+	ts.elicitation = ts.servers.elicitation
 	for _, lp := range cfg.LocalPrograms {
-		t := FromLocalProgram(lp)
-		ts.container.Register(t)
+		t := ts.servers.use(lp.Name, func() *Mark3labsTool {
+			t := FromLocalProgram(lp)
+			t.sampler = newMCPSampler(lp.Name, lp.Sampling, cfg, traffic)
+			t.elicitor = ts.elicitation.forServer(lp.Name)
+			t.recordTo(traffic)
+			return t
+		})
 		if err := ts.registerTool(ctx, t); err != nil {
 			return nil, &localProgramDiscoveryError{
 				name:       t.Name,
@@ -62,7 +115,10 @@ func NewToolSet(ctx context.Context, cfg *config.File) (*ToolSet, error) {
 			} // fail hard per requirements
 		}
 	}
-	if err := ts.loadToolsFromDocker(ctx, cfg); err != nil {
+	if err := ts.loadToolsFromDocker(ctx, cfg, traffic); err != nil {
+		return nil, err
+	}
+	if err := ts.loadToolsFromHTTP(ctx, cfg, traffic); err != nil {
 		return nil, err
 	}
 	if len(ts.gateway.resourceServices) > 0 {
@@ -84,6 +140,9 @@ func (ts *ToolSet) registerTool(ctx context.Context, t Tool) error {
 	if definition.uriHandler != nil {
 		ts.gateway.register(definition.uriHandler)
 	}
+	for _, prompt := range definition.prompts {
+		ts.promptsByName[prompt.name] = prompt
+	}
 	ts.defs = append(ts.defs, definition.tool...)
 	ts.instructions = append(ts.instructions, definition.instructions...)
 	return nil
@@ -111,10 +170,65 @@ func (ts *ToolSet) HandleCall(ctx context.Context, call api.ToolCall) ([]api.Mes
 	return msgs, err
 }
 
+// toolCallResult is the outcome of a single call dispatched by HandleCalls
+type toolCallResult struct {
+	call    api.ToolCall
+	replies []api.Message
+	err     error
+}
+
+// HandleCalls invokes each call returning the results in the same order as the calls.  With more than one worker,
+// calls to different tools run concurrently with at most workers in flight.  Calls to the same tool, or to any tool
+// of a server declared serial-only, are run one after another.
+func (ts *ToolSet) HandleCalls(ctx context.Context, calls []api.ToolCall, workers int) []toolCallResult {
+	results := make([]toolCallResult, len(calls))
+	if workers <= 1 || len(calls) <= 1 {
+		for i, call := range calls {
+			replies, err := ts.HandleCall(ctx, call)
+			results[i] = toolCallResult{call: call, replies: replies, err: err}
+		}
+		return results
+	}
+
+	// Group the calls which must be run in sequence, preserving the order groups were first seen.
+	var order []any
+	groups := map[any][]int{}
+	for i, call := range calls {
+		var key any = call.Function.Name
+		if t, ok := ts.byName[call.Function.Name]; ok {
+			if serial, ok := t.(serialTool); ok && serial.serialOnly() {
+				key = t
+			}
+		}
+		if _, seen := groups[key]; !seen {
+			order = append(order, key)
+		}
+		groups[key] = append(groups[key], i)
+	}
+
+	slots := make(chan struct{}, workers)
+	var wait sync.WaitGroup
+	for _, key := range order {
+		indexes := groups[key]
+		wait.Add(1)
+		go func() {
+			defer wait.Done()
+			for _, i := range indexes {
+				slots <- struct{}{}
+				replies, err := ts.HandleCall(ctx, calls[i])
+				<-slots
+				results[i] = toolCallResult{call: calls[i], replies: replies, err: err}
+			}
+		}()
+	}
+	wait.Wait()
+	return results
+}
+
 // toolResponseMessage is a utility to respond to a tool invocation with some content
 func toolResponseMessage(call api.ToolCall, content string) api.Message {
 	return api.Message{
-		Role:       "tool",
+		Role:       roleTool,
 		ToolName:   call.Function.Name,
 		ToolCallID: call.ID,
 		Content:    content,
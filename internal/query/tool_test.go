@@ -0,0 +1,123 @@
+package query
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ollama/ollama/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// concurrencyProbeTool records the peak number of invocations in flight.
+type concurrencyProbeTool struct {
+	names    []string
+	serial   bool
+	inFlight atomic.Int32
+	peak     atomic.Int32
+	delay    time.Duration
+}
+
+func (c *concurrencyProbeTool) defineAPI(ctx context.Context) (*toolDefinition, error) {
+	definition := &toolDefinition{}
+	for _, name := range c.names {
+		definition.tool = append(definition.tool, api.Tool{Type: ToolTypeFunction, Function: api.ToolFunction{Name: name}})
+	}
+	return definition, nil
+}
+
+func (c *concurrencyProbeTool) invoke(ctx context.Context, call api.ToolCall) ([]api.Message, error) {
+	now := c.inFlight.Add(1)
+	for {
+		peak := c.peak.Load()
+		if now <= peak || c.peak.CompareAndSwap(peak, now) {
+			break
+		}
+	}
+	time.Sleep(c.delay)
+	c.inFlight.Add(-1)
+	return []api.Message{toolResponseMessage(call, call.ID)}, nil
+}
+
+func (c *concurrencyProbeTool) serialOnly() bool { return c.serial }
+
+func probeToolSet(t *testing.T, tools ...Tool) *ToolSet {
+	t.Helper()
+	ts := &ToolSet{byName: map[string]Tool{}, gateway: newMCPResourceGateway(), container: &Container{state: sync.Mutex{}}, promptsByName: map[string]*mcpPrompt{}}
+	for _, tool := range tools {
+		require.NoError(t, ts.registerTool(context.Background(), tool))
+	}
+	return ts
+}
+
+func probeCalls(names ...string) []api.ToolCall {
+	calls := make([]api.ToolCall, len(names))
+	for i, name := range names {
+		calls[i] = api.ToolCall{ID: name + "-" + string(rune('a'+i)), Function: api.ToolCallFunction{Name: name}}
+	}
+	return calls
+}
+
+func TestToolSet_HandleCallsPreservesOrder(t *testing.T) {
+	probe := &concurrencyProbeTool{names: []string{"one", "two", "three"}, delay: 10 * time.Millisecond}
+	ts := probeToolSet(t, probe)
+	calls := probeCalls("three", "one", "two", "one")
+
+	results := ts.HandleCalls(context.Background(), calls, 4)
+	require.Len(t, results, len(calls))
+	for i, result := range results {
+		assert.NoError(t, result.err)
+		assert.Equal(t, calls[i].ID, result.call.ID)
+		if assert.Len(t, result.replies, 1) {
+			assert.Equal(t, calls[i].ID, result.replies[0].Content)
+		}
+	}
+	assert.Equal(t, int32(3), probe.peak.Load(), "distinct tools run concurrently while calls to the same tool do not")
+}
+
+func TestToolSet_HandleCallsSequentialByDefault(t *testing.T) {
+	probe := &concurrencyProbeTool{names: []string{"one", "two"}, delay: time.Millisecond}
+	ts := probeToolSet(t, probe)
+
+	ts.HandleCalls(context.Background(), probeCalls("one", "two"), 0)
+	assert.Equal(t, int32(1), probe.peak.Load())
+}
+
+func TestToolSet_HandleCallsRespectsWorkerLimit(t *testing.T) {
+	probe := &concurrencyProbeTool{names: []string{"a", "b", "c", "d"}, delay: 10 * time.Millisecond}
+	ts := probeToolSet(t, probe)
+
+	ts.HandleCalls(context.Background(), probeCalls("a", "b", "c", "d"), 2)
+	assert.Equal(t, int32(2), probe.peak.Load())
+}
+
+func TestToolSet_HandleCallsSerialServer(t *testing.T) {
+	serial := &concurrencyProbeTool{names: []string{"s.one", "s.two"}, serial: true, delay: 10 * time.Millisecond}
+	parallel := &concurrencyProbeTool{names: []string{"p.one", "p.two"}, delay: 10 * time.Millisecond}
+	ts := probeToolSet(t, serial, parallel)
+
+	ts.HandleCalls(context.Background(), probeCalls("s.one", "s.two", "p.one", "p.two"), 4)
+	assert.Equal(t, int32(1), serial.peak.Load())
+	assert.Equal(t, int32(2), parallel.peak.Load())
+}
+
+func TestToolSet_HandleCallUnknownTool(t *testing.T) {
+	ts := probeToolSet(t)
+	replies, err := ts.HandleCall(context.Background(), api.ToolCall{ID: "1", Function: api.ToolCallFunction{Name: "missing"}})
+	require.NoError(t, err, "the model is told rather than the conversation failing")
+	require.Len(t, replies, 1)
+	assert.Equal(t, "1", replies[0].ToolCallID)
+	assert.Contains(t, replies[0].Content, `tool not found {name: \"missing\"}`)
+}
+
+func TestToolSet_HandleCallWrapsFailures(t *testing.T) {
+	cause := errors.New("cause")
+	ts := probeToolSet(t, &failingTool{name: "broken", err: cause})
+	_, err := ts.HandleCall(context.Background(), api.ToolCall{ID: "7", Function: api.ToolCallFunction{Name: "broken"}})
+	require.ErrorIs(t, err, cause)
+	assert.Contains(t, err.Error(), `tool invocation "broken" (id: 7)`)
+}
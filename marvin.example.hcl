@@ -1,5 +1,27 @@
 model = "llama3.2:latest"
 
+# Models are served by Ollama as configured by OLLAMA_HOST unless a backend is selected.  Servers offering the OpenAI
+# compatible API, such as llama.cpp server, vLLM or LM Studio, use the openai provider:
+#
+# backend "openai" {
+#   url         = "http://localhost:8080/v1"
+#   api_key_env = "OPENAI_API_KEY"
+#   timeout     = "5m"
+# }
+
+# Generation options sent with every chat and embedding request.  Each may be overridden on the command line, for
+# example `--temperature 0.7 --seed 7`.
+ollama_options {
+  temperature = 0
+  seed        = 42
+  num_ctx     = 8192
+  keep_alive  = "10m"
+  think       = "low"
+}
+
+# Run up to 4 tool calls from a single model turn concurrently; `--parallel-tools` overrides this.
+parallel_tool_calls = 4
+
 system_prompt {
   from_string = <<EOS
 You are an example AI tool demonstrating Marvin, an AI tooling assistant allowing for plugging in various assistants
@@ -15,4 +37,31 @@ local_program "gitea" {
 local_program "docs" {
   # provides access to specific files
   program = "file-mcp"
+  # the server can not handle concurrent requests, so calls to it are never run in parallel
+  serial = true
+}
+
+# Bound tool usage; once a limit is reached the model is asked for a final answer without tools.  Each limit may be
+# overridden on the command line, for example `--max-turns 3`.  Without a limits block a run may make 20 turns and repeat
+# an identical call 3 times; 0 lifts a limit.
+limits {
+  max_turns           = 8
+  max_tool_calls      = 20
+  max_calls_per_tool  = 5
+  max_tokens          = 60000
+  max_identical_calls = 2
+}
+
+# Compact the conversation once the estimated prompt reaches 80% of the model's context window.  Strategies are
+# drop_tool_results (default), summarize, and sliding_window.  The most recent messages are never compacted.
+context {
+  strategy    = "summarize"
+  threshold   = 0.8
+  keep_recent = 6
+}
+
+# Agents select a model, system prompt, tools and documents from those above; pick one with `--agent`.
+agent "gitea" {
+  tools     = ["gitea"]
+  documents = []
 }